@@ -2,13 +2,20 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"github.com/dustin/go-humanize"
 
 	"nssc/internal/api"
 	"nssc/internal/frontend"
@@ -16,6 +23,7 @@ import (
 	"nssc/internal/ninep"
 	"nssc/internal/users"
 	"nssc/internal/webdav"
+	"nssc/internal/webhook"
 )
 
 // version is set at build time via:
@@ -26,7 +34,7 @@ var version = "dev"
 func main() {
 	if len(os.Args) < 2 {
 		fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n", os.Args[0])
-		fmt.Fprintln(os.Stderr, "Commands: run, adduser")
+		fmt.Fprintln(os.Stderr, "Commands: run, adduser, dirquota, limits, verify, migrate, encrypt, webhook")
 		os.Exit(1)
 	}
 
@@ -35,6 +43,18 @@ func main() {
 		runServer(os.Args[2:])
 	case "adduser":
 		addUser(os.Args[2:])
+	case "dirquota":
+		dirQuota(os.Args[2:])
+	case "limits":
+		limits(os.Args[2:])
+	case "verify":
+		verify(os.Args[2:])
+	case "migrate":
+		migrate(os.Args[2:])
+	case "encrypt":
+		encrypt(os.Args[2:])
+	case "webhook":
+		webhooks(os.Args[2:])
 	default:
 		fmt.Fprintf(os.Stderr, "Unknown command: %s\n", os.Args[1])
 		os.Exit(1)
@@ -45,6 +65,13 @@ func runServer(args []string) {
 	flags := flag.NewFlagSet("run", flag.ExitOnError)
 	addr := flags.String("p", ":0", "HTTP listen address")
 	ninepAddr := flags.String("9p", "", "9P listen address (e.g. :564 or unix:///run/nssc.sock)")
+	masterKey := flags.String("master-key", "", "file with a hex master key; enables encryption at rest")
+	s3URL := flags.String("s3", "", "store user files in an S3 bucket (https://host/bucket[/prefix][?region=name])")
+	reconcile := flags.Duration("reconcile", time.Hour, "interval for recounting disk usage (0 disables)")
+	watch := flags.Bool("watch", true, "track changes made directly in user directories (Linux only)")
+	warn := flags.String("warn", "80,95", "comma-separated quota percentages that raise warnings")
+	uploadLimit := flags.String("upload-limit", "0", "largest web upload request, e.g. 10GiB (0 for no limit)")
+	publicLimit := flags.String("public-archive-limit", "1GiB", "largest shared directory downloadable from its public link (0 for no limit)")
 	if err := flags.Parse(args); err != nil {
 		log.Fatal(err)
 	}
@@ -63,10 +90,71 @@ func runServer(args []string) {
 		log.Fatalf("run: failed to load users database: %v", err)
 	}
 
-	ufss, err := fs.NewUserFSServer(rootDir, nil, db.Users)
+	opts, err := storageOptions(*masterKey, *s3URL)
+	if err != nil {
+		log.Fatalf("run: %v", err)
+	}
+	softLimits, err := parsePercents(*warn)
+	if err != nil {
+		log.Fatalf("run: invalid -warn: %v", err)
+	}
+	maxUpload, err := humanize.ParseBytes(*uploadLimit)
+	if err != nil {
+		log.Fatalf("run: invalid -upload-limit: %v", err)
+	}
+	maxPublicArchive, err := humanize.ParseBytes(*publicLimit)
+	if err != nil {
+		log.Fatalf("run: invalid -public-archive-limit: %v", err)
+	}
+	opts = append(opts, fs.WithReconcileInterval(*reconcile), fs.WithSoftLimits(softLimits...))
+	if *watch && *s3URL == "" {
+		opts = append(opts, fs.WithWatch())
+	}
+	commonQuota, limitOpts, err := serverLimits(db)
+	if err != nil {
+		log.Fatalf("run: %v", err)
+	}
+	opts = append(opts, limitOpts...)
+	ufss, err := fs.NewUserFSServer(rootDir, commonQuota, db.Users, opts...)
 	if err != nil {
 		log.Fatalf("run: failed to init user FS: %v", err)
 	}
+	st := ufss.Status()
+	log.Printf("run: storage quota %s, used %s; reserve %s, disk free %s",
+		sizeOrNone(st.Quota), humanize.IBytes(uint64(st.Used)), sizeOrNone(st.Reserve), sizeOrNone(st.DiskFree))
+
+	hooks, err := webhook.New(fs.WebhooksDir(rootDir))
+	if err != nil {
+		log.Fatalf("run: failed to load webhooks: %v", err)
+	}
+	hooks.Start(ufss.Events())
+
+	// Flush metadata and usage counters on shutdown.
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		hooks.Close()
+		if err := ufss.Close(); err != nil {
+			log.Printf("run: failed to save metadata: %v", err)
+		}
+		os.Exit(0)
+	}()
+
+	// Apply directory quotas changed with dirquota on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			fresh := &users.UsersDB{}
+			if err := fresh.Load(filepath.Join(rootDir, "db.json")); err != nil {
+				log.Printf("run: failed to reload users database: %v", err)
+				continue
+			}
+			ufss.ReloadDirQuotas(fresh.Users)
+			log.Printf("run: directory quotas reloaded")
+		}
+	}()
 
 	mux := http.NewServeMux()
 
@@ -77,13 +165,13 @@ func runServer(args []string) {
 		fmt.Fprint(w, frontend.CSS)
 	})
 
-	apiHandler := api.NewHandler(db, rootDir, ufss)
+	apiHandler := api.NewHandler(db, rootDir, ufss, hooks)
 	mux.Handle("/api/", http.StripPrefix("/api", apiHandler))
 
 	webdavHandler := webdav.NewHandler(db, rootDir, ufss)
 	mux.Handle("/webdav/", webdavHandler)
 
-	frontendHandler := frontend.NewHandler(db, rootDir, ufss, version, 0)
+	frontendHandler := frontend.NewHandler(db, rootDir, ufss, version, int64(maxUpload), int64(maxPublicArchive))
 	mux.Handle("/", frontendHandler)
 
 	if *ninepAddr != "" {
@@ -102,6 +190,27 @@ func runServer(args []string) {
 	}
 }
 
+// storageOptions translates storage related flags into UserFSServer options.
+// S3 credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func storageOptions(masterKeyFile, s3URL string) ([]fs.ServerOption, error) {
+	var opts []fs.ServerOption
+	if s3URL != "" {
+		cfg, err := fs.ParseS3URL(s3URL)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, fs.WithBackend(fs.S3Backends(cfg)))
+	}
+	if masterKeyFile != "" {
+		key, err := fs.LoadMasterKey(masterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, fs.WithMasterKey(key))
+	}
+	return opts, nil
+}
+
 func addUser(args []string) {
 	if len(args) < 2 {
 		log.Fatal("adduser: usage: adduser <dir> <username> [quota]")
@@ -154,3 +263,383 @@ func addUser(args []string) {
 
 	log.Printf("adduser: user %q added successfully", username)
 }
+
+// serverLimits returns the common quota and the options applying the
+// server-wide limits recorded in the users database.
+func serverLimits(db *users.UsersDB) (*fs.Quota, []fs.ServerOption, error) {
+	var (
+		quota *fs.Quota
+		opts  []fs.ServerOption
+	)
+	if db.StorageQuota != "" {
+		total, err := humanize.ParseBytes(db.StorageQuota)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid storage quota %q: %w", db.StorageQuota, err)
+		}
+		quota = fs.NewQuota(int64(total))
+	}
+	if db.Reserve != "" {
+		reserve, err := humanize.ParseBytes(db.Reserve)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid reserve %q: %w", db.Reserve, err)
+		}
+		opts = append(opts, fs.WithReserve(int64(reserve)))
+	}
+	return quota, opts, nil
+}
+
+// sizeOrNone formats a byte count, printing "none" for 0 and "unknown"
+// for negative values.
+func sizeOrNone(n int64) string {
+	switch {
+	case n < 0:
+		return "unknown"
+	case n == 0:
+		return "none"
+	}
+	return humanize.IBytes(uint64(n))
+}
+
+// limits shows and changes the server-wide storage quota and free space
+// reserve, and reports how much of them is in use. Changes take effect
+// when the server is next started.
+func limits(args []string) {
+	flags := flag.NewFlagSet("limits", flag.ExitOnError)
+	quota := flags.String("quota", "", "cap on the bytes stored by all users (e.g. 2TiB, none)")
+	reserve := flags.String("reserve", "", "free disk space writes must leave (e.g. 10GiB, none)")
+	masterKey := flags.String("master-key", "", "file with the hex master key of encrypted storage")
+	s3URL := flags.String("s3", "", "S3 bucket holding user files, as given to run")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() < 1 {
+		log.Fatal("limits: usage: limits [-quota size|none] [-reserve size|none] [-master-key file] [-s3 url] <dir>")
+	}
+	rootDir := flags.Arg(0)
+
+	db := &users.UsersDB{}
+	dbPath := filepath.Join(rootDir, "db.json")
+	if err := db.Load(dbPath); err != nil {
+		log.Fatalf("limits: failed to load users database: %v", err)
+	}
+
+	changed := false
+	for _, l := range []struct {
+		value string
+		field *string
+	}{{*quota, &db.StorageQuota}, {*reserve, &db.Reserve}} {
+		switch l.value {
+		case "":
+			continue
+		case "none":
+			*l.field = ""
+		default:
+			if _, err := humanize.ParseBytes(l.value); err != nil {
+				log.Fatalf("limits: invalid size %q: %v", l.value, err)
+			}
+			*l.field = l.value
+		}
+		changed = true
+	}
+	if changed {
+		if err := db.Save(dbPath); err != nil {
+			log.Fatalf("limits: failed to save database: %v", err)
+		}
+		log.Printf("limits: updated; restart the server to apply them")
+	}
+
+	commonQuota, opts, err := serverLimits(db)
+	if err != nil {
+		log.Fatalf("limits: %v", err)
+	}
+	storageOpts, err := storageOptions(*masterKey, *s3URL)
+	if err != nil {
+		log.Fatalf("limits: %v", err)
+	}
+	ufss, err := fs.NewUserFSServer(rootDir, commonQuota, db.Users, append(opts, storageOpts...)...)
+	if err != nil {
+		log.Fatalf("limits: failed to init user FS: %v", err)
+	}
+	// Only read: no Close, which would write back the metadata of a
+	// possibly running server.
+
+	st := ufss.Status()
+	fmt.Printf("Storage quota: %s used of %s\n", humanize.IBytes(uint64(st.Used)), sizeOrNone(st.Quota))
+	fmt.Printf("Reserve:       %s, disk free %s\n", sizeOrNone(st.Reserve), sizeOrNone(st.DiskFree))
+	for _, user := range db.Users {
+		ufs, err := ufss.GetUserFS(user.Name)
+		if err != nil {
+			continue
+		}
+		total, used, _ := ufs.GetQuota()
+		fmt.Printf("  %-16s %s used of %s\n", user.Name, humanize.IBytes(uint64(used)), sizeOrNone(total))
+	}
+}
+
+// parsePercents parses a comma-separated list of percentages.
+func parsePercents(s string) ([]int, error) {
+	var res []int
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		p, err := strconv.Atoi(strings.TrimSuffix(f, "%"))
+		if err != nil || p <= 0 || p > 100 {
+			return nil, fmt.Errorf("bad percentage %q", f)
+		}
+		res = append(res, p)
+	}
+	return res, nil
+}
+
+// dirQuota sets or removes the quota of a directory in a user tree. A
+// running server applies it on SIGHUP.
+func dirQuota(args []string) {
+	if len(args) < 3 {
+		log.Fatal("dirquota: usage: dirquota <dir> <username> <path> [quota|none]\n" +
+			"A running server applies changes when it receives SIGHUP, or when it is restarted.")
+	}
+	rootDir, username, dir := args[0], args[1], strings.Trim(args[2], "/")
+	if dir == "" {
+		log.Fatal("dirquota: the root is limited by the user quota")
+	}
+
+	db := &users.UsersDB{}
+	dbPath := filepath.Join(rootDir, "db.json")
+	if err := db.Load(dbPath); err != nil {
+		log.Fatalf("dirquota: failed to load users database: %v", err)
+	}
+
+	if len(args) < 4 {
+		user := db.GetUser(username)
+		if user == nil {
+			log.Fatalf("dirquota: user %q not found", username)
+		}
+		if quota, ok := user.DirQuotas[dir]; ok {
+			fmt.Printf("/%s: %s\n", dir, quota)
+		} else {
+			fmt.Printf("/%s: none\n", dir)
+		}
+		return
+	}
+
+	quota := args[3]
+	if quota == "none" {
+		quota = ""
+	} else if _, err := humanize.ParseBytes(quota); err != nil {
+		log.Fatalf("dirquota: invalid quota %q: %v", quota, err)
+	}
+	if err := db.SetDirQuota(username, dir, quota); err != nil {
+		log.Fatalf("dirquota: %v", err)
+	}
+	if err := db.Save(dbPath); err != nil {
+		log.Fatalf("dirquota: failed to save database: %v", err)
+	}
+	log.Printf("dirquota: quota of %s:/%s updated; send SIGHUP to the server or restart it to apply it", username, dir)
+}
+
+// verify re-hashes stored files and reports checksum mismatches.
+// Files without a recorded checksum get one as a side effect.
+func verify(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	masterKey := flags.String("master-key", "", "file with the hex master key of encrypted storage")
+	s3URL := flags.String("s3", "", "S3 bucket holding user files, as given to run")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		log.Fatal("verify: usage: verify [-master-key file] [-s3 url] <dir> [username]")
+	}
+	rootDir := args[0]
+
+	db := &users.UsersDB{}
+	if err := db.Load(filepath.Join(rootDir, "db.json")); err != nil {
+		log.Fatalf("verify: failed to load users database: %v", err)
+	}
+	names, _ := db.GetUsers()
+	if len(args) >= 2 {
+		if db.GetUser(args[1]) == nil {
+			log.Fatalf("verify: user %q not found", args[1])
+		}
+		names = []string{args[1]}
+	}
+
+	opts, err := storageOptions(*masterKey, *s3URL)
+	if err != nil {
+		log.Fatalf("verify: %v", err)
+	}
+	ufss, err := fs.NewUserFSServer(rootDir, nil, db.Users, opts...)
+	if err != nil {
+		log.Fatalf("verify: failed to init user FS: %v", err)
+	}
+
+	var checked, mismatched int
+	for _, name := range names {
+		ufs, err := ufss.GetUserFS(name)
+		if err != nil {
+			log.Fatalf("verify: %v", err)
+		}
+		err = ufs.Verify(context.Background(), func(res fs.VerifyResult) {
+			checked++
+			switch res.Status {
+			case fs.VerifyMismatch:
+				mismatched++
+				fmt.Printf("%s: MISMATCH %s: expected %s, got %s\n", name, res.Path, res.Expected, res.Actual)
+			case fs.VerifyModified:
+				fmt.Printf("%s: modified %s: checksum updated\n", name, res.Path)
+			case fs.VerifyMissing:
+				fmt.Printf("%s: new %s: checksum recorded\n", name, res.Path)
+			}
+		})
+		if err != nil {
+			log.Fatalf("verify: %s: %v", name, err)
+		}
+	}
+	if err := ufss.Sync(); err != nil {
+		log.Fatalf("verify: failed to save metadata: %v", err)
+	}
+
+	fmt.Printf("%d files checked, %d mismatches\n", checked, mismatched)
+	if mismatched > 0 {
+		os.Exit(1)
+	}
+}
+
+// migrate converts a storage root to deduplicated storage. The server must
+// not be running while the migration is in progress.
+func migrate(args []string) {
+	if len(args) < 1 {
+		log.Fatal("migrate: usage: migrate <dir>\n" +
+			"Deduplicates identical files of each user. Every user has a blob store of their own,\n" +
+			"so files stored by several users are kept once per user: nothing is saved across users.")
+	}
+	rootDir := args[0]
+
+	db := &users.UsersDB{}
+	if err := db.Load(filepath.Join(rootDir, "db.json")); err != nil {
+		log.Fatalf("migrate: failed to load users database: %v", err)
+	}
+
+	ufss, err := fs.NewUserFSServer(rootDir, nil, db.Users)
+	if err != nil {
+		log.Fatalf("migrate: failed to init user FS: %v", err)
+	}
+
+	stats, err := ufss.Migrate(context.Background())
+	if err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	fmt.Printf("%d files migrated, %d deduplicated, %s saved (within each user)\n",
+		stats.Files, stats.Linked, humanize.IBytes(uint64(stats.Saved)))
+}
+
+// encrypt converts a storage root to encrypted storage, rewriting every
+// existing file. The server must not be running while the migration is in
+// progress; an interrupted one is resumed by running it again.
+func encrypt(args []string) {
+	flags := flag.NewFlagSet("encrypt", flag.ExitOnError)
+	masterKey := flags.String("master-key", "", "file with the hex master key to encrypt with")
+	s3URL := flags.String("s3", "", "S3 bucket holding user files, as given to run")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	if flags.NArg() < 1 || *masterKey == "" {
+		log.Fatal("encrypt: usage: encrypt -master-key file [-s3 url] <dir>")
+	}
+	rootDir := flags.Arg(0)
+
+	db := &users.UsersDB{}
+	if err := db.Load(filepath.Join(rootDir, "db.json")); err != nil {
+		log.Fatalf("encrypt: failed to load users database: %v", err)
+	}
+	key, err := fs.LoadMasterKey(*masterKey)
+	if err != nil {
+		log.Fatalf("encrypt: %v", err)
+	}
+	opts, err := storageOptions("", *s3URL)
+	if err != nil {
+		log.Fatalf("encrypt: %v", err)
+	}
+
+	stats, err := fs.EncryptStorage(context.Background(), rootDir, db.Users, key, opts...)
+	if err != nil {
+		log.Fatalf("encrypt: %v", err)
+	}
+	fmt.Printf("%d files encrypted, %s\n", stats.Files, humanize.IBytes(uint64(stats.Bytes)))
+}
+
+// webhooks lists, registers and removes webhooks, including ones
+// receiving the events of all users, and shows their delivery history.
+// A running server picks up the changes with the next event.
+func webhooks(args []string) {
+	const usage = "webhook: usage: webhook list <dir> | webhook add [-user name] [-events upload,remove,...] [-path dir] [-secret key] <dir> <url> | webhook remove <dir> <id> | webhook history <dir> <id>"
+	if len(args) < 1 {
+		log.Fatal(usage)
+	}
+	cmd, args := args[0], args[1:]
+	flags := flag.NewFlagSet("webhook "+cmd, flag.ExitOnError)
+	user := flags.String("user", "", "only deliver the events of this user")
+	eventList := flags.String("events", "", "comma-separated event types to deliver (default all)")
+	path := flags.String("path", "", "only deliver the changes beneath this directory")
+	secret := flags.String("secret", "", "key of the payload signatures (default random)")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+	args = flags.Args()
+	if len(args) < 1 {
+		log.Fatal(usage)
+	}
+
+	hooks, err := webhook.New(fs.WebhooksDir(args[0]))
+	if err != nil {
+		log.Fatalf("webhook: %v", err)
+	}
+	switch {
+	case cmd == "list":
+		list, err := hooks.Hooks("")
+		if err != nil {
+			log.Fatalf("webhook: %v", err)
+		}
+		for _, h := range list {
+			owner := h.User
+			if owner == "" {
+				owner = "(all users)"
+			}
+			events := strings.Join(h.Events, ",")
+			if events == "" {
+				events = "all"
+			}
+			fmt.Printf("%s %-16s /%-20s %-20s %s\n", h.ID, owner, h.Path, events, h.URL)
+		}
+	case cmd == "add" && len(args) == 2:
+		h := webhook.Hook{User: *user, URL: args[1], Secret: *secret, Path: *path, Admin: true}
+		if *eventList != "" {
+			h.Events = strings.Split(*eventList, ",")
+		}
+		h, err := hooks.Add(h)
+		if err != nil {
+			log.Fatalf("webhook: %v", err)
+		}
+		fmt.Printf("id:     %s\nsecret: %s\n", h.ID, h.Secret)
+	case cmd == "remove" && len(args) == 2:
+		if err := hooks.Remove("", args[1]); err != nil {
+			log.Fatalf("webhook: %v", err)
+		}
+		log.Printf("webhook: %s removed", args[1])
+	case cmd == "history" && len(args) == 2:
+		records, err := hooks.History("", args[1])
+		if err != nil {
+			log.Fatalf("webhook: %v", err)
+		}
+		for _, r := range records {
+			result := strconv.Itoa(r.Status)
+			if r.Error != "" {
+				result = r.Error
+			}
+			fmt.Printf("%s %s #%d %-9s %s /%s: %s\n", r.Time.Local().Format(time.DateTime), r.Delivery, r.Attempt, r.Outcome, r.Event, r.Path, result)
+		}
+	default:
+		log.Fatal(usage)
+	}
+}
@@ -4,11 +4,17 @@ go 1.25.0
 
 require (
 	aqwari.net/net/styx v0.0.0-20221011015736-bf55d759d56b
+	github.com/alecthomas/chroma/v2 v2.24.1
 	github.com/dustin/go-humanize v1.0.1
 	github.com/golang-jwt/jwt/v5 v5.3.1
 	github.com/google/uuid v1.6.0
+	github.com/yuin/goldmark v1.8.2
 	golang.org/x/crypto v0.54.0
+	golang.org/x/image v0.25.0
 	golang.org/x/net v0.56.0
 )
 
-require aqwari.net/retry v0.0.0-20180428204214-1281ce5d8df0 // indirect
+require (
+	aqwari.net/retry v0.0.0-20180428204214-1281ce5d8df0 // indirect
+	github.com/dlclark/regexp2 v1.12.0 // indirect
+)
@@ -0,0 +1,284 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path"
+
+	"nssc/internal/fs"
+)
+
+const (
+	maxBatchOps  = 1000    // operations of a ?batch request
+	maxBatchBody = 1 << 20 // bytes of a ?batch request
+)
+
+// batchRequest is the body of POST ?batch. Paths are relative to the
+// directory the request is made at.
+type batchRequest struct {
+	// Atomic runs all of the operations or none: once one fails, those
+	// done are undone and the rest skipped.
+	Atomic     bool      `json:"atomic"`
+	Operations []batchOp `json:"operations"`
+}
+
+// batchOp is an operation of a batch: "delete", "mkdir" or "share" of
+// Path, or "move" or "copy" of Path to Dest.
+type batchOp struct {
+	Op   string `json:"op"`
+	Path string `json:"path"`
+	Dest string `json:"dest,omitempty"`
+}
+
+// batchResult is the outcome of an operation: a Status of "deleted",
+// "created", "moved", "copied" or "shared", "rolled_back" or "skipped"
+// in a failed atomic batch, or an Error as sendJSONError reports it.
+type batchResult struct {
+	batchOp
+	Status   string     `json:"status,omitempty"`
+	ShareURL string     `json:"share_url,omitempty"`
+	Error    *jsonError `json:"error,omitempty"`
+}
+
+// batchStep is a done operation of an atomic batch: undo reverts it,
+// commit finishes it once the batch succeeded. Either may be nil.
+type batchStep struct {
+	undo, commit func() error
+}
+
+// batch answers POST ?batch by running a list of operations, answering
+// 200 if all succeeded. A best-effort batch with failures answers 207; a
+// failed atomic batch answers with the status of the failed operation.
+func (h *APIHandler) batch(w http.ResponseWriter, r *http.Request, ctx context.Context, dir string, ufs *fs.UserFS) {
+	var req batchRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBody)).Decode(&req); err != nil {
+		sendJSONError(w, "Invalid batch", http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 || len(req.Operations) > maxBatchOps {
+		sendJSONError(w, "A batch holds 1 to 1000 operations", http.StatusBadRequest)
+		return
+	}
+
+	results := make([]batchResult, len(req.Operations))
+	var paths []string
+	invalid := -1
+	for i, op := range req.Operations {
+		results[i].batchOp = op
+		if msg := validateBatchOp(dir, op); msg != "" {
+			results[i].Error = &jsonError{Code: http.StatusBadRequest, Message: msg}
+			if invalid < 0 {
+				invalid = i
+			}
+			continue
+		}
+		req.Operations[i].Path = batchName(dir, op.Path)
+		paths = append(paths, req.Operations[i].Path)
+		if op.Dest != "" {
+			req.Operations[i].Dest = batchName(dir, op.Dest)
+			paths = append(paths, req.Operations[i].Dest)
+		}
+	}
+	if req.Atomic && invalid >= 0 {
+		for i := range results {
+			if results[i].Error == nil {
+				results[i].Status = "skipped"
+			}
+		}
+		sendBatchResults(w, http.StatusBadRequest, results)
+		return
+	}
+
+	defer h.locks.lock(ufs.Name(), paths...)()
+	var steps []batchStep
+	code := http.StatusOK
+	for i, op := range req.Operations {
+		if results[i].Error != nil {
+			code = http.StatusMultiStatus
+			continue
+		}
+		status, shareURL, step, err := h.runBatchOp(ctx, op, ufs, req.Atomic)
+		if err == nil {
+			results[i].Status, results[i].ShareURL = status, shareURL
+			steps = append(steps, step)
+			continue
+		}
+		log.Printf("batch %s %s error: %v", op.Op, op.Path, err)
+		errCode, msg := batchError(op, err)
+		results[i].Error = &jsonError{Code: errCode, Message: msg}
+		if !req.Atomic {
+			code = http.StatusMultiStatus
+			continue
+		}
+		for j := i + 1; j < len(results); j++ {
+			results[j].Status = "skipped"
+		}
+		for j := i - 1; j >= 0; j-- {
+			results[j].Status, results[j].ShareURL = "rolled_back", ""
+			if undo := steps[j].undo; undo != nil {
+				if err := undo(); err != nil {
+					log.Printf("batch rollback of %s %s error: %v", results[j].Op, results[j].Path, err)
+					results[j].Status = ""
+					results[j].Error = &jsonError{Code: http.StatusInternalServerError, Message: "Rollback failed"}
+				}
+			}
+		}
+		sendBatchResults(w, errCode, results)
+		return
+	}
+	for _, step := range steps {
+		if step.commit != nil {
+			if err := step.commit(); err != nil {
+				log.Printf("batch commit error: %v", err)
+			}
+		}
+	}
+	sendBatchResults(w, code, results)
+}
+
+// validateBatchOp returns why op, at the directory dir, cannot run
+// whatever the tree holds, or "".
+func validateBatchOp(dir string, op batchOp) string {
+	switch op.Op {
+	case "delete", "move", "copy":
+		if isRootName(batchName(dir, op.Path)) {
+			return "Invalid path"
+		}
+	case "mkdir", "share":
+	default:
+		return "Unknown operation"
+	}
+	if (op.Op == "move" || op.Op == "copy") && (op.Dest == "" || isRootName(batchName(dir, op.Dest))) {
+		return "Invalid destination"
+	}
+	return ""
+}
+
+// batchName returns name relative to the directory of the request.
+func batchName(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// isRootName reports whether name is the user root once cleaned, as
+// "", ".", "/" or "a/.." are.
+func isRootName(name string) bool {
+	return path.Clean("/"+name) == "/"
+}
+
+// runBatchOp runs op. In an atomic batch, what it deletes or replaces is
+// stashed until the batch is committed, so the returned step can undo it.
+func (h *APIHandler) runBatchOp(ctx context.Context, op batchOp, ufs *fs.UserFS, atomic bool) (status, shareURL string, step batchStep, err error) {
+	switch op.Op {
+	case "delete":
+		if _, err := ufs.Stat(ctx, op.Path); err != nil {
+			return "", "", step, err
+		}
+		if !atomic {
+			return "deleted", "", step, ufs.RemoveAll(ctx, op.Path)
+		}
+		s, err := ufs.Stash(ctx, op.Path)
+		if err != nil {
+			return "", "", step, err
+		}
+		return "deleted", "", batchStep{undo: s.Restore, commit: s.Commit}, nil
+
+	case "mkdir":
+		_, statErr := ufs.Stat(ctx, op.Path)
+		if err := ufs.MkdirAll(ctx, op.Path, 0750); err != nil {
+			return "", "", step, err
+		}
+		if statErr == nil {
+			return "created", "", step, nil
+		}
+		return "created", "", batchStep{undo: func() error { return ufs.RemoveAll(ctx, op.Path) }}, nil
+
+	case "move", "copy":
+		info, err := ufs.Stat(ctx, op.Path)
+		if err != nil {
+			return "", "", step, err
+		}
+		var replaced *fs.Stash
+		if dst, err := ufs.Stat(ctx, op.Dest); atomic && err == nil && !dst.IsDir() && !info.IsDir() {
+			if replaced, err = ufs.Stash(ctx, op.Dest); err != nil {
+				return "", "", step, err
+			}
+		}
+		if op.Op == "move" {
+			status = "moved"
+			err = ufs.Rename(ctx, op.Path, op.Dest)
+			step.undo = func() error { return ufs.Rename(ctx, op.Dest, op.Path) }
+		} else {
+			status = "copied"
+			err = ufs.Copy(ctx, op.Path, op.Dest)
+			step.undo = func() error { return ufs.RemoveAll(ctx, op.Dest) }
+		}
+		if replaced != nil {
+			if err != nil {
+				if rerr := replaced.Restore(); rerr != nil {
+					log.Printf("batch restore of %s error: %v", op.Dest, rerr)
+				}
+				return "", "", step, err
+			}
+			undo := step.undo
+			step.undo = func() error {
+				if err := undo(); err != nil {
+					return err
+				}
+				return replaced.Restore()
+			}
+			step.commit = replaced.Commit
+		}
+		return status, "", step, err
+
+	case "share":
+		if _, err := ufs.Stat(ctx, op.Path); err != nil {
+			return "", "", step, err
+		}
+		id, err := h.shareMgr.CreateShare(ufs.Name(), op.Path)
+		if err != nil {
+			return "", "", step, err
+		}
+		return "shared", "/public/" + id, batchStep{undo: func() error { return h.shareMgr.RemoveShare(id) }}, nil
+	}
+	return "", "", step, os.ErrInvalid
+}
+
+// batchError maps the error of op to a status and message.
+func batchError(op batchOp, err error) (int, string) {
+	switch {
+	case fs.IsInsufficientStorage(err):
+		return http.StatusInsufficientStorage, "Insufficient storage"
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound, "Resource not found"
+	case errors.Is(err, os.ErrExist):
+		return http.StatusConflict, "Destination exists"
+	case errors.Is(err, os.ErrInvalid):
+		return http.StatusBadRequest, "Invalid path"
+	}
+	switch op.Op {
+	case "delete":
+		return http.StatusInternalServerError, "Deletion failed"
+	case "mkdir":
+		return http.StatusInternalServerError, "Directory creation failed"
+	case "share":
+		return http.StatusInternalServerError, "Sharing failed"
+	case "copy":
+		return http.StatusInternalServerError, "Copy failed"
+	}
+	return http.StatusInternalServerError, "Move failed"
+}
+
+func sendBatchResults(w http.ResponseWriter, code int, results []batchResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(map[string][]batchResult{"results": results}); err != nil {
+		log.Printf("batch encode error: %v", err)
+	}
+}
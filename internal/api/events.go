@@ -0,0 +1,91 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"nssc/internal/events"
+	"nssc/internal/fs"
+)
+
+// eventsKeepAlive is how often an idle event stream gets a comment, so
+// proxies do not close it.
+const eventsKeepAlive = 30 * time.Second
+
+// quotaState is the data of the quota events of a stream.
+type quotaState struct {
+	Used  int64 `json:"used"`
+	Total int64 `json:"total"`
+}
+
+// events answers ?events with a stream of server-sent events reporting
+// the changes beneath dir as they happen: one per bus event, named by its
+// type, and a "quota" event whenever the usage of the user changed.
+// Quota warnings are sent whatever the directory.
+func (h *APIHandler) events(w http.ResponseWriter, r *http.Request, dir string, ufs *fs.UserFS) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		sendJSONError(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	ch, cancel := h.fs.Events().Subscribe(256)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(name string, v any) bool {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+			return false
+		}
+		flusher.Flush()
+		return true
+	}
+	total, used, _ := ufs.GetQuota()
+	quota := quotaState{Used: used, Total: total}
+	if !send("quota", quota) {
+		return
+	}
+
+	ping := time.NewTicker(eventsKeepAlive)
+	defer ping.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ping.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e := <-ch:
+			if e.User != ufs.Name() {
+				continue
+			}
+			if e.Type != events.QuotaWarning && !e.Beneath(dir) {
+				continue
+			}
+			if !send(string(e.Type), e) {
+				return
+			}
+			total, used, _ := ufs.GetQuota()
+			if now := (quotaState{Used: used, Total: total}); now != quota {
+				quota = now
+				if !send("quota", quota) {
+					return
+				}
+			}
+		}
+	}
+}
@@ -1,20 +1,27 @@
 package api
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"mime"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
 	"nssc/internal/fs"
 	"nssc/internal/share"
 	"nssc/internal/users"
+	"nssc/internal/webhook"
 )
 
 type APIHandler struct {
@@ -22,15 +29,21 @@ type APIHandler struct {
 	rootDir  string
 	shareMgr *share.ShareManager
 	fs       *fs.UserFSServer
+	hooks    *webhook.Manager // nil if webhooks are disabled
+	locks    pathLocks
 }
 
-func NewHandler(db *users.UsersDB, rootDir string, fs *fs.UserFSServer) *APIHandler {
+// NewHandler creates an APIHandler. Users manage their webhooks in hooks,
+// which may be nil.
+func NewHandler(db *users.UsersDB, rootDir string, fs *fs.UserFSServer, hooks *webhook.Manager) *APIHandler {
 	shareMgr := share.NewShareManager(filepath.Join(rootDir, "public"))
+	shareMgr.Events = fs.Events()
 	return &APIHandler{
 		db:       db,
 		rootDir:  rootDir,
 		shareMgr: shareMgr,
 		fs:       fs,
+		hooks:    hooks,
 	}
 }
 
@@ -91,8 +104,55 @@ func (h *APIHandler) handleGet(w http.ResponseWriter, r *http.Request, ctx conte
 		return
 	}
 
+	query := r.URL.Query()
+	if query.Has("meta") {
+		h.getAttrs(w, ctx, path, ufs)
+		return
+	}
+	if query.Has("favorites") {
+		h.listFavorites(w, path, ufs)
+		return
+	}
+	if query.Has("search") {
+		h.search(w, r, path, ufs)
+		return
+	}
+	if query.Has("changes") {
+		h.changes(w, r, path, ufs)
+		return
+	}
+	if query.Has("events") {
+		h.events(w, r, path, ufs)
+		return
+	}
+	if query.Has("webhooks") {
+		h.listWebhooks(w, ufs)
+		return
+	}
+	if id := query.Get("webhook"); id != "" {
+		h.getWebhook(w, id, ufs)
+		return
+	}
+	if query.Has("thumb") {
+		h.thumbnail(w, r, path, ufs)
+		return
+	}
+	if query.Has("archive") {
+		h.archive(w, r, path, info, ufs)
+		return
+	}
+
+	if query.Has("stat") {
+		h.stat(w, ctx, path, ufs)
+		return
+	}
+
 	if info.IsDir() {
-		h.listDirectory(w, path, ufs)
+		if query.Has("recursive") {
+			h.listRecursive(w, r, ctx, path, ufs)
+			return
+		}
+		h.listDirectory(w, r, ctx, path, ufs)
 		return
 	}
 
@@ -102,40 +162,183 @@ func (h *APIHandler) handleGet(w http.ResponseWriter, r *http.Request, ctx conte
 		return
 	}
 	defer f.Close()
+	sum, _ := ufs.Checksum(ctx, path)
+	fs.SetChecksumHeaders(w.Header(), info, sum)
 	http.ServeContent(w, r, info.Name(), info.ModTime(), f.(interface {
 		Read([]byte) (int, error)
 		Seek(int64, int) (int64, error)
 	}))
 }
 
-func (h *APIHandler) listDirectory(w http.ResponseWriter, path string, ufs *fs.UserFS) {
-	entries, err := ufs.ReadDir(path)
+// listDirectory lists a page of path, ordered by ?sort= (name, size,
+// mtime or type) and ?order= (asc or desc), keeping only the entries
+// tagged ?tag= if given.
+func (h *APIHandler) listDirectory(w http.ResponseWriter, r *http.Request, ctx context.Context, path string, ufs *fs.UserFS) {
+	query := r.URL.Query()
+	page, perPage, ok := pageParams(query, maxPerPage)
+	if !ok {
+		sendJSONError(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	opts := fs.ListOptions{
+		Sort:   query.Get("sort"),
+		Tag:    query.Get("tag"),
+		Offset: (page - 1) * perPage,
+		Limit:  perPage,
+	}
+	switch query.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Desc = true
+	default:
+		sendJSONError(w, "Invalid order", http.StatusBadRequest)
+		return
+	}
+	list, err := ufs.List(ctx, path, opts)
+	if errors.Is(err, fs.ErrBadSort) {
+		sendJSONError(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		sendJSONError(w, "Failed to read directory", http.StatusInternalServerError)
 		return
 	}
 
-	response := make([]map[string]interface{}, 0)
-	for _, entry := range entries {
-		info, _ := entry.Info()
-		if info == nil {
-			continue
-		}
-		response = append(response, map[string]interface{}{
-			"name":      entry.Name(),
-			"size":      info.Size(),
-			"is_dir":    entry.IsDir(),
-			"modified":  info.ModTime().Format(time.RFC3339),
-			"mime_type": getMimeType(info),
-		})
+	response := make([]map[string]interface{}, 0, len(list.Entries))
+	for _, entry := range list.Entries {
+		response = append(response, listItem(ctx, entry, ufs))
 	}
 
+	setPageHeaders(w, r, page, perPage, list.Total)
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
 		log.Printf("listDirectory encode error: %v", err)
 	}
 }
 
+// listItem describes an entry of a listing.
+func listItem(ctx context.Context, entry fs.ListEntry, ufs *fs.UserFS) map[string]interface{} {
+	item := map[string]interface{}{
+		"name":      entry.Name(),
+		"size":      entry.Size(),
+		"is_dir":    entry.IsDir(),
+		"modified":  entry.ModTime().Format(time.RFC3339),
+		"mime_type": getMimeType(entry),
+	}
+	if !entry.IsDir() {
+		if sum, _ := ufs.Checksum(ctx, entry.Path); sum != "" {
+			item["sha256"] = sum
+		}
+	}
+	if len(entry.Attrs.Tags) > 0 {
+		item["tags"] = entry.Attrs.Tags
+	}
+	if entry.Attrs.Favorite {
+		item["favorite"] = true
+	}
+	return item
+}
+
+// listRecursive streams the entries beneath path, down to ?depth= levels
+// (1 lists the children alone; no limit by default), as one JSON array
+// in directory order. Each entry carries its path relative to path.
+func (h *APIHandler) listRecursive(w http.ResponseWriter, r *http.Request, ctx context.Context, path string, ufs *fs.UserFS) {
+	depth := 0
+	if s := r.URL.Query().Get("depth"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			sendJSONError(w, "Invalid depth", http.StatusBadRequest)
+			return
+		}
+		depth = n
+	}
+	top, err := ufs.List(ctx, path, fs.ListOptions{})
+	if err != nil {
+		sendJSONError(w, "Failed to read directory", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	io.WriteString(w, "[")
+	first := true
+	var walk func(list fs.ListPage, rel string, level int) error
+	walk = func(list fs.ListPage, rel string, level int) error {
+		for _, entry := range list.Entries {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := listItem(ctx, entry, ufs)
+			item["path"] = entry.Name()
+			if rel != "" {
+				item["path"] = rel + "/" + entry.Name()
+			}
+			if !first {
+				io.WriteString(w, ",")
+			}
+			first = false
+			if err := enc.Encode(item); err != nil {
+				return err
+			}
+			if !entry.IsDir() || depth > 0 && level >= depth {
+				continue
+			}
+			// Directories vanishing meanwhile are left out.
+			sub, err := ufs.List(ctx, entry.Path, fs.ListOptions{})
+			if err != nil {
+				continue
+			}
+			if err := walk(sub, item["path"].(string), level+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(top, "", 1); err != nil {
+		log.Printf("listRecursive %s: %v", path, err)
+		return
+	}
+	io.WriteString(w, "]\n")
+}
+
+// stat describes path without its contents: the fields of a listing
+// entry plus its mode, the public links sharing it and, for directories,
+// the number of entries in it.
+func (h *APIHandler) stat(w http.ResponseWriter, ctx context.Context, path string, ufs *fs.UserFS) {
+	info, err := ufs.Stat(ctx, path)
+	if err != nil {
+		sendJSONError(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+	attrs, _ := ufs.Attrs(ctx, path)
+	entry := fs.ListEntry{FileInfo: info, Path: path, Attrs: attrs}
+	item := listItem(ctx, entry, ufs)
+	item["mode"] = fmt.Sprintf("%04o", info.Mode().Perm())
+	sum, _ := ufs.Checksum(ctx, path)
+	item["etag"] = fs.ETagOf(info, sum)
+	shares := []string{}
+	if ids, err := h.shareMgr.FindShares(ufs.Name(), path); err == nil {
+		for _, id := range ids {
+			shares = append(shares, "/public/"+id)
+		}
+	}
+	item["share_urls"] = shares
+	if info.IsDir() {
+		list, err := ufs.List(ctx, path, fs.ListOptions{Limit: 1})
+		if err != nil {
+			sendJSONError(w, "Failed to read directory", http.StatusInternalServerError)
+			return
+		}
+		item["dirs"] = list.Dirs
+		item["files"] = list.Total - list.Dirs
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(item); err != nil {
+		log.Printf("stat encode error: %v", err)
+	}
+}
+
 func (h *APIHandler) handlePost(w http.ResponseWriter, r *http.Request, ctx context.Context, path string, ufs *fs.UserFS) {
 	if r.URL.Query().Get("mkdir") != "" {
 		h.createDirectory(w, ctx, path, ufs)
@@ -147,9 +350,70 @@ func (h *APIHandler) handlePost(w http.ResponseWriter, r *http.Request, ctx cont
 		return
 	}
 
+	if r.URL.Query().Has("meta") {
+		h.setAttrs(w, r, ctx, path, ufs)
+		return
+	}
+
+	if r.URL.Query().Has("webhooks") {
+		h.addWebhook(w, r, path, ufs)
+		return
+	}
+
+	if r.URL.Query().Has("batch") {
+		h.batch(w, r, ctx, path, ufs)
+		return
+	}
+
+	if r.URL.Query().Get("move") != "" {
+		h.move(w, r, ctx, path, r.URL.Query().Get("move"), ufs)
+		return
+	}
+
 	sendJSONError(w, "Invalid operation", http.StatusBadRequest)
 }
 
+// move answers POST ?move={dest} by moving path to dest, replacing what
+// is there. If-Match and If-Unmodified-Since apply to path, while
+// If-None-Match applies to dest, so "*" keeps the move from replacing it.
+func (h *APIHandler) move(w http.ResponseWriter, r *http.Request, ctx context.Context, path, dest string, ufs *fs.UserFS) {
+	defer h.locks.lock(ufs.Name(), path, dest)()
+	match := ifMatch(r)
+	src := func(res fs.Resource) error {
+		if err := match(res); err != nil {
+			return err
+		}
+		if !res.Exists {
+			return errSourceNotFound
+		}
+		return nil
+	}
+	if err := ufs.RenameIf(ctx, path, dest, src, ifNoneMatch(r)); err != nil {
+		if preconditionFailed(w, err) {
+			return
+		}
+		log.Printf("move %s to %s error: %v", path, dest, err)
+		switch {
+		case errors.Is(err, errSourceNotFound):
+			sendJSONError(w, "Resource not found", http.StatusNotFound)
+		case fs.IsInsufficientStorage(err):
+			sendJSONError(w, "Insufficient storage", http.StatusInsufficientStorage)
+		case errors.Is(err, os.ErrInvalid), errors.Is(err, os.ErrNotExist):
+			sendJSONError(w, "Invalid destination", http.StatusBadRequest)
+		default:
+			sendJSONError(w, "Move failed", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"status": "moved",
+		"path":   dest,
+	}); err != nil {
+		log.Printf("move encode error: %v", err)
+	}
+}
+
 func (h *APIHandler) createDirectory(w http.ResponseWriter, ctx context.Context, path string, ufs *fs.UserFS) {
 	if err := ufs.MkdirAll(ctx, path, 0750); err != nil {
 		sendJSONError(w, "Directory creation failed", http.StatusInternalServerError)
@@ -167,13 +431,29 @@ func (h *APIHandler) createDirectory(w http.ResponseWriter, ctx context.Context,
 
 func (h *APIHandler) handlePut(w http.ResponseWriter, r *http.Request, ctx context.Context, path string, ufs *fs.UserFS) {
 	defer r.Body.Close()
+	if r.URL.Query().Has("extract") {
+		h.extract(w, r, ctx, path, ufs)
+		return
+	}
 
-	if err := ufs.WriteFile(path, r.Body, r.ContentLength); err != nil {
+	defer h.locks.lock(ufs.Name(), path)()
+	if err := ufs.WriteFileIf(path, r.Body, r.ContentLength, ifAll(r)); err != nil {
+		if preconditionFailed(w, err) {
+			return
+		}
 		log.Printf("handlePut WriteFile error: %v", err)
+		if fs.IsInsufficientStorage(err) {
+			sendJSONError(w, "Insufficient storage", http.StatusInsufficientStorage)
+			return
+		}
 		sendJSONError(w, "Upload failed", http.StatusInternalServerError)
 		return
 	}
 
+	setQuotaWarnings(w, ufs, path)
+	if etag, err := ufs.ETag(ctx, path); err == nil {
+		w.Header().Set("ETag", etag)
+	}
 	w.WriteHeader(http.StatusCreated)
 	if err := json.NewEncoder(w).Encode(map[string]string{
 		"status": "uploaded",
@@ -183,8 +463,46 @@ func (h *APIHandler) handlePut(w http.ResponseWriter, r *http.Request, ctx conte
 	}
 }
 
+// extract answers PUT ?extract=1 by unpacking the zip, tar or tar.gz
+// archive in the body into the directory path. The response lists the
+// outcome of every entry.
+func (h *APIHandler) extract(w http.ResponseWriter, r *http.Request, ctx context.Context, path string, ufs *fs.UserFS) {
+	results, err := ufs.Extract(ctx, path, r.Body)
+	if err != nil {
+		log.Printf("extract error: %v", err)
+		switch {
+		case fs.IsInsufficientStorage(err):
+			sendJSONError(w, "Insufficient storage", http.StatusInsufficientStorage)
+		case errors.Is(err, fs.ErrNotArchive):
+			sendJSONError(w, err.Error(), http.StatusUnsupportedMediaType)
+		case errors.Is(err, os.ErrInvalid):
+			sendJSONError(w, "Invalid path", http.StatusBadRequest)
+		default:
+			sendJSONError(w, "Extraction failed", http.StatusInternalServerError)
+		}
+		return
+	}
+	if results == nil {
+		results = []fs.ExtractResult{}
+	}
+	setQuotaWarnings(w, ufs, path)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		log.Printf("extract encode error: %v", err)
+	}
+}
+
 func (h *APIHandler) handleDelete(w http.ResponseWriter, r *http.Request, ctx context.Context, path string, ufs *fs.UserFS) {
-	if err := ufs.RemoveAll(ctx, path); err != nil {
+	if id := r.URL.Query().Get("webhook"); id != "" {
+		h.removeWebhook(w, id, ufs)
+		return
+	}
+	defer h.locks.lock(ufs.Name(), path)()
+	if err := ufs.RemoveAllIf(ctx, path, ifAll(r)); err != nil {
+		if preconditionFailed(w, err) {
+			return
+		}
 		sendJSONError(w, "Deletion failed", http.StatusInternalServerError)
 		return
 	}
@@ -193,13 +511,12 @@ func (h *APIHandler) handleDelete(w http.ResponseWriter, r *http.Request, ctx co
 }
 
 func (h *APIHandler) createShare(w http.ResponseWriter, ctx context.Context, path string, ufs *fs.UserFS) {
-	// Stat confirms the path exists and is inside the user root (resolvePath is called internally).
+	// Stat confirms the path exists and is inside the user root (traversal is rejected).
 	if _, err := ufs.Stat(ctx, path); err != nil {
 		sendJSONError(w, "Path not found", http.StatusNotFound)
 		return
 	}
-	// Pass userRoot + relPath; CreateShare performs EvalSymlinks and boundary check.
-	linkID, err := h.shareMgr.CreateShare(ufs.Root(), path)
+	linkID, err := h.shareMgr.CreateShare(ufs.Name(), path)
 	if err != nil {
 		sendJSONError(w, "Sharing failed", http.StatusInternalServerError)
 		return
@@ -212,19 +529,306 @@ func (h *APIHandler) createShare(w http.ResponseWriter, ctx context.Context, pat
 	}
 }
 
+func (h *APIHandler) getAttrs(w http.ResponseWriter, ctx context.Context, path string, ufs *fs.UserFS) {
+	attrs, err := ufs.Attrs(ctx, path)
+	if err != nil {
+		sendJSONError(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(attrs); err != nil {
+		log.Printf("getAttrs encode error: %v", err)
+	}
+}
+
+// attrsUpdate is the body of POST ?meta. Fields left out keep their value.
+type attrsUpdate struct {
+	Tags     *[]string `json:"tags"`
+	Comment  *string   `json:"comment"`
+	Favorite *bool     `json:"favorite"`
+}
+
+func (h *APIHandler) setAttrs(w http.ResponseWriter, r *http.Request, ctx context.Context, path string, ufs *fs.UserFS) {
+	defer r.Body.Close()
+	var upd attrsUpdate
+	if err := json.NewDecoder(r.Body).Decode(&upd); err != nil {
+		sendJSONError(w, "Invalid metadata", http.StatusBadRequest)
+		return
+	}
+	attrs, err := ufs.Attrs(ctx, path)
+	if err != nil {
+		sendJSONError(w, "Resource not found", http.StatusNotFound)
+		return
+	}
+	if upd.Tags != nil {
+		attrs.Tags = *upd.Tags
+	}
+	if upd.Comment != nil {
+		attrs.Comment = *upd.Comment
+	}
+	if upd.Favorite != nil {
+		attrs.Favorite = *upd.Favorite
+	}
+	if err := ufs.SetAttrs(ctx, path, attrs); err != nil {
+		log.Printf("setAttrs error: %v", err)
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.getAttrs(w, ctx, path, ufs)
+}
+
+// listFavorites lists the favorites beneath path, with their paths
+// relative to the user root.
+func (h *APIHandler) listFavorites(w http.ResponseWriter, path string, ufs *fs.UserFS) {
+	favorites, err := ufs.FindAttrs(path, func(a fs.Attrs) bool { return a.Favorite })
+	if err != nil {
+		sendJSONError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	keys := make([]string, 0, len(favorites))
+	for key := range favorites {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	response := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		item := map[string]interface{}{"path": key}
+		if tags := favorites[key].Tags; len(tags) > 0 {
+			item["tags"] = tags
+		}
+		if comment := favorites[key].Comment; comment != "" {
+			item["comment"] = comment
+		}
+		response = append(response, item)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("listFavorites encode error: %v", err)
+	}
+}
+
+// search answers ?search= with a page of the entries beneath path matching
+// the query, best first. ?page= (from 1) and ?per_page= select the page;
+// X-Total-Count and a Link header with the next and previous pages
+// describe the rest.
+func (h *APIHandler) search(w http.ResponseWriter, r *http.Request, path string, ufs *fs.UserFS) {
+	query := r.URL.Query()
+	if len(query.Get("search")) > 200 {
+		sendJSONError(w, "Search query too long", http.StatusBadRequest)
+		return
+	}
+	page, perPage, ok := pageParams(query, defaultPerPage)
+	if !ok {
+		sendJSONError(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+	res, err := ufs.Search(r.Context(), path, query.Get("search"), (page-1)*perPage, perPage)
+	if errors.Is(err, fs.ErrBadQuery) {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("search error: %v", err)
+		sendJSONError(w, "Search failed", http.StatusInternalServerError)
+		return
+	}
+	if res.Results == nil {
+		res.Results = []fs.SearchResult{}
+	}
+	setPageHeaders(w, r, page, perPage, res.Total)
+	if res.Partial {
+		w.Header().Set("X-Search-Partial", "true")
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res.Results); err != nil {
+		log.Printf("search encode error: %v", err)
+	}
+}
+
+// maxChangesWait bounds how long ?changes&wait= holds a request.
+const maxChangesWait = 5 * time.Minute
+
+// changes answers ?changes&cursor= with the journal entries concerning
+// path after the cursor, waiting up to ?wait= seconds for one if there is
+// none yet. cursor=latest returns the cursor to start from without any
+// entries. An expired cursor gets 410: the client has to list the tree
+// again.
+func (h *APIHandler) changes(w http.ResponseWriter, r *http.Request, path string, ufs *fs.UserFS) {
+	query := r.URL.Query()
+	var cursor int64
+	switch s := query.Get("cursor"); s {
+	case "":
+		sendJSONError(w, "Missing cursor", http.StatusBadRequest)
+		return
+	case "latest":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fs.ChangePage{Changes: []fs.Change{}, Cursor: ufs.ChangeCursor()})
+		return
+	default:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			sendJSONError(w, "Invalid cursor", http.StatusBadRequest)
+			return
+		}
+		cursor = n
+	}
+	var wait time.Duration
+	if s := query.Get("wait"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || time.Duration(n)*time.Second > maxChangesWait {
+			sendJSONError(w, "Invalid wait", http.StatusBadRequest)
+			return
+		}
+		wait = time.Duration(n) * time.Second
+	}
+	_, perPage, ok := pageParams(query, maxPerPage)
+	if !ok {
+		sendJSONError(w, "Invalid page", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), wait)
+	defer cancel()
+	page, err := ufs.Changes(ctx, path, cursor, perPage)
+	if errors.Is(err, fs.ErrCursorExpired) {
+		sendJSONError(w, "Cursor expired", http.StatusGone)
+		return
+	}
+	if err != nil {
+		sendJSONError(w, "Invalid path", http.StatusBadRequest)
+		return
+	}
+	if page.Changes == nil {
+		page.Changes = []fs.Change{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		log.Printf("changes encode error: %v", err)
+	}
+}
+
+// thumbnail answers ?thumb=N with an image of path fitting in N×N pixels.
+func (h *APIHandler) thumbnail(w http.ResponseWriter, r *http.Request, path string, ufs *fs.UserFS) {
+	size, err := strconv.Atoi(r.URL.Query().Get("thumb"))
+	if _, ok := fs.ThumbnailSize(size); err != nil || !ok {
+		sendJSONError(w, "Invalid thumbnail size", http.StatusBadRequest)
+		return
+	}
+	thumb, err := ufs.Thumbnail(r.Context(), path, size)
+	if errors.Is(err, fs.ErrNoThumbnail) {
+		sendJSONError(w, "No thumbnail for this file type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Printf("thumbnail error: %v", err)
+		sendJSONError(w, "Cannot make thumbnail", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", thumb.ContentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", thumb.ModTime, bytes.NewReader(thumb.Data))
+}
+
+// archive answers ?archive=zip|tar.gz by streaming path, and everything
+// beneath it, as an archive.
+func (h *APIHandler) archive(w http.ResponseWriter, r *http.Request, path string, info os.FileInfo, ufs *fs.UserFS) {
+	format := r.URL.Query().Get("archive")
+	contentType, ok := fs.ArchiveTypes[format]
+	if !ok {
+		sendJSONError(w, "Archive format must be zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+	name := info.Name()
+	if strings.Trim(path, "/") == "" {
+		name = ufs.Name()
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	// The archive is streamed: errors past this point can only cut it short.
+	if err := ufs.WriteArchive(r.Context(), w, format, []string{path}); err != nil {
+		log.Printf("archive %s error: %v", path, err)
+	}
+}
+
+// defaultPerPage and maxPerPage bound the entries of a page.
+const (
+	defaultPerPage = 50
+	maxPerPage     = 1000
+)
+
+// pageParams returns the ?page= (from 1) and ?per_page= of a request.
+func pageParams(query url.Values, perPageDefault int) (page, perPage int, ok bool) {
+	page, perPage = 1, perPageDefault
+	if s := query.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return 0, 0, false
+		}
+		page = n
+	}
+	if s := query.Get("per_page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPerPage {
+			return 0, 0, false
+		}
+		perPage = n
+	}
+	return page, perPage, true
+}
+
+// setPageHeaders describes the pages of a paginated response with
+// X-Total-Count and a Link header pointing to the neighbouring pages.
+func setPageHeaders(w http.ResponseWriter, r *http.Request, page, perPage, total int) {
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	// RequestURI still holds the /api/ prefix stripped from URL.
+	base, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil {
+		base = r.URL
+	}
+	link := func(p int, rel string) string {
+		u := *base
+		q := u.Query()
+		q.Set("page", strconv.Itoa(p))
+		q.Set("per_page", strconv.Itoa(perPage))
+		u.RawQuery = q.Encode()
+		return "<" + u.RequestURI() + `>; rel="` + rel + `"`
+	}
+	var links []string
+	if page*perPage < total {
+		links = append(links, link(page+1, "next"))
+	}
+	if page > 1 {
+		links = append(links, link(page-1, "prev"))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+}
+
+// jsonError is the error reported by sendJSONError.
+type jsonError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
 func sendJSONError(w http.ResponseWriter, message string, code int) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
-	if err := json.NewEncoder(w).Encode(map[string]interface{}{
-		"error": map[string]interface{}{
-			"code":    code,
-			"message": message,
-		},
+	if err := json.NewEncoder(w).Encode(map[string]jsonError{
+		"error": {Code: code, Message: message},
 	}); err != nil {
 		log.Printf("sendJSONError encode error: %v", err)
 	}
 }
 
+// setQuotaWarnings adds an X-Quota-Warning header for every quota applying
+// to path that is filled beyond a soft limit.
+func setQuotaWarnings(w http.ResponseWriter, ufs *fs.UserFS, path string) {
+	for _, warning := range ufs.QuotaWarningsFor(path) {
+		w.Header().Add("X-Quota-Warning", warning.String())
+	}
+}
+
 // getMimeType returns the MIME type for a file by extension,
 // falling back to application/octet-stream for unknown types.
 func getMimeType(info os.FileInfo) string {
@@ -1,21 +1,36 @@
 package api_test
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	iofs "io/fs"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"nssc/internal/api"
 	"nssc/internal/fs"
+	"nssc/internal/share"
 	"nssc/internal/users"
+	"nssc/internal/webhook"
 )
 
 // newTestHandler wraps api.Handler the same way main.go does:
 // http.StripPrefix("/api/", handler) so the handler receives paths
 // without the /api/ prefix.
 func newTestHandler(db *users.UsersDB, rootDir string, ufss *fs.UserFSServer) http.Handler {
-	return http.StripPrefix("/api/", api.NewHandler(db, rootDir, ufss))
+	return http.StripPrefix("/api/", api.NewHandler(db, rootDir, ufss, nil))
 }
 
 func TestAPIHandler(t *testing.T) {
@@ -47,4 +62,844 @@ func TestAPIHandler(t *testing.T) {
 			t.Error("Invalid content type")
 		}
 	})
+	t.Run("Download has checksum headers", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/user/file.txt", nil)
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, req)
+		// sha256("content")
+		want := `"ed7002b439e9ac845f22357d822bac1444730fbdb6016d3ec9432297b9ec9f73"`
+		if got := w.Header().Get("ETag"); got != want {
+			t.Errorf("ETag %s, want %s", got, want)
+		}
+		if w.Header().Get("Digest") == "" {
+			t.Error("Missing Digest header")
+		}
+	})
+}
+
+func TestAPIInsufficientStorage(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "10B")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+
+	req := httptest.NewRequest("PUT", "/api/user/big.txt", strings.NewReader(strings.Repeat("x", 20)))
+	req.SetBasicAuth("user", "pass")
+	req.ContentLength = 20
+	w := httptest.NewRecorder()
+
+	handler.ServeHTTP(w, req)
+	if w.Code != http.StatusInsufficientStorage {
+		t.Errorf("Status code %d, want %d", w.Code, http.StatusInsufficientStorage)
+	}
+}
+
+func TestAPIMetadata(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+	ufs, _ := ufss.GetUserFS("user")
+	ufs.WriteFile("a.txt", strings.NewReader("a"), 1)
+	ufs.WriteFile("b.txt", strings.NewReader("b"), 1)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/api/user/a.txt?meta", `{"tags":["Work","work","urgent"],"favorite":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("set status %d: %s", w.Code, w.Body)
+	}
+	// Omitted fields are kept.
+	do("POST", "/api/user/a.txt?meta", `{"comment":"draft"}`)
+	w = do("GET", "/api/user/a.txt?meta", "")
+	want := `{"tags":["urgent","work"],"comment":"draft","favorite":true}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("meta = %s, want %s", got, want)
+	}
+
+	if w := do("POST", "/api/user/b.txt?meta", `{"tags":["two words"]}`); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid tag status %d, want 400", w.Code)
+	}
+	if w := do("POST", "/api/user/missing.txt?meta", `{"favorite":true}`); w.Code != http.StatusNotFound {
+		t.Errorf("missing file status %d, want 404", w.Code)
+	}
+
+	w = do("GET", "/api/user/?tag=WORK", "")
+	if body := w.Body.String(); !strings.Contains(body, `"a.txt"`) || strings.Contains(body, `"b.txt"`) {
+		t.Errorf("listing by tag = %s", body)
+	}
+	w = do("GET", "/api/user/?favorites", "")
+	if got := strings.TrimSpace(w.Body.String()); got != `[{"comment":"draft","path":"a.txt","tags":["urgent","work"]}]` {
+		t.Errorf("favorites = %s", got)
+	}
+}
+
+func TestAPISearch(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+	ufs, _ := ufss.GetUserFS("user")
+	ufs.WriteFile("docs/a.txt", strings.NewReader("the quick brown fox"), 19)
+	ufs.WriteFile("b.txt", strings.NewReader("a quick fox"), 11)
+
+	search := func(target string) (*httptest.ResponseRecorder, []fs.SearchResult) {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var results []fs.SearchResult
+		json.NewDecoder(w.Body).Decode(&results)
+		return w, results
+	}
+
+	_, results := search("/api/user/docs/?search=quick+fox")
+	if len(results) != 1 || results[0].Path != "docs/a.txt" || results[0].Snippet != "the quick brown fox" {
+		t.Errorf("results = %+v", results)
+	}
+
+	w, results := search("/api/user/?search=is:file&per_page=1")
+	if len(results) != 1 || w.Header().Get("X-Total-Count") != "2" {
+		t.Errorf("page 1 = %+v, total %s", results, w.Header().Get("X-Total-Count"))
+	}
+	if link := w.Header().Get("Link"); link != `</api/user/?page=2&per_page=1&search=is%3Afile>; rel="next"` {
+		t.Errorf("Link = %s", link)
+	}
+	if w, _ := search("/api/user/?search=size:>lots"); w.Code != http.StatusBadRequest {
+		t.Errorf("bad query status %d, want 400", w.Code)
+	}
+}
+
+func TestAPIListing(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+	ufs, _ := ufss.GetUserFS("user")
+	ufs.WriteFile("a.txt", strings.NewReader("aaa"), 3)
+	ufs.WriteFile("b.txt", strings.NewReader("b"), 1)
+	ufs.WriteFile("c.txt", strings.NewReader("cc"), 2)
+
+	list := func(target string) (*httptest.ResponseRecorder, []string) {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var entries []struct{ Name string }
+		json.NewDecoder(w.Body).Decode(&entries)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+		return w, names
+	}
+
+	w, names := list("/api/user/?sort=size&order=desc&per_page=2")
+	if strings.Join(names, ",") != "a.txt,c.txt" || w.Header().Get("X-Total-Count") != "3" {
+		t.Errorf("page 1 = %v, total %s", names, w.Header().Get("X-Total-Count"))
+	}
+	if link := w.Header().Get("Link"); link != `</api/user/?order=desc&page=2&per_page=2&sort=size>; rel="next"` {
+		t.Errorf("Link = %s", link)
+	}
+	if _, names := list("/api/user/?sort=size&order=desc&page=2&per_page=2"); strings.Join(names, ",") != "b.txt" {
+		t.Errorf("page 2 = %v", names)
+	}
+	for _, q := range []string{"sort=color", "order=up", "page=0"} {
+		if w, _ := list("/api/user/?" + q); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", q, w.Code)
+		}
+	}
+}
+
+func TestAPIStat(t *testing.T) {
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(root, nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, root, ufss)
+	ufs, _ := ufss.GetUserFS("user")
+	ufs.WriteFile("docs/a.txt", strings.NewReader("alpha"), 5)
+	ufs.WriteFile("docs/sub/b.txt", strings.NewReader("beta"), 4)
+	ufs.WriteFile("docs/sub/deep/c.txt", strings.NewReader("gamma"), 5)
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	var share map[string]string
+	json.NewDecoder(do("POST", "/api/user/docs/a.txt?share=1").Body).Decode(&share)
+	var stat struct {
+		Size      int64    `json:"size"`
+		Mode      string   `json:"mode"`
+		MimeType  string   `json:"mime_type"`
+		SHA256    string   `json:"sha256"`
+		ShareURLs []string `json:"share_urls"`
+		Dirs      int      `json:"dirs"`
+		Files     int      `json:"files"`
+	}
+	json.NewDecoder(do("GET", "/api/user/docs/a.txt?stat").Body).Decode(&stat)
+	if stat.Size != 5 || stat.Mode == "" || stat.MimeType != "text/plain; charset=utf-8" || stat.SHA256 == "" ||
+		len(stat.ShareURLs) != 1 || stat.ShareURLs[0] != share["share_url"] {
+		t.Errorf("file stat = %+v, share %v", stat, share)
+	}
+	stat.ShareURLs = nil
+	json.NewDecoder(do("GET", "/api/user/docs/?stat").Body).Decode(&stat)
+	if stat.Dirs != 1 || stat.Files != 1 || len(stat.ShareURLs) != 0 {
+		t.Errorf("dir stat = %+v", stat)
+	}
+	if w := do("GET", "/api/user/missing?stat"); w.Code != http.StatusNotFound {
+		t.Errorf("missing: status %d, want 404", w.Code)
+	}
+
+	walk := func(target string) []string {
+		var entries []struct{ Path string }
+		if err := json.NewDecoder(do("GET", target).Body).Decode(&entries); err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+		var paths []string
+		for _, e := range entries {
+			paths = append(paths, e.Path)
+		}
+		return paths
+	}
+	if got := strings.Join(walk("/api/user/docs/?recursive"), ","); got != "a.txt,sub,sub/b.txt,sub/deep,sub/deep/c.txt" {
+		t.Errorf("recursive = %s", got)
+	}
+	if got := strings.Join(walk("/api/user/docs/?recursive&depth=2"), ","); got != "a.txt,sub,sub/b.txt,sub/deep" {
+		t.Errorf("depth 2 = %s", got)
+	}
+	if w := do("GET", "/api/user/docs/?recursive&depth=0"); w.Code != http.StatusBadRequest {
+		t.Errorf("depth 0: status %d, want 400", w.Code)
+	}
+}
+
+func TestAPIPreconditions(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+
+	do := func(method, target, body string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("PUT", "/api/user/a.txt", "one", "If-None-Match", "*")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusCreated || etag == "" {
+		t.Fatalf("create: status %d, ETag %q", w.Code, etag)
+	}
+	if w := do("PUT", "/api/user/a.txt", "two", "If-None-Match", "*"); w.Code != http.StatusPreconditionFailed || w.Header().Get("ETag") != etag {
+		t.Errorf("create over existing: status %d, ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	if w := do("GET", "/api/user/a.txt", ""); w.Header().Get("ETag") != etag {
+		t.Errorf("GET ETag %q, want %q", w.Header().Get("ETag"), etag)
+	}
+
+	// A stale tag loses against the write that changed it.
+	w = do("PUT", "/api/user/a.txt", "two", "If-Match", etag)
+	if w.Code != http.StatusCreated || w.Header().Get("ETag") == etag {
+		t.Fatalf("update: status %d, ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+	newTag := w.Header().Get("ETag")
+	if w := do("PUT", "/api/user/a.txt", "three", "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale update: status %d", w.Code)
+	}
+	if w := do("DELETE", "/api/user/a.txt", "", "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale delete: status %d", w.Code)
+	}
+	past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+	if w := do("DELETE", "/api/user/a.txt", "", "If-Unmodified-Since", past); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete if unmodified since: status %d", w.Code)
+	}
+
+	do("PUT", "/api/user/b.txt", "b")
+	if w := do("POST", "/api/user/a.txt?move=b.txt", "", "If-None-Match", "*"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("move over existing: status %d", w.Code)
+	}
+	if w := do("POST", "/api/user/a.txt?move=c.txt", "", "If-Match", newTag, "If-None-Match", "*"); w.Code != http.StatusOK {
+		t.Errorf("move: status %d: %s", w.Code, w.Body)
+	}
+	// If-Match compares strongly, so a weak tag never matches.
+	if w := do("DELETE", "/api/user/c.txt", "", "If-Match", `W/`+newTag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete if weak tag matches: status %d", w.Code)
+	}
+	if w := do("PUT", "/api/user/c.txt", "c", "If-None-Match", `W/`+newTag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("put if weak tag does not match: status %d", w.Code)
+	}
+	if w := do("DELETE", "/api/user/c.txt", "", "If-Match", newTag); w.Code != http.StatusNoContent {
+		t.Errorf("delete: status %d", w.Code)
+	}
+	if w := do("DELETE", "/api/user/c.txt", "", "If-Match", "*"); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("delete missing: status %d", w.Code)
+	}
+}
+
+func TestAPIChanges(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+	ufs, _ := ufss.GetUserFS("user")
+
+	changes := func(target string) (*httptest.ResponseRecorder, fs.ChangePage) {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var page fs.ChangePage
+		json.NewDecoder(w.Body).Decode(&page)
+		return w, page
+	}
+
+	_, latest := changes("/api/user/?changes&cursor=latest")
+	ufs.WriteFile("a.txt", strings.NewReader("a"), 1)
+	_, page := changes(fmt.Sprintf("/api/user/?changes&cursor=%d", latest.Cursor))
+	if len(page.Changes) != 1 || page.Changes[0].Type != "create" || page.Changes[0].Path != "a.txt" {
+		t.Errorf("changes = %+v", page)
+	}
+
+	// A long poll returns as soon as something changes.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ufs.RemoveAll(context.Background(), "a.txt")
+	}()
+	began := time.Now()
+	_, page = changes(fmt.Sprintf("/api/user/?changes&cursor=%d&wait=10", page.Cursor))
+	if len(page.Changes) != 1 || page.Changes[0].Type != "remove" || time.Since(began) > 5*time.Second {
+		t.Errorf("long poll = %+v after %v", page, time.Since(began))
+	}
+
+	for target, code := range map[string]int{
+		"/api/user/?changes":                  http.StatusBadRequest,
+		"/api/user/?changes&cursor=x":         http.StatusBadRequest,
+		"/api/user/?changes&cursor=0&wait=-1": http.StatusBadRequest,
+		"/api/user/?changes&cursor=99":        http.StatusGone,
+	} {
+		if w, _ := changes(target); w.Code != code {
+			t.Errorf("%s: status %d, want %d", target, w.Code, code)
+		}
+	}
+}
+
+func TestAPIEvents(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	srv := httptest.NewServer(newTestHandler(db, t.TempDir(), ufss))
+	defer srv.Close()
+	ufs, _ := ufss.GetUserFS("user")
+	ctx := context.Background()
+	ufs.MkdirAll(ctx, "docs", 0755)
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/user/docs?events", nil)
+	req.SetBasicAuth("user", "pass")
+	resp, err := (&http.Client{Timeout: 10 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q", ct)
+	}
+	stream := bufio.NewReader(resp.Body)
+	next := func() (name string, data map[string]any) {
+		for {
+			line, err := stream.ReadString('\n')
+			if err != nil {
+				t.Fatalf("stream: %v", err)
+			}
+			switch line = strings.TrimSuffix(line, "\n"); {
+			case strings.HasPrefix(line, "event: "):
+				name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &data)
+			case line == "" && name != "":
+				return name, data
+			}
+		}
+	}
+
+	if name, data := next(); name != "quota" || data["used"] != 0.0 {
+		t.Errorf("first event %s %v, want quota of 0 bytes", name, data)
+	}
+	// Changes outside the directory are not streamed.
+	ufs.WriteFile("other.txt", strings.NewReader("other"), 5)
+	ufs.WriteFile("docs/a.txt", strings.NewReader("abc"), 3)
+	if name, data := next(); name != "create" || data["path"] != "docs/a.txt" {
+		t.Errorf("event %s %v, want create of docs/a.txt", name, data)
+	}
+	if name, data := next(); name != "quota" || data["used"] != 8.0 {
+		t.Errorf("event %s %v, want quota of 8 bytes", name, data)
+	}
+
+	share, _ := http.NewRequest("POST", srv.URL+"/api/user/docs/a.txt?share=1", nil)
+	share.SetBasicAuth("user", "pass")
+	if resp, err := http.DefaultClient.Do(share); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("share: %v %v", resp, err)
+	}
+	if name, data := next(); name != "share" || data["path"] != "docs/a.txt" || data["share"] == nil {
+		t.Errorf("event %s %v, want share of docs/a.txt", name, data)
+	}
+
+	ufs.Rename(ctx, "docs/a.txt", "b.txt")
+	if name, data := next(); name != "rename" || data["old_path"] != "docs/a.txt" {
+		t.Errorf("event %s %v, want rename from docs/a.txt", name, data)
+	}
+	ufs.RemoveAll(ctx, "b.txt")
+	ufs.RemoveAll(ctx, "docs")
+	if name, data := next(); name != "remove" || data["path"] != "docs" {
+		t.Errorf("event %s %v, want remove of docs", name, data)
+	}
+}
+
+func TestAPIWebhooks(t *testing.T) {
+	received := make(chan *http.Request, 10)
+	bodies := make(chan []byte, 10)
+	recv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer recv.Close()
+
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	root := t.TempDir()
+	ufss, _ := fs.NewUserFSServer(root, nil, db.Users)
+	defer ufss.Close()
+	hooks, err := webhook.New(fs.WebhooksDir(root), webhook.WithClient(recv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hooks.Start(ufss.Events())
+	defer hooks.Close()
+	handler := http.StripPrefix("/api/", api.NewHandler(db, root, ufss, hooks))
+	ufs, _ := ufss.GetUserFS("user")
+	ufs.MkdirAll(context.Background(), "inbox", 0755)
+
+	do := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("POST", "/api/user/?webhooks", `{"url":"mailto:x@example.com"}`); w.Code != http.StatusBadRequest {
+		t.Errorf("bad URL: status %d", w.Code)
+	}
+	w := do("POST", "/api/user/inbox?webhooks", fmt.Sprintf(`{"url":%q,"events":["upload"]}`, recv.URL))
+	var hook webhook.Hook
+	json.NewDecoder(w.Body).Decode(&hook)
+	if w.Code != http.StatusCreated || hook.Secret == "" || hook.Path != "inbox" {
+		t.Fatalf("register: status %d, hook %+v", w.Code, hook)
+	}
+	var list []webhook.Hook
+	json.NewDecoder(do("GET", "/api/user/?webhooks", "").Body).Decode(&list)
+	if len(list) != 1 || list[0].ID != hook.ID || list[0].Secret != "" {
+		t.Errorf("list = %+v", list)
+	}
+
+	ufs.WriteFile("elsewhere.txt", strings.NewReader("x"), 1)
+	if w := do("PUT", "/api/user/inbox/scan.pdf", "%PDF"); w.Code != http.StatusCreated {
+		t.Fatalf("upload: status %d", w.Code)
+	}
+	select {
+	case r := <-received:
+		body := <-bodies
+		var p webhook.Payload
+		json.Unmarshal(body, &p)
+		if r.Header.Get("X-Nssc-Signature") != webhook.Sign(hook.Secret, body) || p.Event.Path != "inbox/scan.pdf" {
+			t.Errorf("delivery %s signed %s", body, r.Header.Get("X-Nssc-Signature"))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delivery")
+	}
+
+	var history struct {
+		webhook.Hook
+		History []webhook.Record `json:"history"`
+	}
+	for deadline := time.Now().Add(5 * time.Second); len(history.History) == 0 && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+		json.NewDecoder(do("GET", "/api/user/?webhook="+hook.ID, "").Body).Decode(&history)
+	}
+	if history.ID != hook.ID || len(history.History) != 1 || history.History[0].Outcome != "delivered" {
+		t.Errorf("history = %+v", history)
+	}
+
+	if w := do("DELETE", "/api/user/?webhook="+hook.ID, ""); w.Code != http.StatusNoContent {
+		t.Errorf("remove: status %d", w.Code)
+	}
+	if w := do("DELETE", "/api/user/?webhook="+hook.ID, ""); w.Code != http.StatusNotFound {
+		t.Errorf("second remove: status %d", w.Code)
+	}
+	if _, err := ufs.Stat(context.Background(), "inbox/scan.pdf"); err != nil {
+		t.Errorf("files gone after removing the webhook: %v", err)
+	}
+}
+
+func TestAPIBatch(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, t.TempDir(), ufss)
+	ufs, _ := ufss.GetUserFS("user")
+	ctx := context.Background()
+	for name, content := range map[string]string{"a.txt": "a", "b.txt": "b", "dir/c.txt": "c", "keep.txt": "k"} {
+		ufs.WriteFile(name, strings.NewReader(content), int64(len(content)))
+	}
+
+	type result struct {
+		Op       string `json:"op"`
+		Status   string `json:"status"`
+		ShareURL string `json:"share_url"`
+		Error    *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	batch := func(body string) (int, []result) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/user/?batch", strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		var res struct{ Results []result }
+		if err := json.NewDecoder(w.Body).Decode(&res); err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		return w.Code, res.Results
+	}
+	statuses := func(results []result) string {
+		var s []string
+		for _, r := range results {
+			if r.Error != nil {
+				s = append(s, fmt.Sprint(r.Error.Code))
+			} else {
+				s = append(s, r.Status)
+			}
+		}
+		return strings.Join(s, " ")
+	}
+	content := func(name string) string {
+		f, err := ufs.Open(ctx, name)
+		if err != nil {
+			return ""
+		}
+		defer f.Close()
+		b, _ := io.ReadAll(f)
+		return string(b)
+	}
+
+	code, results := batch(`{"operations":[
+		{"op":"delete","path":"a.txt"},
+		{"op":"mkdir","path":"new/sub"},
+		{"op":"move","path":"b.txt","dest":"new/b.txt"},
+		{"op":"copy","path":"dir","dest":"dir2"},
+		{"op":"share","path":"keep.txt"},
+		{"op":"delete","path":"missing.txt"},
+		{"op":"chmod","path":"keep.txt"}]}`)
+	if want := "deleted created moved copied shared 404 400"; code != http.StatusMultiStatus || statuses(results) != want {
+		t.Errorf("best effort: status %d, results %s, want 207 %s", code, statuses(results), want)
+	}
+	if results[4].ShareURL == "" || content("new/b.txt") != "b" || content("dir2/c.txt") != "c" || content("a.txt") != "" {
+		t.Errorf("best effort batch not applied: %+v", results)
+	}
+
+	// The last operation fails, so the others are undone.
+	code, results = batch(`{"atomic":true,"operations":[
+		{"op":"delete","path":"dir2"},
+		{"op":"mkdir","path":"fresh"},
+		{"op":"move","path":"new/b.txt","dest":"dir/c.txt"},
+		{"op":"move","path":"missing.txt","dest":"x.txt"},
+		{"op":"delete","path":"keep.txt"}]}`)
+	if want := "rolled_back rolled_back rolled_back 404 skipped"; code != http.StatusNotFound || statuses(results) != want {
+		t.Errorf("atomic: status %d, results %s, want 404 %s", code, statuses(results), want)
+	}
+	if content("dir2/c.txt") != "c" || content("new/b.txt") != "b" || content("dir/c.txt") != "c" || content("keep.txt") != "k" {
+		t.Error("failed atomic batch not undone")
+	}
+	if _, err := ufs.Stat(ctx, "fresh"); err == nil {
+		t.Error("directory of a failed atomic batch left behind")
+	}
+
+	// Nothing resolving to the root may be deleted, moved or copied.
+	code, results = batch(`{"operations":[
+		{"op":"delete","path":"."},
+		{"op":"delete","path":"dir/.."},
+		{"op":"move","path":"/","dest":"x"},
+		{"op":"copy","path":"dir","dest":"dir/../."}]}`)
+	if want := "400 400 400 400"; code != http.StatusMultiStatus || statuses(results) != want {
+		t.Errorf("root: status %d, results %s, want 207 %s", code, statuses(results), want)
+	}
+	if content("keep.txt") != "k" {
+		t.Fatal("tree removed by a batch")
+	}
+
+	code, results = batch(`{"atomic":true,"operations":[{"op":"delete","path":"keep.txt"},{"op":"move","path":"x"}]}`)
+	if want := "skipped 400"; code != http.StatusBadRequest || statuses(results) != want {
+		t.Errorf("invalid atomic: status %d, results %s, want 400 %s", code, statuses(results), want)
+	}
+
+	code, results = batch(`{"atomic":true,"operations":[
+		{"op":"delete","path":"dir2"},
+		{"op":"move","path":"new/b.txt","dest":"dir/c.txt"}]}`)
+	if want := "deleted moved"; code != http.StatusOK || statuses(results) != want {
+		t.Errorf("atomic: status %d, results %s, want 200 %s", code, statuses(results), want)
+	}
+	if content("dir/c.txt") != "b" {
+		t.Error("replaced file has the old content")
+	}
+	for _, dir := range []string{"", "dir"} {
+		entries, _ := ufs.ReadDir(dir)
+		for _, e := range entries {
+			if strings.HasPrefix(e.Name(), ".nssc-") || e.Name() == "dir2" {
+				t.Errorf("%s left in /%s", e.Name(), dir)
+			}
+		}
+	}
+	if _, used, _ := ufs.GetQuota(); used != 2 {
+		t.Errorf("used = %d, want 2", used)
+	}
+}
+
+func TestAPIThumbnail(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+	ufs, _ := ufss.GetUserFS("user")
+	var buf bytes.Buffer
+	png.Encode(&buf, image.NewGray(image.Rect(0, 0, 300, 600)))
+	ufs.WriteFile("photo.png", bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	ufs.WriteFile("notes.txt", strings.NewReader("text"), 4)
+
+	get := func(target string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth("user", "pass")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/user/photo.png?thumb=128")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "image/jpeg" {
+		t.Fatalf("status %d, type %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	cfg, _, err := image.DecodeConfig(w.Body)
+	if err != nil || cfg.Width != 64 || cfg.Height != 128 {
+		t.Errorf("thumbnail %dx%d, %v", cfg.Width, cfg.Height, err)
+	}
+	if w := get("/api/user/photo.png?thumb=128", "If-Modified-Since", w.Header().Get("Last-Modified")); w.Code != http.StatusNotModified {
+		t.Errorf("revalidation status %d, want 304", w.Code)
+	}
+	for target, code := range map[string]int{
+		"/api/user/photo.png?thumb=big":  http.StatusBadRequest,
+		"/api/user/photo.png?thumb=5000": http.StatusBadRequest,
+		"/api/user/notes.txt?thumb=128":  http.StatusUnsupportedMediaType,
+		"/api/user/missing.png?thumb=64": http.StatusNotFound,
+	} {
+		if w := get(target); w.Code != code {
+			t.Errorf("%s: status %d, want %d", target, w.Code, code)
+		}
+	}
+}
+
+func TestAPIArchive(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+	ufs, _ := ufss.GetUserFS("user")
+	ufs.WriteFile("docs/a.txt", strings.NewReader("alpha"), 5)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/api/user/docs/?archive=zip")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" ||
+		w.Header().Get("Content-Disposition") != "attachment; filename=docs.zip" {
+		t.Fatalf("status %d, headers %v", w.Code, w.Header())
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil || len(zr.File) != 2 || zr.File[1].Name != "docs/a.txt" {
+		t.Errorf("archive: %v", err)
+	}
+	if w := get("/api/user/?archive=tar.gz"); w.Code != http.StatusOK || w.Header().Get("Content-Disposition") != "attachment; filename=user.tar.gz" {
+		t.Errorf("root archive: status %d, headers %v", w.Code, w.Header())
+	}
+	if w := get("/api/user/docs/?archive=rar"); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown format: status %d, want 400", w.Code)
+	}
+}
+
+func TestAPIExtract(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer ufss.Close()
+	handler := newTestHandler(db, "/tmp", ufss)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("docs/a.txt")
+	w.Write([]byte("alpha"))
+	zw.Create("../escape")
+	zw.Close()
+
+	put := func(target string, body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", target, bytes.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	rec := put("/api/user/project/?extract=1", buf.Bytes())
+	var results []fs.ExtractResult
+	json.NewDecoder(rec.Body).Decode(&results)
+	if rec.Code != http.StatusCreated || len(results) != 2 || results[0].Error != "" || results[1].Error == "" {
+		t.Fatalf("status %d, results %+v", rec.Code, results)
+	}
+	ufs, _ := ufss.GetUserFS("user")
+	if _, err := ufs.Stat(context.Background(), "project/docs/a.txt"); err != nil {
+		t.Error(err)
+	}
+	if rec := put("/api/user/project/?extract=1", []byte("not an archive")); rec.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("plain body: status %d, want 415", rec.Code)
+	}
+}
+
+// remoteBackend keeps a tree in a local directory but, like the S3
+// backend, gives the server no local root to reach it by.
+type remoteBackend string
+
+func (b remoteBackend) path(name string) string {
+	return filepath.Join(string(b), filepath.FromSlash(name))
+}
+
+func (b remoteBackend) OpenFile(name string, flag int, perm os.FileMode) (fs.File, error) {
+	f, err := os.OpenFile(b.path(name), flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+func (b remoteBackend) Stat(name string) (iofs.FileInfo, error)      { return os.Stat(b.path(name)) }
+func (b remoteBackend) ReadDir(name string) ([]iofs.DirEntry, error) { return os.ReadDir(b.path(name)) }
+func (b remoteBackend) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(b.path(name), perm)
+}
+func (b remoteBackend) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(b.path(name), perm)
+}
+func (b remoteBackend) Remove(name string) error    { return os.Remove(b.path(name)) }
+func (b remoteBackend) RemoveAll(name string) error { return os.RemoveAll(b.path(name)) }
+func (b remoteBackend) Rename(oldName, newName string) error {
+	return os.Rename(b.path(oldName), b.path(newName))
+}
+func (b remoteBackend) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(b.path(name), atime, mtime)
+}
+func (b remoteBackend) Truncate(name string, size int64) error {
+	return os.Truncate(b.path(name), size)
+}
+func (b remoteBackend) Usage(name string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(b.path(name), func(_ string, d iofs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			info, err := d.Info()
+			if err == nil {
+				size += info.Size()
+			}
+			return err
+		}
+		return err
+	})
+	return size, err
+}
+
+func TestAPIShareRemoteStorage(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	root, trees := t.TempDir(), t.TempDir()
+	ufss, err := fs.NewUserFSServer(root, nil, db.Users, fs.WithBackend(func(user string) (fs.Backend, error) {
+		return remoteBackend(filepath.Join(trees, user)), os.MkdirAll(filepath.Join(trees, user), 0755)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ufss.Close()
+	ufs, _ := ufss.GetUserFS("user")
+	if ufs.Root() != "" {
+		t.Fatalf("Root = %q, want none", ufs.Root())
+	}
+	ufs.WriteFile("docs/a.txt", strings.NewReader("alpha"), 5)
+	handler := newTestHandler(db, root, ufss)
+
+	do := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.SetBasicAuth("user", "pass")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+	w := do("POST", "/api/user/docs/a.txt?share=1")
+	var shared map[string]string
+	json.NewDecoder(w.Body).Decode(&shared)
+	if w.Code != http.StatusOK || shared["share_url"] == "" {
+		t.Fatalf("share: status %d, %v", w.Code, shared)
+	}
+	var stat struct {
+		ShareURLs []string `json:"share_urls"`
+	}
+	json.NewDecoder(do("GET", "/api/user/docs/a.txt?stat").Body).Decode(&stat)
+	if len(stat.ShareURLs) != 1 || stat.ShareURLs[0] != shared["share_url"] {
+		t.Errorf("share_urls = %v, want [%s]", stat.ShareURLs, shared["share_url"])
+	}
+
+	// The link names the file by owner and path, not by a local path.
+	id := strings.TrimPrefix(shared["share_url"], "/public/")
+	if user, name, err := share.NewShareManager(filepath.Join(root, "public")).Resolve(id); err != nil || user != "user" || name != "docs/a.txt" {
+		t.Errorf("Resolve = %q, %q, %v", user, name, err)
+	}
 }
@@ -0,0 +1,160 @@
+package api
+
+import (
+	"errors"
+	"hash/fnv"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"nssc/internal/fs"
+)
+
+// errSourceNotFound stops a move of a path that does not exist.
+var errSourceNotFound = errors.New("source not found")
+
+// preconditionError is returned by the preconditions of a request that
+// do not hold, with the state of the path they were evaluated on.
+type preconditionError struct {
+	res fs.Resource
+}
+
+func (e *preconditionError) Error() string { return "precondition failed" }
+
+// ifMatch returns the check of If-Match, or If-Unmodified-Since in its
+// absence, of r, as RFC 9110 section 13.2.2 orders them.
+func ifMatch(r *http.Request) fs.Precondition {
+	return func(res fs.Resource) error {
+		if !matchPreconditions(r, res) {
+			return &preconditionError{res}
+		}
+		return nil
+	}
+}
+
+// ifNoneMatch returns the check of If-None-Match of r.
+func ifNoneMatch(r *http.Request) fs.Precondition {
+	return func(res fs.Resource) error {
+		if !noneMatchPrecondition(r, res) {
+			return &preconditionError{res}
+		}
+		return nil
+	}
+}
+
+// ifAll returns the check of all the preconditions of r on one path.
+func ifAll(r *http.Request) fs.Precondition {
+	match, noneMatch := ifMatch(r), ifNoneMatch(r)
+	return func(res fs.Resource) error {
+		if err := match(res); err != nil {
+			return err
+		}
+		return noneMatch(res)
+	}
+}
+
+// matchPreconditions evaluates If-Match, or If-Unmodified-Since in its
+// absence, on res.
+func matchPreconditions(r *http.Request, res fs.Resource) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !res.Exists {
+			return false
+		}
+		return im == "*" || etagListed(im, res.ETag, false)
+	}
+	if ius := r.Header.Get("If-Unmodified-Since"); ius != "" && res.Exists {
+		if t, err := http.ParseTime(ius); err == nil {
+			return !res.ModTime.Truncate(time.Second).After(t)
+		}
+	}
+	return true
+}
+
+// noneMatchPrecondition evaluates If-None-Match on res; "*" holds only
+// if res does not exist, which keeps a write from replacing a file.
+func noneMatchPrecondition(r *http.Request, res fs.Resource) bool {
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" || !res.Exists {
+		return true
+	}
+	return inm != "*" && !etagListed(inm, res.ETag, true)
+}
+
+// etagListed reports whether the comma-separated list of entity tags
+// holds etag. With weak comparison, as If-None-Match uses, weak tags
+// match by their opaque part; with strong comparison, as If-Match
+// requires, a weak tag never matches.
+func etagListed(list, etag string, weak bool) bool {
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// preconditionFailed answers 412 with the current entity tag, if any, if
+// err is a preconditionError, and reports whether it was.
+func preconditionFailed(w http.ResponseWriter, err error) bool {
+	var pe *preconditionError
+	if !errors.As(err, &pe) {
+		return false
+	}
+	if pe.res.Exists {
+		w.Header().Set("ETag", pe.res.ETag)
+	}
+	sendJSONError(w, "Precondition failed", http.StatusPreconditionFailed)
+	return true
+}
+
+// pathLocks serializes the API changes of a path, so no single request
+// changes a path between the operations of a batch. Preconditions are
+// evaluated by UserFS under its own lock. Each user has a fixed set of
+// mutexes the paths share, so a large batch of one user never holds up
+// another. The zero value is ready for use.
+type pathLocks struct {
+	mu    sync.Mutex
+	users map[string]*[numPathLocks]sync.Mutex
+}
+
+const numPathLocks = 64
+
+// lock locks the mutexes of the paths of user, in a fixed order, and
+// returns the function unlocking them.
+func (l *pathLocks) lock(user string, paths ...string) func() {
+	l.mu.Lock()
+	if l.users == nil {
+		l.users = make(map[string]*[numPathLocks]sync.Mutex)
+	}
+	locks := l.users[user]
+	if locks == nil {
+		locks = new([numPathLocks]sync.Mutex)
+		l.users[user] = locks
+	}
+	l.mu.Unlock()
+
+	var held [numPathLocks]bool
+	for _, p := range paths {
+		h := fnv.New32a()
+		h.Write([]byte(path.Clean("/" + p)))
+		held[h.Sum32()%numPathLocks] = true
+	}
+	for i := range locks {
+		if held[i] {
+			locks[i].Lock()
+		}
+	}
+	return func() {
+		for i := range locks {
+			if held[i] {
+				locks[i].Unlock()
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"nssc/internal/fs"
+	"nssc/internal/webhook"
+)
+
+// webhookRequest is the body of POST ?webhooks.
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+// listWebhooks answers GET ?webhooks with the hooks of the user, without
+// their secrets.
+func (h *APIHandler) listWebhooks(w http.ResponseWriter, ufs *fs.UserFS) {
+	if h.hooks == nil {
+		sendJSONError(w, "Webhooks not enabled", http.StatusNotImplemented)
+		return
+	}
+	hooks, err := h.hooks.Hooks(ufs.Name())
+	if err != nil {
+		log.Printf("webhooks error: %v", err)
+		sendJSONError(w, "Webhooks unavailable", http.StatusInternalServerError)
+		return
+	}
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(hooks); err != nil {
+		log.Printf("webhooks encode error: %v", err)
+	}
+}
+
+// addWebhook answers POST ?webhooks by registering a hook for the changes
+// beneath path. The secret is only returned here.
+func (h *APIHandler) addWebhook(w http.ResponseWriter, r *http.Request, path string, ufs *fs.UserFS) {
+	if h.hooks == nil {
+		sendJSONError(w, "Webhooks not enabled", http.StatusNotImplemented)
+		return
+	}
+	defer r.Body.Close()
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendJSONError(w, "Invalid webhook", http.StatusBadRequest)
+		return
+	}
+	hook, err := h.hooks.Add(webhook.Hook{
+		User:   ufs.Name(),
+		URL:    req.URL,
+		Secret: req.Secret,
+		Events: req.Events,
+		Path:   path,
+	})
+	if errors.Is(err, webhook.ErrInvalid) {
+		sendJSONError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		log.Printf("addWebhook error: %v", err)
+		sendJSONError(w, "Registering failed", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	if err := json.NewEncoder(w).Encode(hook); err != nil {
+		log.Printf("addWebhook encode error: %v", err)
+	}
+}
+
+// getWebhook answers GET ?webhook={id} with the hook and the history of
+// its deliveries.
+func (h *APIHandler) getWebhook(w http.ResponseWriter, id string, ufs *fs.UserFS) {
+	if h.hooks == nil {
+		sendJSONError(w, "Webhooks not enabled", http.StatusNotImplemented)
+		return
+	}
+	history, err := h.hooks.History(ufs.Name(), id)
+	if errors.Is(err, webhook.ErrNotFound) {
+		sendJSONError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("getWebhook error: %v", err)
+		sendJSONError(w, "Webhooks unavailable", http.StatusInternalServerError)
+		return
+	}
+	hooks, _ := h.hooks.Hooks(ufs.Name())
+	res := struct {
+		webhook.Hook
+		History []webhook.Record `json:"history"`
+	}{History: history}
+	for _, hook := range hooks {
+		if hook.ID == id {
+			res.Hook = hook
+			res.Secret = ""
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Printf("getWebhook encode error: %v", err)
+	}
+}
+
+// removeWebhook answers DELETE ?webhook={id}.
+func (h *APIHandler) removeWebhook(w http.ResponseWriter, id string, ufs *fs.UserFS) {
+	if h.hooks == nil {
+		sendJSONError(w, "Webhooks not enabled", http.StatusNotImplemented)
+		return
+	}
+	err := h.hooks.Remove(ufs.Name(), id)
+	if errors.Is(err, webhook.ErrNotFound) {
+		sendJSONError(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("removeWebhook error: %v", err)
+		sendJSONError(w, "Removing failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+// Package events distributes notifications about changes in user trees
+// to subsystems interested in them, such as indexes, caches and feeds.
+package events
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type is the kind of change an Event describes.
+type Type string
+
+const (
+	Create Type = "create" // a file was created
+	Write  Type = "write"  // a file's content changed
+	Remove Type = "remove" // a file or directory was removed
+	Rename Type = "rename" // a file or directory was moved to Path
+	Mkdir  Type = "mkdir"  // a directory was created
+	Share  Type = "share"  // a public link to Path was created
+
+	// QuotaWarning reports that the quota of Path ("" for the user quota)
+	// was filled beyond a soft limit: Size of Limit bytes are used.
+	QuotaWarning Type = "quota_warning"
+)
+
+// Event describes a single change in a user tree.
+type Event struct {
+	Type    Type      `json:"type"`
+	User    string    `json:"user"`
+	Path    string    `json:"path"`               // slash-separated, relative to the user root
+	OldPath string    `json:"old_path,omitempty"` // source of a Rename
+	IsDir   bool      `json:"is_dir,omitempty"`
+	Size    int64     `json:"size,omitempty"`
+	Limit   int64     `json:"limit,omitempty"`
+	Share   string    `json:"share,omitempty"` // id of the public link of a Share
+	Time    time.Time `json:"time"`
+	// External is set for changes made outside nssc, e.g. by an admin
+	// copying files into the storage directory.
+	External bool `json:"external,omitempty"`
+}
+
+// Beneath reports whether the change concerns dir or a path inside it,
+// at its Path or, for a Rename, its OldPath. Everything is beneath the
+// root "".
+func (e Event) Beneath(dir string) bool {
+	return beneath(e.Path, dir) || e.OldPath != "" && beneath(e.OldPath, dir)
+}
+
+func beneath(name, dir string) bool {
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// Bus fans events out to subscribers. Publishing never blocks on a
+// subscriber from Subscribe: one that does not keep up loses events and a
+// warning is logged.
+type Bus struct {
+	mu   sync.RWMutex
+	subs map[*subscription]struct{}
+}
+
+type subscription struct {
+	ch      chan Event
+	done    chan struct{} // closed on cancel; nil unless Publish waits for room
+	dropped atomic.Int64
+}
+
+// NewBus returns an empty Bus.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[*subscription]struct{})}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// buffering up to size events, and a function that cancels the
+// subscription and closes the channel.
+func (b *Bus) Subscribe(size int) (<-chan Event, func()) {
+	return b.subscribe(&subscription{ch: make(chan Event, size)})
+}
+
+// SubscribeBlocking is Subscribe for consumers that may not lose events,
+// such as durable queues: once the buffer is full, Publish waits for room
+// instead of dropping. As every publisher waits for it, the consumer must
+// receive promptly, keeping slow work off the receiving goroutine.
+func (b *Bus) SubscribeBlocking(size int) (<-chan Event, func()) {
+	return b.subscribe(&subscription{ch: make(chan Event, size), done: make(chan struct{})})
+}
+
+func (b *Bus) subscribe(sub *subscription) (<-chan Event, func()) {
+	b.mu.Lock()
+	b.subs[sub] = struct{}{}
+	b.mu.Unlock()
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			if sub.done != nil {
+				// Release a Publish waiting for room, which holds mu.
+				close(sub.done)
+			}
+			b.mu.Lock()
+			delete(b.subs, sub)
+			b.mu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// Publish delivers e to all subscribers. A nil Bus discards events.
+func (b *Bus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.subs {
+		if sub.done != nil {
+			select {
+			case sub.ch <- e:
+			case <-sub.done:
+			}
+			continue
+		}
+		select {
+		case sub.ch <- e:
+			sub.dropped.Store(0)
+		default:
+			if sub.dropped.Add(1) == 1 {
+				log.Printf("Event bus: slow subscriber, dropping %s %s/%s", e.Type, e.User, e.Path)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package events_test
+
+import (
+	"testing"
+
+	"nssc/internal/events"
+)
+
+func TestBus(t *testing.T) {
+	bus := events.NewBus()
+	a, cancelA := bus.Subscribe(1)
+	b, cancelB := bus.Subscribe(1)
+	defer cancelB()
+
+	bus.Publish(events.Event{Type: events.Create, User: "u", Path: "f"})
+	// A full subscriber must not block the publisher.
+	bus.Publish(events.Event{Type: events.Remove, User: "u", Path: "f"})
+
+	for _, ch := range []<-chan events.Event{a, b} {
+		e := <-ch
+		if e.Type != events.Create || e.Path != "f" || e.Time.IsZero() {
+			t.Errorf("event = %+v", e)
+		}
+	}
+	cancelA()
+	if _, ok := <-a; ok {
+		t.Error("channel not closed after cancel")
+	}
+	bus.Publish(events.Event{Type: events.Mkdir})
+	if e := <-b; e.Type != events.Mkdir {
+		t.Errorf("event = %+v, want mkdir", e)
+	}
+	var nilBus *events.Bus
+	nilBus.Publish(events.Event{}) // must not panic
+
+	// A blocking subscriber gets every event, and cancelling it releases
+	// the publishers waiting for room.
+	c, cancelC := bus.SubscribeBlocking(1)
+	go func() {
+		for range 3 {
+			bus.Publish(events.Event{Type: events.Write})
+		}
+	}()
+	for range 3 {
+		if e := <-c; e.Type != events.Write {
+			t.Errorf("blocking event = %+v, want write", e)
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		bus.Publish(events.Event{Type: events.Write})
+		bus.Publish(events.Event{Type: events.Write})
+		close(done)
+	}()
+	cancelC()
+	<-done
+}
@@ -7,10 +7,14 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"mime"
+	"mime/multipart"
 	"net/http"
 	"net/url"
+	"path"
 	"path/filepath"
-	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/dustin/go-humanize"
@@ -21,37 +25,38 @@ import (
 	"nssc/internal/users"
 )
 
-const (
-	defaultUploadMaxMemory = 100 << 20 // 100 MiB
-	sessionCookieName      = "nssc_session"
-)
+const sessionCookieName = "nssc_session"
 
 type FrontendHandler struct {
-	db              *users.UsersDB
-	rootDir         string
-	version         string
-	shareMgr        *share.ShareManager
-	template        *template.Template
-	fs              *fs.UserFSServer
-	uploadMaxMemory int64 // max multipart memory; 0 → defaultUploadMaxMemory
+	db          *users.UsersDB
+	rootDir     string
+	version     string
+	shareMgr    *share.ShareManager
+	template    *template.Template
+	fs          *fs.UserFSServer
+	uploadLimit int64 // max bytes of an upload request; 0 if unlimited
+
+	publicArchiveLimit int64 // max bytes of a shared directory download; 0 if unlimited
 }
 
 // NewHandler creates a FrontendHandler.
 // version is the build-time version string (set via -ldflags "-X main.Version=...").
-// Pass maxMemory > 0 to override the default 100 MiB multipart limit.
-func NewHandler(db *users.UsersDB, rootDir string, fs *fs.UserFSServer, version string, maxMemory int64) *FrontendHandler {
-	if maxMemory <= 0 {
-		maxMemory = defaultUploadMaxMemory
-	}
+// Pass uploadLimit > 0 to cap the bytes of an upload request, and
+// publicArchiveLimit > 0 to cap the bytes of a shared directory downloaded
+// through its public link.
+func NewHandler(db *users.UsersDB, rootDir string, fs *fs.UserFSServer, version string, uploadLimit, publicArchiveLimit int64) *FrontendHandler {
 	shareMgr := share.NewShareManager(filepath.Join(rootDir, "public"))
+	shareMgr.Events = fs.Events()
 	return &FrontendHandler{
-		db:              db,
-		rootDir:         rootDir,
-		version:         version,
-		shareMgr:        shareMgr,
-		template:        tplPage,
-		fs:              fs,
-		uploadMaxMemory: maxMemory,
+		db:          db,
+		rootDir:     rootDir,
+		version:     version,
+		shareMgr:    shareMgr,
+		template:    tplPage,
+		fs:          fs,
+		uploadLimit: uploadLimit,
+
+		publicArchiveLimit: publicArchiveLimit,
 	}
 }
 
@@ -89,6 +94,10 @@ func (h *FrontendHandler) GetUserFromCookie(r *http.Request) *users.User {
 }
 
 func (h *FrontendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if id, ok := strings.CutPrefix(r.URL.Path, "/public/"); ok {
+		h.servePublic(w, r, id)
+		return
+	}
 	user := h.GetUserFromCookie(r)
 	if user != nil {
 		ufs, err := h.fs.GetUserFS(user.Name)
@@ -136,6 +145,60 @@ func (h *FrontendHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	h.handleAuthorizedRequest(w, r, username, ufs)
 }
 
+// servePublic answers /public/{id}, without authentication, with the
+// shared file, or an archive of the shared directory if it holds no more
+// than publicArchiveLimit bytes. The content is sandboxed, so shared pages
+// cannot run scripts on the origin of nssc.
+func (h *FrontendHandler) servePublic(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, name, err := h.shareMgr.Resolve(id)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	ufs, err := h.fs.GetUserFS(user)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	fi, err := ufs.Stat(r.Context(), name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Security-Policy", "sandbox")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if fi.IsDir() {
+		size, err := ufs.DirUsage(name)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		if h.publicArchiveLimit > 0 && size > h.publicArchiveLimit {
+			http.Error(w, "Shared directory too large to download", http.StatusForbidden)
+			return
+		}
+		h.serveArchive(w, r, fi.Name(), []string{name}, ufs)
+		return
+	}
+	f, err := ufs.Open(r.Context(), name)
+	if err != nil {
+		log.Printf("Share %s open error: %v", id, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	rs, ok := f.(io.ReadSeeker)
+	if !ok {
+		http.Error(w, "File serving not supported", http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), rs)
+}
+
 func (h *FrontendHandler) handleAuthorizedRequest(w http.ResponseWriter, r *http.Request, username string, ufs *fs.UserFS) {
 	if r.Method == http.MethodPost {
 		switch r.URL.Path {
@@ -148,17 +211,28 @@ func (h *FrontendHandler) handleAuthorizedRequest(w http.ResponseWriter, r *http
 		case "/rm":
 			h.handleDelete(w, r, username, ufs)
 			return
-		case "/search":
-			h.handleSearch(w, r, username, ufs)
-			return
 		case "/share":
 			h.handleShare(w, r, username, ufs)
 			return
 		case "/upload":
 			h.handleUpload(w, r, username, ufs)
 			return
+		case "/favorite":
+			h.handleFavorite(w, r, username, ufs)
+			return
+		case "/archive":
+			h.handleArchive(w, r, username, ufs)
+			return
 		}
 	}
+	if r.URL.Path == "/search" {
+		h.handleSearch(w, r, username, ufs)
+		return
+	}
+	if r.URL.Path == "/favorites" {
+		h.handleFavorites(w, r, username, ufs)
+		return
+	}
 	if r.URL.Path == "/" {
 		http.Redirect(w, r, "/user/", http.StatusSeeOther)
 		return
@@ -188,6 +262,22 @@ func (h *FrontendHandler) userHandler(w http.ResponseWriter, r *http.Request, us
 		http.Error(w, "Forbidden path", http.StatusForbidden)
 		return
 	}
+	if r.URL.Query().Has("archive") {
+		name := fi.Name()
+		if curPath == "/" || curPath == "." {
+			name = user
+		}
+		h.serveArchive(w, r, name, []string{decodedPath}, ufs)
+		return
+	}
+	if !fi.IsDir() && r.URL.Query().Has("thumb") {
+		h.serveThumbnail(w, r, decodedPath, ufs)
+		return
+	}
+	if !fi.IsDir() && r.URL.Query().Has("preview") {
+		h.servePreview(w, r, user, decodedPath, fi, ufs)
+		return
+	}
 	if !fi.IsDir() {
 		f, err := ufs.Open(ctx, decodedPath)
 		if err != nil {
@@ -195,49 +285,97 @@ func (h *FrontendHandler) userHandler(w http.ResponseWriter, r *http.Request, us
 			http.Error(w, "Forbidden path", http.StatusForbidden)
 			return
 		}
+		defer f.Close()
 		rs, ok := f.(io.ReadSeeker)
 		if !ok {
 			http.Error(w, "File serving not supported", http.StatusInternalServerError)
 			return
 		}
+		sum, _ := ufs.Checksum(ctx, decodedPath)
+		fs.SetChecksumHeaders(w.Header(), fi, sum)
+		// The preview embeds files from here, on the site's origin: those
+		// the browser could run script in are downloaded instead, and
+		// documents are sandboxed. PDF viewers do not run in a sandbox.
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		if r.URL.Query().Has("download") || !inlineSafe(fi.Name()) {
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": fi.Name()}))
+		}
+		if previewKind(fi.Name()) != "pdf" {
+			w.Header().Set("Content-Security-Policy", "sandbox")
+		}
 		http.ServeContent(w, r, fi.Name(), fi.ModTime(), rs)
 		return
 	}
-	files, err := ufs.ReadDir(decodedPath)
+	// ?tag= narrows the listing to the entries carrying the tag, and
+	// ?view=gallery shows it as a grid of thumbnails. ?sort=, ?order=
+	// and ?page= order and page it.
+	query := r.URL.Query()
+	tag := query.Get("tag")
+	gallery := query.Get("view") == "gallery"
+	page := 1
+	if s := query.Get("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	sortKey := query.Get("sort")
+	list, err := ufs.List(ctx, decodedPath, fs.ListOptions{
+		Sort:   sortKey,
+		Desc:   query.Get("order") == "desc",
+		Tag:    tag,
+		Offset: (page - 1) * listPageSize,
+		Limit:  listPageSize,
+	})
+	if errors.Is(err, fs.ErrBadSort) {
+		http.Error(w, "Invalid sort", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Error reading directory", http.StatusInternalServerError)
 		return
 	}
-	var (
-		fileEntries []fs.FileEntry
-		filesCount  int
-		dirsCount   int
-	)
-	for _, f := range files {
-		info, err := f.Info()
-		if err != nil {
-			log.Printf("File info error: %v", err)
-			continue
-		}
+	fileEntries := make([]fs.FileEntry, 0, len(list.Entries))
+	for _, info := range list.Entries {
 		size := ""
 		if !info.IsDir() {
 			size = humanize.IBytes(uint64(info.Size()))
 		}
-		modTime := info.ModTime().Format("2006-01-02T15:04:05+0000")
-		rel := filepath.Join(curPath, f.Name())
-		if info.IsDir() {
-			dirsCount++
-		} else {
-			filesCount++
-		}
 		fileEntries = append(fileEntries, fs.FileEntry{
-			Name:    f.Name(),
-			RelPath: rel,
-			IsDir:   info.IsDir(),
-			Size:    size,
-			ModTime: modTime,
+			Name:     info.Name(),
+			RelPath:  "/" + info.Path,
+			IsDir:    info.IsDir(),
+			Size:     size,
+			ModTime:  info.ModTime().Format("2006-01-02T15:04:05+0000"),
+			Tags:     info.Attrs.Tags,
+			Favorite: info.Attrs.Favorite,
+			Thumb:    !info.IsDir() && fs.HasThumbnail(info.Name()),
 		})
 	}
+	if sortKey == "" {
+		sortKey = "name"
+	}
+	var columns []SortColumn
+	for _, c := range []SortColumn{{Label: "Name", Key: "name"}, {Label: "Size", Key: "size"}, {Label: "Modified", Key: "mtime"}, {Label: "Type", Key: "type"}} {
+		order := "asc"
+		if c.Key == sortKey {
+			c.Current = query.Get("order")
+			if c.Current != "desc" {
+				c.Current, order = "asc", "desc"
+			}
+		}
+		c.Href = listingURL(curPath, query, "sort", c.Key, "order", order, "page", "")
+		columns = append(columns, c)
+	}
+	var prevURL, nextURL string
+	if page > 1 {
+		prevURL = listingURL(curPath, query, "page", strconv.Itoa(page-1))
+	}
+	if page*listPageSize < list.Total {
+		nextURL = listingURL(curPath, query, "page", strconv.Itoa(page+1))
+	}
 	parentPath := ""
 	if curPath != "" {
 		parentPath = filepath.Dir(curPath)
@@ -258,9 +396,19 @@ func (h *FrontendHandler) userHandler(w http.ResponseWriter, r *http.Request, us
 		QuotaTotalStr: quotaTotalStr,
 		QuotaUsed:     uint64(quotaUsed),
 		QuotaUsedStr:  quotaUsedStr,
+		QuotaWarnings: ufs.QuotaWarnings(),
 		SearchQuery:   searchQuery,
-		FilesCount:    filesCount,
-		DirsCount:     dirsCount,
+		Tag:           tag,
+		Gallery:       gallery,
+		Columns:       columns,
+		Sort:          query.Get("sort"),
+		Order:         query.Get("order"),
+		ListPage:      page,
+		ListPages:     (list.Total + listPageSize - 1) / listPageSize,
+		PrevURL:       prevURL,
+		NextURL:       nextURL,
+		FilesCount:    list.Total - list.Dirs,
+		DirsCount:     list.Dirs,
 		Version:       h.version,
 	}
 	if err := h.template.Execute(w, data); err != nil {
@@ -268,42 +416,220 @@ func (h *FrontendHandler) userHandler(w http.ResponseWriter, r *http.Request, us
 	}
 }
 
-func (h *FrontendHandler) handleUpload(w http.ResponseWriter, r *http.Request, user string, ufs *fs.UserFS) {
-	if err := r.ParseMultipartForm(h.uploadMaxMemory); err != nil {
-		log.Printf("Form parse error: %v", err)
-		http.Error(w, "Form parse error: "+err.Error(), http.StatusBadRequest)
+// listPageSize is the number of entries shown per page of a listing.
+const listPageSize = 200
+
+// listingURL returns the link to the listing of dir with query, changed
+// by the key and value pairs of set; empty values are left out.
+func listingURL(dir string, query url.Values, set ...string) string {
+	q := url.Values{}
+	for k := range query {
+		if v := query.Get(k); v != "" {
+			q.Set(k, v)
+		}
+	}
+	for i := 0; i+1 < len(set); i += 2 {
+		if set[i+1] == "" {
+			q.Del(set[i])
+		} else {
+			q.Set(set[i], set[i+1])
+		}
+	}
+	u := url.URL{Path: "/user" + strings.TrimSuffix(dir, "/") + "/", RawQuery: q.Encode()}
+	return u.String()
+}
+
+// serveThumbnail answers ?thumb=N for the gallery view.
+func (h *FrontendHandler) serveThumbnail(w http.ResponseWriter, r *http.Request, path string, ufs *fs.UserFS) {
+	size, err := strconv.Atoi(r.URL.Query().Get("thumb"))
+	if _, ok := fs.ThumbnailSize(size); err != nil || !ok {
+		http.Error(w, "Invalid thumbnail size", http.StatusBadRequest)
+		return
+	}
+	thumb, err := ufs.Thumbnail(r.Context(), path, size)
+	if errors.Is(err, fs.ErrNoThumbnail) {
+		http.Error(w, "No thumbnail for this file type", http.StatusUnsupportedMediaType)
 		return
 	}
-	curPath := r.FormValue("path")
-	file, header, err := r.FormFile("file")
 	if err != nil {
-		log.Printf("Form file error: %v", err)
-		http.Error(w, "File error: "+err.Error(), http.StatusBadRequest)
+		log.Printf("Path %s thumbnail error: %v", path, err)
+		http.Error(w, "Cannot make thumbnail", http.StatusInternalServerError)
 		return
 	}
-	defer file.Close()
+	w.Header().Set("Content-Type", thumb.ContentType)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	http.ServeContent(w, r, "", thumb.ModTime, bytes.NewReader(thumb.Data))
+}
 
-	sz := header.Size
-	var src io.Reader = file
-	if sz < 0 {
-		// Unknown size (streaming upload): buffer to get the real size.
-		buf := &bytes.Buffer{}
-		if _, err := io.Copy(buf, file); err != nil {
-			http.Error(w, "Read error: "+err.Error(), http.StatusInternalServerError)
+// handleUpload stores the files of an upload form, reading the multipart
+// stream part by part into storage, so nothing is buffered and quotas are
+// charged as the files grow. Fields apply to the files after them, so the
+// form puts path and extract before its file inputs. Files from a folder
+// input keep their relative paths. Going over the upload limit or a quota
+// aborts the request, keeping the files stored before. A single file leads
+// back to the listing; more, or failures, get a results page.
+func (h *FrontendHandler) handleUpload(w http.ResponseWriter, r *http.Request, user string, ufs *fs.UserFS) {
+	if h.uploadLimit > 0 {
+		if r.ContentLength > h.uploadLimit {
+			http.Error(w, "Upload larger than "+humanize.IBytes(uint64(h.uploadLimit)), http.StatusRequestEntityTooLarge)
 			return
 		}
-		sz = int64(buf.Len())
-		src = buf
+		r.Body = http.MaxBytesReader(w, r.Body, h.uploadLimit)
 	}
-
-	dstPath := filepath.Join(curPath, header.Filename)
-	if err := ufs.WriteFile(dstPath, src, sz); err != nil {
-		log.Printf("File saving error: %v", err)
-		http.Error(w, "Save error: "+err.Error(), http.StatusInternalServerError)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Form parse error: "+err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Printf("Form file %s saved to %s", header.Filename, dstPath)
-	http.Redirect(w, r, "/user/"+curPath, http.StatusSeeOther)
+	var (
+		curPath string
+		extract bool
+		items   []ResultItem
+		code    int // set once the request is aborted
+	)
+	for code == 0 {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Form parse error: %v", err)
+			if code = abortCode(err); code == 0 {
+				code = http.StatusBadRequest
+			}
+			items = append(items, ResultItem{Path: "(request)", Error: err.Error()})
+			break
+		}
+		switch part.FormName() {
+		case "path":
+			b, _ := io.ReadAll(io.LimitReader(part, 4096))
+			curPath = string(b)
+		case "extract":
+			extract = true
+		case "file":
+			name := uploadName(part)
+			if name == "" {
+				// An input left empty.
+				break
+			}
+			dstPath := path.Join("/", curPath, name)
+			if extract && isArchiveName(name) {
+				extracted, err := h.extractUpload(r.Context(), ufs, path.Dir(dstPath), part)
+				items = append(items, extracted...)
+				if err != nil {
+					code = abortCode(err)
+				}
+				break
+			}
+			item := ResultItem{Path: strings.TrimPrefix(dstPath, "/")}
+			if err := saveUpload(r.Context(), ufs, dstPath, part); err != nil {
+				log.Printf("File %s saving error: %v", dstPath, err)
+				item.Error = err.Error()
+				code = abortCode(err)
+			} else {
+				log.Printf("Form file %s saved to %s", name, dstPath)
+			}
+			items = append(items, item)
+		}
+		part.Close()
+	}
+	if code == 0 && len(items) == 1 && items[0].Error == "" && !extract {
+		http.Redirect(w, r, "/user/"+curPath, http.StatusSeeOther)
+		return
+	}
+	if code == 0 {
+		code = http.StatusOK
+	}
+	h.renderResults(w, code, ResultsData{Title: "Upload", Dir: curPath, Items: items, Version: h.version})
+}
+
+// abortCode returns the status an upload error aborts the request with,
+// 0 for errors of one file the others can go on after.
+func abortCode(err error) int {
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge
+	case fs.IsInsufficientStorage(err):
+		return http.StatusInsufficientStorage
+	}
+	return 0
+}
+
+// uploadName returns the name a file part was sent with, keeping the
+// relative path folder inputs send, which Part.FileName drops.
+func uploadName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return ""
+	}
+	name := strings.ReplaceAll(params["filename"], `\`, "/")
+	// Rooting the name keeps it beneath the target directory.
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "." {
+		return ""
+	}
+	return name
+}
+
+// isArchiveName reports whether name looks like an archive Extract unpacks.
+func isArchiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, ext := range []string{".zip", ".tar", ".tar.gz", ".tgz"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveUpload streams r into the file name, which is charged to the quota
+// as it grows. A failed upload leaves no partial file behind.
+func saveUpload(ctx context.Context, ufs *fs.UserFS, name string, r io.Reader) error {
+	f, err := ufs.Create(ctx, name, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		ufs.Remove(ctx, name)
+	}
+	return err
+}
+
+// extractUpload unpacks an uploaded archive into dir, returning the outcome
+// of each entry, or of the archive as a whole, and the error that stopped
+// it from being unpacked.
+func (h *FrontendHandler) extractUpload(ctx context.Context, ufs *fs.UserFS, dir string, r io.Reader) ([]ResultItem, error) {
+	results, err := ufs.Extract(ctx, dir, r)
+	if err != nil {
+		log.Printf("Extract into %s error: %v", dir, err)
+		return []ResultItem{{Path: strings.TrimPrefix(dir, "/"), Error: err.Error()}}, err
+	}
+	items := make([]ResultItem, 0, len(results))
+	for _, res := range results {
+		items = append(items, ResultItem{Path: res.Path, Error: res.Error})
+	}
+	return items, nil
+}
+
+// renderResults shows the outcome of an operation on many entries, with
+// the status code.
+func (h *FrontendHandler) renderResults(w http.ResponseWriter, code int, data ResultsData) {
+	data.Dir = strings.TrimPrefix(data.Dir, "/")
+	for _, item := range data.Items {
+		if item.Error != "" {
+			data.Failed++
+		}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	if err := tplResults.Execute(w, data); err != nil {
+		log.Printf("Template execute error: %v", err)
+	}
 }
 
 func (h *FrontendHandler) handleMkdir(w http.ResponseWriter, r *http.Request, user string, ufs *fs.UserFS) {
@@ -335,10 +661,10 @@ func (h *FrontendHandler) handleDelete(w http.ResponseWriter, r *http.Request, u
 		http.Error(w, "Form parse error", http.StatusBadRequest)
 		return
 	}
+	// The checkboxes carry paths from the user root.
 	paths := r.Form["path"]
 	curPath := r.FormValue("dir")
-	for _, p := range paths {
-		path := filepath.Join(curPath, p)
+	for _, path := range paths {
 		if err := ufs.RemoveAll(ctx, path); err != nil {
 			http.Error(w, "Delete error: "+err.Error(), http.StatusInternalServerError)
 			return
@@ -348,6 +674,53 @@ func (h *FrontendHandler) handleDelete(w http.ResponseWriter, r *http.Request, u
 	http.Redirect(w, r, "/user/"+curPath, http.StatusSeeOther)
 }
 
+// handleArchive streams the entries selected in a listing as an archive.
+func (h *FrontendHandler) handleArchive(w http.ResponseWriter, r *http.Request, user string, ufs *fs.UserFS) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Form parse error", http.StatusBadRequest)
+		return
+	}
+	paths := r.Form["path"]
+	if len(paths) == 0 {
+		http.Redirect(w, r, "/user/"+r.FormValue("dir"), http.StatusSeeOther)
+		return
+	}
+	name := filepath.Base(filepath.Clean("/" + r.FormValue("dir")))
+	if len(paths) == 1 {
+		name = filepath.Base(filepath.Clean("/" + paths[0]))
+	}
+	if name == "/" {
+		name = user
+	}
+	h.serveArchive(w, r, name, paths, ufs)
+}
+
+// serveArchive streams paths as an archive named name, in the format of
+// ?archive= or the format field, zip by default.
+func (h *FrontendHandler) serveArchive(w http.ResponseWriter, r *http.Request, name string, paths []string, ufs *fs.UserFS) {
+	format := r.FormValue("archive")
+	if format == "" {
+		format = "zip"
+	}
+	contentType, ok := fs.ArchiveTypes[format]
+	if !ok {
+		http.Error(w, "Archive format must be zip or tar.gz", http.StatusBadRequest)
+		return
+	}
+	// Check the paths before the headers go out.
+	for _, p := range paths {
+		if _, err := ufs.Stat(r.Context(), p); err != nil {
+			http.Error(w, "File not found", http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + "." + format}))
+	if err := ufs.WriteArchive(r.Context(), w, format, paths); err != nil {
+		log.Printf("Archive error: %v", err)
+	}
+}
+
 func (h *FrontendHandler) handleLogout(w http.ResponseWriter, r *http.Request, user string) {
 	http.SetCookie(w, &http.Cookie{
 		Name:     sessionCookieName,
@@ -363,31 +736,65 @@ func (h *FrontendHandler) handleLogout(w http.ResponseWriter, r *http.Request, u
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// searchPageSize is the number of search results shown per page.
+const searchPageSize = 50
+
+// handleSearch shows a page of the results of a search of the whole tree,
+// from the search form or a ?query=&page= link.
 func (h *FrontendHandler) handleSearch(w http.ResponseWriter, r *http.Request, user string, ufs *fs.UserFS) {
 	if err := r.ParseForm(); err != nil {
 		http.Error(w, "Form parse error", http.StatusBadRequest)
 		return
 	}
-	query := r.FormValue("q")
+	query := r.FormValue("query")
 	if len(query) > 200 {
 		http.Error(w, "Search query too long", http.StatusBadRequest)
 		return
 	}
-	re, err := regexp.Compile(query)
+	page := 1
+	if s := r.FormValue("page"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid page", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	res, err := ufs.Search(r.Context(), "", query, (page-1)*searchPageSize, searchPageSize)
+	if errors.Is(err, fs.ErrBadQuery) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Invalid search pattern: "+err.Error(), http.StatusBadRequest)
+		log.Printf("Search error: %v", err)
+		http.Error(w, "Search error", http.StatusInternalServerError)
 		return
 	}
-	results, _ := ufs.Search(re)
+	hits := make([]SearchHit, 0, len(res.Results))
+	for _, r := range res.Results {
+		hits = append(hits, newSearchHit(r))
+	}
+	var prevPage, nextPage int
+	if page > 1 {
+		prevPage = page - 1
+	}
+	if page*searchPageSize < res.Total {
+		nextPage = page + 1
+	}
 	quotaTotal, quotaUsed, _ := ufs.GetQuota()
 	data := PageData{
 		User:          user,
-		Files:         results,
+		Results:       hits,
+		ResultsTotal:  res.Total,
+		SearchPartial: res.Partial,
+		PrevPage:      prevPage,
+		NextPage:      nextPage,
 		SearchQuery:   query,
 		QuotaTotal:    uint64(quotaTotal),
 		QuotaTotalStr: humanize.IBytes(uint64(quotaTotal)),
 		QuotaUsed:     uint64(quotaUsed),
 		QuotaUsedStr:  humanize.IBytes(uint64(quotaUsed)),
+		QuotaWarnings: ufs.QuotaWarnings(),
 		Version:       h.version,
 	}
 	if err := h.template.Execute(w, data); err != nil {
@@ -401,22 +808,104 @@ func (h *FrontendHandler) handleShare(w http.ResponseWriter, r *http.Request, us
 		return
 	}
 	relPath := r.FormValue("path")
-	// Validate that the path exists inside the user FS (resolvePath guards traversal).
+	// Validate that the path exists inside the user FS (Stat rejects traversal).
 	if _, err := ufs.Stat(context.Background(), relPath); err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
-	userRoot := filepath.Join(h.rootDir, "user", user)
-	link, err := h.shareMgr.CreateShare(userRoot, relPath)
+	link, err := h.shareMgr.CreateShare(ufs.Name(), relPath)
 	if err != nil {
 		log.Printf("Share error: %v", err)
 		http.Error(w, "Sharing failed", http.StatusInternalServerError)
 		return
 	}
+	if r.FormValue("back") == "preview" {
+		target := url.URL{Path: "/user" + filepath.Clean("/"+relPath), RawQuery: "preview=1"}
+		http.Redirect(w, r, target.String(), http.StatusSeeOther)
+		return
+	}
 	curPath := filepath.Dir(relPath)
 	http.Redirect(w, r, "/user/"+curPath+"?shared="+link, http.StatusSeeOther)
 }
 
+// handleFavorites lists the favorites of the whole tree.
+func (h *FrontendHandler) handleFavorites(w http.ResponseWriter, r *http.Request, user string, ufs *fs.UserFS) {
+	ctx := context.Background()
+	favorites, _ := ufs.FindAttrs("", func(a fs.Attrs) bool { return a.Favorite })
+	var (
+		fileEntries []fs.FileEntry
+		filesCount  int
+		dirsCount   int
+	)
+	for name, attrs := range favorites {
+		info, err := ufs.Stat(ctx, name)
+		if err != nil {
+			continue
+		}
+		size := ""
+		if info.IsDir() {
+			dirsCount++
+		} else {
+			size = humanize.IBytes(uint64(info.Size()))
+			filesCount++
+		}
+		fileEntries = append(fileEntries, fs.FileEntry{
+			Name:     name,
+			RelPath:  "/" + name,
+			IsDir:    info.IsDir(),
+			Size:     size,
+			ModTime:  info.ModTime().Format("2006-01-02T15:04:05+0000"),
+			Tags:     attrs.Tags,
+			Favorite: true,
+		})
+	}
+	sort.Slice(fileEntries, func(i, j int) bool { return fileEntries[i].Name < fileEntries[j].Name })
+	quotaTotal, quotaUsed, _ := ufs.GetQuota()
+	data := PageData{
+		User:          user,
+		Files:         fileEntries,
+		Favorites:     true,
+		QuotaTotal:    uint64(quotaTotal),
+		QuotaTotalStr: humanize.IBytes(uint64(quotaTotal)),
+		QuotaUsed:     uint64(quotaUsed),
+		QuotaUsedStr:  humanize.IBytes(uint64(quotaUsed)),
+		QuotaWarnings: ufs.QuotaWarnings(),
+		FilesCount:    filesCount,
+		DirsCount:     dirsCount,
+		Version:       h.version,
+	}
+	if err := h.template.Execute(w, data); err != nil {
+		log.Printf("Template execute error: %v", err)
+	}
+}
+
+// handleFavorite marks or unmarks a file or directory as a favorite and
+// returns to the page the form was posted from.
+func (h *FrontendHandler) handleFavorite(w http.ResponseWriter, r *http.Request, user string, ufs *fs.UserFS) {
+	ctx := context.Background()
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Form parse error", http.StatusBadRequest)
+		return
+	}
+	relPath := r.FormValue("path")
+	attrs, err := ufs.Attrs(ctx, relPath)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	attrs.Favorite = r.FormValue("favorite") != ""
+	if err := ufs.SetAttrs(ctx, relPath, attrs); err != nil {
+		log.Printf("Favorite error: %v", err)
+		http.Error(w, "Favorite error: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.FormValue("back") == "favorites" {
+		http.Redirect(w, r, "/favorites", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/user"+filepath.Dir(relPath), http.StatusSeeOther)
+}
+
 // suppress unused import errors when errors/template are only used in other files
 var _ = errors.New
 var _ = template.HTMLEscapeString
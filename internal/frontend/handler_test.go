@@ -0,0 +1,66 @@
+package frontend_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRawFileHeaders(t *testing.T) {
+	base := t.TempDir()
+	h, _ := newPublicTest(t, base, 0)
+	dir := filepath.Join(base, "root", "alice")
+	for name, attachment := range map[string]bool{
+		"a.png":   false,
+		"a.mp4":   false,
+		"a.pdf":   false,
+		"a.txt":   false,
+		"a.svg":   true,
+		"a.html":  true,
+		"a.xml":   true,
+		"README":  true,
+		"a.PNG":   false,
+		"x.html5": true,
+	} {
+		os.WriteFile(filepath.Join(dir, name), []byte("<html><script>alert(1)</script></html>"), 0644)
+		r := httptest.NewRequest("GET", "/user/"+name, nil)
+		r.SetBasicAuth("alice", "pass")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", name, w.Code)
+		}
+		disposition := w.Header().Get("Content-Disposition")
+		if got := strings.HasPrefix(disposition, "attachment"); got != attachment {
+			t.Errorf("%s: Content-Disposition = %q", name, disposition)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: served without nosniff", name)
+		}
+		csp := w.Header().Get("Content-Security-Policy")
+		if want := name != "a.pdf"; (csp == "sandbox") != want {
+			t.Errorf("%s: Content-Security-Policy = %q", name, csp)
+		}
+	}
+}
+
+func TestRawFileChecksum(t *testing.T) {
+	h, _ := newPublicTest(t, t.TempDir(), 0)
+	r := httptest.NewRequest("GET", "/user/docs/a.txt", nil)
+	r.SetBasicAuth("alice", "pass")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	sum := sha256.Sum256([]byte("alpha"))
+	if etag := w.Header().Get("ETag"); etag != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Errorf("ETag = %q", etag)
+	}
+	if digest := w.Header().Get("Digest"); digest != "sha-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("Digest = %q", digest)
+	}
+}
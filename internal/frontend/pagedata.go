@@ -1,6 +1,11 @@
 package frontend
 
 import (
+	"html/template"
+	"net/url"
+
+	"github.com/dustin/go-humanize"
+
 	"nssc/internal/fs"
 )
 
@@ -14,9 +19,115 @@ type PageData struct {
 	QuotaTotalStr string
 	QuotaUsed     uint64
 	QuotaUsedStr  string
+	// QuotaWarnings lists quotas filled beyond a soft limit, shown as a banner.
+	QuotaWarnings []fs.QuotaWarning
 	SearchQuery   string
-	FilesCount    int
-	DirsCount     int
+	// Results are a page of the hits of a search, shown instead of Files.
+	Results      []SearchHit
+	ResultsTotal int
+	// SearchPartial is set when the search index was still being updated.
+	SearchPartial bool
+	// PrevPage and NextPage are the neighbouring result pages, 0 if none.
+	PrevPage int
+	NextPage int
+	// Tag is the tag the listing is filtered by, if any.
+	Tag string
+	// Favorites is set on the page listing the favorites of the tree.
+	Favorites bool
+	// Gallery shows the listing as a grid of thumbnails.
+	Gallery bool
+	// Columns are the headers the listing can be sorted by. Sort and Order
+	// are the ?sort= and ?order= of the listing, "" for the defaults.
+	Columns []SortColumn
+	Sort    string
+	Order   string
+	// ListPage is the page of the listing shown, from 1, out of ListPages;
+	// PrevURL and NextURL link the neighbouring pages, empty if none.
+	ListPage   int
+	ListPages  int
+	PrevURL    string
+	NextURL    string
+	FilesCount int
+	DirsCount  int
 	// Version is the build-time version string injected via -ldflags "-X main.version=..."
 	Version string
 }
+
+// PreviewQuery returns the query of the preview links of the listing.
+func (d PageData) PreviewQuery() template.URL {
+	return previewQuery(d.Sort, d.Order, d.Tag)
+}
+
+// previewQuery returns the query of a preview whose previous and next
+// links step through the files in the order of the listing sorted by
+// sort and order and filtered by tag.
+func previewQuery(sort, order, tag string) template.URL {
+	q := url.Values{"preview": {"1"}}
+	for k, v := range map[string]string{"sort": sort, "order": order, "tag": tag} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	return template.URL(q.Encode())
+}
+
+// SortColumn is a header of the listing, linking to the listing sorted
+// by Key. Current is "asc" or "desc" if the listing is sorted by it.
+type SortColumn struct {
+	Label   string
+	Key     string
+	Href    string
+	Current string
+}
+
+// ResultsData holds the data passed to the results template, which lists
+// the outcome of an operation on many entries.
+type ResultsData struct {
+	Title   string
+	Dir     string // where the listing goes back to
+	Items   []ResultItem
+	Failed  int
+	Version string
+}
+
+// ResultItem is the outcome for one entry, failed if Error is set.
+type ResultItem struct {
+	Path  string
+	Error string
+}
+
+// SearchHit is a search result prepared for the template.
+type SearchHit struct {
+	fs.SearchResult
+	SizeStr string
+	// Parts is the snippet split at the highlighted words.
+	Parts []SnippetPart
+}
+
+// SnippetPart is a piece of a snippet, highlighted if it matches the query.
+type SnippetPart struct {
+	Text  string
+	Match bool
+}
+
+func newSearchHit(res fs.SearchResult) SearchHit {
+	hit := SearchHit{SearchResult: res}
+	if !res.IsDir {
+		hit.SizeStr = humanize.IBytes(uint64(res.Size))
+	}
+	pos := 0
+	for _, h := range res.Highlights {
+		if h[0] < pos || h[1] > len(res.Snippet) {
+			continue
+		}
+		if h[0] > pos {
+			hit.Parts = append(hit.Parts, SnippetPart{Text: res.Snippet[pos:h[0]]})
+		}
+		hit.Parts = append(hit.Parts, SnippetPart{Text: res.Snippet[h[0]:h[1]], Match: true})
+		pos = h[1]
+	}
+	if pos < len(res.Snippet) {
+		hit.Parts = append(hit.Parts, SnippetPart{Text: res.Snippet[pos:]})
+	}
+	return hit
+}
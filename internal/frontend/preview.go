@@ -0,0 +1,221 @@
+package frontend
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/dustin/go-humanize"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+
+	"nssc/internal/fs"
+)
+
+// maxPreviewText bounds the text shown by a preview; longer files are cut.
+const maxPreviewText = 1 << 20
+
+var (
+	codeFormatter = chromahtml.New(chromahtml.WithClasses(true), chromahtml.WithLineNumbers(true))
+	codeStyle     = styles.Get("github")
+	// markdown renders CommonMark with GitHub extensions. Raw HTML in the
+	// source is dropped.
+	markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+)
+
+// codeCSS is the stylesheet of highlighted code, inlined in previews.
+// previewCSP, the policy of preview pages, allows it by its hash, so no
+// inline style or script is needed.
+var codeCSS, previewCSP = func() (string, string) {
+	var buf bytes.Buffer
+	if err := codeFormatter.WriteCSS(&buf, codeStyle); err != nil {
+		panic(err)
+	}
+	sum := sha256.Sum256(buf.Bytes())
+	csp := "default-src 'none'; img-src 'self'; media-src 'self'; frame-src 'self'; " +
+		"style-src 'self' 'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'; " +
+		"form-action 'self'; base-uri 'none'; frame-ancestors 'none'"
+	return buf.String(), csp
+}()
+
+// PreviewData holds the data passed to the preview template.
+type PreviewData struct {
+	User    string
+	Name    string
+	RelPath string
+	Dir     string
+	Size    string
+	ModTime string
+	// Kind selects how the file is shown: image, audio, video, pdf,
+	// markdown, text, or none if it cannot be previewed.
+	Kind    string
+	Content template.HTML // rendered markdown or highlighted text
+	CodeCSS template.CSS
+	// Truncated is set when only the first maxPreviewText bytes are shown.
+	Truncated bool
+	// Prev and Next are the neighbouring files of the folder, "" if none,
+	// in the order of the listing the preview was opened from, which Query
+	// keeps.
+	Prev  string
+	Next  string
+	Query template.URL
+	// Shared is the URL of the latest public link to the file, if any.
+	Shared  string
+	Version string
+}
+
+// servePreview shows the file at path in a page of its own.
+func (h *FrontendHandler) servePreview(w http.ResponseWriter, r *http.Request, user, path string, info os.FileInfo, ufs *fs.UserFS) {
+	ctx := r.Context()
+	relPath := filepath.Clean(path)
+	data := PreviewData{
+		User:    user,
+		Name:    info.Name(),
+		RelPath: relPath,
+		Dir:     filepath.Dir(relPath),
+		Size:    humanize.IBytes(uint64(info.Size())),
+		ModTime: info.ModTime().Format("2006-01-02T15:04:05+0000"),
+		Kind:    previewKind(info.Name()),
+		CodeCSS: template.CSS(codeCSS),
+		Version: h.version,
+	}
+	query := r.URL.Query()
+	data.Query = previewQuery(query.Get("sort"), query.Get("order"), query.Get("tag"))
+	prev, next, err := ufs.Neighbours(ctx, path, fs.ListOptions{
+		Sort: query.Get("sort"),
+		Desc: query.Get("order") == "desc",
+		Tag:  query.Get("tag"),
+	})
+	if err == nil {
+		if prev != "" {
+			data.Prev = "/" + prev
+		}
+		if next != "" {
+			data.Next = "/" + next
+		}
+	}
+	if ids, err := h.shareMgr.FindShares(ufs.Name(), path); err == nil && len(ids) > 0 {
+		data.Shared = "/public/" + ids[len(ids)-1]
+	}
+
+	if data.Kind == "markdown" || data.Kind == "text" {
+		f, err := ufs.Open(ctx, path)
+		if err != nil {
+			log.Printf("Path %s open error: %v", path, err)
+			http.Error(w, "Forbidden path", http.StatusForbidden)
+			return
+		}
+		raw, err := io.ReadAll(io.LimitReader(f, maxPreviewText+1))
+		f.Close()
+		if err != nil {
+			http.Error(w, "Error reading file", http.StatusInternalServerError)
+			return
+		}
+		if len(raw) > maxPreviewText {
+			raw, data.Truncated = raw[:maxPreviewText], true
+		}
+		text, ok := previewText(raw)
+		if !ok {
+			data.Kind = "none"
+		} else if data.Kind == "markdown" {
+			data.Content, err = renderMarkdown(text)
+		} else {
+			data.Content, err = highlight(info.Name(), text)
+		}
+		if err != nil {
+			log.Printf("Path %s preview error: %v", path, err)
+			data.Kind = "none"
+		}
+	}
+
+	w.Header().Set("Content-Security-Policy", previewCSP)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	if err := tplPreview.Execute(w, data); err != nil {
+		log.Printf("Template execute error: %v", err)
+	}
+}
+
+// previewKind tells how a file is previewed from its name. Anything not
+// known to be media is tried as text.
+func previewKind(name string) string {
+	ext := strings.ToLower(filepath.Ext(name))
+	switch ext {
+	case ".md", ".markdown":
+		return "markdown"
+	case ".pdf":
+		return "pdf"
+	}
+	t, _, _ := strings.Cut(mime.TypeByExtension(ext), "/")
+	switch t {
+	case "image", "audio", "video":
+		return t
+	}
+	return "text"
+}
+
+// inlineSafe reports whether a file of the given name may be shown by the
+// browser rather than downloaded: media and PDFs, except SVG images, which
+// can hold script, and plain text.
+func inlineSafe(name string) bool {
+	t, _, _ := mime.ParseMediaType(mime.TypeByExtension(strings.ToLower(filepath.Ext(name))))
+	switch {
+	case t == "image/svg+xml":
+		return false
+	case t == "application/pdf", t == "text/plain":
+		return true
+	}
+	kind, _, _ := strings.Cut(t, "/")
+	return kind == "image" || kind == "audio" || kind == "video"
+}
+
+// previewText returns data as a string if it is UTF-8 text. A rune cut at
+// the end by the read limit is dropped.
+func previewText(data []byte) (string, bool) {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return "", false
+	}
+	for i := 0; i < utf8.UTFMax && len(data) > 0 && !utf8.Valid(data); i++ {
+		data = data[:len(data)-1]
+	}
+	return string(data), utf8.Valid(data)
+}
+
+func renderMarkdown(text string) (template.HTML, error) {
+	var buf bytes.Buffer
+	if err := markdown.Convert([]byte(text), &buf); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
+
+// highlight formats text as HTML with line numbers, highlighted by the
+// language its file name suggests.
+func highlight(name, text string) (template.HTML, error) {
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, text)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := codeFormatter.Format(&buf, codeStyle, it); err != nil {
+		return "", err
+	}
+	return template.HTML(buf.String()), nil
+}
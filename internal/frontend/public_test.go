@@ -0,0 +1,158 @@
+package frontend_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nssc/internal/frontend"
+	"nssc/internal/fs"
+	"nssc/internal/share"
+	"nssc/internal/users"
+)
+
+// newPublicTest returns a handler for a root below base holding
+// alice/docs/a.txt, and the share manager of the root.
+func newPublicTest(t *testing.T, base string, archiveLimit int64) (*frontend.FrontendHandler, *share.ShareManager) {
+	t.Helper()
+	root := filepath.Join(base, "root")
+	db := &users.UsersDB{}
+	db.AddUser("alice", "pass", "1GiB")
+	ufss, err := fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ufss.Close() })
+	ufs, _ := ufss.GetUserFS("alice")
+	if err := ufs.WriteFile("docs/a.txt", strings.NewReader("alpha"), 5); err != nil {
+		t.Fatal(err)
+	}
+	return frontend.NewHandler(db, root, ufss, "test", 0, archiveLimit), share.NewShareManager(filepath.Join(root, "public"))
+}
+
+func serve(h http.Handler, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+func TestPublicFile(t *testing.T) {
+	h, sm := newPublicTest(t, t.TempDir(), 0)
+	id, err := sm.CreateShare("alice", "docs/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, "GET", "/public/"+id)
+	if w.Code != http.StatusOK || w.Body.String() != "alpha" {
+		t.Fatalf("GET: status %d, body %q", w.Code, w.Body)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "sandbox" {
+		t.Errorf("Content-Security-Policy = %q, want sandbox", csp)
+	}
+	if w := serve(h, "HEAD", "/public/"+id); w.Code != http.StatusOK {
+		t.Errorf("HEAD: status %d", w.Code)
+	}
+	for _, method := range []string{"POST", "PUT", "DELETE"} {
+		if w := serve(h, method, "/public/"+id); w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: status %d, want 405", method, w.Code)
+		}
+	}
+	if w := serve(h, "GET", "/public/"+id); w.Body.String() != "alpha" {
+		t.Errorf("file changed to %q", w.Body)
+	}
+}
+
+func TestPublicDoesNotAuthorize(t *testing.T) {
+	h, sm := newPublicTest(t, t.TempDir(), 0)
+	id, err := sm.CreateShare("alice", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, target := range []string{
+		"/public/../alice/docs/a.txt",
+		"/public/" + id + "/a.txt",
+		"/public/" + id + "/../a.txt",
+		"/public/",
+		"/public/01966845-72bb-7902-85b3-a44a0112d351",
+	} {
+		if w := serve(h, "GET", target); w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: status %d, want 404", target, w.Code)
+		}
+	}
+	// Outside /public/ the user tree still takes a login.
+	if w := serve(h, "GET", "/docs/a.txt"); strings.Contains(w.Body.String(), "alpha") {
+		t.Errorf("GET /docs/a.txt without login served the file")
+	}
+}
+
+func TestPublicEscapes(t *testing.T) {
+	base := t.TempDir()
+	h, sm := newPublicTest(t, base, 0)
+	root := filepath.Dir(sm.PublicDir)
+	os.WriteFile(filepath.Join(base, "outside.txt"), []byte("secret"), 0644)
+	os.WriteFile(filepath.Join(root, "db.json"), []byte("secret"), 0600)
+	os.Symlink(filepath.Join(base, "outside.txt"), filepath.Join(root, "alice", "docs", "out.txt"))
+	os.MkdirAll(sm.PublicDir, 0750)
+	links := map[string]string{
+		"up":       "../../outside.txt",
+		"abs":      filepath.Join(base, "outside.txt"),
+		"root":     "../db.json",
+		"state":    "../.nssc/storage.json",
+		"nobody":   "../bob/a.txt",
+		"dotdot":   "../alice/../../outside.txt",
+		"usertree": "../alice",
+	}
+	for id, target := range links {
+		if err := os.Symlink(target, filepath.Join(sm.PublicDir, id)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := sm.CreateShare("alice", "docs/out.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links[id] = "symlink leading out of the tree"
+	for id, target := range links {
+		w := serve(h, "GET", "/public/"+id)
+		if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "secret") {
+			t.Errorf("link to %s: status %d, body %q", target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestPublicDirectory(t *testing.T) {
+	base := t.TempDir()
+	h, sm := newPublicTest(t, base, 4)
+	id, err := sm.CreateShare("alice", "docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(h, "GET", "/public/"+id); w.Code != http.StatusForbidden {
+		t.Errorf("directory over the limit: status %d, want 403", w.Code)
+	}
+
+	h, sm = newPublicTest(t, t.TempDir(), 5)
+	if id, err = sm.CreateShare("alice", "docs"); err != nil {
+		t.Fatal(err)
+	}
+	w := serve(h, "GET", "/public/"+id)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("directory: status %d, type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range zr.File {
+		names = append(names, f.Name)
+	}
+	if !strings.Contains(strings.Join(names, " "), "a.txt") {
+		t.Errorf("archive holds %v, want a.txt", names)
+	}
+}
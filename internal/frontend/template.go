@@ -14,6 +14,70 @@ var tplPage = template.Must(template.New("index").Parse(`
 </head>
 <body>
 
+{{ range .QuotaWarnings }}
+<div class="warning">Quota warning: {{ . }}</div>
+{{ end }}
+
+<div class="userform">
+{{ if .Favorites }}
+<span class="fds">Favorites · <a href="/user/">All files</a></span>
+{{ else if .Tag }}
+<span class="fds">Tagged "{{ .Tag }}" · <a href="/user{{ .CurrentPath }}">Show all</a></span>
+{{ else }}
+<span class="fds"><a href="/favorites">Favorites</a></span>
+{{ end }}
+{{ if .Columns }}
+<span class="fds">Sort by{{ range .Columns }} <a class="page" href="{{ .Href }}">{{ .Label }}{{ if eq .Current "asc" }} ▲{{ else if eq .Current "desc" }} ▼{{ end }}</a>{{ end }}</span>
+{{ end }}
+{{ if not .Favorites }}
+<span class="fds">{{ if .Gallery }}<a href="/user{{ .CurrentPath }}{{ if .Tag }}?tag={{ .Tag }}{{ end }}">List</a> · Gallery{{ else }}List · <a href="/user{{ .CurrentPath }}?view=gallery{{ if .Tag }}&tag={{ .Tag }}{{ end }}">Gallery</a>{{ end }}</span>
+{{ end }}
+</div>
+
+{{ if .SearchQuery }}
+<div class="userform">
+<span class="fds">{{ .ResultsTotal }} results for "{{ .SearchQuery }}" · <a href="/user/">All files</a></span>
+{{ if .SearchPartial }}<div class="warning">The search index is still being updated; recent changes may be missing.</div>{{ end }}
+</div>
+<div>
+<table>
+  <tbody>
+    {{ range .Results }}
+    <tr>
+      <td>
+        <a href="/user/{{ .Path }}{{ if .IsDir }}/{{ end }}">{{ .Path }}</a>
+        {{ if .Parts }}<div class="snippet">{{ range .Parts }}{{ if .Match }}<mark>{{ .Text }}</mark>{{ else }}{{ .Text }}{{ end }}{{ end }}</div>{{ end }}
+      </td>
+      <td>{{ .SizeStr }}</td>
+    </tr>
+    {{ end }}
+  </tbody>
+</table>
+</div>
+{{ if or .PrevPage .NextPage }}
+<div class="pages">
+  {{ if .PrevPage }}<a class="page" href="/search?query={{ .SearchQuery }}&page={{ .PrevPage }}">« Previous</a>{{ end }}
+  {{ if .NextPage }}<a class="page" href="/search?query={{ .SearchQuery }}&page={{ .NextPage }}">Next »</a>{{ end }}
+</div>
+{{ end }}
+{{ end }}
+
+{{ if .Gallery }}
+<div class="gallery">
+  {{ if .ParentPath }}
+  <a class="tile" href="/user/{{ .ParentPath }}?view=gallery"><span class="icon">..</span></a>
+  {{ end }}
+  {{ range .Files }}
+  {{ if .IsDir }}
+  <a class="tile" href="/user{{ .RelPath }}/?view=gallery"><span class="icon">📁</span><span class="name">{{ .Name }}</span></a>
+  {{ else if .Thumb }}
+  <a class="tile" href="/user{{ .RelPath }}?{{ $.PreviewQuery }}"><img src="/user{{ .RelPath }}?thumb=256" alt="{{ .Name }}" loading="lazy"><span class="name">{{ .Name }}</span></a>
+  {{ else }}
+  <a class="tile" href="/user{{ .RelPath }}"><span class="icon">📄</span><span class="name">{{ .Name }}</span></a>
+  {{ end }}
+  {{ end }}
+</div>
+{{ else }}
 <div>
 <table>
   <tbody>
@@ -25,6 +89,7 @@ var tplPage = template.Must(template.New("index").Parse(`
       <td></td>
       <td></td>
       <td></td>
+      <td></td>
     </tr>
     {{ end }}
     {{ range .Files }}
@@ -36,6 +101,7 @@ var tplPage = template.Must(template.New("index").Parse(`
           {{ else }}
           <a href="/user{{ .RelPath }}">{{ .Name }}</a>
           {{ end }}
+          {{ range .Tags }}<a class="tag" href="/user{{ $.CurrentPath }}?tag={{ . }}">#{{ . }}</a>{{ end }}
       </td>
       <td>
           {{ if not .IsDir }}
@@ -46,21 +112,41 @@ var tplPage = template.Must(template.New("index").Parse(`
       <td>
         {{ if not .IsDir }}
           <form method="post" action="/share">
-              <input type="hidden" name="name" value="/{{ $.User }}{{ .RelPath }}">
+              <input type="hidden" name="path" value="{{ .RelPath }}">
               <input type="submit" value="Share">
           </form>
         {{ end }}
       </td>
-      <td>{{ if not .IsDir }}<a href="/user{{ .RelPath }}?preview=1">Preview</a>{{ end }}</td>
+      <td>{{ if .IsDir }}<a href="/user{{ .RelPath }}/?archive=zip">Download</a>{{ else }}<a href="/user{{ .RelPath }}?{{ $.PreviewQuery }}">Preview</a>{{ end }}</td>
+      <td>
+        <form method="post" action="/favorite">
+            <input type="hidden" name="path" value="{{ .RelPath }}">
+            {{ if $.Favorites }}<input type="hidden" name="back" value="favorites">{{ end }}
+            {{ if .Favorite }}
+            <input type="submit" value="★" title="Remove from favorites">
+            {{ else }}
+            <input type="hidden" name="favorite" value="1">
+            <input type="submit" value="☆" title="Add to favorites">
+            {{ end }}
+        </form>
+      </td>
     </tr>
     {{ end }}
   </tbody>
 </table>
 </div>
+{{ end }}
+{{ if or .PrevURL .NextURL }}
+<div class="pages">
+  {{ if .PrevURL }}<a class="page" href="{{ .PrevURL }}">« Previous</a>{{ end }}
+  <span class="page">Page {{ .ListPage }} of {{ .ListPages }}</span>
+  {{ if .NextURL }}<a class="page" href="{{ .NextURL }}">Next »</a>{{ end }}
+</div>
+{{ end }}
 
 <div class="userform">
 <form action="/search" method="post">
-  <input type="text" name="query" placeholder="Search term" value="{{ .SearchQuery }}">
+  <input type="text" name="query" placeholder="words *.pdf type:image size:>10MB modified:>7d in:/docs is:dir" value="{{ .SearchQuery }}">
   <input type="submit" value="Search">
 </form>
 </div>
@@ -68,7 +154,9 @@ var tplPage = template.Must(template.New("index").Parse(`
 <div class="userform">
 <form action="/upload" method="post" enctype="multipart/form-data">
   <input type="hidden" name="path" value="{{ .CurrentPath }}">
-  <input type="file" name="file" required>
+  <label><input type="checkbox" name="extract" value="1"> Extract zip/tar</label>
+  <label>Files <input type="file" name="file" multiple></label>
+  <label>Folder <input type="file" name="file" webkitdirectory></label>
   <input type="submit" value="Upload">
 </form>
 </div>
@@ -84,6 +172,7 @@ var tplPage = template.Must(template.New("index").Parse(`
 <div class="userform">
 <form id="rm" method="post" action="/rm">
     <input type="hidden" name="dir" value="{{ .CurrentPath }}">
+    <input type="submit" formaction="/archive" value="Download selected">
     <input type="submit" value="Remove selected files">
 </form>
 </div>
@@ -116,6 +205,102 @@ Powered by nssc {{ .Version }}
 </html>
 `))
 
+var tplPreview = template.Must(template.New("preview").Parse(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8" />
+	<title>nssc - {{ .RelPath }}</title>
+	<link rel="stylesheet" href="/style.css">
+	<style>{{ .CodeCSS }}</style>
+</head>
+<body>
+
+<div class="userform">
+<span class="fds">
+  <a href="/user{{ .Dir }}">{{ .Dir }}</a>&nbsp;·&nbsp;{{ .Name }}&nbsp;·&nbsp;{{ .Size }}&nbsp;·&nbsp;{{ .ModTime }}
+</span>
+</div>
+
+<div class="pages">
+  {{ if .Prev }}<a class="page" href="/user{{ .Prev }}?{{ .Query }}">« Previous</a>{{ end }}
+  <a class="page abutton" href="/user{{ .RelPath }}?download=1">Download</a>
+  <form method="post" action="/share">
+    <input type="hidden" name="path" value="{{ .RelPath }}">
+    <input type="hidden" name="back" value="preview">
+    <input type="submit" value="Share">
+  </form>
+  {{ if .Next }}<a class="page" href="/user{{ .Next }}?{{ .Query }}">Next »</a>{{ end }}
+</div>
+
+{{ if .Shared }}
+<div class="userform">
+<span class="fds">Shared as <a href="{{ .Shared }}">{{ .Shared }}</a></span>
+</div>
+{{ end }}
+
+<div class="preview">
+{{ if eq .Kind "image" }}
+  <img src="/user{{ .RelPath }}" alt="{{ .Name }}">
+{{ else if eq .Kind "audio" }}
+  <audio controls preload="metadata" src="/user{{ .RelPath }}"></audio>
+{{ else if eq .Kind "video" }}
+  <video controls preload="metadata" src="/user{{ .RelPath }}"></video>
+{{ else if eq .Kind "pdf" }}
+  <iframe src="/user{{ .RelPath }}" title="{{ .Name }}"></iframe>
+{{ else if eq .Kind "markdown" }}
+  <article class="markdown">{{ .Content }}</article>
+{{ else if eq .Kind "text" }}
+  {{ .Content }}
+{{ else }}
+  <span class="fds">No preview available for this file.</span>
+{{ end }}
+{{ if .Truncated }}<div class="warning">Only the first 1 MiB is shown; download the file to see all of it.</div>{{ end }}
+</div>
+
+<footer>
+Powered by nssc {{ .Version }}
+</footer>
+
+</body>
+</html>
+`))
+
+var tplResults = template.Must(template.New("results").Parse(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+	<meta charset="UTF-8" />
+	<title>nssc - {{ .Title }}</title>
+	<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+
+<div class="userform">
+<span class="fds">{{ .Title }}: {{ len .Items }} entries, {{ .Failed }} failed · <a href="/user/{{ .Dir }}">Back</a></span>
+</div>
+
+<div>
+<table>
+  <tbody>
+    {{ range .Items }}
+    <tr>
+      <td>{{ .Path }}</td>
+      <td>{{ if .Error }}<span class="failed">{{ .Error }}</span>{{ else }}ok{{ end }}</td>
+    </tr>
+    {{ end }}
+  </tbody>
+</table>
+</div>
+
+<footer>
+Powered by nssc {{ .Version }}
+</footer>
+
+</body>
+</html>
+`))
+
 var CSS = `body {
     margin: 0 auto;
     font-family: 'Courier New', Courier, monospace;
@@ -129,6 +314,23 @@ a {
 .userform {
     padding: 4px;
 }
+.snippet {
+    font-size: 12px;
+    color: dimgray;
+}
+.tag {
+    margin-left: 0.5em;
+    font-size: 12px;
+    color: gray;
+}
+.failed {
+    color: darkred;
+}
+.warning {
+    padding: 4px;
+    justify-content: center;
+    background-color: khaki;
+}
 .loginform {
     display: grid;
 }
@@ -157,5 +359,52 @@ tr:nth-child(even) {
 }
 .pages {
     display: flex;
+    justify-content: center;
+}
+.preview {
+    justify-content: center;
+    padding: 8px;
+}
+.preview img, .preview video {
+    max-width: 90vw;
+    max-height: 80vh;
+}
+.preview iframe {
+    width: 90vw;
+    height: 80vh;
+    border: none;
+}
+.markdown {
+    max-width: 50em;
+    font-family: sans-serif;
+}
+.gallery {
+    display: grid;
+    grid-template-columns: repeat(auto-fill, 160px);
+    gap: 8px;
+    justify-content: center;
+}
+.tile {
+    display: flex;
+    flex-direction: column;
+    align-items: center;
+    justify-content: center;
+    width: 160px;
+    height: 180px;
+    background-color: lightgray;
+}
+.tile img {
+    max-width: 150px;
+    max-height: 150px;
+}
+.tile .icon {
+    font-size: 48px;
+}
+.tile .name {
+    max-width: 150px;
+    overflow: hidden;
+    white-space: nowrap;
+    text-overflow: ellipsis;
+    font-size: 12px;
 }
 `
@@ -0,0 +1,179 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"time"
+)
+
+// ArchiveTypes maps the formats WriteArchive writes to their content types.
+var ArchiveTypes = map[string]string{
+	"zip":    "application/zip",
+	"tar.gz": "application/gzip",
+}
+
+// archiveWriter adds entries to an archive being streamed.
+type archiveWriter interface {
+	dir(name string, modTime time.Time) error
+	file(name string, info fs.FileInfo, r io.Reader) error
+	Close() error
+}
+
+// WriteArchive streams the entries at paths and everything beneath them
+// to w as an archive in format, a key of ArchiveTypes. Entries are named
+// after their base name, so the selected entries of a directory unpack
+// side by side; the user root unpacks as its contents. Symlinks leading
+// out of the tree and symlinks to directories are skipped. The paths are
+// checked before anything is written, so an error wrapping fs.ErrNotExist
+// or fs.ErrInvalid leaves w untouched.
+func (u *UserFS) WriteArchive(ctx context.Context, w io.Writer, format string, paths []string) error {
+	var aw archiveWriter
+	switch format {
+	case "zip":
+		aw = &zipArchive{zw: zip.NewWriter(w)}
+	case "tar.gz":
+		gw := gzip.NewWriter(w)
+		aw = &tarArchive{gw: gw, tw: tar.NewWriter(gw)}
+	default:
+		return fmt.Errorf("unsupported archive format %q", format)
+	}
+
+	names := make([]string, len(paths))
+	infos := make([]fs.FileInfo, len(paths))
+	for i, p := range paths {
+		name, err := cleanName(p)
+		if err != nil {
+			return &fs.PathError{Op: "archive", Path: p, Err: fs.ErrInvalid}
+		}
+		u.mu.RLock()
+		info, err := u.backend.Stat(name)
+		u.mu.RUnlock()
+		if err != nil {
+			return &fs.PathError{Op: "archive", Path: p, Err: err}
+		}
+		names[i], infos[i] = name, info
+	}
+	for i, name := range names {
+		entry := baseName(name)
+		if name == "" {
+			entry = ""
+		}
+		if err := u.archiveEntry(ctx, aw, name, entry, infos[i]); err != nil {
+			return err
+		}
+	}
+	return aw.Close()
+}
+
+// archiveEntry adds name, stored as entry, and everything beneath it.
+func (u *UserFS) archiveEntry(ctx context.Context, aw archiveWriter, name, entry string, info fs.FileInfo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		u.mu.RLock()
+		f, err := u.backend.OpenFile(name, os.O_RDONLY, 0)
+		u.mu.RUnlock()
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return aw.file(entry, info, f)
+	}
+	if entry != "" {
+		if err := aw.dir(entry, info.ModTime()); err != nil {
+			return err
+		}
+	}
+	u.mu.RLock()
+	entries, err := u.backend.ReadDir(name)
+	u.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		child := joinName(name, e.Name())
+		if ignoredName(child) {
+			continue
+		}
+		// Stat follows symlinks, refusing those that leave the tree.
+		u.mu.RLock()
+		ci, err := u.backend.Stat(child)
+		u.mu.RUnlock()
+		if err != nil || e.Type()&fs.ModeSymlink != 0 && ci.IsDir() {
+			continue
+		}
+		if err := u.archiveEntry(ctx, aw, child, joinName(entry, e.Name()), ci); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) dir(name string, modTime time.Time) error {
+	_, err := a.zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modTime})
+	return err
+}
+
+func (a *zipArchive) file(name string, info fs.FileInfo, r io.Reader) error {
+	hdr := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime()}
+	hdr.SetMode(info.Mode())
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchive) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchive struct {
+	gw *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchive) dir(name string, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: modTime})
+}
+
+func (a *tarArchive) file(name string, info fs.FileInfo, r io.Reader) error {
+	// The header carries the size, so a file changing while it is read
+	// fails the archive rather than corrupting it.
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(info.Mode().Perm()),
+		Size:     info.Size(),
+		ModTime:  info.ModTime(),
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(a.tw, r, info.Size()); err != nil {
+		return fmt.Errorf("archive %s: %w", name, err)
+	}
+	return nil
+}
+
+func (a *tarArchive) Close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	return a.gw.Close()
+}
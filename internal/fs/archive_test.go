@@ -0,0 +1,110 @@
+package fs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestWriteArchive(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(root, nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+
+	writeString(t, ufs, "docs/a.txt", "alpha")
+	writeString(t, ufs, "docs/sub/b.txt", "beta")
+	writeString(t, ufs, "c.txt", "gamma")
+	ufs.Mkdir(ctx, "docs/empty", 0755)
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644)
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "user", "docs", "escape"))
+	os.Symlink("../c.txt", filepath.Join(root, "user", "docs", "link.txt"))
+	os.Symlink("..", filepath.Join(root, "user", "docs", "loop"))
+
+	want := map[string]string{
+		"docs/":          "",
+		"docs/a.txt":     "alpha",
+		"docs/empty/":    "",
+		"docs/link.txt":  "gamma",
+		"docs/sub/":      "",
+		"docs/sub/b.txt": "beta",
+		"c.txt":          "gamma",
+	}
+	for _, format := range []string{"zip", "tar.gz"} {
+		var buf bytes.Buffer
+		if err := ufs.WriteArchive(ctx, &buf, format, []string{"/docs", "c.txt"}); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		got := readArchive(t, format, buf.Bytes())
+		if !maps.Equal(got, want) {
+			t.Errorf("%s entries = %v, want %v", format, got, want)
+		}
+	}
+
+	// The root unpacks as its contents.
+	var buf bytes.Buffer
+	ufs.WriteArchive(ctx, &buf, "zip", []string{"/"})
+	if got := readArchive(t, "zip", buf.Bytes()); got["c.txt"] != "gamma" || got["docs/a.txt"] != "alpha" {
+		t.Errorf("root entries = %v", got)
+	}
+
+	for _, p := range []string{"missing", "../user", "docs/escape"} {
+		buf.Reset()
+		err := ufs.WriteArchive(ctx, &buf, "zip", []string{"c.txt", p})
+		if !errors.Is(err, iofs.ErrNotExist) && !errors.Is(err, iofs.ErrInvalid) || buf.Len() != 0 {
+			t.Errorf("%s: error = %v, %d bytes written", p, err, buf.Len())
+		}
+	}
+}
+
+// readArchive returns the contents of the entries of an archive by name.
+func readArchive(t *testing.T, format string, data []byte) map[string]string {
+	t.Helper()
+	entries := make(map[string]string)
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range zr.File {
+			rc, _ := f.Open()
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			entries[f.Name] = string(b)
+		}
+		return entries
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(tr)
+		entries[hdr.Name] = string(b)
+	}
+	return entries
+}
@@ -0,0 +1,144 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// maxTagLen and maxCommentLen bound the attributes a client can attach.
+const (
+	maxTagLen     = 64
+	maxCommentLen = 4096
+)
+
+// Attrs are the user-managed attributes of a file or directory. Unlike
+// FileMeta they describe the entry rather than its content, so they
+// survive writes and follow renames.
+type Attrs struct {
+	Tags     []string `json:"tags,omitempty"`
+	Comment  string   `json:"comment,omitempty"`
+	Favorite bool     `json:"favorite,omitempty"`
+}
+
+// IsZero reports whether a carries no attributes.
+func (a Attrs) IsZero() bool {
+	return len(a.Tags) == 0 && a.Comment == "" && !a.Favorite
+}
+
+// HasTag reports whether a is tagged tag, ignoring case.
+func (a Attrs) HasTag(tag string) bool {
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	for _, t := range a.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize lowercases, deduplicates and sorts the tags of a and checks
+// the attributes are within bounds.
+func (a Attrs) normalize() (Attrs, error) {
+	seen := make(map[string]bool, len(a.Tags))
+	var tags []string
+	for _, t := range a.Tags {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || seen[t] {
+			continue
+		}
+		if len(t) > maxTagLen || strings.ContainsFunc(t, func(r rune) bool {
+			return unicode.IsSpace(r) || unicode.IsControl(r) || r == ','
+		}) {
+			return a, fmt.Errorf("invalid tag %q", t)
+		}
+		seen[t] = true
+		tags = append(tags, t)
+	}
+	sort.Strings(tags)
+	a.Tags = tags
+	a.Comment = strings.TrimSpace(a.Comment)
+	if len(a.Comment) > maxCommentLen {
+		return a, fmt.Errorf("comment longer than %d bytes", maxCommentLen)
+	}
+	return a, nil
+}
+
+// attrStore keeps the Attrs of a tree.
+type attrStore struct {
+	*pathStore[Attrs]
+}
+
+func loadAttrStore(path string) (*attrStore, error) {
+	ps, err := loadPathStore[Attrs](path)
+	if err != nil {
+		return nil, err
+	}
+	return &attrStore{ps}, nil
+}
+
+// Attrs returns the attributes of path, which must exist.
+func (u *UserFS) Attrs(ctx context.Context, path string) (Attrs, error) {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	name, err := cleanName(path)
+	if err != nil {
+		return Attrs{}, &fs.PathError{Op: "attrs", Path: path, Err: fs.ErrInvalid}
+	}
+	if _, err := u.backend.Stat(name); err != nil {
+		return Attrs{}, &fs.PathError{Op: "attrs", Path: path, Err: err}
+	}
+	a, _ := u.attrs.get(name)
+	return a, nil
+}
+
+// SetAttrs replaces the attributes of path, which must exist. Tags are
+// lowercased, deduplicated and sorted; zero Attrs clear the entry.
+func (u *UserFS) SetAttrs(ctx context.Context, path string, a Attrs) error {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	name, err := cleanName(path)
+	if err != nil {
+		return &fs.PathError{Op: "setattrs", Path: path, Err: fs.ErrInvalid}
+	}
+	a, err = a.normalize()
+	if err != nil {
+		return err
+	}
+	if _, err := u.backend.Stat(name); err != nil {
+		return &fs.PathError{Op: "setattrs", Path: path, Err: err}
+	}
+	if a.IsZero() {
+		u.attrs.drop(name)
+	} else {
+		u.attrs.set(name, a)
+	}
+	return nil
+}
+
+// FindAttrs returns the entries beneath dir, keyed by path relative to
+// the user root, whose attributes satisfy match.
+func (u *UserFS) FindAttrs(dir string, match func(Attrs) bool) (map[string]Attrs, error) {
+	name, err := cleanName(dir)
+	if err != nil {
+		return nil, err
+	}
+	res := u.attrs.entries(name)
+	for k, a := range res {
+		if !match(a) {
+			delete(res, k)
+		}
+	}
+	return res, nil
+}
+
+// drop removes the entry of name alone, leaving its descendants.
+func (s *attrStore) drop(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, metaKey(name))
+	s.scheduleSave()
+}
@@ -0,0 +1,61 @@
+package fs_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestAttrs(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(root, nil, db.Users)
+	ufs, _ := server.GetUserFS("user")
+	ufs.MkdirAll(ctx, "docs", 0755)
+	ufs.WriteFile("docs/a.txt", strings.NewReader("a"), 1)
+
+	if err := ufs.SetAttrs(ctx, "missing.txt", fs.Attrs{Favorite: true}); err == nil {
+		t.Error("SetAttrs on a missing file succeeded")
+	}
+	if err := ufs.SetAttrs(ctx, "docs/a.txt", fs.Attrs{Tags: []string{"a,b"}}); err == nil {
+		t.Error("SetAttrs with an invalid tag succeeded")
+	}
+	ufs.SetAttrs(ctx, "docs", fs.Attrs{Tags: []string{"Project"}})
+	ufs.SetAttrs(ctx, "docs/a.txt", fs.Attrs{Tags: []string{" b", "A", "b"}, Comment: "note", Favorite: true})
+
+	// Attributes survive content changes and follow renames.
+	ufs.WriteFile("docs/a.txt", strings.NewReader("changed"), 7)
+	if err := ufs.Rename(ctx, "docs", "papers"); err != nil {
+		t.Fatal(err)
+	}
+	a, err := ufs.Attrs(ctx, "papers/a.txt")
+	if err != nil || !a.Favorite || a.Comment != "note" || strings.Join(a.Tags, ",") != "a,b" {
+		t.Errorf("Attrs after rename = %+v, %v", a, err)
+	}
+	if a, _ := ufs.Attrs(ctx, "papers"); !a.HasTag("project") {
+		t.Errorf("directory attrs = %+v", a)
+	}
+
+	// They are persisted across restarts.
+	server.Close()
+	server, _ = fs.NewUserFSServer(root, nil, db.Users)
+	defer server.Close()
+	ufs, _ = server.GetUserFS("user")
+	favorites, _ := ufs.FindAttrs("", func(a fs.Attrs) bool { return a.Favorite })
+	if _, ok := favorites["papers/a.txt"]; !ok || len(favorites) != 1 {
+		t.Errorf("favorites = %v", favorites)
+	}
+
+	// Zero attributes and removals clear the entries.
+	ufs.SetAttrs(ctx, "papers", fs.Attrs{})
+	ufs.RemoveAll(ctx, "papers/a.txt")
+	ufs.WriteFile("papers/a.txt", strings.NewReader("a"), 1)
+	if all, _ := ufs.FindAttrs("", func(fs.Attrs) bool { return true }); len(all) != 0 {
+		t.Errorf("attrs left after removal: %v", all)
+	}
+}
@@ -0,0 +1,154 @@
+package fs
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/webdav"
+)
+
+// File is an open file of a Backend. Regular files support positional I/O
+// so they can be served over 9P as well as HTTP and WebDAV.
+type File interface {
+	webdav.File
+	io.ReaderAt
+	io.WriterAt
+	Truncate(size int64) error
+}
+
+// Backend stores the files of a single user tree. Names are clean,
+// slash-separated paths relative to the tree root; "" is the root itself.
+// Errors follow the os package conventions (fs.ErrNotExist and friends).
+type Backend interface {
+	// OpenFile opens or creates name with os.OpenFile flag semantics.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Stat(name string) (fs.FileInfo, error)
+	// ReadDir returns the entries of directory name sorted by name.
+	ReadDir(name string) ([]fs.DirEntry, error)
+	Mkdir(name string, perm os.FileMode) error
+	MkdirAll(name string, perm os.FileMode) error
+	// Remove removes a file or an empty directory.
+	Remove(name string) error
+	RemoveAll(name string) error
+	Rename(oldName, newName string) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Truncate(name string, size int64) error
+	// Usage returns the total size of regular files at or beneath name.
+	Usage(name string) (int64, error)
+}
+
+// BackendFactory creates the Backend holding the tree of username.
+type BackendFactory func(username string) (Backend, error)
+
+// WithBackend stores user trees in backends created by f instead of
+// directories under the server root.
+func WithBackend(f BackendFactory) ServerOption {
+	return func(s *UserFSServer) {
+		s.backends = f
+	}
+}
+
+// cleanName turns a client path into a Backend name, rejecting paths that
+// escape the user root.
+func cleanName(name string) (string, error) {
+	cleaned := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(name)), "/")
+	if cleaned == "." {
+		return "", nil
+	}
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", fs.ErrInvalid
+	}
+	return cleaned, nil
+}
+
+// parentName returns the Backend name of the directory containing name.
+func parentName(name string) string {
+	dir := path.Dir(name)
+	if dir == "." || dir == "/" {
+		return ""
+	}
+	return dir
+}
+
+// joinName returns the Backend name of entry name inside directory dir.
+func joinName(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return dir + "/" + name
+}
+
+// backendFS exposes a Backend as a read-only io/fs.FS, so fs.WalkDir and
+// friends work on any storage.
+type backendFS struct {
+	b Backend
+}
+
+func fsName(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return "", nil
+	}
+	return name, nil
+}
+
+func (f backendFS) Open(name string) (fs.File, error) {
+	n, err := fsName("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.b.OpenFile(n, os.O_RDONLY, 0)
+}
+
+func (f backendFS) Stat(name string) (fs.FileInfo, error) {
+	n, err := fsName("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.b.Stat(n)
+}
+
+func (f backendFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	n, err := fsName("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.b.ReadDir(n)
+}
+
+// walkUsage sums the sizes of regular files at or beneath name by walking b.
+func walkUsage(b Backend, name string) (int64, error) {
+	root := name
+	if root == "" {
+		root = "."
+	}
+	var size int64
+	err := fs.WalkDir(backendFS{b}, root, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
+
+// sortEntries orders directory entries by name as os.ReadDir does.
+func sortEntries(entries []fs.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+}
@@ -0,0 +1,209 @@
+package fs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+)
+
+// VerifyStatus is the outcome of re-hashing a single stored file.
+type VerifyStatus string
+
+const (
+	// VerifyOK means the stored data matches the recorded checksum.
+	VerifyOK VerifyStatus = "ok"
+	// VerifyMismatch means the file is unchanged by size and mtime but its
+	// content no longer matches the recorded checksum (bit rot).
+	VerifyMismatch VerifyStatus = "mismatch"
+	// VerifyMissing means no checksum was recorded; one has been stored now.
+	VerifyMissing VerifyStatus = "missing"
+	// VerifyModified means the file changed outside nssc after its checksum
+	// was recorded; the new checksum has been stored.
+	VerifyModified VerifyStatus = "modified"
+)
+
+// VerifyResult describes a single file checked by Verify.
+type VerifyResult struct {
+	Path     string
+	Status   VerifyStatus
+	Expected string
+	Actual   string
+}
+
+// hashFile returns the hex SHA-256 of the content of the file name.
+func (u *UserFS) hashFile(name string) (string, error) {
+	f, err := u.backend.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordChecksum stores sum for name, which was fully written from sum's input.
+func (u *UserFS) recordChecksum(name string, sum []byte) {
+	info, err := u.backend.Stat(name)
+	if err != nil {
+		u.meta.remove(name)
+		return
+	}
+	u.storeChecksum(name, hex.EncodeToString(sum), info)
+}
+
+// recordChecksumSize stores sum for name if it covers all hashed bytes of the
+// file; otherwise the file is re-hashed from storage.
+func (u *UserFS) recordChecksumSize(name string, sum []byte, hashed int64) {
+	info, err := u.backend.Stat(name)
+	if err != nil {
+		u.meta.remove(name)
+		return
+	}
+	if sum != nil && info.Size() == hashed {
+		u.storeChecksum(name, hex.EncodeToString(sum), info)
+		return
+	}
+	hexSum, err := u.hashFile(name)
+	if err != nil {
+		log.Printf("Checksum %s error: %v", name, err)
+		u.meta.remove(name)
+		return
+	}
+	u.storeChecksum(name, hexSum, info)
+}
+
+// storeChecksum records sum for the file name, linking it into the blob
+// store first when the storage is deduplicated.
+func (u *UserFS) storeChecksum(name, sum string, info fs.FileInfo) {
+	if fullPath, ok := u.diskPath(name); ok && u.dedup() {
+		if _, err := u.server.linkBlob(u.name, fullPath, sum); err != nil {
+			log.Printf("Dedup %s error: %v", name, err)
+		} else if linked, err := os.Stat(fullPath); err == nil {
+			// A link to an existing blob carries the blob's mtime.
+			info = linked
+		}
+	}
+	u.meta.set(name, FileMeta{SHA256: sum, Size: info.Size(), ModTime: info.ModTime()})
+}
+
+// Checksum returns the hex SHA-256 recorded for name, or "" if none is
+// recorded or the file changed since it was computed.
+func (u *UserFS) Checksum(ctx context.Context, name string) (string, error) {
+	info, err := u.Stat(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return u.checksum(name, info), nil
+}
+
+// checksum returns the checksum recorded for name, described by info, or
+// "" as Checksum does.
+func (u *UserFS) checksum(name string, info fs.FileInfo) string {
+	if info.IsDir() {
+		return ""
+	}
+	fm, ok := u.meta.get(name)
+	if !ok || fm.Size != info.Size() || !fm.ModTime.Equal(info.ModTime()) {
+		return ""
+	}
+	return fm.SHA256
+}
+
+// Verify re-hashes every regular file in the user tree and reports each one
+// to fn. Missing or outdated checksums are recorded; mismatches are left
+// untouched so the damaged file can be restored and verified again.
+func (u *UserFS) Verify(ctx context.Context, fn func(VerifyResult)) error {
+	return fs.WalkDir(u.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum, err := u.hashFile(name)
+		if err != nil {
+			return err
+		}
+		res := VerifyResult{Path: name, Actual: sum}
+		fm, ok := u.meta.get(name)
+		switch {
+		case !ok || fm.SHA256 == "":
+			res.Status = VerifyMissing
+		case fm.Size != info.Size() || !fm.ModTime.Equal(info.ModTime()):
+			res.Status = VerifyModified
+			res.Expected = fm.SHA256
+		case fm.SHA256 != sum:
+			res.Status = VerifyMismatch
+			res.Expected = fm.SHA256
+		default:
+			res.Status = VerifyOK
+			res.Expected = fm.SHA256
+		}
+		if res.Status == VerifyMissing || res.Status == VerifyModified {
+			u.meta.set(name, FileMeta{SHA256: sum, Size: info.Size(), ModTime: info.ModTime()})
+		}
+		fn(res)
+		return nil
+	})
+}
+
+// Sync flushes pending metadata, attribute, index and usage changes to disk.
+func (u *UserFS) Sync() error {
+	if err := u.usage.save(); err != nil {
+		return err
+	}
+	if err := u.index.flush(); err != nil {
+		return err
+	}
+	if err := u.attrs.save(); err != nil {
+		return err
+	}
+	return u.meta.save()
+}
+
+// ETag returns the entity tag of path, the one the REST API and WebDAV
+// both report: see ETagOf.
+func (u *UserFS) ETag(ctx context.Context, path string) (string, error) {
+	info, err := u.Stat(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	sum, _ := u.Checksum(ctx, path)
+	return ETagOf(info, sum), nil
+}
+
+// ETagOf returns the entity tag of the entry described by info with the
+// checksum sum: the quoted checksum if there is one, otherwise made of
+// the modification time and size as golang.org/x/net/webdav makes it.
+func ETagOf(info fs.FileInfo, sum string) string {
+	if sum != "" {
+		return `"` + sum + `"`
+	}
+	return fmt.Sprintf(`"%x%x"`, info.ModTime().UnixNano(), info.Size())
+}
+
+// SetChecksumHeaders sets the ETag of a file download, see ETagOf, and
+// exposes the checksum sum, if any, as an RFC 3230 Digest header.
+func SetChecksumHeaders(h http.Header, info fs.FileInfo, sum string) {
+	h.Set("ETag", ETagOf(info, sum))
+	if raw, err := hex.DecodeString(sum); err == nil && sum != "" {
+		h.Set("Digest", "sha-256="+base64.StdEncoding.EncodeToString(raw))
+	}
+}
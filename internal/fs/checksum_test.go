@@ -0,0 +1,104 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func newTestUserFS(t *testing.T) *fs.UserFS {
+	t.Helper()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, err := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufs, err := server.GetUserFS("user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ufs
+}
+
+func TestChecksumRecorded(t *testing.T) {
+	ctx := context.Background()
+	ufs := newTestUserFS(t)
+	data := []byte("checksum me")
+
+	if err := ufs.WriteFile("a.txt", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if sum, _ := ufs.Checksum(ctx, "a.txt"); sum != sha256Hex(data) {
+		t.Errorf("WriteFile checksum = %q, want %q", sum, sha256Hex(data))
+	}
+
+	f, err := ufs.OpenFile(ctx, "b.txt", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(data[:5])
+	f.Write(data[5:])
+	f.Close()
+	if sum, _ := ufs.Checksum(ctx, "b.txt"); sum != sha256Hex(data) {
+		t.Errorf("OpenFile checksum = %q, want %q", sum, sha256Hex(data))
+	}
+
+	// Out-of-order writes fall back to re-hashing on Close.
+	f, err = ufs.OpenFile(ctx, "b.txt", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Seek(0, 0)
+	f.Write([]byte("C"))
+	f.Close()
+	want := sha256Hex(append([]byte("C"), data[1:]...))
+	if sum, _ := ufs.Checksum(ctx, "b.txt"); sum != want {
+		t.Errorf("rewritten checksum = %q, want %q", sum, want)
+	}
+
+	if err := ufs.Rename(ctx, "a.txt", "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if sum, _ := ufs.Checksum(ctx, "c.txt"); sum != sha256Hex(data) {
+		t.Errorf("checksum not moved on rename: %q", sum)
+	}
+}
+
+func TestVerifyDetectsCorruption(t *testing.T) {
+	ctx := context.Background()
+	ufs := newTestUserFS(t)
+	data := []byte("original")
+	if err := ufs.WriteFile("f.txt", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip content in place while keeping size and mtime, as bit rot would.
+	full := filepath.Join(ufs.Root(), "f.txt")
+	info, _ := os.Stat(full)
+	os.WriteFile(full, []byte("0riginal"), 0644)
+	os.Chtimes(full, info.ModTime(), info.ModTime())
+
+	var got []fs.VerifyResult
+	if err := ufs.Verify(ctx, func(r fs.VerifyResult) { got = append(got, r) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Status != fs.VerifyMismatch {
+		t.Fatalf("Verify results = %+v, want one mismatch", got)
+	}
+	if got[0].Expected != sha256Hex(data) {
+		t.Errorf("expected checksum = %q", got[0].Expected)
+	}
+}
@@ -0,0 +1,96 @@
+package fs
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"nssc/internal/events"
+)
+
+// Resource is the state of a path a conditional change is checked on.
+type Resource struct {
+	Exists  bool
+	ETag    string // see ETagOf
+	ModTime time.Time
+}
+
+// Precondition decides from the state of a path whether a change of it
+// goes ahead. An error stops the change and is returned as is.
+//
+// The *If methods check their preconditions and make the change under the
+// lock of the tree, so no write of any protocol comes in between.
+type Precondition func(Resource) error
+
+// resource returns the state of the cleaned name (must be called with mu
+// held).
+func (u *UserFS) resource(name string) Resource {
+	info, err := u.backend.Stat(name)
+	if err != nil {
+		return Resource{}
+	}
+	return Resource{Exists: true, ETag: ETagOf(info, u.checksum(name, info)), ModTime: info.ModTime()}
+}
+
+// WriteFileIf is WriteFile if the state of name satisfies check.
+func (u *UserFS) WriteFileIf(name string, file io.Reader, sz int64, check Precondition) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	name, err := cleanName(name)
+	if err != nil {
+		return err
+	}
+	if err := check(u.resource(name)); err != nil {
+		return err
+	}
+	defer u.changing(name)()
+	return u.writeFile(name, file, sz)
+}
+
+// RemoveAllIf is RemoveAll if the state of path satisfies check.
+func (u *UserFS) RemoveAllIf(ctx context.Context, path string, check Precondition) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	name, err := cleanName(path)
+	if err != nil {
+		return err
+	}
+	if err := check(u.resource(name)); err != nil {
+		return err
+	}
+	defer u.changing(name)()
+	info, err := u.removeAll(name)
+	if err != nil {
+		return err
+	}
+	u.record(events.Event{Type: events.Remove, Path: name, IsDir: info.IsDir()})
+	return nil
+}
+
+// RenameIf is Rename if the states of oldPath and newPath satisfy
+// checkOld and checkNew.
+func (u *UserFS) RenameIf(ctx context.Context, oldPath, newPath string, checkOld, checkNew Precondition) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	oldName, err := cleanName(oldPath)
+	if err != nil {
+		return err
+	}
+	newName, err := cleanName(newPath)
+	if err != nil {
+		return err
+	}
+	if err := checkOld(u.resource(oldName)); err != nil {
+		return err
+	}
+	if err := checkNew(u.resource(newName)); err != nil {
+		return err
+	}
+	defer u.changing(oldName, newName)()
+	info, err := u.rename(oldName, newName)
+	if err != nil {
+		return err
+	}
+	u.record(events.Event{Type: events.Rename, Path: newName, OldPath: oldName, IsDir: info.IsDir()})
+	return nil
+}
@@ -0,0 +1,85 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestConditionalChanges(t *testing.T) {
+	ctx := context.Background()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+
+	errStale := errors.New("stale")
+	ifETag := func(etag string) fs.Precondition {
+		return func(res fs.Resource) error {
+			if !res.Exists || res.ETag != etag {
+				return errStale
+			}
+			return nil
+		}
+	}
+	absent := func(res fs.Resource) error {
+		if res.Exists {
+			return errStale
+		}
+		return nil
+	}
+
+	if err := ufs.WriteFileIf("a.txt", strings.NewReader("one"), 3, absent); err != nil {
+		t.Fatal(err)
+	}
+	if err := ufs.WriteFileIf("a.txt", strings.NewReader("two"), 3, absent); err != errStale {
+		t.Fatalf("second create: error = %v, want the precondition's", err)
+	}
+	etag, _ := ufs.ETag(ctx, "a.txt")
+
+	// Of writers that all saw the same version, exactly one replaces it.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	won := 0
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := fmt.Sprintf("writer %d", i)
+			if ufs.WriteFileIf("a.txt", strings.NewReader(data), int64(len(data)), ifETag(etag)) == nil {
+				mu.Lock()
+				won++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Errorf("%d conditional writes of the same version succeeded, want 1", won)
+	}
+
+	etag, _ = ufs.ETag(ctx, "a.txt")
+	if err := ufs.RenameIf(ctx, "a.txt", "b.txt", ifETag(etag), absent); err != nil {
+		t.Fatal(err)
+	}
+	writeString(t, ufs, "c.txt", "c")
+	if err := ufs.RenameIf(ctx, "b.txt", "c.txt", ifETag(etag), absent); err != errStale {
+		t.Errorf("move over a file: error = %v, want the precondition's", err)
+	}
+	if err := ufs.RemoveAllIf(ctx, "b.txt", ifETag(`"other"`)); err != errStale {
+		t.Errorf("remove: error = %v, want the precondition's", err)
+	}
+	if err := ufs.RemoveAllIf(ctx, "b.txt", ifETag(etag)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat(ctx, "b.txt"); err == nil {
+		t.Error("b.txt not removed")
+	}
+}
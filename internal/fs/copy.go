@@ -0,0 +1,107 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+
+	"nssc/internal/events"
+)
+
+// Copy copies the file or directory tree at src to dst, which may not be
+// src or lie inside it. A file replaces a file at dst, while a directory
+// is only copied to a path that does not exist. Tags, comments and
+// favorites are not copied. If copying a tree fails halfway, the part
+// copied is removed again.
+func (u *UserFS) Copy(ctx context.Context, src, dst string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	srcName, err := cleanName(src)
+	if err != nil {
+		return err
+	}
+	dstName, err := cleanName(dst)
+	if err != nil {
+		return err
+	}
+	if srcName == "" || dstName == "" || under(dstName, srcName) {
+		return &fs.PathError{Op: "copy", Path: dst, Err: fs.ErrInvalid}
+	}
+	defer u.changing(dstName)()
+	info, err := u.backend.Stat(srcName)
+	if err != nil {
+		return err
+	}
+	dstInfo, err := u.backend.Stat(dstName)
+	if err == nil && (info.IsDir() || dstInfo.IsDir()) {
+		return &fs.PathError{Op: "copy", Path: dst, Err: fs.ErrExist}
+	}
+	if !info.IsDir() {
+		return u.copyFile(srcName, dstName, info.Size())
+	}
+
+	if err := u.checkQuotas(dstName, u.usage.subtree(srcName)); err != nil {
+		return err
+	}
+	if err := u.backend.MkdirAll(parentName(dstName), 0755); err != nil {
+		return err
+	}
+	if err := u.copyTree(ctx, srcName, dstName, info.Mode().Perm()); err != nil {
+		if _, rerr := u.removeAll(dstName); rerr == nil {
+			u.record(events.Event{Type: events.Remove, Path: dstName, IsDir: true})
+		}
+		return err
+	}
+	return nil
+}
+
+// copyFile copies the file src of size bytes to dst (must be called with
+// mu held).
+func (u *UserFS) copyFile(src, dst string, size int64) error {
+	f, err := u.backend.OpenFile(src, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return u.writeFile(dst, f, size)
+}
+
+// copyTree copies the directory src to dst, which does not exist yet
+// (must be called with mu held).
+func (u *UserFS) copyTree(ctx context.Context, src, dst string, perm os.FileMode) error {
+	if err := u.backend.Mkdir(dst, perm); err != nil {
+		return err
+	}
+	u.record(events.Event{Type: events.Mkdir, Path: dst, IsDir: true})
+	entries, err := u.backend.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if ignoredName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		from, to := joinName(src, e.Name()), joinName(dst, e.Name())
+		switch {
+		case info.IsDir():
+			err = u.copyTree(ctx, from, to, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			err = u.copyFile(from, to, info.Size())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
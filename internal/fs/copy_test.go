@@ -0,0 +1,116 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	iofs "io/fs"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func readString(t *testing.T, ufs *fs.UserFS, name string) string {
+	t.Helper()
+	f, err := ufs.Open(context.Background(), name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestCopy(t *testing.T) {
+	ctx := context.Background()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "100B")
+	server, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+	writeString(t, ufs, "docs/a.txt", "aaaa")
+	writeString(t, ufs, "docs/sub/b.txt", "bbbbbb")
+	writeString(t, ufs, "c.txt", "c")
+
+	if err := ufs.Copy(ctx, "docs", "backup/docs"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, ufs, "backup/docs/sub/b.txt"); got != "bbbbbb" {
+		t.Errorf("copied content = %q", got)
+	}
+	if _, used, _ := ufs.GetQuota(); used != 21 {
+		t.Errorf("used = %d after copying, want 21", used)
+	}
+	if err := ufs.Copy(ctx, "docs/a.txt", "c.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readString(t, ufs, "c.txt"); got != "aaaa" {
+		t.Errorf("replaced content = %q", got)
+	}
+
+	for _, tc := range []struct {
+		src, dst string
+		want     error
+	}{
+		{"docs", "docs/sub/docs", iofs.ErrInvalid},
+		{"docs", "backup/docs", iofs.ErrExist},
+		{"c.txt", "docs", iofs.ErrExist},
+		{"missing", "x", iofs.ErrNotExist},
+		{"docs", "../x", iofs.ErrInvalid},
+	} {
+		if err := ufs.Copy(ctx, tc.src, tc.dst); !errors.Is(err, tc.want) {
+			t.Errorf("Copy(%s, %s) = %v, want %v", tc.src, tc.dst, err, tc.want)
+		}
+	}
+
+	// A tree beyond the quota is not copied at all.
+	writeString(t, ufs, "big/x.bin", string(make([]byte, 40)))
+	if err := ufs.Copy(ctx, "big", "big2"); !errors.Is(err, fs.ErrQuotaExceeded) {
+		t.Errorf("Copy beyond quota = %v", err)
+	}
+	if _, err := ufs.Stat(ctx, "big2"); !errors.Is(err, iofs.ErrNotExist) {
+		t.Errorf("Stat(big2) = %v after a failed copy", err)
+	}
+}
+
+func TestStash(t *testing.T) {
+	ctx := context.Background()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+	writeString(t, ufs, "dir/a.txt", "aaa")
+	ufs.SetAttrs(ctx, "dir/a.txt", fs.Attrs{Tags: []string{"keep"}})
+
+	s, err := ufs.Stash(ctx, "dir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page, _ := ufs.List(ctx, "", fs.ListOptions{}); page.Total != 0 {
+		t.Errorf("listing shows %d entries while stashed", page.Total)
+	}
+	if err := s.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	if attrs, _ := ufs.Attrs(ctx, "dir/a.txt"); readString(t, ufs, "dir/a.txt") != "aaa" || len(attrs.Tags) != 1 {
+		t.Errorf("restored file lost its content or tags: %+v", attrs)
+	}
+
+	cursor := ufs.ChangeCursor()
+	s, _ = ufs.Stash(ctx, "dir")
+	if err := s.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if _, used, _ := ufs.GetQuota(); used != 0 {
+		t.Errorf("used = %d after commit", used)
+	}
+	page, _ := ufs.Changes(ctx, "", cursor, 0)
+	if len(page.Changes) != 1 || page.Changes[0].Type != "remove" || page.Changes[0].Path != "dir" {
+		t.Errorf("changes = %+v, want the removal of dir alone", page.Changes)
+	}
+}
@@ -0,0 +1,494 @@
+package fs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Encrypted files start with a header of cryptMagic and a random file ID,
+// followed by chunks of up to cryptChunkSize plaintext bytes. Each chunk is
+// stored as nonce || AES-GCM ciphertext || tag and authenticated together
+// with the file ID, its index and whether it is the last one, so chunks
+// cannot be swapped between positions or files and a file cut short is
+// detected. The last chunk holds the remainder of the size, possibly
+// nothing. Every chunk write uses a fresh random nonce, which keeps
+// in-place rewrites (WebDAV, 9P) safe. The file key is derived from the
+// user's data key and the file ID with HKDF.
+//
+// Every regular file of an encrypted storage root is encrypted:
+// EncryptStorage converts the files stored before. The plaintext size
+// follows from the on-disk size, so Stat does not need to read anything.
+const (
+	cryptMagic     = "NSSCENC1"
+	cryptIDSize    = 16
+	cryptHeaderLen = int64(len(cryptMagic) + cryptIDSize)
+	cryptChunkSize = 64 << 10
+	cryptNonceSize = 12
+	cryptOverhead  = cryptNonceSize + 16
+	cryptChunkLen  = cryptChunkSize + cryptOverhead
+)
+
+var errCryptCorrupt = errors.New("encrypted file is corrupt")
+
+// logicalSize converts the on-disk size of an encrypted file into its
+// plaintext size.
+func logicalSize(phys int64) int64 {
+	p := phys - cryptHeaderLen
+	if p <= 0 {
+		return 0
+	}
+	size := p / cryptChunkLen * cryptChunkSize
+	if rem := p % cryptChunkLen; rem > cryptOverhead {
+		size += rem - cryptOverhead
+	}
+	return size
+}
+
+// validCryptSize reports whether phys is the on-disk size of a complete
+// encrypted file, which ends with a last chunk of at least the overhead.
+func validCryptSize(phys int64) bool {
+	p := phys - cryptHeaderLen
+	return p >= cryptOverhead && p%cryptChunkLen >= cryptOverhead
+}
+
+// readCryptHeader returns the file ID of an encrypted file.
+func readCryptHeader(f io.ReaderAt) ([]byte, error) {
+	hdr := make([]byte, cryptHeaderLen)
+	if _, err := f.ReadAt(hdr, 0); err != nil {
+		if err == io.EOF {
+			return nil, errCryptCorrupt
+		}
+		return nil, err
+	}
+	if string(hdr[:len(cryptMagic)]) != cryptMagic {
+		return nil, errCryptCorrupt
+	}
+	return hdr[len(cryptMagic):], nil
+}
+
+// cryptInfo reports the plaintext size of an encrypted file.
+type cryptInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (i cryptInfo) Size() int64 { return i.size }
+
+// logicalInfo returns info reporting the plaintext size of regular files.
+func logicalInfo(info fs.FileInfo) fs.FileInfo {
+	if !info.Mode().IsRegular() {
+		return info
+	}
+	return cryptInfo{FileInfo: info, size: logicalSize(info.Size())}
+}
+
+// cryptDirEntry reports the plaintext size of encrypted directory entries.
+type cryptDirEntry struct {
+	fs.DirEntry
+}
+
+func (e cryptDirEntry) Info() (fs.FileInfo, error) {
+	info, err := e.DirEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+	return logicalInfo(info), nil
+}
+
+// cryptFile reads and writes an encrypted file, caching one decrypted chunk.
+type cryptFile struct {
+	f        File
+	aead     cipher.AEAD
+	id       []byte
+	append   bool
+	writable bool
+
+	mu    sync.Mutex
+	size  int64 // plaintext size including unflushed writes
+	phys  int64 // on-disk size
+	final int64 // index of the chunk stored as the last one, or -1
+	pos   int64
+	idx   int64 // index of the chunk held in buf, or -1
+	buf   []byte
+	raw   []byte
+	dirty bool
+}
+
+func newCryptFile(f File, key, id []byte, phys int64, flag int) (*cryptFile, error) {
+	fileKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, id, []byte("nssc chunk key")), fileKey); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(fileKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	final := int64(-1)
+	if phys > cryptHeaderLen {
+		final = (phys - cryptHeaderLen) / cryptChunkLen
+	}
+	return &cryptFile{
+		f:        f,
+		aead:     aead,
+		id:       id,
+		append:   flag&os.O_APPEND != 0,
+		writable: flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND) != 0,
+		size:     logicalSize(phys),
+		phys:     phys,
+		final:    final,
+		idx:      -1,
+		buf:      make([]byte, 0, cryptChunkSize),
+		raw:      make([]byte, cryptChunkLen),
+	}, nil
+}
+
+func chunkOffset(i int64) int64 {
+	return cryptHeaderLen + i*cryptChunkLen
+}
+
+func (c *cryptFile) aad(i int64, final bool) []byte {
+	ad := make([]byte, 0, cryptIDSize+9)
+	ad = append(ad, c.id...)
+	ad = binary.BigEndian.AppendUint64(ad, uint64(i))
+	if final {
+		return append(ad, 1)
+	}
+	return append(ad, 0)
+}
+
+// load makes chunk i the cached chunk, writing back the previous one.
+func (c *cryptFile) load(i int64) error {
+	if c.idx == i {
+		return nil
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	c.idx = -1
+	c.buf = c.buf[:0]
+	if off := chunkOffset(i); off < c.phys {
+		n := min(cryptChunkLen, c.phys-off)
+		if n < cryptOverhead {
+			return errCryptCorrupt
+		}
+		raw := c.raw[:n]
+		if _, err := c.f.ReadAt(raw, off); err != nil {
+			if err == io.EOF {
+				return errCryptCorrupt
+			}
+			return err
+		}
+		pt, err := c.aead.Open(c.buf, raw[:cryptNonceSize], raw[cryptNonceSize:], c.aad(i, i == c.final))
+		if err != nil {
+			return errCryptCorrupt
+		}
+		c.buf = pt
+	}
+	c.idx = i
+	return nil
+}
+
+// flush encrypts the cached chunk with a fresh nonce if it was modified,
+// marking it as the last one if it is at the end of the file.
+func (c *cryptFile) flush() error {
+	if !c.dirty {
+		return nil
+	}
+	nonce := c.raw[:cryptNonceSize]
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	final := c.idx == c.size/cryptChunkSize
+	out := c.aead.Seal(nonce, nonce, c.buf, c.aad(c.idx, final))
+	off := chunkOffset(c.idx)
+	if _, err := c.f.WriteAt(out, off); err != nil {
+		return err
+	}
+	c.phys = max(c.phys, off+int64(len(out)))
+	if final {
+		c.final = c.idx
+	} else if c.final == c.idx {
+		c.final = -1
+	}
+	c.dirty = false
+	return nil
+}
+
+// finalize stores the last chunk of a written file as such.
+func (c *cryptFile) finalize() error {
+	if !c.writable {
+		return nil
+	}
+	if last := c.size / cryptChunkSize; c.final != last {
+		if err := c.load(last); err != nil {
+			return err
+		}
+		c.dirty = true
+	}
+	return c.flush()
+}
+
+func (c *cryptFile) readAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < c.size {
+		if err := c.load(off / cryptChunkSize); err != nil {
+			return n, err
+		}
+		o := off % cryptChunkSize
+		if o >= int64(len(c.buf)) {
+			return n, errCryptCorrupt
+		}
+		m := copy(p[n:], c.buf[o:])
+		n += m
+		off += int64(m)
+	}
+	if n < len(p) {
+		// The end of the file is only trusted once the last chunk,
+		// which may be empty, authenticates as the last one.
+		if err := c.load(c.size / cryptChunkSize); err != nil {
+			return n, err
+		}
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *cryptFile) writeAt(p []byte, off int64) (int, error) {
+	if off > c.size {
+		if err := c.extend(off); err != nil {
+			return 0, err
+		}
+	}
+	n := 0
+	for n < len(p) {
+		if err := c.load(off / cryptChunkSize); err != nil {
+			return n, err
+		}
+		o := int(off % cryptChunkSize)
+		m := min(len(p)-n, cryptChunkSize-o)
+		if o+m > len(c.buf) {
+			c.buf = c.buf[:o+m]
+		}
+		copy(c.buf[o:], p[n:n+m])
+		c.dirty = true
+		n += m
+		off += int64(m)
+		if off > c.size {
+			c.size = off
+		}
+	}
+	return n, nil
+}
+
+// extend zero-fills the file up to size.
+func (c *cryptFile) extend(size int64) error {
+	zeros := make([]byte, cryptChunkSize)
+	for c.size < size {
+		n := min(int64(len(zeros)), size-c.size)
+		if _, err := c.writeAt(zeros[:n], c.size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cryptFile) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.readAt(p, c.pos)
+	c.pos += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (c *cryptFile) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.readAt(p, off)
+}
+
+func (c *cryptFile) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.append {
+		c.pos = c.size
+	}
+	n, err := c.writeAt(p, c.pos)
+	c.pos += int64(n)
+	return n, err
+}
+
+func (c *cryptFile) WriteAt(p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writeAt(p, off)
+}
+
+func (c *cryptFile) Seek(offset int64, whence int) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += c.pos
+	case io.SeekEnd:
+		offset += c.size
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	c.pos = offset
+	return offset, nil
+}
+
+// Truncate changes the plaintext size of the file.
+func (c *cryptFile) Truncate(size int64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size >= c.size {
+		return c.extend(size)
+	}
+	// The chunk holding the new end is stored again as the last one.
+	i, o := size/cryptChunkSize, size%cryptChunkSize
+	if err := c.load(i); err != nil {
+		return err
+	}
+	c.buf = c.buf[:o]
+	c.size = size
+	c.dirty = true
+	if err := c.flush(); err != nil {
+		return err
+	}
+	c.phys = chunkOffset(i) + cryptOverhead + o
+	return c.f.Truncate(c.phys)
+}
+
+func (c *cryptFile) Stat() (fs.FileInfo, error) {
+	info, err := c.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return cryptInfo{FileInfo: info, size: c.size}, nil
+}
+
+func (c *cryptFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return c.f.Readdir(count)
+}
+
+func (c *cryptFile) Close() error {
+	c.mu.Lock()
+	err := c.finalize()
+	c.mu.Unlock()
+	if cerr := c.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// cryptBackend encrypts the regular files of the wrapped Backend.
+type cryptBackend struct {
+	Backend
+	key []byte // user data key
+}
+
+func (b *cryptBackend) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND) != 0
+	innerFlag := flag
+	if writable {
+		// Chunks are read back before being rewritten, and appends are
+		// emulated on top of the plaintext size.
+		innerFlag = flag&^(os.O_WRONLY|os.O_APPEND) | os.O_RDWR
+	}
+	f, err := b.Backend.OpenFile(name, innerFlag, perm)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return f, nil
+	}
+	var id []byte
+	switch {
+	case info.Size() == 0 && writable:
+		id = make([]byte, cryptIDSize)
+		if _, err = rand.Read(id); err == nil {
+			_, err = f.WriteAt(append([]byte(cryptMagic), id...), 0)
+		}
+	case info.Size() == 0:
+		// Nothing was written to the file yet.
+		return f, nil
+	case !writable && !validCryptSize(info.Size()):
+		err = errCryptCorrupt
+	default:
+		id, err = readCryptHeader(f)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	cf, err := newCryptFile(f, b.key, id, max(info.Size(), cryptHeaderLen), flag)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return cf, nil
+}
+
+func (b *cryptBackend) Stat(name string) (fs.FileInfo, error) {
+	info, err := b.Backend.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	return logicalInfo(info), nil
+}
+
+func (b *cryptBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	entries, err := b.Backend.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	for i, e := range entries {
+		entries[i] = cryptDirEntry{DirEntry: e}
+	}
+	return entries, nil
+}
+
+func (b *cryptBackend) Truncate(name string, size int64) error {
+	f, err := b.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (b *cryptBackend) Usage(name string) (int64, error) {
+	return walkUsage(b, name)
+}
@@ -0,0 +1,282 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+// newEncryptedServer encrypts the storage root with key and opens it.
+func newEncryptedServer(t *testing.T, root string, key []byte, userList []users.User, opts ...fs.ServerOption) *fs.UserFSServer {
+	t.Helper()
+	if _, err := fs.EncryptStorage(context.Background(), root, userList, key, opts...); err != nil {
+		t.Fatal(err)
+	}
+	server, err := fs.NewUserFSServer(root, nil, userList, append(opts, fs.WithMasterKey(key))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server
+}
+
+func TestEncryptedStorage(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server := newEncryptedServer(t, root, key, db.Users)
+	ufs, _ := server.GetUserFS("user")
+
+	// Span several chunks with a partial last one.
+	data := bytes.Repeat([]byte("secret data "), 20000)
+	if err := ufs.WriteFile("s.txt", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := os.ReadFile(filepath.Join(ufs.Root(), "s.txt"))
+	if bytes.Contains(raw, []byte("secret")) {
+		t.Fatal("plaintext found on disk")
+	}
+	if info, err := ufs.Stat(ctx, "s.txt"); err != nil || info.Size() != int64(len(data)) {
+		t.Fatalf("Stat size = %v, %v; want %d", info, err, len(data))
+	}
+	if _, used, _ := ufs.GetQuota(); used != int64(len(data)) {
+		t.Errorf("quota used = %d, want logical size %d", used, len(data))
+	}
+
+	// In-place write across a chunk boundary, then a ranged read.
+	f, err := ufs.OpenFile(ctx, "s.txt", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch := []byte("PATCHED")
+	off := int64(64<<10 - 3)
+	f.Seek(off, io.SeekStart)
+	f.Write(patch)
+	f.Close()
+	copy(data[off:], patch)
+
+	r, err := ufs.Open(ctx, "s.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := r.(io.ReadSeeker)
+	rs.Seek(off-10, io.SeekStart)
+	buf := make([]byte, 30)
+	io.ReadFull(rs, buf)
+	r.Close()
+	if !bytes.Equal(buf, data[off-10:off+20]) {
+		t.Errorf("ranged read = %q, want %q", buf, data[off-10:off+20])
+	}
+
+	if err := ufs.Truncate(ctx, "s.txt", 100); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = ufs.Open(ctx, "s.txt")
+	got, _ := io.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, data[:100]) {
+		t.Errorf("after truncate read %d bytes, want first 100", len(got))
+	}
+
+	// Neither the search index nor thumbnails are kept on disk, as they
+	// would show the content in plaintext.
+	writeString(t, ufs, "p.png", pngImage(t, 300, 300, false))
+	if _, err := ufs.Thumbnail(ctx, "p.png", 64); err != nil {
+		t.Fatal(err)
+	}
+	if page, err := ufs.Search(ctx, "", "secret", 0, 0); err != nil || len(page.Results) == 0 {
+		t.Errorf("search = %+v, %v", page, err)
+	}
+	server.Close()
+	for _, dir := range []string{"index", "thumbs"} {
+		if _, err := os.Stat(filepath.Join(root, ".nssc", dir)); !os.IsNotExist(err) {
+			t.Errorf("%s kept on disk: %v", dir, err)
+		}
+	}
+
+	// Restarting without the master key must fail rather than serve ciphertext.
+	if _, err := fs.NewUserFSServer(root, nil, db.Users); err == nil {
+		t.Error("expected error opening encrypted storage without a key")
+	}
+	if _, err := fs.NewUserFSServer(root, nil, db.Users, fs.WithMasterKey(bytes.Repeat([]byte{8}, 32))); err == nil {
+		t.Error("expected error opening encrypted storage with a wrong key")
+	}
+}
+
+func TestEncryptedTruncation(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server := newEncryptedServer(t, root, bytes.Repeat([]byte{7}, 32), db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+	const header, chunk, chunkLen = 24, 64 << 10, 64<<10 + 28
+
+	read := func(name string) ([]byte, error) {
+		f, err := ufs.Open(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return io.ReadAll(f)
+	}
+	for _, size := range []int{0, 100, chunk, 2*chunk + 5} {
+		name := fmt.Sprintf("f%d", size)
+		data := bytes.Repeat([]byte{'x'}, size)
+		if err := ufs.WriteFile(name, bytes.NewReader(data), int64(size)); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := read(name); err != nil || !bytes.Equal(got, data) {
+			t.Fatalf("%s: read %d bytes, %v", name, len(got), err)
+		}
+		onDisk := filepath.Join(root, "user", name)
+		whole, _ := os.ReadFile(onDisk)
+
+		// Cutting the file anywhere, also at a chunk boundary or leaving
+		// what looks like an empty last chunk, is noticed when read.
+		cuts := []int{len(whole) - 1}
+		for k := 0; header+k*chunkLen < len(whole); k++ {
+			cuts = append(cuts, header+k*chunkLen, header+k*chunkLen+28)
+		}
+		for _, cut := range cuts {
+			if cut >= len(whole) {
+				continue
+			}
+			os.WriteFile(onDisk, whole[:cut], 0644)
+			if got, err := read(name); err == nil {
+				t.Errorf("%s cut at %d: read %d bytes without error", name, cut, len(got))
+			}
+		}
+		os.WriteFile(onDisk, whole, 0644)
+	}
+
+	// Growing a file moves the end to a new last chunk.
+	f, err := ufs.OpenFile(ctx, "f100", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(bytes.Repeat([]byte{'y'}, chunk))
+	f.Close()
+	if err := ufs.Truncate(ctx, "f0", chunk); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{
+		"f100": append(bytes.Repeat([]byte{'x'}, 100), bytes.Repeat([]byte{'y'}, chunk)...),
+		"f0":   make([]byte, chunk),
+	}
+	for name, data := range want {
+		if got, err := read(name); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: read %d bytes, %v; want %d bytes", name, len(got), err, len(data))
+		}
+	}
+}
+
+func TestEncryptStorage(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, err := fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufs, _ := server.GetUserFS("user")
+	files := map[string]string{
+		"a.txt":       "plain text",
+		"d/magic.bin": "NSSCENC1 but written before encryption",
+		"d/big.bin":   strings.Repeat("large file ", 20000),
+		"empty.txt":   "",
+	}
+	for name, content := range files {
+		writeString(t, ufs, name, content)
+	}
+	server.Close()
+	storageConfig := filepath.Join(root, ".nssc", "storage.json")
+
+	// A key alone does not turn plain storage into encrypted storage.
+	if _, err := fs.NewUserFSServer(root, nil, db.Users, fs.WithMasterKey(key)); err == nil {
+		t.Fatal("expected error opening plain storage with a key")
+	}
+	if _, err := os.Stat(storageConfig); !os.IsNotExist(err) {
+		t.Errorf("storage config written by a refused start: %v", err)
+	}
+
+	// An interrupted migration keeps every server off the root, and leaves
+	// a copy that is removed when the migration is resumed.
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := fs.EncryptStorage(cancelled, root, db.Users, key); err == nil {
+		t.Fatal("expected error from a cancelled migration")
+	}
+	if _, err := fs.NewUserFSServer(root, nil, db.Users); err == nil {
+		t.Error("expected error opening half-encrypted storage")
+	}
+	if _, err := fs.NewUserFSServer(root, nil, db.Users, fs.WithMasterKey(key)); err == nil {
+		t.Error("expected error opening half-encrypted storage with a key")
+	}
+	os.WriteFile(filepath.Join(root, "user", ".nssc-partial"), []byte("partial"), 0644)
+	os.WriteFile(filepath.Join(root, ".nssc", "encrypt", "user.jsonl"), []byte(`{"name":"a.txt","tmp":".nssc-partial"}`+"\n"), 0600)
+
+	stats, err := fs.EncryptStorage(ctx, root, db.Users, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != len(files) {
+		t.Errorf("encrypted %d files, want %d", stats.Files, len(files))
+	}
+	if _, err := fs.EncryptStorage(ctx, root, db.Users, key); err == nil {
+		t.Error("expected error encrypting encrypted storage")
+	}
+
+	server, err = fs.NewUserFSServer(root, nil, db.Users, fs.WithMasterKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ufs, _ = server.GetUserFS("user")
+	entries, _ := os.ReadDir(filepath.Join(root, "user"))
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".nssc-") {
+			t.Errorf("copy %s left behind", e.Name())
+		}
+	}
+	var total int64
+	for name, content := range files {
+		raw, _ := os.ReadFile(filepath.Join(root, "user", name))
+		if len(content) > 0 && bytes.Contains(raw, []byte(content[:10])) {
+			t.Errorf("%s: plaintext found on disk", name)
+		}
+		f, err := ufs.Open(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(f)
+		f.Close()
+		if err != nil || string(got) != content {
+			t.Errorf("%s: read %d bytes, %v; want %d bytes", name, len(got), err, len(content))
+		}
+		total += int64(len(content))
+	}
+	if _, used, _ := ufs.GetQuota(); used != total {
+		t.Errorf("used = %d, want %d", used, total)
+	}
+	err = ufs.Verify(ctx, func(res fs.VerifyResult) {
+		if res.Status != fs.VerifyOK {
+			t.Errorf("verify %s: %s", res.Path, res.Status)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
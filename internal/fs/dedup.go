@@ -0,0 +1,298 @@
+package fs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+)
+
+// In deduplicated storage every distinct content of a user is stored once
+// under <root>/.nssc/blobs/<user>/<sha[:2]>/<sha>, and files in the user
+// tree are hard links to those blobs. Users never share blobs: linked
+// files share their inode's modification time and mode, which must not
+// leak from one user to another. The link count is the reference count: a blob whose only
+// remaining link is its own entry in the store is garbage. Blobs are
+// immutable, so any in-place change first gives the file its own inode.
+//
+// Quota keeps counting the logical size of every file, so a blob shared by
+// several files still costs the full size for each of them.
+
+// MigrateStats summarises a conversion to deduplicated storage.
+type MigrateStats struct {
+	Files  int   // regular files processed
+	Linked int   // files replaced by a link to an existing blob
+	Saved  int64 // bytes no longer stored more than once
+}
+
+func (s *UserFSServer) blobPath(user, sum string) string {
+	return filepath.Join(s.root, stateDirName, "blobs", user, sum[:2], sum)
+}
+
+// linkBlob makes fullPath share storage with the blob of user for sum, adding
+// fullPath to the store if it is the first copy of that content. It reports
+// whether fullPath was replaced by a link to an already stored blob.
+func (s *UserFSServer) linkBlob(user, fullPath, sum string) (bool, error) {
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, nil
+	}
+	blob := s.blobPath(user, sum)
+	blobInfo, err := os.Stat(blob)
+	if os.IsNotExist(err) {
+		if err := os.MkdirAll(filepath.Dir(blob), 0700); err != nil {
+			return false, err
+		}
+		return false, os.Link(fullPath, blob)
+	}
+	if err != nil {
+		return false, err
+	}
+	if os.SameFile(info, blobInfo) {
+		return false, nil
+	}
+	if blobInfo.Size() != info.Size() {
+		return false, fmt.Errorf("blob %s has size %d, want %d", sum, blobInfo.Size(), info.Size())
+	}
+	tmp := filepath.Join(filepath.Dir(fullPath), ".nssc-"+uuid.NewString())
+	if err := os.Link(blob, tmp); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp, fullPath); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, nil
+}
+
+// releaseBlob removes the blob of user for sum once no file links to it.
+func (s *UserFSServer) releaseBlob(user, sum string) {
+	if sum == "" {
+		return
+	}
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	blob := s.blobPath(user, sum)
+	info, err := os.Stat(blob)
+	if err != nil {
+		return
+	}
+	if linkCount(info) <= 1 {
+		if err := os.Remove(blob); err != nil {
+			log.Printf("Blob %s remove error: %v", sum, err)
+		}
+	}
+}
+
+// gcBlobs removes every blob no user file links to.
+func (s *UserFSServer) gcBlobs() error {
+	dir := filepath.Join(s.root, stateDirName, "blobs")
+	s.blobMu.Lock()
+	defer s.blobMu.Unlock()
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if linkCount(info) <= 1 {
+			return os.Remove(path)
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Migrate switches the storage root to deduplicated mode and converts all
+// existing user files into links to the blob store. The mode is persisted
+// first, so an interrupted migration can simply be run again.
+func (s *UserFSServer) Migrate(ctx context.Context) (MigrateStats, error) {
+	var stats MigrateStats
+	if !dedupSupported {
+		return stats, fmt.Errorf("deduplication is not supported on this platform")
+	}
+	if s.Storage().Encrypt {
+		return stats, fmt.Errorf("encrypted storage cannot be deduplicated")
+	}
+	s.mu.Lock()
+	s.storage.Dedup = true
+	err := s.saveStorageConfig()
+	s.mu.Unlock()
+	if err != nil {
+		return stats, err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for name, ufs := range s.users {
+		if err := ufs.migrate(ctx, &stats); err != nil {
+			return stats, fmt.Errorf("migrate %s: %w", name, err)
+		}
+	}
+	if err := s.gcBlobs(); err != nil {
+		return stats, err
+	}
+	for _, ufs := range s.users {
+		if err := ufs.Sync(); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+func (u *UserFS) migrate(ctx context.Context, stats *MigrateStats) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return fs.WalkDir(u.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fullPath, ok := u.diskPath(name)
+		if !ok {
+			return fmt.Errorf("%s: not stored on local disk", name)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		sum := ""
+		if fm, ok := u.meta.get(name); ok && fm.Size == info.Size() && fm.ModTime.Equal(info.ModTime()) {
+			sum = fm.SHA256
+		}
+		if sum == "" {
+			if sum, err = u.hashFile(name); err != nil {
+				return err
+			}
+		}
+		linked, err := u.server.linkBlob(u.name, fullPath, sum)
+		if err != nil {
+			return err
+		}
+		stats.Files++
+		if linked {
+			stats.Linked++
+			stats.Saved += info.Size()
+		}
+		if info, err = os.Stat(fullPath); err != nil {
+			return err
+		}
+		u.meta.set(name, FileMeta{SHA256: sum, Size: info.Size(), ModTime: info.ModTime()})
+		return nil
+	})
+}
+
+// dedup reports whether the user tree is backed by the blob store.
+func (u *UserFS) dedup() bool {
+	return u.server != nil && u.server.Storage().Dedup
+}
+
+// diskPath returns the local path of name if the tree is kept in a plain
+// directory on disk.
+func (u *UserFS) diskPath(name string) (string, bool) {
+	d, ok := u.backend.(*diskBackend)
+	if !ok {
+		return "", false
+	}
+	fullPath, err := d.path(name)
+	if err != nil {
+		return "", false
+	}
+	return fullPath, true
+}
+
+// detach gives the file name its own inode if it shares a blob, so an
+// in-place change cannot alter other files with the same content. Without
+// keepContent the file is just unlinked, which suits truncating opens.
+func (u *UserFS) detach(name string, keepContent bool) error {
+	if !u.dedup() {
+		return nil
+	}
+	fullPath, ok := u.diskPath(name)
+	if !ok {
+		return nil
+	}
+	u.server.blobMu.Lock()
+	info, err := os.Lstat(fullPath)
+	if err != nil || !info.Mode().IsRegular() || linkCount(info) < 2 {
+		u.server.blobMu.Unlock()
+		return nil
+	}
+	if keepContent {
+		err = copyToOwnInode(fullPath, info)
+	} else {
+		err = os.Remove(fullPath)
+	}
+	u.server.blobMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if fm, ok := u.meta.get(name); ok {
+		u.server.releaseBlob(u.name, fm.SHA256)
+	}
+	return nil
+}
+
+// copyToOwnInode replaces fullPath with a private copy of its content,
+// keeping mode and modification time.
+func copyToOwnInode(fullPath string, info fs.FileInfo) error {
+	src, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	tmp := filepath.Join(filepath.Dir(fullPath), ".nssc-"+uuid.NewString())
+	dst, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chtimes(tmp, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, fullPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// releaseBlobs drops blobs that were only referenced by the given sums'
+// former files.
+func (u *UserFS) releaseBlobs(sums []string) {
+	if !u.dedup() {
+		return
+	}
+	for _, sum := range sums {
+		u.server.releaseBlob(u.name, sum)
+	}
+}
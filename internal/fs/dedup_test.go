@@ -0,0 +1,72 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestDedup(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("alice", "pass", "1GiB")
+	db.AddUser("bob", "pass", "1GiB")
+	server, err := fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := server.GetUserFS("alice")
+	bob, _ := server.GetUserFS("bob")
+
+	data := bytes.Repeat([]byte("archive"), 100)
+	alice.WriteFile("a.bin", bytes.NewReader(data), int64(len(data)))
+
+	stats, err := server.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Files != 1 || stats.Linked != 0 {
+		t.Errorf("Migrate stats = %+v", stats)
+	}
+
+	alice.WriteFile("copy.bin", bytes.NewReader(data), int64(len(data)))
+	bob.WriteFile("b.bin", bytes.NewReader(data), int64(len(data)))
+	aInfo, _ := os.Stat(filepath.Join(alice.Root(), "a.bin"))
+	cInfo, _ := os.Stat(filepath.Join(alice.Root(), "copy.bin"))
+	bInfo, _ := os.Stat(filepath.Join(bob.Root(), "b.bin"))
+	if !os.SameFile(aInfo, cInfo) {
+		t.Fatal("identical uploads are not deduplicated")
+	}
+	// Linked files share their mtime and mode, so users never share blobs.
+	if os.SameFile(aInfo, bInfo) {
+		t.Fatal("files of different users share storage")
+	}
+	if _, used, _ := alice.GetQuota(); used != 2*int64(len(data)) {
+		t.Errorf("alice quota used = %d, want logical size %d", used, 2*len(data))
+	}
+
+	// An in-place write must not leak into the other file.
+	f, err := alice.OpenFile(ctx, "copy.bin", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte("X"))
+	f.Close()
+	got, _ := os.ReadFile(filepath.Join(alice.Root(), "a.bin"))
+	if !bytes.Equal(got, data) {
+		t.Error("write to a deduplicated file changed another copy")
+	}
+
+	alice.RemoveAll(ctx, "a.bin")
+	alice.RemoveAll(ctx, "copy.bin")
+	blobs, _ := filepath.Glob(filepath.Join(root, ".nssc", "blobs", "*", "*", "*"))
+	if len(blobs) != 1 {
+		t.Errorf("blob store holds %d blobs, want only bob's", len(blobs))
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !windows
+
+package fs
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+const dedupSupported = true
+
+// linkCount returns the number of hard links to the file described by info.
+func linkCount(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
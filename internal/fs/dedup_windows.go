@@ -0,0 +1,14 @@
+//go:build windows
+
+package fs
+
+import "io/fs"
+
+// Deduplication relies on hard link counts, which os.FileInfo does not
+// expose on Windows.
+const dedupSupported = false
+
+// linkCount is not implemented on Windows.
+func linkCount(info fs.FileInfo) uint64 {
+	return 1
+}
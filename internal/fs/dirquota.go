@@ -0,0 +1,221 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+
+	"github.com/dustin/go-humanize"
+
+	"nssc/internal/events"
+	"nssc/internal/users"
+)
+
+// defaultSoftLimits are the percentages of a quota at which warnings are
+// raised unless WithSoftLimits says otherwise.
+var defaultSoftLimits = []int{80, 95}
+
+// WithSoftLimits sets the percentages of a quota at which warnings are
+// raised. No percentages disable warnings.
+func WithSoftLimits(percents ...int) ServerOption {
+	return func(s *UserFSServer) {
+		s.softLimits = append([]int(nil), percents...)
+		sort.Ints(s.softLimits)
+	}
+}
+
+// QuotaWarning describes a quota filled beyond a soft limit.
+type QuotaWarning struct {
+	Path    string `json:"path"` // directory the quota applies to, "" for the user quota
+	Used    int64  `json:"used"`
+	Limit   int64  `json:"limit"`
+	Percent int    `json:"percent"` // soft limit reached
+}
+
+func (w QuotaWarning) String() string {
+	return fmt.Sprintf("/%s: %d%% of %s used", w.Path, w.Used*100/w.Limit, humanize.IBytes(uint64(w.Limit)))
+}
+
+// SetDirQuota limits the bytes stored beneath dir. A limit of 0 removes
+// the quota. A quota belongs to the path: it is not carried along when
+// the directory is renamed.
+func (u *UserFS) SetDirQuota(dir string, limit int64) error {
+	name, err := cleanName(dir)
+	if err != nil {
+		return err
+	}
+	if name == "" {
+		return errors.New("the root is limited by the user quota")
+	}
+	u.dirQuotaMu.Lock()
+	defer u.dirQuotaMu.Unlock()
+	if limit <= 0 {
+		delete(u.dirQuotas, name)
+		return nil
+	}
+	if u.dirQuotas == nil {
+		u.dirQuotas = make(map[string]int64)
+	}
+	u.dirQuotas[name] = limit
+	return nil
+}
+
+// setDirQuotas replaces the directory quotas of the tree with limits, as
+// a users database lists them. Invalid entries are logged and skipped.
+func (u *UserFS) setDirQuotas(limits map[string]string) {
+	quotas := make(map[string]int64, len(limits))
+	for dir, limit := range limits {
+		name, err := cleanName(dir)
+		if err == nil && name == "" {
+			err = errors.New("the root is limited by the user quota")
+		}
+		var size uint64
+		if err == nil {
+			size, err = humanize.ParseBytes(limit)
+		}
+		if err != nil {
+			log.Printf("Directory quota %s/%s error: %v", u.name, dir, err)
+			continue
+		}
+		if size > 0 {
+			quotas[name] = int64(size)
+		}
+	}
+	u.dirQuotaMu.Lock()
+	u.dirQuotas = quotas
+	u.dirQuotaMu.Unlock()
+}
+
+// ReloadDirQuotas applies the directory quotas of userList, the users
+// database read again, to the running trees. Users missing from the list
+// keep theirs.
+func (s *UserFSServer) ReloadDirQuotas(userList []users.User) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, user := range userList {
+		if ufs, ok := s.users[user.Name]; ok {
+			ufs.setDirQuotas(user.DirQuotas)
+		}
+	}
+}
+
+// DirQuotas returns the directory quotas of the tree.
+func (u *UserFS) DirQuotas() map[string]int64 {
+	u.dirQuotaMu.RLock()
+	defer u.dirQuotaMu.RUnlock()
+	res := make(map[string]int64, len(u.dirQuotas))
+	for dir, limit := range u.dirQuotas {
+		res[dir] = limit
+	}
+	return res
+}
+
+// quotaDirs returns the directory quotas applying to name.
+func (u *UserFS) quotaDirs(name string) map[string]int64 {
+	u.dirQuotaMu.RLock()
+	defer u.dirQuotaMu.RUnlock()
+	var res map[string]int64
+	for dir, limit := range u.dirQuotas {
+		if under(name, dir) {
+			if res == nil {
+				res = make(map[string]int64)
+			}
+			res[dir] = limit
+		}
+	}
+	return res
+}
+
+// checkDirQuotas returns an error if adding size bytes to name would exceed
+// a directory quota. Quotas that also apply to from, the source of a move,
+// are skipped, as their usage does not change.
+func (u *UserFS) checkDirQuotas(name string, size int64, from string) error {
+	if size <= 0 {
+		return nil
+	}
+	for dir, limit := range u.quotaDirs(name) {
+		if from != "" && under(from, dir) {
+			continue
+		}
+		if remain := limit - u.usage.subtree(dir); remain < size {
+			return fmt.Errorf("directory /%s %w: remain %d < need %d", dir, ErrQuotaExceeded, max(remain, 0), size)
+		}
+	}
+	return nil
+}
+
+// softLimit returns the highest soft limit used bytes of limit reach, or 0.
+func (u *UserFS) softLimit(used, limit int64) int {
+	if u.server == nil || limit <= 0 {
+		return 0
+	}
+	reached := 0
+	for _, p := range u.server.softLimits {
+		if used*100 >= int64(p)*limit {
+			reached = p
+		}
+	}
+	return reached
+}
+
+// warnCrossed logs and publishes a warning for every quota that size bytes
+// just written to files inside dir pushed beyond a soft limit.
+func (u *UserFS) warnCrossed(dir string, size int64) {
+	check := func(path string, used, limit int64) {
+		p := u.softLimit(used, limit)
+		if p == 0 || p == u.softLimit(used-size, limit) {
+			return
+		}
+		w := QuotaWarning{Path: path, Used: used, Limit: limit, Percent: p}
+		log.Printf("Quota warning %s: %s", u.name, w)
+		u.server.events.Publish(events.Event{
+			Type:  events.QuotaWarning,
+			User:  u.name,
+			Path:  path,
+			Size:  used,
+			Limit: limit,
+		})
+	}
+	if total, used, _ := u.quota.Values(); total > 0 {
+		check("", used, total)
+	}
+	for d, limit := range u.quotaDirs(dir) {
+		check(d, u.usage.subtree(d), limit)
+	}
+}
+
+// QuotaWarnings returns the quotas of the tree filled beyond a soft limit.
+func (u *UserFS) QuotaWarnings() []QuotaWarning {
+	return u.quotaWarnings(func(string) bool { return true })
+}
+
+// QuotaWarningsFor returns the quotas applying to name that are filled
+// beyond a soft limit.
+func (u *UserFS) QuotaWarningsFor(name string) []QuotaWarning {
+	name, err := cleanName(name)
+	if err != nil {
+		return nil
+	}
+	return u.quotaWarnings(func(dir string) bool { return under(name, dir) })
+}
+
+func (u *UserFS) quotaWarnings(applies func(dir string) bool) []QuotaWarning {
+	var res []QuotaWarning
+	if total, used, _ := u.quota.Values(); total > 0 {
+		if p := u.softLimit(used, total); p > 0 {
+			res = append(res, QuotaWarning{Used: used, Limit: total, Percent: p})
+		}
+	}
+	for dir, limit := range u.DirQuotas() {
+		if !applies(dir) {
+			continue
+		}
+		used := u.usage.subtree(dir)
+		if p := u.softLimit(used, limit); p > 0 {
+			res = append(res, QuotaWarning{Path: dir, Used: used, Limit: limit, Percent: p})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+	return res
+}
@@ -0,0 +1,114 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"nssc/internal/events"
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestDirQuota(t *testing.T) {
+	ctx := context.Background()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	db.SetDirQuota("user", "camera", "100B")
+	server, err := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+	ch, cancel := server.Events().Subscribe(16)
+	defer cancel()
+
+	if err := ufs.WriteFile("camera/a.jpg", strings.NewReader(strings.Repeat("a", 70)), 70); err != nil {
+		t.Fatal(err)
+	}
+	if w := ufs.QuotaWarnings(); len(w) != 0 {
+		t.Errorf("warnings at 70%% = %v, want none", w)
+	}
+	if e := nextEvent(t, ch); e.Type != events.Create {
+		t.Errorf("event = %+v, want create of camera/a.jpg", e)
+	}
+	// Crossing 80% raises a warning once.
+	if err := ufs.WriteFile("camera/2024/b.jpg", strings.NewReader(strings.Repeat("b", 15)), 15); err != nil {
+		t.Fatal(err)
+	}
+	e := nextEvent(t, ch)
+	if e.Type != events.QuotaWarning || e.Path != "camera" || e.Size != 85 || e.Limit != 100 {
+		t.Errorf("event = %+v, want quota warning for camera", e)
+	}
+	w := ufs.QuotaWarningsFor("camera/2024/b.jpg")
+	if len(w) != 1 || w[0].Percent != 80 || w[0].String() != "/camera: 85% of 100 B used" {
+		t.Errorf("warnings = %v, want camera at 80%%", w)
+	}
+	if w := ufs.QuotaWarningsFor("other.txt"); len(w) != 0 {
+		t.Errorf("warnings outside camera = %v, want none", w)
+	}
+
+	// The hard limit applies to every write path.
+	err = ufs.WriteFile("camera/c.jpg", strings.NewReader(strings.Repeat("c", 20)), 20)
+	if !errors.Is(err, fs.ErrQuotaExceeded) {
+		t.Errorf("WriteFile over limit error = %v, want ErrQuotaExceeded", err)
+	}
+	f, err := ufs.OpenFile(ctx, "camera/a.jpg", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, 200)); !errors.Is(err, fs.ErrQuotaExceeded) {
+		t.Errorf("Write over limit error = %v, want ErrQuotaExceeded", err)
+	}
+	f.Close()
+	if err := ufs.Truncate(ctx, "camera/a.jpg", 1000); !errors.Is(err, fs.ErrQuotaExceeded) {
+		t.Errorf("Truncate over limit error = %v, want ErrQuotaExceeded", err)
+	}
+	ufs.WriteFile("big.bin", strings.NewReader(strings.Repeat("x", 50)), 50)
+	if err := ufs.Rename(ctx, "big.bin", "camera/big.bin"); !errors.Is(err, fs.ErrQuotaExceeded) {
+		t.Errorf("Rename into full directory error = %v, want ErrQuotaExceeded", err)
+	}
+	// Moves within the directory do not count against it.
+	if err := ufs.Rename(ctx, "camera/a.jpg", "camera/2024/a.jpg"); err != nil {
+		t.Errorf("Rename within directory: %v", err)
+	}
+	// Writes elsewhere are only limited by the user quota.
+	if err := ufs.WriteFile("other.txt", strings.NewReader(strings.Repeat("o", 200)), 200); err != nil {
+		t.Errorf("WriteFile outside camera: %v", err)
+	}
+}
+
+func TestReloadDirQuotas(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	db.SetDirQuota("user", "camera", "100B")
+	server, err := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+	write := func(name string, size int) error {
+		return ufs.WriteFile(name, strings.NewReader(strings.Repeat("x", size)), int64(size))
+	}
+	if err := write("camera/a.jpg", 150); !errors.Is(err, fs.ErrQuotaExceeded) {
+		t.Fatalf("write over the quota: error = %v", err)
+	}
+
+	db.SetDirQuota("user", "camera", "")
+	db.SetDirQuota("user", "docs", "100B")
+	db.SetDirQuota("user", "bad", "lots")
+	server.ReloadDirQuotas(db.Users)
+	if got := ufs.DirQuotas(); len(got) != 1 || got["docs"] != 100 {
+		t.Errorf("quotas after reload = %v, want docs only", got)
+	}
+	if err := write("camera/a.jpg", 150); err != nil {
+		t.Errorf("write after the quota was removed: %v", err)
+	}
+	if err := write("docs/a.txt", 150); !errors.Is(err, fs.ErrQuotaExceeded) {
+		t.Errorf("write over the new quota: error = %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package fs
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// diskBackend stores a user tree in a local directory.
+type diskBackend struct {
+	root string
+}
+
+func newDiskBackend(root string) *diskBackend {
+	return &diskBackend{root: root}
+}
+
+// path maps name to a local path, refusing symlinks that lead out of root.
+func (d *diskBackend) path(name string) (string, error) {
+	if name == "" {
+		return d.root, nil
+	}
+	fullPath := filepath.Join(d.root, filepath.FromSlash(name))
+	// Resolve symlinks to prevent path traversal via symlinks.
+	resolved, err := filepath.EvalSymlinks(fullPath)
+	if err != nil {
+		// File may not exist yet (e.g. WriteFile creating new file) — fall back to lexical check.
+		resolved = fullPath
+	}
+	rel, err := filepath.Rel(d.root, resolved)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", fs.ErrInvalid
+	}
+	return fullPath, nil
+}
+
+func (d *diskBackend) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.OpenFile(p, flag, perm)
+}
+
+func (d *diskBackend) Stat(name string) (fs.FileInfo, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (d *diskBackend) ReadDir(name string) ([]fs.DirEntry, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadDir(p)
+}
+
+func (d *diskBackend) Mkdir(name string, perm os.FileMode) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Mkdir(p, perm)
+}
+
+func (d *diskBackend) MkdirAll(name string, perm os.FileMode) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.MkdirAll(p, perm)
+}
+
+func (d *diskBackend) Remove(name string) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d *diskBackend) RemoveAll(name string) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(p)
+}
+
+func (d *diskBackend) Rename(oldName, newName string) error {
+	oldPath, err := d.path(oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := d.path(newName)
+	if err != nil {
+		return err
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (d *diskBackend) Chtimes(name string, atime, mtime time.Time) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Chtimes(p, atime, mtime)
+}
+
+func (d *diskBackend) Truncate(name string, size int64) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Truncate(p, size)
+}
+
+func (d *diskBackend) Usage(name string) (int64, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return 0, err
+	}
+	return DiskUsage(p)
+}
+
+// DiskUsage returns the total size of the files beneath the local
+// directory dir, skipping those it cannot read. It uses fs.WalkDir to avoid
+// the per-entry Lstat call of filepath.Walk.
+func DiskUsage(dir string) (int64, error) {
+	var size int64
+	err := fs.WalkDir(os.DirFS(dir), ".", func(_ string, e fs.DirEntry, err error) error {
+		if err != nil || e == nil || e.IsDir() {
+			return nil
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil
+		}
+		size += info.Size()
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,252 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"nssc/internal/users"
+)
+
+// EncryptStats summarises an encryption migration.
+type EncryptStats struct {
+	Files int   // files encrypted
+	Bytes int64 // plaintext bytes encrypted
+}
+
+// EncryptStorage switches the storage root to encrypted mode with
+// masterKey, rewriting every existing user file encrypted with the data key
+// of its owner. The options select the backend as for NewUserFSServer. The
+// root is marked as being encrypted first, so no server starts on it until
+// the migration is done; an interrupted migration is resumed by running it
+// again. The server must not be running meanwhile.
+func EncryptStorage(ctx context.Context, root string, userList []users.User, masterKey []byte, opts ...ServerOption) (EncryptStats, error) {
+	var stats EncryptStats
+	opts = append(opts, func(s *UserFSServer) { s.encrypting = true })
+	s, err := NewUserFSServer(root, nil, userList, opts...)
+	if err != nil {
+		return stats, err
+	}
+	defer s.Close()
+	switch {
+	case s.masterKey != nil || s.storage.Encrypt:
+		return stats, fmt.Errorf("storage is encrypted already")
+	case s.storage.Dedup:
+		return stats, fmt.Errorf("encryption cannot be combined with deduplicated storage")
+	}
+	s.mu.Lock()
+	s.masterKey = masterKey
+	s.storage.Encrypting = true
+	err = s.saveStorageConfig()
+	s.mu.Unlock()
+	if err != nil {
+		return stats, err
+	}
+
+	s.mu.RLock()
+	for name, ufs := range s.users {
+		key, err := s.userKey(name)
+		if err == nil {
+			err = ufs.encrypt(ctx, &cryptBackend{Backend: ufs.backend, key: key}, s.encryptLogPath(name), &stats)
+		}
+		if err == nil {
+			err = ufs.Sync()
+		}
+		if err != nil {
+			s.mu.RUnlock()
+			return stats, fmt.Errorf("encrypt %s: %w", name, err)
+		}
+	}
+	s.mu.RUnlock()
+
+	s.mu.Lock()
+	s.storage.Encrypt, s.storage.Encrypting = true, false
+	err = s.saveStorageConfig()
+	s.mu.Unlock()
+	if err != nil {
+		return stats, err
+	}
+	// The search indexes and thumbnails hold the content in plaintext.
+	for _, dir := range []string{"encrypt", "index", "thumbs"} {
+		if err := os.RemoveAll(filepath.Join(root, stateDirName, dir)); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// encryptLogPath returns the location of the list of the files of the
+// given user encrypted so far.
+func (s *UserFSServer) encryptLogPath(username string) string {
+	return filepath.Join(s.root, stateDirName, "encrypt", username+".jsonl")
+}
+
+// encryptEntry is a line of the encryption log of a user: the copy tmp of
+// name is about to be written, or, with Done set, is complete and about to
+// replace name.
+type encryptEntry struct {
+	Name string `json:"name"`
+	Tmp  string `json:"tmp"`
+	Done bool   `json:"done,omitempty"`
+}
+
+// encrypt rewrites every plain file of the tree through cb. Each file is
+// encrypted into a copy next to it, then renamed over the original; both
+// steps are recorded in the log at logPath first. A copy left by an
+// interruption is renamed into place if it was complete, and removed
+// otherwise.
+func (u *UserFS) encrypt(ctx context.Context, cb *cryptBackend, logPath string, stats *EncryptStats) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	entries, torn, err := loadEncryptLog(logPath)
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool)
+	for _, e := range entries {
+		if !e.Done {
+			continue
+		}
+		done[e.Name] = true
+		if err := u.backend.Rename(e.Tmp, e.Name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	for _, e := range entries {
+		if !done[e.Name] {
+			if err := u.backend.Remove(e.Tmp); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+		}
+	}
+
+	var names []string
+	err = fs.WalkDir(u.FS(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && !done[name] {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log, err := os.OpenFile(logPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer log.Close()
+	if torn {
+		if _, err := log.Write([]byte("\n")); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		size, err := u.encryptFile(cb, name, log)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		stats.Files++
+		stats.Bytes += size
+	}
+	return nil
+}
+
+// logEncrypt appends e to the encryption log and waits until it is stored.
+func logEncrypt(log *os.File, e encryptEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := log.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return log.Sync()
+}
+
+// encryptFile replaces the plain file name by an encrypted copy, keeping
+// its mode and modification time, and returns its size.
+func (u *UserFS) encryptFile(cb *cryptBackend, name string, log *os.File) (int64, error) {
+	info, err := u.backend.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+	e := encryptEntry{Name: name, Tmp: joinName(parentName(name), ".nssc-"+uuid.NewString())}
+	if err := logEncrypt(log, e); err != nil {
+		return 0, err
+	}
+	src, err := u.backend.OpenFile(name, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	dst, err := cb.OpenFile(e.Tmp, os.O_RDWR|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		u.backend.Remove(e.Tmp)
+		return 0, err
+	}
+	e.Done = true
+	if err := logEncrypt(log, e); err != nil {
+		return 0, err
+	}
+	if err := u.backend.Rename(e.Tmp, name); err != nil {
+		return 0, err
+	}
+	if err := u.backend.Chtimes(name, info.ModTime(), info.ModTime()); err != nil {
+		return 0, err
+	}
+	// Backends that cannot keep the time (S3) change it; the content and
+	// so the checksum are the same.
+	if fm, ok := u.meta.get(name); ok && fm.Size == info.Size() && fm.ModTime.Equal(info.ModTime()) {
+		if now, err := cb.Stat(name); err == nil {
+			fm.ModTime = now.ModTime()
+			u.meta.set(name, fm)
+		}
+	}
+	return info.Size(), nil
+}
+
+// loadEncryptLog reads the entries of the encryption log at path. A last
+// line cut short by an interruption is ignored, as its step was not taken
+// yet, and reported as torn so the next entry starts a new line.
+func loadEncryptLog(path string) (entries []encryptEntry, torn bool, err error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, false, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	lines := strings.Split(string(data), "\n")
+	for _, line := range lines[:len(lines)-1] {
+		var e encryptEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return nil, false, fmt.Errorf("encryption log %s: %w", path, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, lines[len(lines)-1] != "", nil
+}
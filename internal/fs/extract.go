@@ -0,0 +1,228 @@
+package fs
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxIndexFile and maxIndexText bound the work of indexing a file: larger
+// files are indexed by name only, and text beyond the limit is ignored.
+const (
+	maxIndexFile = 32 << 20
+	maxIndexText = 256 << 10
+)
+
+// officeParts are the archive members holding the text of office
+// documents, by extension.
+var officeParts = map[string]string{
+	".odt":  "content.xml",
+	".ods":  "content.xml",
+	".odp":  "content.xml",
+	".docx": "word/document.xml",
+}
+
+// extractText returns the text of the regular file name for indexing, ""
+// if it holds none that can be extracted: binary files, unsupported
+// formats and damaged documents are indexed by name only.
+func (u *UserFS) extractText(name string, size int64) string {
+	if size == 0 || size > maxIndexFile {
+		return ""
+	}
+	u.mu.RLock()
+	f, err := u.backend.OpenFile(name, os.O_RDONLY, 0)
+	u.mu.RUnlock()
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	ext := strings.ToLower(path.Ext(name))
+	if part, ok := officeParts[ext]; ok {
+		return officeText(f, size, part)
+	}
+	if ext == ".pdf" {
+		data, err := io.ReadAll(io.LimitReader(f, size))
+		if err != nil {
+			return ""
+		}
+		return pdfText(data)
+	}
+	data, err := io.ReadAll(io.LimitReader(f, maxIndexText))
+	if err != nil {
+		return ""
+	}
+	return plainText(data)
+}
+
+// plainText returns data as text if it looks like UTF-8 text. A rune cut
+// at the end of data by the read limit is dropped.
+func plainText(data []byte) string {
+	if bytes.IndexByte(data, 0) >= 0 {
+		return ""
+	}
+	for i := 0; i < utf8.UTFMax && len(data) > 0; i++ {
+		if r, size := utf8.DecodeLastRune(data); r != utf8.RuneError || size != 1 {
+			break
+		}
+		data = data[:len(data)-1]
+	}
+	if !utf8.Valid(data) {
+		return ""
+	}
+	return string(data)
+}
+
+// officeText returns the character data of the XML member part of an
+// OpenDocument or Office Open XML archive.
+func officeText(r io.ReaderAt, size int64, part string) string {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return ""
+	}
+	m, err := zr.Open(part)
+	if err != nil {
+		return ""
+	}
+	defer m.Close()
+	var b strings.Builder
+	dec := xml.NewDecoder(io.LimitReader(m, maxIndexFile))
+	for b.Len() < maxIndexText {
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		switch tok := tok.(type) {
+		case xml.CharData:
+			b.Write(tok)
+		case xml.EndElement:
+			// Paragraphs, cells and runs end words.
+			b.WriteByte(' ')
+		}
+	}
+	return b.String()
+}
+
+// pdfText returns the text shown by the content streams of a PDF. It is a
+// best effort: only uncompressed and Flate streams are read, and only
+// literal strings are decoded, which covers documents using standard
+// fonts but not those with embedded CID fonts.
+func pdfText(data []byte) string {
+	var b strings.Builder
+	for b.Len() < maxIndexText {
+		i := bytes.Index(data, []byte("stream"))
+		if i < 0 {
+			break
+		}
+		dict := data[:i]
+		if j := bytes.LastIndex(dict, []byte("<<")); j >= 0 {
+			dict = dict[j:]
+		}
+		data = data[i+len("stream"):]
+		data = bytes.TrimLeft(data, "\r\n")
+		end := bytes.Index(data, []byte("endstream"))
+		if end < 0 {
+			break
+		}
+		stream := data[:end]
+		data = data[end+len("endstream"):]
+		switch {
+		case bytes.Contains(dict, []byte("/FlateDecode")):
+			zr, err := zlib.NewReader(bytes.NewReader(stream))
+			if err != nil {
+				continue
+			}
+			// Truncated streams still yield their decoded prefix.
+			stream, _ = io.ReadAll(io.LimitReader(zr, maxIndexFile))
+		case bytes.Contains(dict, []byte("/Filter")):
+			continue
+		}
+		pdfShowText(&b, stream)
+	}
+	return b.String()
+}
+
+// pdfShowText appends the literal strings shown by the text operators of a
+// content stream to b.
+func pdfShowText(b *strings.Builder, stream []byte) {
+	var pending []string // string operands since the last operator
+	for i := 0; i < len(stream); {
+		c := stream[i]
+		switch {
+		case c == '(':
+			s, n := pdfLiteral(stream[i:])
+			pending = append(pending, s)
+			i += n
+		case c == '%':
+			for i < len(stream) && stream[i] != '\n' && stream[i] != '\r' {
+				i++
+			}
+		case c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c == '\'' || c == '"' || c == '*':
+			j := i
+			for j < len(stream) && (stream[j] >= 'A' && stream[j] <= 'Z' || stream[j] >= 'a' && stream[j] <= 'z' || stream[j] == '*' || stream[j] == '\'' || stream[j] == '"') {
+				j++
+			}
+			switch string(stream[i:j]) {
+			case "Tj", "TJ", "'", "\"":
+				for _, s := range pending {
+					b.WriteString(s)
+				}
+				b.WriteByte(' ')
+			case "T*", "Td", "TD", "ET":
+				b.WriteByte(' ')
+			}
+			pending = pending[:0]
+			i = j
+		default:
+			i++
+		}
+	}
+}
+
+// pdfLiteral decodes the literal string at the start of s, returning it
+// and the bytes consumed.
+func pdfLiteral(s []byte) (string, int) {
+	var b strings.Builder
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '(':
+			if depth > 0 {
+				b.WriteByte(c)
+			}
+			depth++
+		case ')':
+			if depth--; depth == 0 {
+				return b.String(), i + 1
+			}
+			b.WriteByte(c)
+		case '\\':
+			if i++; i >= len(s) {
+				break
+			}
+			switch e := s[i]; e {
+			case 'n', 'r', 't':
+				b.WriteByte(' ')
+			case 'b', 'f', '\n', '\r':
+			case '0', '1', '2', '3', '4', '5', '6', '7':
+				v := 0
+				for k := 0; k < 3 && i < len(s) && s[i] >= '0' && s[i] <= '7'; k++ {
+					v = v*8 + int(s[i]-'0')
+					i++
+				}
+				i--
+				b.WriteRune(rune(v & 0xff)) // PDFDocEncoding matches Latin-1 for text
+			default:
+				b.WriteByte(e)
+			}
+		default:
+			b.WriteRune(rune(c))
+		}
+	}
+	return b.String(), len(s)
+}
@@ -1,9 +1,13 @@
 package fs
 
 type FileEntry struct {
-	Name    string
-	RelPath string
-	IsDir   bool
-	Size    string
-	ModTime string
+	Name     string
+	RelPath  string
+	IsDir    bool
+	Size     string
+	ModTime  string
+	Tags     []string
+	Favorite bool
+	// Thumb is set for images Thumbnail can scale.
+	Thumb bool
 }
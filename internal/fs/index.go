@@ -0,0 +1,646 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// indexDelay batches index updates, so a burst of uploads is indexed in
+// one pass once it settles.
+const indexDelay = 2 * time.Second
+
+// defaultSearchLimit is the number of results returned when the caller
+// does not ask for a specific number.
+const defaultSearchLimit = 50
+
+// indexDoc is the indexed state of a file or directory. Size and ModTime
+// tell whether the entry changed since it was indexed.
+type indexDoc struct {
+	Size    int64          `json:"size"`
+	ModTime time.Time      `json:"mtime"`
+	IsDir   bool           `json:"dir,omitempty"`
+	Terms   map[string]int `json:"terms,omitempty"` // content term → occurrences
+	Length  int            `json:"len,omitempty"`   // content terms in total
+}
+
+// searchIndex is an inverted index over the names and textual content of
+// a tree. Changed paths are queued with invalidate and indexed in the
+// background; only the documents are stored, the postings are rebuilt
+// when the index is loaded.
+type searchIndex struct {
+	path string
+
+	mu       sync.Mutex
+	docs     map[string]*indexDoc
+	postings map[string]map[string]int // term → name → occurrences
+	totalLen int
+	dirty    map[string]bool
+	timer    *time.Timer // pending update
+	saving   *time.Timer // pending save
+
+	update  func()     // indexes the queued paths
+	running sync.Mutex // held by update
+}
+
+// loadSearchIndex loads the index stored at path, "" for an index kept in
+// memory only. The whole tree is queued, so changes made while nssc was
+// not running are picked up by the first update.
+func loadSearchIndex(path string, update func()) *searchIndex {
+	x := &searchIndex{
+		path:     path,
+		docs:     make(map[string]*indexDoc),
+		postings: make(map[string]map[string]int),
+		dirty:    map[string]bool{"": true},
+		update:   update,
+	}
+	if path == "" {
+		return x
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Search index load %s error: %v", path, err)
+		}
+		return x
+	}
+	if err := json.Unmarshal(data, &x.docs); err != nil {
+		log.Printf("Search index load %s error: %v", path, err)
+		x.docs = make(map[string]*indexDoc)
+		return x
+	}
+	for name, doc := range x.docs {
+		x.addPostings(name, doc)
+	}
+	return x
+}
+
+// forEachTerm calls fn with every term of text and its byte range.
+// Terms are lowercased runs of letters and digits of 2 to 64 bytes.
+func forEachTerm(text string, fn func(term string, start, end int)) {
+	start := -1
+	for i, r := range text + " " {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 && i-start <= 64 && utf8.RuneCountInString(text[start:i]) >= 2 {
+			fn(strings.ToLower(text[start:i]), start, i)
+		}
+		start = -1
+	}
+}
+
+// queryTerms returns the distinct terms of a search query.
+func queryTerms(query string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+	forEachTerm(query, func(term string, _, _ int) {
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	})
+	return terms
+}
+
+// addPostings and dropPostings keep the postings in step with docs (must
+// be called with mu held).
+func (x *searchIndex) addPostings(name string, doc *indexDoc) {
+	for term, n := range doc.Terms {
+		p := x.postings[term]
+		if p == nil {
+			p = make(map[string]int)
+			x.postings[term] = p
+		}
+		p[name] = n
+	}
+	x.totalLen += doc.Length
+}
+
+func (x *searchIndex) dropPostings(name string, doc *indexDoc) {
+	for term := range doc.Terms {
+		if p := x.postings[term]; p != nil {
+			if delete(p, name); len(p) == 0 {
+				delete(x.postings, term)
+			}
+		}
+	}
+	x.totalLen -= doc.Length
+}
+
+// put records doc as the indexed state of name.
+func (x *searchIndex) put(name string, doc *indexDoc) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if old, ok := x.docs[name]; ok {
+		x.dropPostings(name, old)
+	}
+	x.docs[name] = doc
+	x.addPostings(name, doc)
+	x.scheduleSave()
+}
+
+// current reports whether name is indexed with the given size and time.
+func (x *searchIndex) current(name string, info os.FileInfo) bool {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	doc, ok := x.docs[name]
+	if !ok || doc.IsDir != info.IsDir() {
+		return false
+	}
+	// The entries of a directory are checked one by one.
+	return doc.IsDir || doc.Size == info.Size() && doc.ModTime.Equal(info.ModTime())
+}
+
+// remove drops name and everything beneath it, except the names in keep.
+func (x *searchIndex) remove(name string, keep map[string]bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for n, doc := range x.docs {
+		if under(n, name) && !keep[n] {
+			x.dropPostings(n, doc)
+			delete(x.docs, n)
+		}
+	}
+	x.scheduleSave()
+}
+
+// rename moves the documents of oldName and everything beneath it to
+// newName, so a moved tree need not be indexed again.
+func (x *searchIndex) rename(oldName, newName string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for n, doc := range x.docs {
+		if under(n, newName) {
+			x.dropPostings(n, doc)
+			delete(x.docs, n)
+		}
+	}
+	moved := make(map[string]*indexDoc)
+	for n, doc := range x.docs {
+		if under(n, oldName) {
+			x.dropPostings(n, doc)
+			delete(x.docs, n)
+			moved[newName+strings.TrimPrefix(n, oldName)] = doc
+		}
+	}
+	for n, doc := range moved {
+		x.docs[n] = doc
+		x.addPostings(n, doc)
+	}
+	x.scheduleSave()
+}
+
+// invalidate queues names for indexing.
+func (x *searchIndex) invalidate(names ...string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, name := range names {
+		x.dirty[name] = true
+	}
+	if x.timer == nil {
+		x.timer = time.AfterFunc(indexDelay, x.update)
+	}
+}
+
+// takeDirty returns the queued names, shortest first, and clears the queue.
+func (x *searchIndex) takeDirty() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.timer != nil {
+		x.timer.Stop()
+		x.timer = nil
+	}
+	names := make([]string, 0, len(x.dirty))
+	for name := range x.dirty {
+		names = append(names, name)
+	}
+	x.dirty = make(map[string]bool)
+	sort.Slice(names, func(i, j int) bool { return len(names[i]) < len(names[j]) })
+	return names
+}
+
+// scheduleSave arms the delayed save (must be called with mu held).
+func (x *searchIndex) scheduleSave() {
+	if x.path == "" || x.saving != nil {
+		return
+	}
+	x.saving = time.AfterFunc(metaSaveDelay, func() {
+		if err := x.save(); err != nil {
+			log.Printf("Search index save %s error: %v", x.path, err)
+		}
+	})
+}
+
+// flush stops the pending update, leaving the queued names to the next
+// search or change, and saves the index.
+func (x *searchIndex) flush() error {
+	x.mu.Lock()
+	if x.timer != nil {
+		x.timer.Stop()
+		x.timer = nil
+	}
+	x.mu.Unlock()
+	return x.save()
+}
+
+// save writes the documents atomically (write-to-tmp + rename).
+func (x *searchIndex) save() error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.saving != nil {
+		x.saving.Stop()
+		x.saving = nil
+	}
+	if x.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(x.docs)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0700); err != nil {
+		return err
+	}
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, x.path)
+}
+
+// updateIndex indexes the paths queued since the last update.
+func (u *UserFS) updateIndex() {
+	u.index.running.Lock()
+	defer u.index.running.Unlock()
+	for _, name := range u.index.takeDirty() {
+		u.indexPath(name)
+	}
+}
+
+// indexPath brings the index of name, and everything beneath it if it is
+// a directory, up to date. Unchanged files are not read again.
+func (u *UserFS) indexPath(name string) {
+	u.mu.RLock()
+	info, err := u.backend.Stat(name)
+	u.mu.RUnlock()
+	if err != nil {
+		u.index.remove(name, nil)
+		return
+	}
+	if !info.IsDir() {
+		u.index.remove(name, nil)
+		u.indexFile(name, info)
+		return
+	}
+	seen := map[string]bool{name: true}
+	if name != "" {
+		u.index.put(name, &indexDoc{IsDir: true, ModTime: info.ModTime()})
+	}
+	queue := []string{name}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		u.mu.RLock()
+		entries, err := u.backend.ReadDir(dir)
+		u.mu.RUnlock()
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			child := joinName(dir, e.Name())
+			if ignoredName(child) {
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			seen[child] = true
+			switch {
+			case info.IsDir():
+				queue = append(queue, child)
+				if !u.index.current(child, info) {
+					u.index.put(child, &indexDoc{IsDir: true, ModTime: info.ModTime()})
+				}
+			case info.Mode().IsRegular() && !u.index.current(child, info):
+				u.indexFile(child, info)
+			}
+		}
+	}
+	u.index.remove(name, seen)
+}
+
+// indexFile indexes the content of the regular file name.
+func (u *UserFS) indexFile(name string, info os.FileInfo) {
+	doc := &indexDoc{Size: info.Size(), ModTime: info.ModTime()}
+	forEachTerm(u.extractText(name, info.Size()), func(term string, _, _ int) {
+		if doc.Terms == nil {
+			doc.Terms = make(map[string]int)
+		}
+		doc.Terms[term]++
+		doc.Length++
+	})
+	u.index.put(name, doc)
+}
+
+// SearchResult is a file or directory matching a search.
+type SearchResult struct {
+	Path    string    `json:"path"` // relative to the user root
+	Name    string    `json:"name"`
+	IsDir   bool      `json:"is_dir"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modified"`
+	Score   float64   `json:"score"`
+	// Snippet is an excerpt of the content around the first match, and
+	// Highlights the byte ranges of the matching words within it.
+	Snippet    string   `json:"snippet,omitempty"`
+	Highlights [][2]int `json:"highlights,omitempty"`
+}
+
+// BM25 parameters and the weight of name matches relative to content.
+const (
+	bm25K1      = 1.2
+	bm25B       = 0.75
+	prefixScore = 0.5 // a term matching the start of a word counts half
+	nameScore   = 3.0
+)
+
+// searchWait caps how long a search waits for the index to catch up with
+// the tree, e.g. while a large tree is indexed for the first time.
+const searchWait = 5 * time.Second
+
+// SearchPage is a page of search results.
+type SearchPage struct {
+	Results []SearchResult `json:"results"`
+	Total   int            `json:"total"` // results on all pages
+	// Partial is set when the index was still being updated when the
+	// search gave up waiting for it, so recent changes may be missing.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// Search returns the entries beneath dir matching query, best first,
+// skipping offset of them and returning at most limit (0 for the
+// default).
+//
+// Every part of the query must match. Words match the name or the
+// content: whole words and, from three letters on, word prefixes; in
+// names they match anywhere. Words containing * ? or [ are patterns for
+// the name. The filters type:, size:, modified:, in:, is: and tag: are
+// described in parseQuery and its helpers. Content matches come with a
+// snippet. Malformed queries fail with ErrBadQuery.
+func (u *UserFS) Search(ctx context.Context, dir, query string, offset, limit int) (SearchPage, error) {
+	var page SearchPage
+	dir, err := cleanName(dir)
+	if err != nil {
+		return page, err
+	}
+	q, err := parseQuery(query, time.Now())
+	if err != nil {
+		return page, err
+	}
+	if q.empty() {
+		return page, nil
+	}
+	if q.hasIn {
+		dir = q.in
+	}
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	page.Partial = !u.waitIndex(ctx)
+
+	x := u.index
+	x.mu.Lock()
+	var scores map[string]float64
+	var content map[string]bool
+	if len(q.words) > 0 {
+		scores, content = x.match(q.words)
+	} else {
+		scores = make(map[string]float64, len(x.docs))
+		for name := range x.docs {
+			scores[name] = 0
+		}
+	}
+	results := make([]SearchResult, 0, len(scores))
+	for name, s := range scores {
+		if !under(name, dir) || name == dir {
+			continue
+		}
+		doc := x.docs[name]
+		var attrs Attrs
+		if q.needsAttrs() {
+			attrs, _ = u.attrs.get(name)
+		}
+		if !q.match(name, doc, attrs) {
+			continue
+		}
+		results = append(results, SearchResult{
+			Path:    name,
+			Name:    baseName(name),
+			IsDir:   doc.IsDir,
+			Size:    doc.Size,
+			ModTime: doc.ModTime,
+			Score:   math.Round(s*1000) / 1000,
+		})
+	}
+	x.mu.Unlock()
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Path < results[j].Path
+	})
+	page.Total = len(results)
+	results = results[min(offset, len(results)):]
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	for i := range results {
+		if ctx.Err() != nil {
+			return page, ctx.Err()
+		}
+		r := &results[i]
+		if content[r.Path] {
+			r.Snippet, r.Highlights = snippet(u.extractText(r.Path, r.Size), q.words)
+		}
+	}
+	page.Results = results
+	return page, nil
+}
+
+// waitIndex brings the index up to date, waiting at most searchWait. It
+// reports whether the update finished; if not, it goes on in the
+// background.
+func (u *UserFS) waitIndex(ctx context.Context) bool {
+	done := make(chan struct{})
+	go func() {
+		u.updateIndex()
+		close(done)
+	}()
+	timer := time.NewTimer(searchWait)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// match scores the entries matching every one of terms in their name or
+// content, and reports which matched in the content (must be called with
+// mu held).
+func (x *searchIndex) match(terms []string) (map[string]float64, map[string]bool) {
+	n := float64(len(x.docs))
+	avgLen := 1.0
+	if len(x.docs) > 0 && x.totalLen > 0 {
+		avgLen = float64(x.totalLen) / n
+	}
+	scores := make(map[string]float64)
+	content := make(map[string]bool)
+	for i, term := range terms {
+		matched := make(map[string]float64)
+		addPosting := func(p map[string]int, weight float64) {
+			idf := math.Log(1 + (n-float64(len(p))+0.5)/(float64(len(p))+0.5))
+			for name, tf := range p {
+				length := float64(x.docs[name].Length)
+				f := float64(tf)
+				s := weight * idf * f * (bm25K1 + 1) / (f + bm25K1*(1-bm25B+bm25B*length/avgLen))
+				if s > matched[name] {
+					matched[name] = s
+				}
+			}
+		}
+		addPosting(x.postings[term], 1)
+		if utf8.RuneCountInString(term) >= 3 {
+			for t, p := range x.postings {
+				if t != term && strings.HasPrefix(t, term) {
+					addPosting(p, prefixScore)
+				}
+			}
+		}
+		found := matched
+		inContent := make(map[string]bool, len(matched))
+		for name := range matched {
+			inContent[name] = true
+		}
+		for name := range x.docs {
+			if strings.Contains(strings.ToLower(baseName(name)), term) {
+				found[name] += nameScore
+			}
+		}
+		// Every term must match, in the name or the content.
+		if i == 0 {
+			scores = found
+			content = inContent
+			continue
+		}
+		for name := range scores {
+			if s, ok := found[name]; ok {
+				scores[name] += s
+			} else {
+				delete(scores, name)
+			}
+			content[name] = content[name] || inContent[name]
+		}
+	}
+	return scores, content
+}
+
+// snippetBefore and snippetAfter are the bytes of context a snippet shows
+// around the first match.
+const (
+	snippetBefore = 60
+	snippetAfter  = 160
+)
+
+// snippet returns an excerpt of text around the first word matching terms,
+// with whitespace collapsed, and the byte ranges of the matching words in
+// it.
+func snippet(text string, terms []string) (string, [][2]int) {
+	matches := func(word string) bool {
+		for _, t := range terms {
+			if word == t || utf8.RuneCountInString(t) >= 3 && strings.HasPrefix(word, t) {
+				return true
+			}
+		}
+		return false
+	}
+	var hits [][2]int
+	forEachTerm(text, func(term string, start, end int) {
+		if matches(term) {
+			hits = append(hits, [2]int{start, end})
+		}
+	})
+	if len(hits) == 0 {
+		return "", nil
+	}
+	from := max(hits[0][0]-snippetBefore, 0)
+	to := min(hits[0][0]+snippetAfter, len(text))
+	// Start and end on whole words.
+	if from > 0 {
+		if i := strings.IndexFunc(text[from:hits[0][0]], unicode.IsSpace); i >= 0 {
+			from += i
+		}
+	}
+	if to < len(text) {
+		if i := strings.LastIndexFunc(text[hits[0][1]:to], unicode.IsSpace); i >= 0 {
+			to = hits[0][1] + i
+		}
+	}
+	for from < hits[0][0] && !utf8.RuneStart(text[from]) {
+		from++
+	}
+	for to < len(text) && !utf8.RuneStart(text[to]) {
+		to++
+	}
+
+	var b strings.Builder
+	var highlights [][2]int
+	if from > 0 {
+		b.WriteString("… ")
+	}
+	h := 0
+	space := false
+	for i, r := range text[from:to] {
+		i += from
+		for h < len(hits) && hits[h][1] <= i {
+			h++
+		}
+		if unicode.IsSpace(r) {
+			space = true
+			continue
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		if h < len(hits) && hits[h][0] == i {
+			highlights = append(highlights, [2]int{b.Len(), b.Len() + hits[h][1] - hits[h][0]})
+		}
+		b.WriteRune(r)
+	}
+	// A match cut by the end of the window is not highlighted.
+	for len(highlights) > 0 && highlights[len(highlights)-1][1] > b.Len() {
+		highlights = highlights[:len(highlights)-1]
+	}
+	if to < len(text) {
+		b.WriteString(" …")
+	}
+	return b.String(), highlights
+}
@@ -0,0 +1,223 @@
+package fs_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+// paths returns the paths of results in order.
+func paths(results []fs.SearchResult) string {
+	var res []string
+	for _, r := range results {
+		res = append(res, r.Path)
+	}
+	return strings.Join(res, " ")
+}
+
+func writeString(t *testing.T, ufs *fs.UserFS, name, content string) {
+	t.Helper()
+	if err := ufs.WriteFile(name, strings.NewReader(content), int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearch(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(root, nil, db.Users)
+	ufs, _ := server.GetUserFS("user")
+
+	writeString(t, ufs, "notes/garden.md", "# Garden\n\nPlant the tomatoes in May.\nWater the\ttomatoes daily.")
+	writeString(t, ufs, "notes/shopping.txt", "milk, bread, tomato sauce")
+	writeString(t, ufs, "src/main.go", "package main\n\nfunc main() { println(\"hello gardener\") }")
+	writeString(t, ufs, "tomatoes.bin", "\x00\x01\x02tomatoes")
+	writeString(t, ufs, "report.odt", odt(t, "Quarterly revenue grew"))
+	writeString(t, ufs, "invoice.pdf", pdf("Invoice total due"))
+
+	search := func(dir, query string) []fs.SearchResult {
+		t.Helper()
+		page, err := ufs.Search(ctx, dir, query, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return page.Results
+	}
+
+	// Binary content is not indexed, the name still is, and names weigh
+	// more than content. Word prefixes match too.
+	if got := paths(search("", "tomatoes")); got != "tomatoes.bin notes/garden.md" {
+		t.Errorf("tomatoes = %s", got)
+	}
+	if got := paths(search("", "tomat")); got != "tomatoes.bin notes/shopping.txt notes/garden.md" {
+		t.Errorf("tomat = %s", got)
+	}
+	// Every word must match, in the name or the content.
+	if got := paths(search("", "garden water")); got != "notes/garden.md" {
+		t.Errorf("garden water = %s", got)
+	}
+	if got := paths(search("", "revenue")); got != "report.odt" {
+		t.Errorf("revenue = %s", got)
+	}
+	if got := paths(search("", "invoice total")); got != "invoice.pdf" {
+		t.Errorf("invoice total = %s", got)
+	}
+	if got := paths(search("src", "garden")); got != "src/main.go" {
+		t.Errorf("garden in src = %s", got)
+	}
+
+	res := search("notes", "daily")
+	if len(res) != 1 {
+		t.Fatalf("daily = %v", res)
+	}
+	if want := "# Garden Plant the tomatoes in May. Water the tomatoes daily."; res[0].Snippet != want {
+		t.Errorf("snippet = %q, want %q", res[0].Snippet, want)
+	}
+	if h := res[0].Highlights; len(h) != 1 || res[0].Snippet[h[0][0]:h[0][1]] != "daily" {
+		t.Errorf("highlights = %v", h)
+	}
+
+	// Changes are picked up.
+	writeString(t, ufs, "notes/shopping.txt", "eggs")
+	ufs.Rename(ctx, "notes", "diary")
+	ufs.RemoveAll(ctx, "tomatoes.bin")
+	if got := paths(search("", "tomatoes")); got != "diary/garden.md" {
+		t.Errorf("tomatoes after changes = %s", got)
+	}
+	if got := paths(search("", "eggs")); got != "diary/shopping.txt" {
+		t.Errorf("eggs = %s", got)
+	}
+
+	// The index is stored and brought up to date on restart.
+	server.Close()
+	server, _ = fs.NewUserFSServer(root, nil, db.Users)
+	defer server.Close()
+	ufs, _ = server.GetUserFS("user")
+	if got := paths(search("", "eggs")); got != "diary/shopping.txt" {
+		t.Errorf("eggs after restart = %s", got)
+	}
+}
+
+func TestSearchSnippetWindow(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+	text := strings.Repeat("lorem ipsum ", 50) + "needle " + strings.Repeat("dolor sit ", 50)
+	writeString(t, ufs, "long.txt", text)
+
+	page, _ := ufs.Search(context.Background(), "", "needle", 0, 1)
+	res := page.Results
+	if len(res) != 1 {
+		t.Fatalf("results = %v", res)
+	}
+	s := res[0].Snippet
+	if !strings.HasPrefix(s, "… ") || !strings.HasSuffix(s, " …") || len(s) > 250 {
+		t.Errorf("snippet = %q", s)
+	}
+	if h := res[0].Highlights; len(h) != 1 || s[h[0][0]:h[0][1]] != "needle" {
+		t.Errorf("highlights = %v in %q", h, s)
+	}
+}
+
+// odt returns an OpenDocument text holding text.
+func odt(t *testing.T, text string) string {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, _ := zw.Create("content.xml")
+	fmt.Fprintf(w, `<?xml version="1.0"?><office:document-content xmlns:office="o" xmlns:text="t"><office:body><text:p>%s</text:p></office:body></office:document-content>`, text)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// pdf returns a minimal PDF showing text in a Flate-compressed content
+// stream.
+func pdf(text string) string {
+	var content bytes.Buffer
+	zw := zlib.NewWriter(&content)
+	words := strings.Fields(text)
+	fmt.Fprintf(zw, "BT /F1 12 Tf 72 712 Td (%s) Tj [(%s) -250 (", words[0], words[1][:2])
+	fmt.Fprintf(zw, "%s)] TJ T* (%s) Tj ET", words[1][2:], strings.Join(words[2:], " "))
+	zw.Close()
+	return fmt.Sprintf("%%PDF-1.4\n4 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream\nendobj\n%%%%EOF\n", content.Len(), content.String())
+}
+
+func TestSearchFilters(t *testing.T) {
+	ctx := context.Background()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+
+	writeString(t, ufs, "photos/beach.jpg", strings.Repeat("j", 3000))
+	writeString(t, ufs, "photos/old/cat.PNG", strings.Repeat("p", 100))
+	writeString(t, ufs, "projects/plan.md", "holiday plan")
+	writeString(t, ufs, "projects/photos.txt", "list of photos")
+	writeString(t, ufs, "notes.txt", "holiday notes")
+	old := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	ufs.Chtimes(ctx, "photos/old/cat.PNG", old, old)
+	ufs.Chtimes(ctx, "notes.txt", old, old)
+	ufs.SetAttrs(ctx, "projects/plan.md", fs.Attrs{Tags: []string{"work"}, Favorite: true})
+
+	for _, tc := range []struct{ query, want string }{
+		{"type:image", "photos/beach.jpg photos/old/cat.PNG"},
+		{"type:png", "photos/old/cat.PNG"},
+		{"type:.md type:txt", "notes.txt projects/photos.txt projects/plan.md"},
+		{"size:>1KB", "photos/beach.jpg"},
+		{"size:<=100B", "notes.txt photos/old/cat.PNG projects/photos.txt projects/plan.md"},
+		{"size:50..200", "photos/old/cat.PNG"},
+		{"modified:<2025-01-01", "notes.txt photos/old/cat.PNG"},
+		{"modified:2024-06-01", "notes.txt photos/old/cat.PNG"},
+		{"modified:>7d is:file", "photos/beach.jpg projects/photos.txt projects/plan.md"},
+		{"is:dir", "photos photos/old projects"},
+		{"is:dir in:/photos", "photos/old"},
+		{"*.txt", "notes.txt projects/photos.txt"},
+		{"name:p*", "photos projects projects/photos.txt projects/plan.md"},
+		{"holiday in:/projects", "projects/plan.md"},
+		{"holiday modified:<2025-01-01", "notes.txt"},
+		{"photos is:file", "projects/photos.txt"},
+		{"is:favorite", "projects/plan.md"},
+		{"tag:work holiday", "projects/plan.md"},
+		{`in:"/photos/old"`, "photos/old/cat.PNG"},
+	} {
+		page, err := ufs.Search(ctx, "", tc.query, 0, 0)
+		if err != nil {
+			t.Errorf("%s: %v", tc.query, err)
+			continue
+		}
+		if got := paths(page.Results); got != tc.want {
+			t.Errorf("%s = %s, want %s", tc.query, got, tc.want)
+		}
+	}
+
+	for _, query := range []string{"size:>lots", "modified:<someday", "is:big", `in:"/photos`, "name:[", "is:dir is:file", "in:../other"} {
+		if _, err := ufs.Search(ctx, "", query, 0, 0); !errors.Is(err, fs.ErrBadQuery) {
+			t.Errorf("%s: error = %v, want ErrBadQuery", query, err)
+		}
+	}
+
+	// Pages.
+	page, _ := ufs.Search(ctx, "", "is:file", 1, 2)
+	if got := paths(page.Results); page.Total != 5 || got != "photos/beach.jpg photos/old/cat.PNG" {
+		t.Errorf("page 2 = %s of %d", got, page.Total)
+	}
+	page, _ = ufs.Search(ctx, "", "is:file", 10, 2)
+	if len(page.Results) != 0 || page.Total != 5 {
+		t.Errorf("page beyond the end = %+v", page)
+	}
+}
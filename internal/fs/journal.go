@@ -0,0 +1,258 @@
+package fs
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"nssc/internal/events"
+)
+
+// maxJournalEntries is how many of the latest changes the journal of a
+// user keeps; cursors older than that have expired.
+const maxJournalEntries = 10_000
+
+// ErrCursorExpired is returned by Changes for cursors that are not
+// covered by the journal any more, or never were. The client has to list
+// the tree again and continue from the latest cursor.
+var ErrCursorExpired = errors.New("change cursor expired")
+
+// Change is an entry of the change journal of a user. Entries are
+// numbered from 1 in the order the changes were made.
+type Change struct {
+	Seq int64 `json:"seq"`
+	events.Event
+}
+
+// ChangePage is a run of journal entries returned by Changes.
+type ChangePage struct {
+	Changes []Change `json:"changes"`
+	// Cursor is the number of the last entry looked at, to continue from.
+	Cursor int64 `json:"cursor"`
+	// More is set if entries after Cursor are waiting already.
+	More bool `json:"has_more"`
+}
+
+// journal is the append-only log of the changes made in a user tree. The
+// latest entries are kept in memory; the file, if any, has one JSON entry
+// per line and is rewritten with the latest entries as it grows.
+type journal struct {
+	mu      sync.Mutex
+	path    string
+	entries []Change // oldest first
+	last    int64    // number of the last entry, 0 for none
+	lines   int      // entries in the file
+	wake    chan struct{}
+}
+
+// loadJournal reads the journal at path, or starts an in-memory one if
+// path is empty.
+func loadJournal(path string) *journal {
+	j := &journal{path: path, wake: make(chan struct{})}
+	if path == "" {
+		return j
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Journal load %s error: %v", path, err)
+		}
+		return j
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	torn := false
+	for sc.Scan() {
+		var c Change
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil || c.Seq <= j.last {
+			// A line cut short by a crash ends the journal; rewriting it
+			// keeps later entries from following the torn line.
+			torn = true
+			break
+		}
+		j.entries = append(j.entries, c)
+		j.last = c.Seq
+		j.lines++
+		if len(j.entries) > 2*maxJournalEntries {
+			j.entries = append([]Change(nil), j.entries[len(j.entries)-maxJournalEntries:]...)
+		}
+	}
+	if torn || len(j.entries) > maxJournalEntries || j.lines > len(j.entries) {
+		j.compact()
+	}
+	return j
+}
+
+// append numbers e and adds it to the journal, waking up waiting readers.
+func (j *journal) append(e events.Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.last++
+	c := Change{Seq: j.last, Event: e}
+	j.entries = append(j.entries, c)
+	close(j.wake)
+	j.wake = make(chan struct{})
+	if j.path == "" {
+		if len(j.entries) > 2*maxJournalEntries {
+			j.entries = append([]Change(nil), j.entries[len(j.entries)-maxJournalEntries:]...)
+		}
+		return
+	}
+	if len(j.entries) > 2*maxJournalEntries {
+		j.compact()
+		return
+	}
+	line, err := json.Marshal(c)
+	if err == nil {
+		err = appendLine(j.path, line)
+	}
+	if err != nil {
+		log.Printf("Journal append %s error: %v", j.path, err)
+		return
+	}
+	j.lines++
+}
+
+// compact keeps the latest maxJournalEntries entries, rewriting the file
+// with them (must be called with mu held, or before j is shared).
+func (j *journal) compact() {
+	if len(j.entries) > maxJournalEntries {
+		j.entries = append([]Change(nil), j.entries[len(j.entries)-maxJournalEntries:]...)
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		log.Printf("Journal compact %s error: %v", j.path, err)
+		return
+	}
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Printf("Journal compact %s error: %v", j.path, err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, c := range j.entries {
+		if err = enc.Encode(c); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		log.Printf("Journal compact %s error: %v", j.path, err)
+		return
+	}
+	j.lines = len(j.entries)
+}
+
+func appendLine(path string, line []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// read returns up to limit entries after cursor concerning dir, and the
+// channel closed when the next entry is appended.
+func (j *journal) read(dir string, cursor int64, limit int) (ChangePage, <-chan struct{}, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	page := ChangePage{Cursor: cursor}
+	first := j.last - int64(len(j.entries)) // the cursor before the oldest entry
+	if cursor < first || cursor > j.last {
+		return page, nil, ErrCursorExpired
+	}
+	for _, c := range j.entries[cursor-first:] {
+		if len(page.Changes) == limit {
+			page.More = true
+			break
+		}
+		page.Cursor = c.Seq
+		if c.Beneath(dir) {
+			page.Changes = append(page.Changes, c)
+		}
+	}
+	return page, j.wake, nil
+}
+
+// since returns the entries after cursor, and false if the journal does
+// not cover cursor.
+func (j *journal) since(cursor int64) ([]Change, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	first := j.last - int64(len(j.entries))
+	if cursor < first || cursor > j.last {
+		return nil, false
+	}
+	return append([]Change(nil), j.entries[cursor-first:]...), true
+}
+
+// record adds a change in the tree to its journal and publishes it on
+// the event bus.
+func (u *UserFS) record(e events.Event) {
+	e.User = u.name
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	u.journal.append(e)
+	if u.server != nil {
+		u.server.events.Publish(e)
+	}
+}
+
+// ChangeCursor returns the cursor of the latest change, from which
+// Changes returns the changes made from now on.
+func (u *UserFS) ChangeCursor() int64 {
+	u.journal.mu.Lock()
+	defer u.journal.mu.Unlock()
+	return u.journal.last
+}
+
+// Changes returns up to limit (0 for 1000) of the changes made beneath
+// dir after cursor, oldest first. If there are none yet, it waits for
+// them until ctx is done, then returns an empty page. Cursors older than
+// the journal fail with ErrCursorExpired.
+func (u *UserFS) Changes(ctx context.Context, dir string, cursor int64, limit int) (ChangePage, error) {
+	name, err := cleanName(dir)
+	if err != nil {
+		return ChangePage{}, err
+	}
+	if limit <= 0 {
+		limit = 1000
+	}
+	for {
+		page, wake, err := u.journal.read(name, cursor, limit)
+		if err != nil || len(page.Changes) > 0 {
+			return page, err
+		}
+		cursor = page.Cursor
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return page, nil
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestChanges(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(root, nil, db.Users)
+	ufs, _ := server.GetUserFS("user")
+
+	start := ufs.ChangeCursor()
+	ufs.Mkdir(ctx, "docs", 0755)
+	writeString(t, ufs, "docs/a.txt", "alpha")
+	writeString(t, ufs, "docs/a.txt", "alpha 2")
+	f, _ := ufs.Create(ctx, "b.txt", 0644)
+	f.Write([]byte("beta"))
+	f.Close()
+	ufs.Rename(ctx, "docs/a.txt", "c.txt")
+	ufs.RemoveAll(ctx, "docs")
+
+	describe := func(page fs.ChangePage) string {
+		var s []string
+		for _, c := range page.Changes {
+			d := string(c.Type) + " " + c.Path
+			if c.OldPath != "" {
+				d += " from " + c.OldPath
+			}
+			s = append(s, d)
+		}
+		return strings.Join(s, ", ")
+	}
+	page, err := ufs.Changes(ctx, "", start, 0)
+	want := "mkdir docs, create docs/a.txt, write docs/a.txt, create b.txt, rename c.txt from docs/a.txt, remove docs"
+	if err != nil || describe(page) != want || page.Cursor != start+6 {
+		t.Fatalf("changes = %s (cursor %d), %v\nwant %s", describe(page), page.Cursor, err, want)
+	}
+
+	page, _ = ufs.Changes(ctx, "docs", start, 2)
+	if describe(page) != "mkdir docs, create docs/a.txt" || !page.More {
+		t.Errorf("docs, 2 = %s, more %v", describe(page), page.More)
+	}
+	page, _ = ufs.Changes(ctx, "docs", page.Cursor, 0)
+	if describe(page) != "write docs/a.txt, rename c.txt from docs/a.txt, remove docs" || page.More {
+		t.Errorf("docs, rest = %s, more %v", describe(page), page.More)
+	}
+
+	// Waiting ends with the next change, or empty when ctx is done.
+	latest := ufs.ChangeCursor()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ufs.MkdirAll(ctx, "new/dir", 0755)
+	}()
+	waitCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	page, _ = ufs.Changes(waitCtx, "", latest, 0)
+	cancel()
+	if describe(page) != "mkdir new/dir" {
+		t.Errorf("waited for %s", describe(page))
+	}
+	waitCtx, cancel = context.WithTimeout(ctx, 10*time.Millisecond)
+	page, err = ufs.Changes(waitCtx, "", page.Cursor, 0)
+	cancel()
+	if err != nil || len(page.Changes) != 0 || page.Cursor != latest+1 {
+		t.Errorf("timed out wait = %+v, %v", page, err)
+	}
+
+	if _, err := ufs.Changes(ctx, "", latest+5, 0); !errors.Is(err, fs.ErrCursorExpired) {
+		t.Errorf("future cursor: error = %v", err)
+	}
+
+	// The journal survives a restart.
+	server.Close()
+	server, _ = fs.NewUserFSServer(root, nil, db.Users)
+	defer server.Close()
+	ufs, _ = server.GetUserFS("user")
+	if got := ufs.ChangeCursor(); got != latest+1 {
+		t.Errorf("cursor after restart = %d, want %d", got, latest+1)
+	}
+	if page, _ := ufs.Changes(ctx, "", start, 1); describe(page) != "mkdir docs" {
+		t.Errorf("after restart = %s", describe(page))
+	}
+}
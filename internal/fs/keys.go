@@ -0,0 +1,112 @@
+package fs
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ServerOption configures optional UserFSServer behaviour.
+type ServerOption func(*UserFSServer)
+
+// WithMasterKey enables encryption at rest. Each user's data key is stored
+// in the state directory, wrapped (AES-GCM) with the master key.
+func WithMasterKey(key []byte) ServerOption {
+	return func(s *UserFSServer) {
+		s.masterKey = key
+	}
+}
+
+// LoadMasterKey reads a 256-bit master key stored as 64 hex characters,
+// e.g. generated with `openssl rand -hex 32`.
+func LoadMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("master key: %w", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("master key: got %d bytes, want 32", len(key))
+	}
+	return key, nil
+}
+
+// wrappedKey is the on-disk form of a user data key.
+type wrappedKey struct {
+	Nonce string `json:"nonce"`
+	Key   string `json:"key"`
+}
+
+func (s *UserFSServer) keyPath(username string) string {
+	return filepath.Join(s.root, stateDirName, "keys", username+".json")
+}
+
+// userKey returns the data key of username, creating one on first use.
+// The username is authenticated with the wrapped key so keys cannot be
+// swapped between users.
+func (s *UserFSServer) userKey(username string) ([]byte, error) {
+	block, err := aes.NewCipher(s.masterKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	path := s.keyPath(username)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var wk wrappedKey
+		if err := json.Unmarshal(data, &wk); err != nil {
+			return nil, err
+		}
+		nonce, err := hex.DecodeString(wk.Nonce)
+		if err != nil || len(nonce) != aead.NonceSize() {
+			return nil, fmt.Errorf("malformed key file %s", path)
+		}
+		ct, err := hex.DecodeString(wk.Key)
+		if err != nil {
+			return nil, fmt.Errorf("malformed key file %s", path)
+		}
+		key, err := aead.Open(nil, nonce, ct, []byte(username))
+		if err != nil {
+			return nil, fmt.Errorf("cannot unwrap data key of %s: wrong master key?", username)
+		}
+		return key, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	data, err = json.MarshalIndent(wrappedKey{
+		Nonce: hex.EncodeToString(nonce),
+		Key:   hex.EncodeToString(aead.Seal(nil, nonce, key, []byte(username))),
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,243 @@
+package fs
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ErrBadSort is returned by List for sort keys it does not know.
+var ErrBadSort = errors.New("invalid sort key")
+
+// ListOptions select, order and page the entries List returns.
+type ListOptions struct {
+	// Sort is "name" (the default), "size", "mtime" or "type"; ties are
+	// broken by name. Type sorts directories first, then by extension.
+	Sort string
+	Desc bool
+	// Tag keeps only the entries carrying the tag, if set.
+	Tag string
+	// Offset entries are skipped and at most Limit returned, 0 for all.
+	Offset, Limit int
+}
+
+// ListEntry is an entry of a directory listing.
+type ListEntry struct {
+	fs.FileInfo
+	Path  string // relative to the user root
+	Attrs Attrs
+}
+
+// ListPage is a page of a directory listing.
+type ListPage struct {
+	Entries []ListEntry
+	// Total counts the entries on all pages, Dirs the directories among them.
+	Total int
+	Dirs  int
+}
+
+// listItem is an entry while a listing is sorted; info is looked up
+// only when the sort needs it or the entry makes the page.
+type listItem struct {
+	entry fs.DirEntry
+	info  fs.FileInfo
+	attrs Attrs
+}
+
+// List returns a page of the entries of the directory path, ordered as
+// opts says. Sorting by name or type reads the entries alone, so large
+// directories page cheaply; size and mtime look every entry up.
+func (u *UserFS) List(ctx context.Context, path string, opts ListOptions) (ListPage, error) {
+	var page ListPage
+	less, needInfo, err := listOrder(opts)
+	if err != nil {
+		return page, err
+	}
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	dir, err := cleanName(path)
+	if err != nil {
+		return page, &fs.PathError{Op: "list", Path: path, Err: fs.ErrInvalid}
+	}
+	entries, err := u.backend.ReadDir(dir)
+	if err != nil {
+		return page, err
+	}
+	items := make([]*listItem, 0, len(entries))
+	for _, e := range entries {
+		it, ok := u.listItem(dir, e, opts.Tag, needInfo)
+		if !ok {
+			continue
+		}
+		if e.IsDir() {
+			page.Dirs++
+		}
+		items = append(items, it)
+	}
+	if err := ctx.Err(); err != nil {
+		return page, err
+	}
+	sort.SliceStable(items, func(i, j int) bool { return less(items[i], items[j]) })
+
+	page.Total = len(items)
+	if opts.Offset >= len(items) {
+		return page, nil
+	}
+	items = items[opts.Offset:]
+	if opts.Limit > 0 && opts.Limit < len(items) {
+		items = items[:opts.Limit]
+	}
+	page.Entries = make([]ListEntry, 0, len(items))
+	for _, it := range items {
+		name := joinName(dir, it.entry.Name())
+		if it.info == nil {
+			if it.info, err = it.entry.Info(); err != nil {
+				continue
+			}
+		}
+		if opts.Tag == "" {
+			it.attrs, _ = u.attrs.get(name)
+		}
+		page.Entries = append(page.Entries, ListEntry{FileInfo: it.info, Path: name, Attrs: it.attrs})
+	}
+	return page, nil
+}
+
+// Neighbours returns the paths of the files before and after the file
+// name in the listing of its directory with opts, "" if there is none.
+// Directories are skipped, and the paging options ignored. Unlike List it
+// picks the two in one pass over the entries, without sorting them.
+func (u *UserFS) Neighbours(ctx context.Context, name string, opts ListOptions) (prev, next string, err error) {
+	less, needInfo, err := listOrder(opts)
+	if err != nil {
+		return "", "", err
+	}
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	name, err = cleanName(name)
+	if err != nil || name == "" {
+		return "", "", &fs.PathError{Op: "list", Path: name, Err: fs.ErrInvalid}
+	}
+	dir := parentName(name)
+	entries, err := u.backend.ReadDir(dir)
+	if err != nil {
+		return "", "", err
+	}
+	var items []*listItem
+	var cur *listItem
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		it, ok := u.listItem(dir, e, opts.Tag, needInfo)
+		if !ok {
+			continue
+		}
+		if joinName(dir, e.Name()) == name {
+			cur = it
+		}
+		items = append(items, it)
+	}
+	if err := ctx.Err(); err != nil {
+		return "", "", err
+	}
+	if cur == nil {
+		return "", "", nil
+	}
+	var before, after *listItem
+	for _, it := range items {
+		switch {
+		case it == cur:
+		case less(it, cur):
+			if before == nil || less(before, it) {
+				before = it
+			}
+		case after == nil || less(it, after):
+			after = it
+		}
+	}
+	if before != nil {
+		prev = joinName(dir, before.entry.Name())
+	}
+	if after != nil {
+		next = joinName(dir, after.entry.Name())
+	}
+	return prev, next, nil
+}
+
+// listItem returns the item of entry e of dir, or false if it is not
+// listed: hidden, without the tag, or gone.
+func (u *UserFS) listItem(dir string, e fs.DirEntry, tag string, needInfo bool) (*listItem, bool) {
+	name := joinName(dir, e.Name())
+	if ignoredName(name) {
+		return nil, false
+	}
+	it := &listItem{entry: e}
+	if tag != "" {
+		if it.attrs, _ = u.attrs.get(name); !it.attrs.HasTag(tag) {
+			return nil, false
+		}
+	}
+	if needInfo {
+		var err error
+		if it.info, err = e.Info(); err != nil {
+			return nil, false
+		}
+	}
+	return it, true
+}
+
+// listOrder returns the order of a listing with opts, and whether it
+// needs the info of every entry.
+func listOrder(opts ListOptions) (less func(a, b *listItem) bool, needInfo bool, err error) {
+	var compare func(a, b *listItem) int
+	switch opts.Sort {
+	case "", "name":
+		compare = func(a, b *listItem) int { return 0 }
+	case "size":
+		compare = func(a, b *listItem) int { return cmp.Compare(entrySize(a), entrySize(b)) }
+	case "mtime":
+		compare = func(a, b *listItem) int { return a.info.ModTime().Compare(b.info.ModTime()) }
+	case "type":
+		compare = func(a, b *listItem) int {
+			if a.entry.IsDir() != b.entry.IsDir() {
+				if a.entry.IsDir() {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(extension(a.entry.Name()), extension(b.entry.Name()))
+		}
+	default:
+		return nil, false, ErrBadSort
+	}
+	less = func(a, b *listItem) bool {
+		if opts.Desc {
+			a, b = b, a
+		}
+		if c := compare(a, b); c != 0 {
+			return c < 0
+		}
+		return a.entry.Name() < b.entry.Name()
+	}
+	return less, opts.Sort == "size" || opts.Sort == "mtime", nil
+}
+
+// entrySize is the size a listing sorts by; directories count as empty.
+func entrySize(it *listItem) int64 {
+	if it.info.IsDir() {
+		return 0
+	}
+	return it.info.Size()
+}
+
+// extension returns the lowercase extension of name, without the dot.
+func extension(name string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+}
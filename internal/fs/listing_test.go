@@ -0,0 +1,122 @@
+package fs_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestList(t *testing.T) {
+	ctx := context.Background()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+
+	writeString(t, ufs, "b.txt", "bb")
+	writeString(t, ufs, "a.go", "aaaa")
+	writeString(t, ufs, "c.md", "c")
+	ufs.Mkdir(ctx, "dir", 0755)
+	now := time.Now()
+	for i, name := range []string{"c.md", "a.go", "b.txt", "dir"} {
+		mtime := now.Add(time.Duration(i) * time.Hour)
+		ufs.Chtimes(ctx, name, mtime, mtime)
+	}
+	ufs.SetAttrs(ctx, "c.md", fs.Attrs{Tags: []string{"red"}})
+
+	names := func(opts fs.ListOptions) []string {
+		t.Helper()
+		page, err := ufs.List(ctx, "/", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range page.Entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+	for _, tc := range []struct {
+		opts fs.ListOptions
+		want []string
+	}{
+		{fs.ListOptions{}, []string{"a.go", "b.txt", "c.md", "dir"}},
+		{fs.ListOptions{Desc: true}, []string{"dir", "c.md", "b.txt", "a.go"}},
+		{fs.ListOptions{Sort: "size"}, []string{"dir", "c.md", "b.txt", "a.go"}},
+		{fs.ListOptions{Sort: "mtime", Desc: true}, []string{"dir", "b.txt", "a.go", "c.md"}},
+		{fs.ListOptions{Sort: "type"}, []string{"dir", "a.go", "c.md", "b.txt"}},
+		{fs.ListOptions{Offset: 1, Limit: 2}, []string{"b.txt", "c.md"}},
+		{fs.ListOptions{Offset: 9}, nil},
+		{fs.ListOptions{Tag: "red"}, []string{"c.md"}},
+	} {
+		if got := names(tc.opts); !slices.Equal(got, tc.want) {
+			t.Errorf("%+v: %v, want %v", tc.opts, got, tc.want)
+		}
+	}
+
+	page, _ := ufs.List(ctx, "/", fs.ListOptions{Limit: 1})
+	if page.Total != 4 || page.Dirs != 1 || page.Entries[0].Path != "a.go" || len(page.Entries[0].Attrs.Tags) != 0 {
+		t.Errorf("page = %+v", page)
+	}
+	if _, err := ufs.List(ctx, "/", fs.ListOptions{Sort: "color"}); !errors.Is(err, fs.ErrBadSort) {
+		t.Errorf("bad sort: error = %v", err)
+	}
+}
+
+func TestNeighbours(t *testing.T) {
+	ctx := context.Background()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+
+	writeString(t, ufs, "d/b.txt", "bb")
+	writeString(t, ufs, "d/a.go", "aaaa")
+	writeString(t, ufs, "d/c.md", "c")
+	writeString(t, ufs, "d/e.md", "eee")
+	ufs.Mkdir(ctx, "d/sub", 0755)
+	ufs.SetAttrs(ctx, "d/c.md", fs.Attrs{Tags: []string{"red"}})
+	ufs.SetAttrs(ctx, "d/a.go", fs.Attrs{Tags: []string{"red"}})
+
+	// The neighbours are those of the files of the full listing.
+	for _, opts := range []fs.ListOptions{
+		{}, {Desc: true}, {Sort: "size"}, {Sort: "size", Desc: true}, {Sort: "type"}, {Tag: "red"},
+	} {
+		page, err := ufs.List(ctx, "d", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, e := range page.Entries {
+			if !e.IsDir() {
+				files = append(files, e.Path)
+			}
+		}
+		for i, name := range files {
+			var wantPrev, wantNext string
+			if i > 0 {
+				wantPrev = files[i-1]
+			}
+			if i+1 < len(files) {
+				wantNext = files[i+1]
+			}
+			prev, next, err := ufs.Neighbours(ctx, name, opts)
+			if err != nil || prev != wantPrev || next != wantNext {
+				t.Errorf("%+v %s: %q, %q, %v; want %q, %q", opts, name, prev, next, err, wantPrev, wantNext)
+			}
+		}
+	}
+	if prev, next, err := ufs.Neighbours(ctx, "d/b.txt", fs.ListOptions{Tag: "red"}); err != nil || prev != "" || next != "" {
+		t.Errorf("untagged file: %q, %q, %v", prev, next, err)
+	}
+	if _, _, err := ufs.Neighbours(ctx, "d/a.go", fs.ListOptions{Sort: "color"}); !errors.Is(err, fs.ErrBadSort) {
+		t.Errorf("bad sort: error = %v", err)
+	}
+}
@@ -0,0 +1,192 @@
+package fs
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metaSaveDelay batches metadata writes so that a burst of uploads results
+// in a single rewrite of the store file.
+const metaSaveDelay = 2 * time.Second
+
+// FileMeta holds per-file metadata kept outside the user tree.
+// Size and ModTime record the file state the checksum was computed for,
+// so a stale checksum can be detected after an out-of-band change.
+type FileMeta struct {
+	SHA256  string    `json:"sha256,omitempty"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+}
+
+// pathStore is a JSON-backed map of slash-separated paths relative to the
+// user root to per-path records, which follow renames and removals. An
+// empty path keeps the store in memory only.
+type pathStore[T any] struct {
+	path  string
+	mu    sync.Mutex
+	files map[string]T
+	timer *time.Timer
+}
+
+// metaStore keeps the FileMeta of a tree.
+type metaStore struct {
+	*pathStore[FileMeta]
+}
+
+func loadMetaStore(path string) (*metaStore, error) {
+	ps, err := loadPathStore[FileMeta](path)
+	if err != nil {
+		return nil, err
+	}
+	return &metaStore{ps}, nil
+}
+
+func loadPathStore[T any](path string) (*pathStore[T], error) {
+	m := &pathStore[T]{path: path, files: make(map[string]T)}
+	if path == "" {
+		return m, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return m, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.files); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// metaKey normalises a client path into a store key.
+func metaKey(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(name)), "/")
+}
+
+func (m *pathStore[T]) get(name string) (T, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fm, ok := m.files[metaKey(name)]
+	return fm, ok
+}
+
+func (m *pathStore[T]) set(name string, fm T) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[metaKey(name)] = fm
+	m.scheduleSave()
+}
+
+// sums returns the checksums recorded for name and everything beneath it.
+func (m *metaStore) sums(name string) []string {
+	key := metaKey(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []string
+	for k, fm := range m.files {
+		if fm.SHA256 != "" && (k == key || key == "" || strings.HasPrefix(k, key+"/")) {
+			res = append(res, fm.SHA256)
+		}
+	}
+	return res
+}
+
+// entries returns the entries for name and everything beneath it.
+func (m *pathStore[T]) entries(name string) map[string]T {
+	key := metaKey(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res := make(map[string]T)
+	for k, fm := range m.files {
+		if k == key || key == "" || strings.HasPrefix(k, key+"/") {
+			res[k] = fm
+		}
+	}
+	return res
+}
+
+// remove drops name and, if it is a directory, everything beneath it.
+func (m *pathStore[T]) remove(name string) {
+	key := metaKey(name)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range m.files {
+		if k == key || key == "" || strings.HasPrefix(k, key+"/") {
+			delete(m.files, k)
+		}
+	}
+	m.scheduleSave()
+}
+
+// rename moves the entries for oldName (and its descendants) to newName.
+func (m *pathStore[T]) rename(oldName, newName string) {
+	oldKey, newKey := metaKey(oldName), metaKey(newName)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Entries already at the destination are replaced by the move.
+	for k := range m.files {
+		if k == newKey || strings.HasPrefix(k, newKey+"/") {
+			delete(m.files, k)
+		}
+	}
+	moved := make(map[string]T)
+	for k, fm := range m.files {
+		switch {
+		case k == oldKey:
+			moved[newKey] = fm
+		case strings.HasPrefix(k, oldKey+"/"):
+			moved[newKey+strings.TrimPrefix(k, oldKey)] = fm
+		default:
+			continue
+		}
+		delete(m.files, k)
+	}
+	for k, fm := range moved {
+		m.files[k] = fm
+	}
+	m.scheduleSave()
+}
+
+// scheduleSave arms the delayed save (must be called with mu held).
+func (m *pathStore[T]) scheduleSave() {
+	if m.path == "" || m.timer != nil {
+		return
+	}
+	m.timer = time.AfterFunc(metaSaveDelay, func() {
+		if err := m.save(); err != nil {
+			log.Printf("Metadata save %s error: %v", m.path, err)
+		}
+	})
+}
+
+// save writes the store atomically (write-to-tmp + rename).
+func (m *pathStore[T]) save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.timer != nil {
+		m.timer.Stop()
+		m.timer = nil
+	}
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(m.files)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0700); err != nil {
+		return err
+	}
+	tmp := m.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.path)
+}
@@ -0,0 +1,151 @@
+package fs
+
+import (
+	"strings"
+	"sync"
+)
+
+// openSize is the size charged to quota for a file open for writing. All
+// handles of the file share it, so overwrites, seeks back and writes
+// through several handles are charged only for the growth of the file.
+type openSize struct {
+	name string // current name, followed across renames
+	size int64  // bytes charged: the high-water mark of writes or the size last set
+	refs int
+	gone bool // removed or replaced; further writes are not charged
+}
+
+// openSizes tracks the files of a tree open for writing.
+type openSizes struct {
+	mu    sync.Mutex
+	files map[string]*openSize
+}
+
+func newOpenSizes() *openSizes {
+	return &openSizes{files: make(map[string]*openSize)}
+}
+
+// acquire registers a handle of name, whose size after opening is size.
+func (o *openSizes) acquire(name string, size int64) *openSize {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	st, ok := o.files[name]
+	if !ok {
+		st = &openSize{name: name}
+		o.files[name] = st
+	}
+	st.refs++
+	st.size = size
+	return st
+}
+
+// release unregisters a handle. It reports whether it was the last one of
+// a file still in the tree, returning the file's name and charged size.
+func (o *openSizes) release(st *openSize) (string, int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if st.refs--; st.refs > 0 || st.gone {
+		return "", 0, false
+	}
+	delete(o.files, st.name)
+	return st.name, st.size, true
+}
+
+// lookup returns the charged size of name if it is open for writing.
+func (o *openSizes) lookup(name string) (int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if st, ok := o.files[name]; ok {
+		return st.size, true
+	}
+	return 0, false
+}
+
+// set records that name, if open for writing, now has size bytes.
+func (o *openSizes) set(name string, size int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if st, ok := o.files[name]; ok {
+		st.size = size
+	}
+}
+
+// current returns the name of st and the size charged for it, and false
+// if the file left the tree.
+func (o *openSizes) current(st *openSize) (string, int64, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return st.name, st.size, !st.gone
+}
+
+// growth returns the name of st and the bytes growing it to end would add.
+func (o *openSizes) growth(st *openSize, end int64) (string, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if st.gone || end <= st.size {
+		return st.name, 0
+	}
+	return st.name, end - st.size
+}
+
+// grow raises the high-water mark of st to end, returning the name of
+// the file and the bytes to charge for it.
+func (o *openSizes) grow(st *openSize, end int64) (string, int64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if st.gone || end <= st.size {
+		return st.name, 0
+	}
+	delta := end - st.size
+	st.size = end
+	return st.name, delta
+}
+
+// drop detaches name and everything beneath it: their handles no longer
+// charge quota.
+func (o *openSizes) drop(name string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for n, st := range o.files {
+		if under(n, name) {
+			st.gone = true
+			delete(o.files, n)
+		}
+	}
+}
+
+// move follows a rename of oldName, a file or a directory, to newName.
+// Open files replaced by the rename are detached.
+func (o *openSizes) move(oldName, newName string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if st, ok := o.files[newName]; ok {
+		st.gone = true
+		delete(o.files, newName)
+	}
+	moved := make(map[string]*openSize)
+	for n, st := range o.files {
+		if under(n, oldName) {
+			st.name = newName + strings.TrimPrefix(n, oldName)
+			moved[st.name] = st
+			delete(o.files, n)
+		}
+	}
+	for n, st := range moved {
+		o.files[n] = st
+	}
+}
+
+// fileSize returns the size charged for the regular file name: the
+// tracked size while it is open for writing, its stored size otherwise,
+// and 0 if it does not exist.
+func (u *UserFS) fileSize(name string) int64 {
+	if size, ok := u.open.lookup(name); ok {
+		return size
+	}
+	info, err := u.backend.Stat(name)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
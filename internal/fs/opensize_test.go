@@ -0,0 +1,118 @@
+package fs_test
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+// checkUsage fails the test unless the quota usage of ufs matches the
+// files stored in dir.
+func checkUsage(t *testing.T, ufs *fs.UserFS, dir, step string) {
+	t.Helper()
+	stored, err := fs.DiskUsage(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, used, _ := ufs.GetQuota(); used != stored {
+		t.Errorf("%s: used = %d, stored %d", step, used, stored)
+	}
+}
+
+func TestOpenFileAccounting(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, err := fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+	dir := filepath.Join(root, "user")
+
+	ufs.WriteFile("doc.txt", strings.NewReader(strings.Repeat("a", 100)), 100)
+
+	// Overwriting a region and seeking back charge nothing.
+	f, err := ufs.OpenFile(ctx, "doc.txt", os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 60))
+	f.Seek(0, io.SeekStart)
+	f.Write(make([]byte, 60))
+	f.(io.WriterAt).WriteAt(make([]byte, 10), 95)
+	checkUsage(t, ufs, dir, "in-place writes")
+	// A second handle of the same file shares the charged size.
+	g, _ := ufs.OpenFile(ctx, "doc.txt", os.O_WRONLY, 0)
+	g.(io.WriterAt).WriteAt(make([]byte, 20), 90)
+	g.Close()
+	f.Close()
+	checkUsage(t, ufs, dir, "two handles")
+
+	// Truncating while open and rewriting the truncated region.
+	f, _ = ufs.OpenFile(ctx, "doc.txt", os.O_RDWR, 0)
+	if err := ufs.Truncate(ctx, "doc.txt", 10); err != nil {
+		t.Fatal(err)
+	}
+	f.(io.WriterAt).WriteAt(make([]byte, 50), 0)
+	checkUsage(t, ufs, dir, "write after truncate")
+	f.Close()
+	checkUsage(t, ufs, dir, "close after truncate")
+
+	// O_TRUNC and Create credit the old content.
+	f, _ = ufs.OpenFile(ctx, "doc.txt", os.O_RDWR|os.O_TRUNC, 0)
+	checkUsage(t, ufs, dir, "O_TRUNC")
+	f.Write([]byte("abc"))
+	f.Close()
+	f, _ = ufs.Create(ctx, "doc.txt", 0644)
+	checkUsage(t, ufs, dir, "Create over file")
+	f.Write([]byte("abcdef"))
+	f.Close()
+
+	// Appends are settled with the stored size.
+	f, _ = ufs.OpenFile(ctx, "doc.txt", os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte("ghi"))
+	f.Write([]byte("jkl"))
+	f.Close()
+	checkUsage(t, ufs, dir, "append")
+
+	// Renaming or removing an open file.
+	ufs.MkdirAll(ctx, "sub", 0755)
+	f, _ = ufs.OpenFile(ctx, "doc.txt", os.O_RDWR, 0)
+	if err := ufs.Rename(ctx, "doc.txt", "sub/doc.txt"); err != nil {
+		t.Fatal(err)
+	}
+	f.(io.WriterAt).WriteAt(make([]byte, 40), 0)
+	f.Close()
+	checkUsage(t, ufs, dir, "write after rename")
+	f, _ = ufs.OpenFile(ctx, "sub/doc.txt", os.O_RDWR, 0)
+	ufs.Remove(ctx, "sub/doc.txt")
+	f.(io.WriterAt).WriteAt(make([]byte, 100), 0)
+	f.Close()
+	checkUsage(t, ufs, dir, "write after remove")
+
+	// Quota is only needed for growth.
+	small, _ := fs.NewUserFSServer(t.TempDir(), nil, []users.User{{Name: "user", Quota: "100B"}})
+	defer small.Close()
+	ufs, _ = small.GetUserFS("user")
+	ufs.WriteFile("full.bin", strings.NewReader(strings.Repeat("x", 100)), 100)
+	f, _ = ufs.OpenFile(ctx, "full.bin", os.O_RDWR, 0)
+	if _, err := f.Write(make([]byte, 100)); err != nil {
+		t.Errorf("overwrite of full quota: %v", err)
+	}
+	if _, err := f.Write([]byte("x")); err == nil {
+		t.Error("growth beyond quota accepted")
+	}
+	f.Close()
+	if _, used, _ := ufs.GetQuota(); used != 100 {
+		t.Errorf("used = %d, want 100", used)
+	}
+}
@@ -0,0 +1,316 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/dustin/go-humanize"
+)
+
+// ErrBadQuery is returned by Search for queries it cannot parse.
+var ErrBadQuery = errors.New("invalid search query")
+
+// typeExts are the extensions of the file types type: accepts besides
+// plain extensions.
+var typeExts = map[string][]string{
+	"image":    {"jpg", "jpeg", "png", "gif", "webp", "bmp", "svg", "tif", "tiff", "heic", "ico"},
+	"video":    {"mp4", "mkv", "webm", "avi", "mov", "m4v", "mpg", "mpeg"},
+	"audio":    {"mp3", "flac", "ogg", "oga", "opus", "wav", "m4a", "aac"},
+	"document": {"pdf", "odt", "ods", "odp", "doc", "docx", "xls", "xlsx", "ppt", "pptx", "rtf", "epub"},
+	"archive":  {"zip", "tar", "gz", "tgz", "bz2", "xz", "zst", "7z", "rar"},
+	"text": {"txt", "md", "csv", "json", "xml", "yaml", "yml", "toml", "ini", "log", "html", "css",
+		"js", "ts", "go", "py", "rb", "rs", "c", "h", "cpp", "hpp", "java", "sh"},
+}
+
+// searchQuery is a parsed search query. Every part given must match.
+type searchQuery struct {
+	words []string // terms looked up in the full-text index
+	names []string // lowercase glob patterns for the base name
+	types map[string]bool
+	// minSize and maxSize bound file sizes, -1 for no bound.
+	minSize, maxSize int64
+	// from and to bound modification times to [from, to); zero for no bound.
+	from, to time.Time
+	in       string // scope, relative to the user root
+	hasIn    bool
+	isDir    bool
+	isFile   bool
+	favorite bool
+	tags     []string
+}
+
+// parseQuery parses a search query: words, name patterns containing * ?
+// or [, and key:value filters. Relative dates are taken from now.
+func parseQuery(s string, now time.Time) (*searchQuery, error) {
+	q := &searchQuery{minSize: -1, maxSize: -1}
+	fields, err := splitQuery(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		key, value, ok := strings.Cut(f, ":")
+		if !ok || value == "" {
+			q.addWord(f)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "name":
+			err = q.addName(value)
+		case "type":
+			q.addType(value)
+		case "size":
+			err = q.parseSize(value)
+		case "modified":
+			err = q.parseModified(value, now)
+		case "in":
+			if q.in, err = cleanName(value); err != nil {
+				err = fmt.Errorf("%w: in:%s is outside the tree", ErrBadQuery, value)
+			}
+			q.hasIn = true
+		case "is":
+			switch strings.ToLower(value) {
+			case "dir", "folder":
+				q.isDir = true
+			case "file":
+				q.isFile = true
+			case "favorite", "fav":
+				q.favorite = true
+			default:
+				err = fmt.Errorf("%w: unknown is:%s", ErrBadQuery, value)
+			}
+		case "tag":
+			q.tags = append(q.tags, strings.ToLower(value))
+		default:
+			// Not a filter, e.g. a URL.
+			q.addWord(f)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if q.isDir && q.isFile {
+		return nil, fmt.Errorf("%w: is:dir and is:file exclude each other", ErrBadQuery)
+	}
+	return q, nil
+}
+
+// splitQuery splits s at spaces outside double quotes, dropping the
+// quotes.
+func splitQuery(s string) ([]string, error) {
+	var (
+		fields []string
+		b      strings.Builder
+		quoted bool
+		inWord bool
+	)
+	for _, r := range s {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			inWord = true
+		case unicode.IsSpace(r) && !quoted:
+			if inWord {
+				fields = append(fields, b.String())
+				b.Reset()
+			}
+			inWord = false
+		default:
+			b.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("%w: unterminated quote", ErrBadQuery)
+	}
+	if inWord {
+		fields = append(fields, b.String())
+	}
+	return fields, nil
+}
+
+func (q *searchQuery) addWord(w string) {
+	if strings.ContainsAny(w, "*?[") && q.addName(w) == nil {
+		return
+	}
+	q.words = append(q.words, queryTerms(w)...)
+}
+
+func (q *searchQuery) addName(pattern string) error {
+	pattern = strings.ToLower(pattern)
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("%w: name pattern %q: %v", ErrBadQuery, pattern, err)
+	}
+	q.names = append(q.names, pattern)
+	return nil
+}
+
+func (q *searchQuery) addType(t string) {
+	if q.types == nil {
+		q.types = make(map[string]bool)
+	}
+	t = strings.ToLower(strings.TrimPrefix(t, "."))
+	exts, ok := typeExts[t]
+	if !ok {
+		exts = []string{t}
+	}
+	for _, ext := range exts {
+		q.types["."+ext] = true
+	}
+}
+
+// cutOp splits a comparison operator off the start of s.
+func cutOp(s string) (string, string) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if rest, ok := strings.CutPrefix(s, op); ok {
+			return op, rest
+		}
+	}
+	return "=", s
+}
+
+// parseSize parses size:[op]N or size:N..M, with N and M in any unit
+// humanize understands (100MB, 1.5GiB, 512k).
+func (q *searchQuery) parseSize(s string) error {
+	parse := func(v string) (int64, error) {
+		n, err := humanize.ParseBytes(v)
+		if err != nil {
+			return 0, fmt.Errorf("%w: size %q", ErrBadQuery, v)
+		}
+		return int64(n), nil
+	}
+	if lo, hi, ok := strings.Cut(s, ".."); ok {
+		from, err := parse(lo)
+		if err != nil {
+			return err
+		}
+		to, err := parse(hi)
+		if err != nil {
+			return err
+		}
+		q.minSize, q.maxSize = from, to
+		return nil
+	}
+	op, v := cutOp(s)
+	n, err := parse(v)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case ">":
+		q.minSize = n + 1
+	case ">=":
+		q.minSize = n
+	case "<":
+		q.maxSize = n - 1
+	case "<=":
+		q.maxSize = n
+	default:
+		q.minSize, q.maxSize = n, n
+	}
+	return nil
+}
+
+// parseModified parses modified:[op]when. when is a date (2025-01-01),
+// which stands for the whole day, a time (2025-01-01T15:04) or a span
+// back from now (7d, 2w, 12h); modified:>7d means within the last week.
+func (q *searchQuery) parseModified(s string, now time.Time) error {
+	op, v := cutOp(s)
+	start, end, err := parseWhen(v, now)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "<":
+		q.to = start
+	case "<=":
+		q.to = end
+	case ">":
+		q.from = end
+	case ">=":
+		q.from = start
+	default:
+		q.from, q.to = start, end
+	}
+	return nil
+}
+
+// parseWhen returns the period [start, end) a modified: value stands for.
+func parseWhen(v string, now time.Time) (time.Time, time.Time, error) {
+	switch strings.ToLower(v) {
+	case "today":
+		v = now.Format(time.DateOnly)
+	case "yesterday":
+		v = now.AddDate(0, 0, -1).Format(time.DateOnly)
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, v, now.Location()); err == nil {
+		return t, t.AddDate(0, 0, 1), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, v, now.Location()); err == nil {
+			return t, t.Add(time.Nanosecond), nil
+		}
+	}
+	units := map[byte]time.Duration{'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}
+	if len(v) > 1 {
+		if unit, ok := units[v[len(v)-1]]; ok {
+			if n, err := strconv.Atoi(v[:len(v)-1]); err == nil && n >= 0 {
+				t := now.Add(-time.Duration(n) * unit)
+				return t, t.Add(time.Nanosecond), nil
+			}
+		}
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("%w: date %q", ErrBadQuery, v)
+}
+
+// empty reports whether q matches nothing because it asks for nothing.
+func (q *searchQuery) empty() bool {
+	return len(q.words) == 0 && len(q.names) == 0 && q.types == nil &&
+		q.minSize < 0 && q.maxSize < 0 && q.from.IsZero() && q.to.IsZero() &&
+		!q.hasIn && !q.isDir && !q.isFile && !q.favorite && len(q.tags) == 0
+}
+
+// needsAttrs reports whether matching needs the attributes of entries.
+func (q *searchQuery) needsAttrs() bool {
+	return q.favorite || len(q.tags) > 0
+}
+
+// match reports whether the indexed entry name satisfies the filters of
+// q. The words are matched by the index.
+func (q *searchQuery) match(name string, doc *indexDoc, attrs Attrs) bool {
+	base := strings.ToLower(baseName(name))
+	for _, pattern := range q.names {
+		if ok, _ := path.Match(pattern, base); !ok {
+			return false
+		}
+	}
+	if q.isDir && !doc.IsDir || q.isFile && doc.IsDir {
+		return false
+	}
+	// Sizes and types only apply to files.
+	if q.types != nil && (doc.IsDir || !q.types[path.Ext(base)]) {
+		return false
+	}
+	if (q.minSize >= 0 || q.maxSize >= 0) && doc.IsDir {
+		return false
+	}
+	if q.minSize >= 0 && doc.Size < q.minSize || q.maxSize >= 0 && doc.Size > q.maxSize {
+		return false
+	}
+	if !q.from.IsZero() && doc.ModTime.Before(q.from) || !q.to.IsZero() && !doc.ModTime.Before(q.to) {
+		return false
+	}
+	if q.favorite && !attrs.Favorite {
+		return false
+	}
+	for _, tag := range q.tags {
+		if !attrs.HasTag(tag) {
+			return false
+		}
+	}
+	return true
+}
@@ -1,9 +1,24 @@
 package fs
 
 import (
+	"errors"
 	"sync"
 )
 
+var (
+	// ErrQuotaExceeded is returned, wrapped, by writes that do not fit in a quota.
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrReserve is returned, wrapped, by writes that would eat into the
+	// free disk space kept in reserve.
+	ErrReserve = errors.New("free space reserve reached")
+)
+
+// IsInsufficientStorage reports whether err rejected a write for lack of
+// quota or disk space.
+func IsInsufficientStorage(err error) bool {
+	return errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrReserve)
+}
+
 // Represents the FS quota
 type Quota struct {
 	total  int64
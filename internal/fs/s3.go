@@ -0,0 +1,902 @@
+package fs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// S3 keeps every file of a user tree as an object named
+// <prefix><user>/<name>. Directories are zero-length marker objects whose
+// names end in "/"; directories implied by deeper objects are listed too.
+// Objects cannot be modified in place, so files opened for writing are
+// spooled to a local temporary file and uploaded on Close.
+//
+// Modification times are the object's Last-Modified time truncated to
+// seconds; Chtimes is accepted but has no effect.
+
+// s3ReadAhead is the minimum range fetched by a ranged GET, so small
+// sequential reads do not each become a request.
+const s3ReadAhead = 1 << 20
+
+// S3Config describes an S3-compatible bucket holding user trees.
+type S3Config struct {
+	Endpoint  string // scheme and host, e.g. https://s3.example.com:9000
+	Region    string
+	Bucket    string
+	Prefix    string // key prefix inside the bucket, "" or ending in "/"
+	AccessKey string
+	SecretKey string
+	Client    *http.Client // http.DefaultClient if nil
+}
+
+// ParseS3URL parses http(s)://host[:port]/bucket[/prefix][?region=name].
+// Credentials are taken from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func ParseS3URL(raw string) (S3Config, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return S3Config{}, fmt.Errorf("s3 url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return S3Config{}, fmt.Errorf("s3 url: unsupported scheme %q", u.Scheme)
+	}
+	bucket, prefix, _ := strings.Cut(strings.Trim(u.Path, "/"), "/")
+	if bucket == "" {
+		return S3Config{}, fmt.Errorf("s3 url: missing bucket")
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	region := u.Query().Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return S3Config{
+		Endpoint:  u.Scheme + "://" + u.Host,
+		Region:    region,
+		Bucket:    bucket,
+		Prefix:    prefix,
+		AccessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+	}, nil
+}
+
+// S3Backends returns a BackendFactory keeping each user tree under its own
+// key prefix in the bucket described by cfg.
+func S3Backends(cfg S3Config) BackendFactory {
+	c := &s3Client{cfg: cfg}
+	return func(username string) (Backend, error) {
+		if username == "" || strings.ContainsAny(username, "/\\") {
+			return nil, fmt.Errorf("s3: invalid user name %q", username)
+		}
+		return &s3Backend{c: c, prefix: cfg.Prefix + username + "/"}, nil
+	}
+}
+
+// s3Client issues SigV4-signed path-style requests.
+type s3Client struct {
+	cfg S3Config
+}
+
+// s3Object is an entry of a bucket listing.
+type s3Object struct {
+	Key          string `xml:"Key"`
+	Size         int64  `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+}
+
+type s3ListResult struct {
+	IsTruncated           bool       `xml:"IsTruncated"`
+	NextContinuationToken string     `xml:"NextContinuationToken"`
+	Contents              []s3Object `xml:"Contents"`
+	CommonPrefixes        []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+// awsEscape percent-encodes s as required by SigV4: everything except
+// unreserved characters (and "/" unless encodeSlash) is escaped.
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// do sends a request for key (the bucket itself if key is "") and returns
+// the response if its status is 2xx or 206. Other statuses become errors,
+// with 404 mapped to fs.ErrNotExist.
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	canonicalURI := "/" + awsEscape(c.cfg.Bucket, true)
+	if key != "" {
+		canonicalURI += "/" + awsEscape(key, false)
+	}
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		params = append(params, awsEscape(k, true)+"="+awsEscape(query.Get(k), true))
+	}
+	canonicalQuery := strings.Join(params, "&")
+
+	target := strings.TrimRight(c.cfg.Endpoint, "/") + canonicalURI
+	if canonicalQuery != "" {
+		target += "?" + canonicalQuery
+	}
+	req, err := http.NewRequest(method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	c.sign(req, canonicalURI, canonicalQuery)
+
+	client := c.cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, fs.ErrNotExist
+	case http.StatusForbidden:
+		return nil, fs.ErrPermission
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return resp, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// sign adds AWS Signature Version 4 headers. The payload is not hashed so
+// spooled files can be streamed; TLS protects it in transit.
+func (c *s3Client) sign(req *http.Request, canonicalURI, canonicalQuery string) {
+	if c.cfg.AccessKey == "" {
+		return
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+
+	signed := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		lk := strings.ToLower(k)
+		if strings.HasPrefix(lk, "x-amz-") || lk == "range" {
+			signed = append(signed, lk)
+			values[lk] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(signed)
+	var headers strings.Builder
+	for _, k := range signed {
+		headers.WriteString(k + ":" + values[k] + "\n")
+	}
+	signedHeaders := strings.Join(signed, ";")
+
+	canonical := strings.Join([]string{
+		req.Method, canonicalURI, canonicalQuery,
+		headers.String(), signedHeaders, "UNSIGNED-PAYLOAD",
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	scope := day + "/" + c.cfg.Region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.cfg.SecretKey), day)
+	key = hmacSHA256(key, c.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// head returns the size and modification time of key.
+func (c *s3Client) head(key string) (int64, time.Time, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	resp.Body.Close()
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return resp.ContentLength, mtime, nil
+}
+
+// getRange reads up to len(p) bytes of key starting at off.
+func (c *s3Client) getRange(key string, p []byte, off int64) (int, error) {
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+int64(len(p))-1))
+	resp, err := c.do(http.MethodGet, key, nil, header, nil, 0)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			return 0, io.EOF
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && off > 0 {
+		// The server ignored the range; skip to the requested offset.
+		if _, err := io.CopyN(io.Discard, resp.Body, off); err != nil {
+			return 0, io.EOF
+		}
+	}
+	n, err := io.ReadFull(resp.Body, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (c *s3Client) put(key string, body io.Reader, size int64) error {
+	if body == nil {
+		body = strings.NewReader("")
+	}
+	resp, err := c.do(http.MethodPut, key, nil, nil, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) copy(src, dst string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", "/"+awsEscape(c.cfg.Bucket, true)+"/"+awsEscape(src, false))
+	resp, err := c.do(http.MethodPut, dst, nil, header, nil, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *s3Client) delete(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// list returns objects and common prefixes under prefix. With a delimiter
+// only the immediate children are returned. max limits the number of
+// objects fetched (0 means all).
+func (c *s3Client) list(prefix, delimiter string, max int) ([]s3Object, []string, error) {
+	var (
+		objects  []s3Object
+		prefixes []string
+		token    string
+	)
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if max > 0 {
+			query.Set("max-keys", strconv.Itoa(max))
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(http.MethodGet, "", query, nil, nil, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		var res s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("s3 list %s: %w", prefix, err)
+		}
+		objects = append(objects, res.Contents...)
+		for _, p := range res.CommonPrefixes {
+			prefixes = append(prefixes, p.Prefix)
+		}
+		if !res.IsTruncated || res.NextContinuationToken == "" || max > 0 {
+			return objects, prefixes, nil
+		}
+		token = res.NextContinuationToken
+	}
+}
+
+// s3Info describes a file or directory of an s3Backend.
+type s3Info struct {
+	name  string
+	size  int64
+	mtime time.Time
+	dir   bool
+}
+
+func (i *s3Info) Name() string       { return i.name }
+func (i *s3Info) Size() int64        { return i.size }
+func (i *s3Info) ModTime() time.Time { return i.mtime }
+func (i *s3Info) IsDir() bool        { return i.dir }
+func (i *s3Info) Sys() any           { return nil }
+
+func (i *s3Info) Mode() fs.FileMode {
+	if i.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func parseS3Time(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t.Truncate(time.Second)
+}
+
+// s3Backend stores a user tree under prefix in a bucket.
+type s3Backend struct {
+	c      *s3Client
+	prefix string
+}
+
+func (b *s3Backend) key(name string) string {
+	return b.prefix + name
+}
+
+// dirPrefix returns the key prefix of objects inside directory name.
+func (b *s3Backend) dirPrefix(name string) string {
+	if name == "" {
+		return b.prefix
+	}
+	return b.prefix + name + "/"
+}
+
+func baseName(name string) string {
+	if name == "" {
+		return "."
+	}
+	return path.Base(name)
+}
+
+func (b *s3Backend) Stat(name string) (fs.FileInfo, error) {
+	if name == "" {
+		return &s3Info{name: ".", dir: true}, nil
+	}
+	size, mtime, err := b.c.head(b.key(name))
+	if err == nil {
+		return &s3Info{name: baseName(name), size: size, mtime: mtime.Truncate(time.Second)}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	objects, _, err := b.c.list(b.dirPrefix(name), "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if len(objects) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	info := &s3Info{name: baseName(name), dir: true}
+	if objects[0].Key == b.dirPrefix(name) {
+		info.mtime = parseS3Time(objects[0].LastModified)
+	}
+	return info, nil
+}
+
+func (b *s3Backend) ReadDir(name string) ([]fs.DirEntry, error) {
+	info, err := b.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: syscall.ENOTDIR}
+	}
+	prefix := b.dirPrefix(name)
+	objects, prefixes, err := b.c.list(prefix, "/", 0)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	var entries []fs.DirEntry
+	for _, p := range prefixes {
+		entries = append(entries, fs.FileInfoToDirEntry(&s3Info{
+			name: strings.TrimSuffix(strings.TrimPrefix(p, prefix), "/"),
+			dir:  true,
+		}))
+	}
+	for _, o := range objects {
+		if o.Key == prefix {
+			continue // the directory's own marker
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(&s3Info{
+			name:  strings.TrimPrefix(o.Key, prefix),
+			size:  o.Size,
+			mtime: parseS3Time(o.LastModified),
+		}))
+	}
+	sortEntries(entries)
+	return entries, nil
+}
+
+// checkParent makes sure the directory that would contain name exists.
+func (b *s3Backend) checkParent(op, name string) error {
+	info, err := b.Stat(parentName(name))
+	if err != nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !info.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: syscall.ENOTDIR}
+	}
+	return nil
+}
+
+func (b *s3Backend) Mkdir(name string, perm os.FileMode) error {
+	if _, err := b.Stat(name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := b.checkParent("mkdir", name); err != nil {
+		return err
+	}
+	return b.c.put(b.dirPrefix(name), nil, 0)
+}
+
+func (b *s3Backend) MkdirAll(name string, perm os.FileMode) error {
+	if name == "" {
+		return nil
+	}
+	info, err := b.Stat(name)
+	if err == nil {
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: syscall.ENOTDIR}
+		}
+		return nil
+	}
+	if err := b.MkdirAll(parentName(name), perm); err != nil {
+		return err
+	}
+	return b.c.put(b.dirPrefix(name), nil, 0)
+}
+
+func (b *s3Backend) Remove(name string) error {
+	info, err := b.Stat(name)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return b.c.delete(b.key(name))
+	}
+	objects, _, err := b.c.list(b.dirPrefix(name), "", 2)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if o.Key != b.dirPrefix(name) {
+			return &fs.PathError{Op: "remove", Path: name, Err: syscall.ENOTEMPTY}
+		}
+	}
+	return b.c.delete(b.dirPrefix(name))
+}
+
+func (b *s3Backend) RemoveAll(name string) error {
+	if name != "" {
+		if err := b.c.delete(b.key(name)); err != nil {
+			return err
+		}
+	}
+	objects, _, err := b.c.list(b.dirPrefix(name), "", 0)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := b.c.delete(o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename copies and then deletes every object involved; it is not atomic.
+func (b *s3Backend) Rename(oldName, newName string) error {
+	if oldName == "" || newName == "" {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrInvalid}
+	}
+	info, err := b.Stat(oldName)
+	if err != nil {
+		return err
+	}
+	if oldName == newName {
+		return nil
+	}
+	if err := b.checkParent("rename", newName); err != nil {
+		return err
+	}
+	if dst, err := b.Stat(newName); err == nil && (dst.IsDir() || info.IsDir()) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+	if !info.IsDir() {
+		if err := b.c.copy(b.key(oldName), b.key(newName)); err != nil {
+			return err
+		}
+		return b.c.delete(b.key(oldName))
+	}
+	if strings.HasPrefix(newName, oldName+"/") {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrInvalid}
+	}
+	oldPrefix, newPrefix := b.dirPrefix(oldName), b.dirPrefix(newName)
+	objects, _, err := b.c.list(oldPrefix, "", 0)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if err := b.c.copy(o.Key, newPrefix+strings.TrimPrefix(o.Key, oldPrefix)); err != nil {
+			return err
+		}
+	}
+	if len(objects) == 0 || objects[0].Key != oldPrefix {
+		// Keep the directory even if it was only implied by its content.
+		if err := b.c.put(newPrefix, nil, 0); err != nil {
+			return err
+		}
+	}
+	for _, o := range objects {
+		if err := b.c.delete(o.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chtimes only checks that name exists: object times cannot be set.
+func (b *s3Backend) Chtimes(name string, atime, mtime time.Time) error {
+	_, err := b.Stat(name)
+	return err
+}
+
+func (b *s3Backend) Truncate(name string, size int64) error {
+	f, err := b.OpenFile(name, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (b *s3Backend) Usage(name string) (int64, error) {
+	if name != "" {
+		info, err := b.Stat(name)
+		if err != nil {
+			return 0, err
+		}
+		if !info.IsDir() {
+			return info.Size(), nil
+		}
+	}
+	objects, _, err := b.c.list(b.dirPrefix(name), "", 0)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	for _, o := range objects {
+		if !strings.HasSuffix(o.Key, "/") {
+			size += o.Size
+		}
+	}
+	return size, nil
+}
+
+func (b *s3Backend) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	writable := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND) != 0
+	info, err := b.Stat(name)
+	switch {
+	case err == nil && info.IsDir():
+		if writable {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: syscall.EISDIR}
+		}
+		return &s3Dir{b: b, name: name, info: info}, nil
+	case err == nil && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return nil, err
+	case err != nil:
+		if flag&os.O_CREATE == 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+		if err := b.checkParent("open", name); err != nil {
+			return nil, err
+		}
+		info = nil
+	}
+	if !writable {
+		return &s3Reader{c: b.c, key: b.key(name), info: info}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "nssc-s3-*")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(tmp.Name())
+	f := &s3Writer{b: b, name: name, tmp: tmp, appendMode: flag&os.O_APPEND != 0}
+	if info == nil || flag&os.O_TRUNC != 0 {
+		f.dirty = true
+		return f, nil
+	}
+	r := &s3Reader{c: b.c, key: b.key(name), info: info}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// s3Reader reads an object with ranged GETs, buffering s3ReadAhead bytes.
+type s3Reader struct {
+	c      *s3Client
+	key    string
+	info   fs.FileInfo
+	pos    int64
+	buf    []byte
+	bufOff int64
+}
+
+func (r *s3Reader) ReadAt(p []byte, off int64) (int, error) {
+	size := r.info.Size()
+	if off >= size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < size {
+		if off < r.bufOff || off >= r.bufOff+int64(len(r.buf)) {
+			want := min(max(int64(len(p)-n), s3ReadAhead), size-off)
+			buf := make([]byte, want)
+			m, err := r.c.getRange(r.key, buf, off)
+			if m == 0 {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return n, err
+			}
+			r.buf, r.bufOff = buf[:m], off
+		}
+		c := copy(p[n:], r.buf[off-r.bufOff:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (r *s3Reader) Read(p []byte) (int, error) {
+	n, err := r.ReadAt(p, r.pos)
+	r.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.info.Size()
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+func (r *s3Reader) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: r.key, Err: syscall.EBADF}
+}
+
+func (r *s3Reader) WriteAt(p []byte, off int64) (int, error) {
+	return r.Write(p)
+}
+
+func (r *s3Reader) Truncate(size int64) error {
+	return &fs.PathError{Op: "truncate", Path: r.key, Err: syscall.EBADF}
+}
+
+func (r *s3Reader) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: r.key, Err: syscall.ENOTDIR}
+}
+
+func (r *s3Reader) Stat() (fs.FileInfo, error) { return r.info, nil }
+func (r *s3Reader) Close() error               { return nil }
+
+// s3Writer is a file opened for writing, spooled to a local temporary file
+// and uploaded on Close if it was changed.
+type s3Writer struct {
+	b          *s3Backend
+	name       string
+	tmp        *os.File
+	appendMode bool
+	dirty      bool
+}
+
+func (w *s3Writer) Read(p []byte) (int, error)              { return w.tmp.Read(p) }
+func (w *s3Writer) ReadAt(p []byte, off int64) (int, error) { return w.tmp.ReadAt(p, off) }
+func (w *s3Writer) Seek(offset int64, whence int) (int64, error) {
+	return w.tmp.Seek(offset, whence)
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.dirty = true
+	if w.appendMode {
+		if _, err := w.tmp.Seek(0, io.SeekEnd); err != nil {
+			return 0, err
+		}
+	}
+	return w.tmp.Write(p)
+}
+
+func (w *s3Writer) WriteAt(p []byte, off int64) (int, error) {
+	w.dirty = true
+	return w.tmp.WriteAt(p, off)
+}
+
+func (w *s3Writer) Truncate(size int64) error {
+	w.dirty = true
+	return w.tmp.Truncate(size)
+}
+
+func (w *s3Writer) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: w.name, Err: syscall.ENOTDIR}
+}
+
+func (w *s3Writer) Stat() (fs.FileInfo, error) {
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Info{name: baseName(w.name), size: info.Size(), mtime: info.ModTime()}, nil
+}
+
+func (w *s3Writer) Close() error {
+	defer w.tmp.Close()
+	if !w.dirty {
+		return nil
+	}
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	body := io.NewSectionReader(w.tmp, 0, info.Size())
+	return w.b.c.put(w.b.key(w.name), body, info.Size())
+}
+
+// s3Dir is an open directory of an s3Backend.
+type s3Dir struct {
+	b       *s3Backend
+	name    string
+	info    fs.FileInfo
+	entries []fs.FileInfo
+	listed  bool
+}
+
+func (d *s3Dir) Readdir(count int) ([]fs.FileInfo, error) {
+	if !d.listed {
+		entries, err := d.b.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			d.entries = append(d.entries, info)
+		}
+		d.listed = true
+	}
+	if count <= 0 {
+		res := d.entries
+		d.entries = nil
+		return res, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(d.entries))
+	res := d.entries[:n]
+	d.entries = d.entries[n:]
+	return res, nil
+}
+
+// ReadDir lets io/fs walk an open directory without a second listing.
+func (d *s3Dir) ReadDir(count int) ([]fs.DirEntry, error) {
+	infos, err := d.Readdir(count)
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, err
+}
+
+func (d *s3Dir) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		d.entries, d.listed = nil, false
+		return 0, nil
+	}
+	return 0, &fs.PathError{Op: "seek", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *s3Dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *s3Dir) ReadAt(p []byte, off int64) (int, error) {
+	return d.Read(p)
+}
+
+func (d *s3Dir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *s3Dir) WriteAt(p []byte, off int64) (int, error) {
+	return d.Write(p)
+}
+
+func (d *s3Dir) Truncate(size int64) error {
+	return &fs.PathError{Op: "truncate", Path: d.name, Err: syscall.EISDIR}
+}
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *s3Dir) Close() error               { return nil }
@@ -0,0 +1,345 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+// fakeS3 is a minimal in-memory stand-in for an S3-compatible server
+// supporting the path-style requests made by the S3 backend.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	mtimes  map[string]time.Time
+	gets    map[string]int // GET requests by key
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: make(map[string][]byte), mtimes: make(map[string]time.Time), gets: make(map[string]int)}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=key/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		http.Error(w, "NoSuchBucket", http.StatusNotFound)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if key == "" && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if r.Method == http.MethodGet {
+			f.gets[key]++
+		}
+		data, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", f.mtimes[key].Format(http.TimeFormat))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	case http.MethodPut:
+		var data []byte
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			src, _ = url.PathUnescape(strings.TrimPrefix(src, "/bucket/"))
+			var ok bool
+			if data, ok = f.objects[src]; !ok {
+				http.Error(w, "NoSuchKey", http.StatusNotFound)
+				return
+			}
+		} else {
+			data, _ = io.ReadAll(r.Body)
+		}
+		f.objects[key] = bytes.Clone(data)
+		f.mtimes[key] = time.Now()
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "NotImplemented", http.StatusNotImplemented)
+	}
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	after := q.Get("continuation-token")
+	maxKeys := 2 // small pages exercise continuation
+	if n, err := strconv.Atoi(q.Get("max-keys")); err == nil && n < maxKeys {
+		maxKeys = n
+	}
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	type object struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	var res struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []object
+		CommonPrefixes        []struct{ Prefix string }
+	}
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) || k <= after {
+			continue
+		}
+		if len(res.Contents)+len(res.CommonPrefixes) == maxKeys {
+			res.IsTruncated = true
+			break
+		}
+		res.NextContinuationToken = k
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				p := k[:len(prefix)+i+1]
+				if !seen[p] {
+					seen[p] = true
+					res.CommonPrefixes = append(res.CommonPrefixes, struct{ Prefix string }{p})
+				}
+				continue
+			}
+		}
+		res.Contents = append(res.Contents, object{k, len(f.objects[k]), f.mtimes[k].UTC().Format(time.RFC3339Nano)})
+	}
+	if !res.IsTruncated {
+		res.NextContinuationToken = ""
+	}
+	xml.NewEncoder(w).Encode(res)
+}
+
+func TestParseS3URL(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "id")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	cfg, err := fs.ParseS3URL("https://s3.local:9000/data/nssc/users?region=eu-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fs.S3Config{
+		Endpoint:  "https://s3.local:9000",
+		Region:    "eu-1",
+		Bucket:    "data",
+		Prefix:    "nssc/users/",
+		AccessKey: "id",
+		SecretKey: "secret",
+	}
+	if cfg != want {
+		t.Errorf("ParseS3URL = %+v, want %+v", cfg, want)
+	}
+	if _, err := fs.ParseS3URL("ftp://host/bucket"); err == nil {
+		t.Error("expected error for unsupported scheme")
+	}
+	if _, err := fs.ParseS3URL("http://host/"); err == nil {
+		t.Error("expected error for missing bucket")
+	}
+}
+
+func TestS3Backend(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeS3(t)
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	cfg := fs.S3Config{
+		Endpoint:  srv.URL,
+		Region:    "us-east-1",
+		Bucket:    "bucket",
+		Prefix:    "trees/",
+		AccessKey: "key",
+		SecretKey: "secret",
+	}
+	server, err := fs.NewUserFSServer(t.TempDir(), nil, db.Users, fs.WithBackend(fs.S3Backends(cfg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufs, _ := server.GetUserFS("user")
+	if ufs.Root() != "" {
+		t.Errorf("Root() = %q, want empty for S3 storage", ufs.Root())
+	}
+
+	data := bytes.Repeat([]byte("0123456789"), 300000) // spans several read-ahead windows
+	if err := ufs.WriteFile("docs/a b.txt", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.objects["trees/user/docs/a b.txt"]; !ok {
+		t.Fatal("object not stored under the user prefix")
+	}
+	if _, used, _ := ufs.GetQuota(); used != int64(len(data)) {
+		t.Errorf("quota used = %d, want %d", used, len(data))
+	}
+	if sum, _ := ufs.Checksum(ctx, "docs/a b.txt"); sum != sha256Hex(data) {
+		t.Errorf("Checksum = %q", sum)
+	}
+
+	// Ranged read across a read-ahead boundary.
+	f, err := ufs.Open(ctx, "docs/a b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	off := int64(1<<20 - 50)
+	if _, err := f.(io.ReaderAt).ReadAt(buf, off); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, data[off:off+100]) {
+		t.Error("ReadAt returned wrong data")
+	}
+	all, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(all, data) {
+		t.Error("Read returned wrong data")
+	}
+
+	// In-place write as done over WebDAV and 9P.
+	wf, err := ufs.OpenFile(ctx, "docs/a b.txt", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf.Seek(10, io.SeekStart)
+	wf.Write([]byte("PATCH"))
+	wf.Close()
+	copy(data[10:], "PATCH")
+	if sum, _ := ufs.Checksum(ctx, "docs/a b.txt"); sum != sha256Hex(data) {
+		t.Errorf("Checksum after patch = %q", sum)
+	}
+
+	if err := ufs.Mkdir(ctx, "empty", 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("docs/f%d", i)
+		ufs.WriteFile(name, strings.NewReader("x"), 1)
+	}
+	entries, err := ufs.ReadDir("docs")
+	if err != nil || len(entries) != 6 {
+		t.Fatalf("ReadDir(docs) = %d entries, %v; want 6", len(entries), err)
+	}
+	root, _ := ufs.ReadDir("")
+	if len(root) != 2 || root[0].Name() != "docs" || !root[0].IsDir() || root[1].Name() != "empty" {
+		t.Errorf("ReadDir(root) = %v", root)
+	}
+
+	if err := ufs.Rename(ctx, "docs", "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ufs.Stat(ctx, "docs"); err == nil {
+		t.Error("old directory still exists after rename")
+	}
+	if sum, _ := ufs.Checksum(ctx, "moved/a b.txt"); sum != sha256Hex(data) {
+		t.Errorf("Checksum after rename = %q", sum)
+	}
+
+	_, before, _ := ufs.GetQuota()
+	if err := ufs.Truncate(ctx, "moved/a b.txt", 4); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := ufs.Stat(ctx, "moved/a b.txt"); err != nil || info.Size() != 4 {
+		t.Errorf("Stat after truncate = %v, %v", info, err)
+	}
+	if _, used, _ := ufs.GetQuota(); used != before-int64(len(data))+4 {
+		t.Errorf("quota used after truncate = %d, want %d", used, before-int64(len(data))+4)
+	}
+
+	if err := ufs.RemoveAll(ctx, "moved"); err != nil {
+		t.Fatal(err)
+	}
+	if _, used, _ := ufs.GetQuota(); used != 0 {
+		t.Errorf("quota used after RemoveAll = %d, want 0", used)
+	}
+	for k := range fake.objects {
+		if strings.HasPrefix(k, "trees/user/moved") {
+			t.Errorf("object %s left after RemoveAll", k)
+		}
+	}
+}
+
+func TestS3EncryptedStorage(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeS3(t)
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	cfg := fs.S3Config{Endpoint: srv.URL, Region: "us-east-1", Bucket: "bucket", AccessKey: "key", SecretKey: "secret"}
+	server := newEncryptedServer(t, t.TempDir(), bytes.Repeat([]byte{1}, 32), db.Users, fs.WithBackend(fs.S3Backends(cfg)))
+	ufs, _ := server.GetUserFS("user")
+	data := []byte("secret on remote storage")
+	if err := ufs.WriteFile("s.txt", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(fake.objects["user/s.txt"], []byte("secret")) {
+		t.Fatal("plaintext stored in bucket")
+	}
+	f, err := ufs.Open(ctx, "s.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(f)
+	f.Close()
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %q, want %q", got, data)
+	}
+}
+
+func TestS3EncryptedStatDoesNotRead(t *testing.T) {
+	ctx := context.Background()
+	fake, srv := newFakeS3(t)
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	cfg := fs.S3Config{Endpoint: srv.URL, Region: "us-east-1", Bucket: "bucket", AccessKey: "key", SecretKey: "secret"}
+	server := newEncryptedServer(t, t.TempDir(), bytes.Repeat([]byte{1}, 32), db.Users, fs.WithBackend(fs.S3Backends(cfg)))
+	ufs, _ := server.GetUserFS("user")
+	gets := func() int {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.gets["user/s.txt"]
+	}
+	for _, data := range []string{"secret on remote storage", "other secret"} {
+		if err := ufs.WriteFile("s.txt", strings.NewReader(data), int64(len(data))); err != nil {
+			t.Fatal(err)
+		}
+		before := gets()
+		for range 3 {
+			if info, err := ufs.Stat(ctx, "s.txt"); err != nil || info.Size() != int64(len(data)) {
+				t.Fatalf("Stat size = %v, %v; want %d", info, err, len(data))
+			}
+			page, err := ufs.List(ctx, "", fs.ListOptions{})
+			if err != nil || len(page.Entries) != 1 || page.Entries[0].Size() != int64(len(data)) {
+				t.Fatalf("List = %+v, %v", page, err)
+			}
+		}
+		if n := gets() - before; n != 0 {
+			t.Errorf("%d reads of the file for its size", n)
+		}
+	}
+}
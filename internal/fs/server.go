@@ -1,27 +1,49 @@
 package fs
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sync"
+	"time"
 
 	"github.com/dustin/go-humanize"
 
+	"nssc/internal/events"
 	"nssc/internal/users"
 )
 
+// stateDirName is the directory under the server root holding nssc's own
+// bookkeeping (metadata stores and the like), kept out of user trees.
+const stateDirName = ".nssc"
+
 // UserFSServer holds per-user UserFS instances.
 type UserFSServer struct {
 	root        string
 	commonQuota *Quota
+	storage     StorageConfig
+	masterKey   []byte
+	backends    BackendFactory
 	users       map[string]*UserFS
 	mu          sync.RWMutex
+	blobMu      sync.Mutex
+
+	reconcileInterval time.Duration
+	watch             bool
+	softLimits        []int
+	reserve           int64
+	encrypting        bool // opened by EncryptStorage
+	events            *events.Bus
+	stop              context.CancelFunc
+	thumbSlots        chan struct{} // bounds concurrent thumbnail scaling
 }
 
 // NewUserFSServer initialises a UserFSServer and per-user directories.
 // Quota usage is calculated inside each UserFS.Init() — no double counting.
-func NewUserFSServer(root string, commonQuota *Quota, userList []users.User) (*UserFSServer, error) {
+func NewUserFSServer(root string, commonQuota *Quota, userList []users.User, opts ...ServerOption) (*UserFSServer, error) {
 	if err := os.MkdirAll(root, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create root directory: %w", err)
 	}
@@ -29,20 +51,91 @@ func NewUserFSServer(root string, commonQuota *Quota, userList []users.User) (*U
 		root:        root,
 		commonQuota: commonQuota,
 		users:       make(map[string]*UserFS),
+		events:      events.NewBus(),
+		softLimits:  defaultSoftLimits,
+		thumbSlots:  make(chan struct{}, runtime.NumCPU()),
+	}
+	for _, opt := range opts {
+		opt(server)
+	}
+	storage, err := loadStorageConfig(server.storageConfigPath())
+	if err != nil {
+		return nil, fmt.Errorf("failed to load storage config: %w", err)
+	}
+	if storage.Dedup && !dedupSupported {
+		return nil, fmt.Errorf("deduplicated storage is not supported on this platform")
+	}
+	server.storage = storage
+	switch {
+	case storage.Encrypting && !server.encrypting:
+		return nil, fmt.Errorf("encryption of the storage was interrupted: run nssc encrypt again")
+	case server.masterKey != nil && storage.Dedup:
+		return nil, fmt.Errorf("encryption cannot be combined with deduplicated storage")
+	case server.masterKey != nil && !storage.Encrypt:
+		// Files stored so far are plain; only EncryptStorage turns them,
+		// and the mode, into encrypted ones.
+		return nil, fmt.Errorf("storage is not encrypted: encrypt it with nssc encrypt first")
+	case server.masterKey == nil && storage.Encrypt:
+		return nil, fmt.Errorf("storage is encrypted: master key required")
+	}
+	if server.masterKey != nil {
+		// Drop the search indexes and thumbnails of an unencrypted run.
+		for _, dir := range []string{"index", "thumbs"} {
+			if err := os.RemoveAll(filepath.Join(root, stateDirName, dir)); err != nil {
+				return nil, fmt.Errorf("failed to remove plaintext %s: %w", dir, err)
+			}
+		}
+	}
+	if storage.Dedup && server.backends != nil {
+		return nil, fmt.Errorf("deduplicated storage requires local disk backend")
 	}
 	for _, user := range userList {
-		userRoot := filepath.Join(root, user.Name)
-		if err := os.MkdirAll(userRoot, 0755); err != nil {
-			return nil, fmt.Errorf("failed to create user directory for %s: %w", user.Name, err)
+		var (
+			userRoot string
+			backend  Backend
+		)
+		if server.backends != nil {
+			if backend, err = server.backends(user.Name); err != nil {
+				return nil, fmt.Errorf("failed to open storage for %s: %w", user.Name, err)
+			}
+		} else {
+			userRoot = filepath.Join(root, user.Name)
+			if err := os.MkdirAll(userRoot, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create user directory for %s: %w", user.Name, err)
+			}
+			backend = newDiskBackend(userRoot)
+		}
+		if server.masterKey != nil {
+			key, err := server.userKey(user.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load data key for %s: %w", user.Name, err)
+			}
+			backend = &cryptBackend{Backend: backend, key: key}
 		}
 		quota, err := humanize.ParseBytes(user.Quota)
 		if err != nil {
 			quota = 0
 		}
-		ufs := NewUserFS(userRoot, NewQuota(int64(quota)), server)
+		ufs := newUserFS(user.Name, userRoot, backend, NewQuota(int64(quota)), server)
+		ufs.setDirQuotas(user.DirQuotas)
 		ufs.Init() // calculates initial used space; no pre-Walk needed
 		server.users[user.Name] = ufs
 	}
+	ctx, cancel := context.WithCancel(context.Background())
+	server.stop = cancel
+	if server.watch {
+		for name, ufs := range server.users {
+			if ufs.root == "" {
+				continue
+			}
+			if err := ufs.watch(ctx); err != nil {
+				log.Printf("Watch %s error: %v", name, err)
+			}
+		}
+	}
+	if server.reconcileInterval > 0 {
+		go server.reconcileLoop(ctx, server.reconcileInterval)
+	}
 	return server, nil
 }
 
@@ -57,14 +150,124 @@ func (s *UserFSServer) GetUserFS(username string) (*UserFS, error) {
 	return ufs, nil
 }
 
-func (s *UserFSServer) checkCommonQuota(size int64) error {
+// Sync flushes pending metadata of every user to disk.
+func (s *UserFSServer) Sync() error {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	if s.commonQuota == nil {
-		return nil
+	var firstErr error
+	for name, ufs := range s.users {
+		if err := ufs.Sync(); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("sync %s: %w", name, err)
+		}
 	}
-	if total, _, remain := s.commonQuota.Values(); total > 0 && remain < size {
-		return fmt.Errorf("common quota exceeded: remain %d < need %d", remain, size)
+	return firstErr
+}
+
+// Close stops background work and flushes pending metadata to disk.
+func (s *UserFSServer) Close() error {
+	s.stop()
+	return s.Sync()
+}
+
+// metaPath returns the metadata store location for the given user.
+func (s *UserFSServer) metaPath(username string) string {
+	return filepath.Join(s.root, stateDirName, "meta", username+".json")
+}
+
+// attrsPath returns the attribute store location for the given user.
+func (s *UserFSServer) attrsPath(username string) string {
+	return filepath.Join(s.root, stateDirName, "attrs", username+".json")
+}
+
+// indexPath returns the search index location for the given user, or ""
+// to keep the index in memory only, as under encryption: it holds the
+// words of the files in plaintext.
+func (s *UserFSServer) indexPath(username string) string {
+	if s.masterKey != nil {
+		return ""
+	}
+	return filepath.Join(s.root, stateDirName, "index", username+".json")
+}
+
+// thumbsPath returns the thumbnail cache directory for the given user, or
+// "" not to cache thumbnails, as under encryption: they would show the
+// images in plaintext.
+func (s *UserFSServer) thumbsPath(username string) string {
+	if s.masterKey != nil {
+		return ""
+	}
+	return filepath.Join(s.root, stateDirName, "thumbs", username)
+}
+
+// journalPath returns the change journal location for the given user.
+func (s *UserFSServer) journalPath(username string) string {
+	return filepath.Join(s.root, stateDirName, "journal", username+".jsonl")
+}
+
+// WebhooksDir returns the directory of the server rooted at root holding
+// the webhook registrations, their delivery queue and history.
+func WebhooksDir(root string) string {
+	return filepath.Join(root, stateDirName, "webhooks")
+}
+
+// usagePath returns the usage index location for the given user.
+func (s *UserFSServer) usagePath(username string) string {
+	return filepath.Join(s.root, stateDirName, "usage", username+".json")
+}
+
+// WithReserve keeps bytes of the disk holding the storage root free:
+// writes to disk-backed trees that would leave less are rejected.
+func WithReserve(bytes int64) ServerOption {
+	return func(s *UserFSServer) {
+		s.reserve = bytes
+	}
+}
+
+// StorageStatus summarises the server-wide limits and usage.
+type StorageStatus struct {
+	Quota    int64 // cap on the bytes stored by all users, 0 if unlimited
+	Used     int64 // bytes stored by all users
+	Reserve  int64 // free disk space kept in reserve, 0 if none
+	DiskFree int64 // free disk space, -1 if unknown
+}
+
+// Status returns the server-wide limits and usage.
+func (s *UserFSServer) Status() StorageStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	st := StorageStatus{Reserve: s.reserve, DiskFree: -1}
+	if s.commonQuota != nil {
+		st.Quota, _, _ = s.commonQuota.Values()
+	}
+	for _, ufs := range s.users {
+		st.Used += ufs.usage.subtree("")
+	}
+	if free, err := s.DiskFree(); err == nil {
+		st.DiskFree = free
+	}
+	return st
+}
+
+// checkServerLimits returns an error if storing size more bytes would
+// exceed the common quota or eat into the free space reserve.
+func (s *UserFSServer) checkServerLimits(size int64) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.commonQuota != nil {
+		if total, _, remain := s.commonQuota.Values(); total > 0 && remain < size {
+			return fmt.Errorf("common %w: remain %d < need %d", ErrQuotaExceeded, remain, size)
+		}
+	}
+	// The reserve protects the local disk; remote backends have their own limits.
+	if s.reserve > 0 && size > 0 && s.backends == nil {
+		free, err := s.DiskFree()
+		if err != nil {
+			log.Printf("Disk free %s error: %v", s.root, err)
+			return nil
+		}
+		if free-size < s.reserve {
+			return fmt.Errorf("%w: free %d - need %d < reserve %d", ErrReserve, free, size, s.reserve)
+		}
 	}
 	return nil
 }
@@ -1,7 +1,9 @@
 package fs_test
 
 import (
+	"errors"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"nssc/internal/fs"
@@ -36,3 +38,47 @@ func TestDiskFreeCalculation(t *testing.T) {
 		t.Errorf("Некорректные значения свободного места: %+v", free)
 	}
 }
+
+func TestServerLimits(t *testing.T) {
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("alice", "pass", "1GiB")
+	db.AddUser("bob", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(root, nil, db.Users)
+	alice, _ := server.GetUserFS("alice")
+	alice.WriteFile("a.bin", strings.NewReader(strings.Repeat("a", 60)), 60)
+	server.Close()
+
+	// The common quota starts out with the usage of every user.
+	server, err := fs.NewUserFSServer(root, fs.NewQuota(100), db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st := server.Status(); st.Quota != 100 || st.Used != 60 || st.Reserve != 0 {
+		t.Errorf("status = %+v, want quota 100, used 60", st)
+	}
+	bob, _ := server.GetUserFS("bob")
+	err = bob.WriteFile("b.bin", strings.NewReader(strings.Repeat("b", 50)), 50)
+	if !errors.Is(err, fs.ErrQuotaExceeded) {
+		t.Errorf("WriteFile over common quota error = %v, want ErrQuotaExceeded", err)
+	}
+
+	server.Close()
+
+	free, err := server.DiskFree()
+	if err != nil {
+		t.Skip("disk free space unknown:", err)
+	}
+	server, _ = fs.NewUserFSServer(root, nil, db.Users, fs.WithReserve(free+1<<30))
+	defer server.Close()
+	bob, _ = server.GetUserFS("bob")
+	err = bob.WriteFile("b.bin", strings.NewReader(strings.Repeat("b", 50)), 50)
+	if !errors.Is(err, fs.ErrReserve) || !fs.IsInsufficientStorage(err) {
+		t.Errorf("WriteFile into reserve error = %v, want ErrReserve", err)
+	}
+	// Shrinking writes are allowed.
+	alice, _ = server.GetUserFS("alice")
+	if err := alice.WriteFile("a.bin", strings.NewReader("a"), 1); err != nil {
+		t.Errorf("WriteFile shrinking file: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package fs
+
+import (
+	"context"
+	"io/fs"
+
+	"github.com/google/uuid"
+
+	"nssc/internal/events"
+)
+
+// Stash is a file or directory tree set aside by UserFS.Stash.
+type Stash struct {
+	u     *UserFS
+	name  string // where it came from
+	stash string // where it is kept
+	isDir bool
+}
+
+// Stash removes the file or directory tree at path in a way that can be
+// undone: it is moved to a hidden name next to it, to be removed for good
+// with Commit or put back with Restore. Until then it still counts
+// against the quotas, and no change is recorded.
+func (u *UserFS) Stash(ctx context.Context, path string) (*Stash, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	name, err := cleanName(path)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, &fs.PathError{Op: "stash", Path: path, Err: fs.ErrInvalid}
+	}
+	stash := joinName(parentName(name), ".nssc-"+uuid.NewString())
+	defer u.changing(name, stash)()
+	info, err := u.rename(name, stash)
+	if err != nil {
+		return nil, err
+	}
+	return &Stash{u: u, name: name, stash: stash, isDir: info.IsDir()}, nil
+}
+
+// Commit removes the stashed tree, recording its removal.
+func (s *Stash) Commit() error {
+	u := s.u
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.changing(s.stash)()
+	if _, err := u.removeAll(s.stash); err != nil {
+		return err
+	}
+	u.record(events.Event{Type: events.Remove, Path: s.name, IsDir: s.isDir})
+	return nil
+}
+
+// Restore moves the stashed tree back where it was, replacing what is
+// there now.
+func (s *Stash) Restore() error {
+	u := s.u
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	defer u.changing(s.name, s.stash)()
+	_, err := u.rename(s.stash, s.name)
+	return err
+}
@@ -0,0 +1,64 @@
+package fs
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// StorageConfig describes how user data is laid out on disk. It lives in the
+// state directory so a storage root keeps its mode across restarts; running
+// a deduplicated tree as plain storage would let in-place writes leak into
+// every file sharing the same blob.
+type StorageConfig struct {
+	// Dedup stores file contents once in a content-addressed blob store;
+	// user trees hold hard links to the blobs.
+	Dedup bool `json:"dedup,omitempty"`
+	// Encrypt stores file contents encrypted with per-user data keys that
+	// are wrapped by the server master key.
+	Encrypt bool `json:"encrypt,omitempty"`
+	// Encrypting is set while EncryptStorage rewrites the existing files;
+	// the storage holds both plain and encrypted files meanwhile.
+	Encrypting bool `json:"encrypting,omitempty"`
+}
+
+func (s *UserFSServer) storageConfigPath() string {
+	return filepath.Join(s.root, stateDirName, "storage.json")
+}
+
+func loadStorageConfig(path string) (StorageConfig, error) {
+	var cfg StorageConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return cfg, nil
+		}
+		return cfg, err
+	}
+	err = json.Unmarshal(data, &cfg)
+	return cfg, err
+}
+
+// saveStorageConfig writes the config atomically (write-to-tmp + rename).
+func (s *UserFSServer) saveStorageConfig() error {
+	path := s.storageConfigPath()
+	data, err := json.MarshalIndent(s.storage, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Storage returns the storage configuration in effect.
+func (s *UserFSServer) Storage() StorageConfig {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.storage
+}
@@ -0,0 +1,259 @@
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// ErrNoThumbnail is returned by Thumbnail for files that are not images it
+// can decode.
+var ErrNoThumbnail = errors.New("no thumbnail for this file")
+
+// thumbSizes are the edge lengths thumbnails are made in; requests are
+// rounded up to one of them so the cache holds few variants per image.
+var thumbSizes = []int{64, 128, 256, 512, 1024}
+
+// maxThumbSource and maxThumbPixels bound the images thumbnails are made
+// of, so a small file cannot decode to gigabytes of pixels.
+const (
+	maxThumbSource = 64 << 20
+	maxThumbPixels = 40_000_000
+)
+
+// thumbDecoders decode the image formats thumbnails are made of, by
+// extension.
+var thumbDecoders = map[string]func(io.Reader) (image.Image, error){
+	".jpg":  jpeg.Decode,
+	".jpeg": jpeg.Decode,
+	".png":  png.Decode,
+	".gif":  gif.Decode, // the first frame
+	".webp": webp.Decode,
+}
+
+var thumbConfigs = map[string]func(io.Reader) (image.Config, error){
+	".jpg":  jpeg.DecodeConfig,
+	".jpeg": jpeg.DecodeConfig,
+	".png":  png.DecodeConfig,
+	".gif":  gif.DecodeConfig,
+	".webp": webp.DecodeConfig,
+}
+
+// HasThumbnail reports whether Thumbnail supports the format of name,
+// judging by its extension.
+func HasThumbnail(name string) bool {
+	_, ok := thumbDecoders[strings.ToLower(path.Ext(name))]
+	return ok
+}
+
+// ThumbnailSize rounds a requested thumbnail size up to one that is
+// made, and reports whether n is within the supported range.
+func ThumbnailSize(n int) (int, bool) {
+	if n <= 0 {
+		return 0, false
+	}
+	for _, size := range thumbSizes {
+		if n <= size {
+			return size, true
+		}
+	}
+	return 0, false
+}
+
+// Thumbnail is a scaled-down image of a file.
+type Thumbnail struct {
+	Data        []byte
+	ContentType string    // image/jpeg, or image/png for images with transparency
+	ModTime     time.Time // of the source file
+}
+
+// Thumbnail returns an image of path fitting in a size×size square, size
+// being rounded with ThumbnailSize. Images are never scaled up.
+// Thumbnails are cached in the server state directory, outside the quota,
+// and dropped when the file changes.
+func (u *UserFS) Thumbnail(ctx context.Context, path string, size int) (*Thumbnail, error) {
+	size, ok := ThumbnailSize(size)
+	if !ok {
+		return nil, fmt.Errorf("thumbnail size must be 1 to %d", thumbSizes[len(thumbSizes)-1])
+	}
+	name, err := cleanName(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "thumbnail", Path: path, Err: fs.ErrInvalid}
+	}
+	if !HasThumbnail(name) {
+		return nil, ErrNoThumbnail
+	}
+	u.mu.RLock()
+	info, err := u.backend.Stat(name)
+	u.mu.RUnlock()
+	if err != nil {
+		return nil, &fs.PathError{Op: "thumbnail", Path: path, Err: err}
+	}
+	if !info.Mode().IsRegular() || info.Size() > maxThumbSource {
+		return nil, ErrNoThumbnail
+	}
+	if t := u.cachedThumbnail(name, size, info.ModTime()); t != nil {
+		return t, nil
+	}
+	if u.server != nil {
+		// Scaling is CPU-bound: bound how many run at once.
+		select {
+		case u.server.thumbSlots <- struct{}{}:
+			defer func() { <-u.server.thumbSlots }()
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	t, err := u.makeThumbnail(name, size, info)
+	if err != nil {
+		return nil, err
+	}
+	u.cacheThumbnail(name, size, t)
+	return t, nil
+}
+
+// makeThumbnail decodes and scales the image name.
+func (u *UserFS) makeThumbnail(name string, size int, info fs.FileInfo) (*Thumbnail, error) {
+	ext := strings.ToLower(path.Ext(name))
+	u.mu.RLock()
+	f, err := u.backend.OpenFile(name, os.O_RDONLY, 0)
+	u.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxThumbSource))
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := thumbConfigs[ext](bytes.NewReader(data))
+	if err != nil || cfg.Width*cfg.Height > maxThumbPixels {
+		return nil, ErrNoThumbnail
+	}
+	src, err := thumbDecoders[ext](bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrNoThumbnail
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, max(1, h*size/w)
+		} else {
+			w, h = max(1, w*size/h), size
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Src, nil)
+
+	var buf bytes.Buffer
+	t := &Thumbnail{ModTime: info.ModTime()}
+	if dst.Opaque() {
+		t.ContentType = "image/jpeg"
+		err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80})
+	} else {
+		t.ContentType = "image/png"
+		err = png.Encode(&buf, dst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Data = buf.Bytes()
+	return t, nil
+}
+
+// thumbExts maps thumbnail content types to cache file extensions.
+var thumbExts = map[string]string{"image/jpeg": ".jpg", "image/png": ".png"}
+
+// thumbDir returns the cache directory for the thumbnails of name: the
+// cache mirrors the tree, so a directory's thumbnails can be dropped with
+// it. "" if thumbnails are not cached.
+func (u *UserFS) thumbDir(name string) string {
+	if u.server == nil {
+		return ""
+	}
+	dir := u.server.thumbsPath(u.name)
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, filepath.FromSlash(name))
+}
+
+// cachedThumbnail returns the cached thumbnail of name, if it was made of
+// the file as last modified at modTime.
+func (u *UserFS) cachedThumbnail(name string, size int, modTime time.Time) *Thumbnail {
+	dir := u.thumbDir(name)
+	if dir == "" {
+		return nil
+	}
+	for contentType, ext := range thumbExts {
+		p := filepath.Join(dir, "thumb-"+strconv.Itoa(size)+ext)
+		info, err := os.Stat(p)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			continue
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		return &Thumbnail{Data: data, ContentType: contentType, ModTime: modTime}
+	}
+	return nil
+}
+
+// cacheThumbnail stores t, stamped with the modification time of its
+// source. Failures only cost a later rebuild.
+func (u *UserFS) cacheThumbnail(name string, size int, t *Thumbnail) {
+	dir := u.thumbDir(name)
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return
+	}
+	p := filepath.Join(dir, "thumb-"+strconv.Itoa(size)+thumbExts[t.ContentType])
+	tmp, err := os.CreateTemp(dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	_, err = tmp.Write(t.Data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp.Name(), t.ModTime, t.ModTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+}
+
+// dropThumbnails removes the cached thumbnails of names and everything
+// beneath them.
+func (u *UserFS) dropThumbnails(names ...string) {
+	for _, name := range names {
+		if dir := u.thumbDir(name); dir != "" && name != "" {
+			os.RemoveAll(dir)
+		}
+	}
+}
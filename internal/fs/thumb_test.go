@@ -0,0 +1,117 @@
+package fs_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+// pngImage returns a w×h PNG, opaque unless alpha is set.
+func pngImage(t *testing.T, w, h int, alpha bool) string {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	c := color.NRGBA{R: 200, G: 100, B: 50, A: 255}
+	if alpha {
+		c.A = 128
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestThumbnail(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, _ := fs.NewUserFSServer(root, nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+
+	src := pngImage(t, 800, 400, false)
+	writeString(t, ufs, "photos/wide.png", src)
+	_, used, _ := ufs.GetQuota()
+
+	thumb := func(name string, size int) image.Image {
+		t.Helper()
+		th, err := ufs.Thumbnail(ctx, name, size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, _, err := image.Decode(bytes.NewReader(th.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return img
+	}
+
+	// Sizes are rounded up, and the aspect ratio kept.
+	img := thumb("photos/wide.png", 200)
+	if b := img.Bounds(); b.Dx() != 256 || b.Dy() != 128 {
+		t.Errorf("thumbnail is %v, want 256x128", b)
+	}
+	cached := filepath.Join(root, ".nssc", "thumbs", "user", "photos", "wide.png", "thumb-256.jpg")
+	if _, err := os.Stat(cached); err != nil {
+		t.Errorf("thumbnail not cached: %v", err)
+	}
+	if _, after, _ := ufs.GetQuota(); after != used {
+		t.Errorf("usage went from %d to %d", used, after)
+	}
+
+	// Writes drop the cached thumbnail.
+	writeString(t, ufs, "photos/wide.png", pngImage(t, 100, 50, false))
+	if _, err := os.Stat(cached); !os.IsNotExist(err) {
+		t.Errorf("thumbnail kept after write: %v", err)
+	}
+	if b := thumb("photos/wide.png", 256).Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Errorf("thumbnail after write is %v, want the 100x50 original", b)
+	}
+
+	// Changes made behind nssc's back are caught by the modification time.
+	os.WriteFile(filepath.Join(root, "user", "photos", "wide.png"), []byte(pngImage(t, 60, 120, false)), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(filepath.Join(root, "user", "photos", "wide.png"), later, later)
+	if b := thumb("photos/wide.png", 64).Bounds(); b.Dx() != 32 || b.Dy() != 64 {
+		t.Errorf("thumbnail after external change is %v, want 32x64", b)
+	}
+
+	// Transparency is kept.
+	writeString(t, ufs, "icon.png", pngImage(t, 32, 32, true))
+	if th, err := ufs.Thumbnail(ctx, "icon.png", 64); err != nil || th.ContentType != "image/png" {
+		t.Errorf("transparent thumbnail: %v, %v", th, err)
+	}
+
+	writeString(t, ufs, "notes.txt", "not an image")
+	writeString(t, ufs, "broken.jpg", "not a jpeg")
+	for _, name := range []string{"notes.txt", "broken.jpg", "photos"} {
+		if _, err := ufs.Thumbnail(ctx, name, 64); !errors.Is(err, fs.ErrNoThumbnail) {
+			t.Errorf("%s: error = %v, want ErrNoThumbnail", name, err)
+		}
+	}
+	if _, err := ufs.Thumbnail(ctx, "photos/wide.png", 4096); err == nil {
+		t.Error("oversized thumbnail made")
+	}
+
+	// Removing a directory drops the thumbnails beneath it.
+	ufs.RemoveAll(ctx, "photos")
+	if _, err := os.Stat(filepath.Join(root, ".nssc", "thumbs", "user", "photos")); !os.IsNotExist(err) {
+		t.Errorf("thumbnails kept after removal: %v", err)
+	}
+}
@@ -0,0 +1,367 @@
+package fs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// ErrNotArchive is returned by Extract for data that is not a zip, tar or
+// gzip-compressed tar archive.
+var ErrNotArchive = errors.New("not a zip, tar or tar.gz archive")
+
+// maxExtractEntries bounds the entries of an archive Extract unpacks.
+const maxExtractEntries = 100_000
+
+// ExtractResult is the outcome of unpacking one archive entry.
+type ExtractResult struct {
+	Path  string `json:"path"` // relative to the user root
+	IsDir bool   `json:"is_dir,omitempty"`
+	Size  int64  `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// unpackEntry is an archive entry as Extract sees it.
+type unpackEntry struct {
+	name    string
+	mode    fs.FileMode
+	size    int64
+	modTime time.Time
+}
+
+// unpackWalk walks the entries of an archive, passing the readers of
+// their contents to fn.
+type unpackWalk func(fn func(e unpackEntry, r func() (io.ReadCloser, error)) error) error
+
+// Extract unpacks the zip, tar or tar.gz archive read from r into the
+// directory path, creating it if needed. Entries that would land outside
+// it, symlinks and special files are refused. Beyond that every entry
+// succeeds or fails on its own, as told by the results.
+//
+// Archives read from a file are walked twice, so the uncompressed size of
+// the accepted entries is checked against the quotas before anything is
+// written. Tar and tar.gz streams are unpacked as they are read, each
+// entry checked against the quotas as it is written. Zip streams need
+// random access, so they are spooled to a temporary file first, which may
+// not grow beyond what the quotas and the free space reserve still allow.
+func (u *UserFS) Extract(ctx context.Context, path string, r io.Reader) ([]ExtractResult, error) {
+	dir, err := cleanName(path)
+	if err != nil {
+		return nil, &fs.PathError{Op: "extract", Path: path, Err: fs.ErrInvalid}
+	}
+	if f, ok := r.(interface {
+		io.ReaderAt
+		io.Seeker
+	}); ok {
+		if size, err := f.Seek(0, io.SeekEnd); err == nil {
+			return u.extractAt(ctx, dir, f, size)
+		}
+	}
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(512)
+	format, err := archiveFormat(head)
+	if err != nil {
+		return nil, err
+	}
+	if format == "zip" {
+		tmp, size, err := u.spoolArchive(dir, br)
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}()
+		return u.extractAt(ctx, dir, tmp, size)
+	}
+	if err := u.MkdirAll(ctx, dir, 0755); err != nil {
+		return nil, err
+	}
+	var results []ExtractResult
+	err = unpackTar(br, format == "tar.gz")(func(e unpackEntry, open func() (io.ReadCloser, error)) error {
+		if len(results) == maxExtractEntries {
+			return fmt.Errorf("%w: more than %d entries", ErrNotArchive, maxExtractEntries)
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		res, ok := u.checkEntry(dir, e)
+		if ok {
+			if err := u.extractEntry(ctx, res.Path, e, open); err != nil {
+				res.Error = err.Error()
+			}
+		}
+		results = append(results, res)
+		return nil
+	})
+	return results, err
+}
+
+// extractAt unpacks the archive of size bytes read from ra into dir,
+// checking the size of all its entries against the quotas first.
+func (u *UserFS) extractAt(ctx context.Context, dir string, ra io.ReaderAt, size int64) ([]ExtractResult, error) {
+	head := make([]byte, 512)
+	n, _ := ra.ReadAt(head, 0)
+	format, err := archiveFormat(head[:n])
+	if err != nil {
+		return nil, err
+	}
+	walk := func() unpackWalk {
+		if format == "zip" {
+			return unpackZip(ra, size)
+		}
+		return unpackTar(io.NewSectionReader(ra, 0, size), format == "tar.gz")
+	}
+
+	// First pass: check the names and add up the sizes.
+	var (
+		results []ExtractResult
+		accept  []bool
+		need    int64
+	)
+	err = walk()(func(e unpackEntry, _ func() (io.ReadCloser, error)) error {
+		if len(results) == maxExtractEntries {
+			return fmt.Errorf("%w: more than %d entries", ErrNotArchive, maxExtractEntries)
+		}
+		res, ok := u.checkEntry(dir, e)
+		results, accept = append(results, res), append(accept, ok)
+		if ok && !e.mode.IsDir() {
+			need += e.size - u.existingSize(res.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	u.mu.RLock()
+	err = u.checkQuotas(dir, need)
+	u.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := u.MkdirAll(ctx, dir, 0755); err != nil {
+		return nil, err
+	}
+
+	// Second pass: write.
+	i := 0
+	err = walk()(func(e unpackEntry, open func() (io.ReadCloser, error)) error {
+		res := &results[i]
+		ok := accept[i]
+		i++
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		if err := u.extractEntry(ctx, res.Path, e, open); err != nil {
+			res.Error = err.Error()
+		}
+		return nil
+	})
+	return results, err
+}
+
+// checkEntry returns the result of an entry before it is written, and
+// whether it may be.
+func (u *UserFS) checkEntry(dir string, e unpackEntry) (ExtractResult, bool) {
+	res := ExtractResult{Path: joinName(dir, e.name), IsDir: e.mode.IsDir()}
+	if !res.IsDir {
+		res.Size = e.size
+	}
+	name := strings.TrimSuffix(e.name, "/")
+	clean := path.Clean(name)
+	switch {
+	case name == "" || path.IsAbs(name) || strings.Contains(name, `\`) ||
+		clean == "." || clean == ".." || strings.HasPrefix(clean, "../"):
+		res.Error = "path outside the target directory"
+	case e.mode&fs.ModeSymlink != 0:
+		res.Error = "symlinks are not extracted"
+	case !e.mode.IsDir() && !e.mode.IsRegular():
+		res.Error = "special files are not extracted"
+	case e.size < 0:
+		res.Error = "invalid size"
+	case ignoredName(clean):
+		res.Error = "reserved name"
+	default:
+		res.Path = joinName(dir, clean)
+		return res, true
+	}
+	return res, false
+}
+
+// existingSize returns the size of the file name, 0 if there is none.
+func (u *UserFS) existingSize(name string) int64 {
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	return u.fileSize(name)
+}
+
+func (u *UserFS) extractEntry(ctx context.Context, name string, e unpackEntry, open func() (io.ReadCloser, error)) error {
+	if e.mode.IsDir() {
+		if err := u.MkdirAll(ctx, name, 0755); err != nil {
+			return err
+		}
+	} else {
+		rc, err := open()
+		if err != nil {
+			return err
+		}
+		err = u.WriteFile(name, &sizedReader{r: rc, n: e.size}, e.size)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if !e.modTime.IsZero() {
+		u.Chtimes(ctx, name, e.modTime, e.modTime)
+	}
+	return nil
+}
+
+// spoolArchive copies the archive read from r to a temporary file and
+// returns it with its size. The copy fails once it holds more than the
+// quotas would let be unpacked into dir, as it could not be unpacked
+// anyway, so it cannot fill the disk.
+func (u *UserFS) spoolArchive(dir string, r io.Reader) (*os.File, int64, error) {
+	tmp, err := os.CreateTemp("", "nssc-extract-")
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64
+	buf := make([]byte, 1<<20)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			u.mu.RLock()
+			err = u.checkQuotas(dir, size+int64(n))
+			u.mu.RUnlock()
+			if err == nil {
+				_, err = tmp.Write(buf[:n])
+			}
+			size += int64(n)
+		}
+		if err == nil && rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+			err = rerr
+		}
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, 0, err
+		}
+		if rerr != nil {
+			return tmp, size, nil
+		}
+	}
+}
+
+// archiveFormat tells the format of an archive, "zip", "tar" or "tar.gz",
+// by the magic numbers at its head.
+func archiveFormat(head []byte) (string, error) {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")) || bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip", nil
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz", nil
+	case len(head) >= 262 && string(head[257:262]) == "ustar":
+		return "tar", nil
+	}
+	return "", ErrNotArchive
+}
+
+func unpackZip(ra io.ReaderAt, size int64) unpackWalk {
+	return func(fn func(unpackEntry, func() (io.ReadCloser, error)) error) error {
+		zr, err := zip.NewReader(ra, size)
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrNotArchive, err)
+		}
+		for _, f := range zr.File {
+			e := unpackEntry{name: f.Name, mode: f.Mode(), size: int64(f.UncompressedSize64), modTime: f.Modified}
+			if f.UncompressedSize64 > 1<<62 {
+				e.size = -1
+			}
+			if err := fn(e, f.Open); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func unpackTar(r io.Reader, gzipped bool) unpackWalk {
+	return func(fn func(unpackEntry, func() (io.ReadCloser, error)) error) error {
+		if gzipped {
+			gr, err := gzip.NewReader(r)
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrNotArchive, err)
+			}
+			defer gr.Close()
+			r = gr
+		}
+		tr := tar.NewReader(r)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("%w: %v", ErrNotArchive, err)
+			}
+			if hdr.Typeflag == tar.TypeXGlobalHeader {
+				continue
+			}
+			e := unpackEntry{name: hdr.Name, mode: hdr.FileInfo().Mode(), size: hdr.Size, modTime: hdr.ModTime}
+			if hdr.Typeflag == tar.TypeLink {
+				// Hard links are refused like symlinks.
+				e.mode |= fs.ModeSymlink
+			}
+			open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+			if err := fn(e, open); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sizedReader reads exactly n bytes from r, failing if r holds more or
+// fewer, so the size charged to the quota is the size written.
+type sizedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.n <= 0 {
+		// Reading on to the end also has zip verify the checksum.
+		var b [1]byte
+		if n, err := io.ReadFull(s.r, b[:]); n > 0 {
+			return 0, errors.New("entry larger than its recorded size")
+		} else {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > s.n {
+		p = p[:s.n]
+	}
+	n, err := s.r.Read(p)
+	s.n -= int64(n)
+	if err == io.EOF && s.n > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
@@ -0,0 +1,147 @@
+package fs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestExtract(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1KiB")
+	server, _ := fs.NewUserFSServer(root, nil, db.Users)
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+
+	var zbuf bytes.Buffer
+	zw := zip.NewWriter(&zbuf)
+	zw.Create("src/")
+	w, _ := zw.Create("src/main.go")
+	w.Write([]byte("package main"))
+	w, _ = zw.Create("README")
+	w.Write([]byte("read me"))
+	w, _ = zw.Create("../evil")
+	w.Write([]byte("x"))
+	w, _ = zw.Create("/abs")
+	w.Write([]byte("x"))
+	hdr := &zip.FileHeader{Name: "link"}
+	hdr.SetMode(os.ModeSymlink | 0777)
+	w, _ = zw.CreateHeader(hdr)
+	w.Write([]byte("/etc/passwd"))
+	// An entry holding more than its header says.
+	data := []byte("hello world")
+	w, _ = zw.CreateRaw(&zip.FileHeader{Name: "liar", Method: zip.Store, CRC32: crc32.ChecksumIEEE(data),
+		CompressedSize64: uint64(len(data)), UncompressedSize64: 5})
+	w.Write(data)
+	zw.Close()
+
+	results, err := ufs.Extract(ctx, "proj", bytes.NewReader(zbuf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := map[string]bool{}
+	for _, res := range results {
+		failed[res.Path] = res.Error != ""
+	}
+	for path, fail := range map[string]bool{
+		"proj/src": false, "proj/src/main.go": false, "proj/README": false,
+		"proj/../evil": true, "proj//abs": true, "proj/link": true, "proj/liar": true,
+	} {
+		if got, ok := failed[path]; !ok || got != fail {
+			t.Errorf("%s: failed = %v, present %v, want failed %v", path, got, ok, fail)
+		}
+	}
+	if b, err := os.ReadFile(filepath.Join(root, "user", "proj", "src", "main.go")); string(b) != "package main" {
+		t.Errorf("main.go = %q, %v", b, err)
+	}
+	for _, p := range []string{filepath.Join(root, "user", "evil"), filepath.Join(root, "evil"), filepath.Join(root, "user", "proj", "link"), filepath.Join(root, "user", "proj", "liar")} {
+		if _, err := os.Lstat(p); !os.IsNotExist(err) {
+			t.Errorf("%s exists", p)
+		}
+	}
+	if _, used, _ := ufs.GetQuota(); used != int64(len("package main")+len("read me")) {
+		t.Errorf("usage = %d", used)
+	}
+
+	// tar.gz, streamed: links are refused.
+	var tbuf bytes.Buffer
+	gw := gzip.NewWriter(&tbuf)
+	tw := tar.NewWriter(gw)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "a.txt", Size: 3, Mode: 0644})
+	tw.Write([]byte("abc"))
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeSymlink, Name: "sym", Linkname: "/etc"})
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeLink, Name: "hard", Linkname: "a.txt"})
+	tw.Close()
+	gw.Close()
+	results, err = ufs.Extract(ctx, "/", strings.NewReader(tbuf.String()))
+	if err != nil || len(results) != 3 || results[0].Error != "" || results[1].Error == "" || results[2].Error == "" {
+		t.Errorf("tar.gz results = %+v, %v", results, err)
+	}
+
+	// Nothing is written if the uncompressed size exceeds the quota.
+	zbuf.Reset()
+	zw = zip.NewWriter(&zbuf)
+	w, _ = zw.Create("small")
+	w.Write([]byte("s"))
+	w, _ = zw.Create("big")
+	w.Write(bytes.Repeat([]byte("b"), 2000))
+	zw.Close()
+	if _, err := ufs.Extract(ctx, "bomb", bytes.NewReader(zbuf.Bytes())); !fs.IsInsufficientStorage(err) {
+		t.Errorf("over quota: error = %v", err)
+	}
+	if _, err := ufs.Stat(ctx, "bomb"); err == nil {
+		t.Error("over-quota archive partly extracted")
+	}
+
+	// A zip stream is only spooled while it could still fit.
+	zbuf.Reset()
+	zw = zip.NewWriter(&zbuf)
+	w, _ = zw.CreateHeader(&zip.FileHeader{Name: "big", Method: zip.Store})
+	w.Write(bytes.Repeat([]byte("b"), 2000))
+	zw.Close()
+	if _, err := ufs.Extract(ctx, "bomb", struct{ io.Reader }{bytes.NewReader(zbuf.Bytes())}); !fs.IsInsufficientStorage(err) {
+		t.Errorf("over quota stream: error = %v", err)
+	}
+	zbuf.Reset()
+	zw = zip.NewWriter(&zbuf)
+	w, _ = zw.Create("zipped")
+	w.Write([]byte("z"))
+	zw.Close()
+	if results, err := ufs.Extract(ctx, "z", struct{ io.Reader }{bytes.NewReader(zbuf.Bytes())}); err != nil || len(results) != 1 || results[0].Error != "" {
+		t.Errorf("zip stream results = %+v, %v", results, err)
+	}
+
+	// A tar stream is unpacked entry by entry, so what fits is kept.
+	tbuf.Reset()
+	tw = tar.NewWriter(&tbuf)
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "fits", Size: 1, Mode: 0644})
+	tw.Write([]byte("f"))
+	tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "big", Size: 2000, Mode: 0644})
+	tw.Write(bytes.Repeat([]byte("b"), 2000))
+	tw.Close()
+	results, err = ufs.Extract(ctx, "t", struct{ io.Reader }{&tbuf})
+	if err != nil || len(results) != 2 || results[0].Error != "" || results[1].Error == "" {
+		t.Errorf("tar stream results = %+v, %v", results, err)
+	}
+	if _, err := ufs.Stat(ctx, "t/big"); err == nil {
+		t.Error("over-quota tar entry extracted")
+	}
+
+	if _, err := ufs.Extract(ctx, "x", strings.NewReader("plain text")); !errors.Is(err, fs.ErrNotArchive) {
+		t.Errorf("plain text: error = %v", err)
+	}
+}
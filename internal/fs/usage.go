@@ -0,0 +1,541 @@
+package fs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// usageIndex keeps the number of bytes in regular files of every directory
+// of a user tree, so usage is known at startup and for directory removals
+// without walking the tree. Only the bytes directly inside each directory
+// are persisted; subtree totals are derived when the index is loaded.
+//
+// Saves are delayed, so a crash loses the latest changes, and the tree may
+// be changed while the server is down. The index is therefore stored with
+// the modification time of every directory when it was last counted and
+// with the journal cursor it reflects, and checked against both when it is
+// loaded; see UserFS.checkUsage.
+type usageIndex struct {
+	path   string
+	mu     sync.Mutex
+	own    map[string]int64 // bytes of files directly inside the directory
+	tree   map[string]int64 // bytes of files at any depth beneath the directory
+	stamps map[string]int64 // modification time of the directory when counted, in Unix nanoseconds, 0 if unknown
+	saved  int64            // journal cursor of the loaded index
+	cursor func() int64     // returns the journal cursor to store, if set
+	timer  *time.Timer
+}
+
+// usageFile is the stored form of a usageIndex.
+type usageFile struct {
+	Cursor int64            `json:"cursor"`
+	Dirs   map[string]int64 `json:"dirs"`
+	Stamps map[string]int64 `json:"stamps"`
+}
+
+func newUsageIndex(path string) *usageIndex {
+	return &usageIndex{path: path, own: make(map[string]int64), tree: make(map[string]int64), stamps: make(map[string]int64)}
+}
+
+// loadUsageIndex reads the index at path. It reports false if there is none
+// yet, or only one of an earlier version without directory stamps, in
+// which case the caller has to build it.
+func loadUsageIndex(path string) (*usageIndex, bool, error) {
+	x := newUsageIndex(path)
+	if path == "" {
+		return x, false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return x, false, nil
+		}
+		return nil, false, err
+	}
+	var f usageFile
+	if err := json.Unmarshal(data, &f); err != nil || f.Dirs == nil {
+		return x, false, nil
+	}
+	x.own, x.saved = f.Dirs, f.Cursor
+	if f.Stamps != nil {
+		x.stamps = f.Stamps
+	}
+	x.rebuild()
+	return x, true, nil
+}
+
+// ancestors calls fn for dir and every directory above it, ending at the root.
+func ancestors(dir string, fn func(string)) {
+	for {
+		fn(dir)
+		if dir == "" {
+			return
+		}
+		dir = parentName(dir)
+	}
+}
+
+// rebuild derives subtree totals from own (must be called with mu held).
+func (x *usageIndex) rebuild() {
+	x.tree = make(map[string]int64, len(x.own))
+	for dir, n := range x.own {
+		ancestors(dir, func(d string) { x.tree[d] += n })
+	}
+}
+
+// add charges delta bytes to the files directly inside dir.
+func (x *usageIndex) add(dir string, delta int64) {
+	if delta == 0 {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.addLocked(dir, delta)
+	x.scheduleSave()
+}
+
+func (x *usageIndex) addLocked(dir string, delta int64) {
+	x.own[dir] += delta
+	if x.own[dir] == 0 {
+		delete(x.own, dir)
+	}
+	ancestors(dir, func(d string) {
+		x.tree[d] += delta
+		if x.tree[d] == 0 {
+			delete(x.tree, d)
+		}
+	})
+}
+
+// ownUsage returns the bytes of files directly inside dir.
+func (x *usageIndex) ownUsage(dir string) int64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.own[dir]
+}
+
+// subtree returns the bytes of files at any depth beneath dir.
+func (x *usageIndex) subtree(dir string) int64 {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	return x.tree[dir]
+}
+
+// stamp records the modification time of dir when it was counted.
+func (x *usageIndex) stamp(dir string, mtime time.Time) {
+	var ns int64
+	if !mtime.IsZero() {
+		ns = mtime.UnixNano()
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if old, ok := x.stamps[dir]; ok && old == ns {
+		return
+	}
+	x.stamps[dir] = ns
+	x.scheduleSave()
+}
+
+// stampOf returns the modification time of dir recorded when it was
+// counted, and false if it never was.
+func (x *usageIndex) stampOf(dir string) (int64, bool) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	ns, ok := x.stamps[dir]
+	return ns, ok
+}
+
+// known returns every directory that was counted or has recorded usage.
+func (x *usageIndex) known() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	res := make([]string, 0, len(x.stamps))
+	for dir := range x.stamps {
+		res = append(res, dir)
+	}
+	for dir := range x.own {
+		if _, ok := x.stamps[dir]; !ok {
+			res = append(res, dir)
+		}
+	}
+	return res
+}
+
+// dirs returns every directory with recorded usage.
+func (x *usageIndex) dirs() []string {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	res := make([]string, 0, len(x.own))
+	for dir := range x.own {
+		res = append(res, dir)
+	}
+	return res
+}
+
+func under(name, dir string) bool {
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// removeTree drops dir and everything beneath it.
+func (x *usageIndex) removeTree(dir string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for d, n := range x.own {
+		if under(d, dir) {
+			x.addLocked(d, -n)
+		}
+	}
+	for d := range x.stamps {
+		if under(d, dir) {
+			delete(x.stamps, d)
+		}
+	}
+	x.scheduleSave()
+}
+
+// move re-keys directory oldDir and its descendants to newDir.
+func (x *usageIndex) move(oldDir, newDir string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	moved := make(map[string]int64)
+	for d, n := range x.own {
+		if under(d, oldDir) {
+			moved[newDir+strings.TrimPrefix(d, oldDir)] = n
+			x.addLocked(d, -n)
+		}
+	}
+	for d, n := range moved {
+		x.addLocked(d, n)
+	}
+	// Moved directories are counted again when next checked.
+	for d := range x.stamps {
+		if under(d, oldDir) {
+			delete(x.stamps, d)
+		}
+	}
+	x.scheduleSave()
+}
+
+// scheduleSave arms the delayed save (must be called with mu held).
+func (x *usageIndex) scheduleSave() {
+	if x.path == "" || x.timer != nil {
+		return
+	}
+	x.timer = time.AfterFunc(metaSaveDelay, func() {
+		if err := x.save(); err != nil {
+			log.Printf("Usage index save %s error: %v", x.path, err)
+		}
+	})
+}
+
+// save writes the index atomically (write-to-tmp + rename).
+func (x *usageIndex) save() error {
+	// Changes are charged before they are journaled, so the counters
+	// taken after the cursor reflect every change up to it.
+	var cursor int64
+	if x.cursor != nil {
+		cursor = x.cursor()
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if x.timer != nil {
+		x.timer.Stop()
+		x.timer = nil
+	}
+	if x.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(usageFile{Cursor: cursor, Dirs: x.own, Stamps: x.stamps})
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(x.path), 0700); err != nil {
+		return err
+	}
+	tmp := x.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, x.path)
+}
+
+// DirUsage returns the bytes of regular files at any depth beneath the
+// directory path, as recorded in the usage index.
+func (u *UserFS) DirUsage(path string) (int64, error) {
+	name, err := cleanName(path)
+	if err != nil {
+		return 0, err
+	}
+	return u.usage.subtree(name), nil
+}
+
+// dirUsage returns the bytes of regular files directly inside dir and the
+// names of its subdirectories, and stamps dir in the index. Files open for
+// writing count with the size charged for them, which is settled when they
+// are closed.
+func (u *UserFS) dirUsage(dir string) (int64, []string, error) {
+	// Only local directories have modification times that follow their
+	// entries.
+	var mtime time.Time
+	if u.root != "" {
+		info, err := u.backend.Stat(dir)
+		if err != nil {
+			return 0, nil, err
+		}
+		mtime = info.ModTime()
+	}
+	entries, err := u.backend.ReadDir(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer u.usage.stamp(dir, mtime)
+	var (
+		size    int64
+		subdirs []string
+	)
+	for _, e := range entries {
+		name := joinName(dir, e.Name())
+		switch {
+		case e.IsDir():
+			subdirs = append(subdirs, name)
+		case e.Type().IsRegular():
+			if charged, ok := u.open.lookup(name); ok {
+				size += charged
+				continue
+			}
+			info, err := e.Info()
+			if err != nil {
+				continue
+			}
+			size += info.Size()
+		}
+	}
+	return size, subdirs, nil
+}
+
+// buildUsage fills the index from a full walk of the tree. Used when no
+// index has been stored yet.
+func (u *UserFS) buildUsage() {
+	queue := []string{""}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		size, subdirs, err := u.dirUsage(dir)
+		if err != nil {
+			log.Printf("Usage %s/%s error: %v", u.name, dir, err)
+			continue
+		}
+		u.usage.add(dir, size)
+		queue = append(queue, subdirs...)
+	}
+}
+
+// checkUsage recounts the directories of a loaded index that may have
+// changed since it was saved: the directories the journal entries after
+// the saved cursor name, and, on local disk, those whose modification time
+// differs from the one recorded when they were counted. Directories found
+// on the way that were never counted are counted too, and those gone are
+// dropped. It reports false if the journal does not cover the saved cursor
+// any more, in which case the index has to be built again.
+func (u *UserFS) checkUsage() bool {
+	changes, ok := u.journal.since(u.usage.saved)
+	if !ok {
+		return false
+	}
+	suspect := make(map[string]bool)
+	for _, c := range changes {
+		for _, name := range []string{c.Path, c.OldPath} {
+			if name == "" {
+				continue
+			}
+			suspect[parentName(name)] = true
+			if c.IsDir {
+				suspect[name] = true
+			}
+		}
+	}
+	queue := make([]string, 0, len(suspect))
+	for dir := range suspect {
+		queue = append(queue, dir)
+	}
+	if u.root != "" {
+		queue = append(queue, "")
+		queue = append(queue, u.usage.known()...)
+	}
+	seen := make(map[string]bool)
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		if seen[dir] {
+			continue
+		}
+		seen[dir] = true
+		if ns, ok := u.usage.stampOf(dir); ok && !suspect[dir] {
+			if u.root == "" {
+				continue
+			}
+			if info, err := u.backend.Stat(dir); err == nil && info.IsDir() && info.ModTime().UnixNano() == ns {
+				continue
+			}
+		}
+		size, subdirs, err := u.dirUsage(dir)
+		if err != nil {
+			if info, serr := u.backend.Stat(dir); serr == nil && info.IsDir() {
+				log.Printf("Usage %s/%s error: %v", u.name, dir, err)
+				continue
+			}
+			if gone := u.usage.subtree(dir); gone != 0 {
+				log.Printf("Usage %s/%s changed while stopped: directory gone", u.name, dir)
+			}
+			u.usage.removeTree(dir)
+			continue
+		}
+		if delta := size - u.usage.ownUsage(dir); delta != 0 {
+			log.Printf("Usage %s/%s changed while stopped: corrected by %d bytes", u.name, dir, delta)
+			u.usage.add(dir, delta)
+		}
+		for _, sub := range subdirs {
+			if _, ok := u.usage.stampOf(sub); !ok {
+				queue = append(queue, sub)
+			}
+		}
+	}
+	return true
+}
+
+// recountDir compares the bytes of files directly inside dir with the
+// index and charges the difference. It returns the correction applied and
+// the subdirectories of dir.
+func (u *UserFS) recountDir(dir string) (int64, []string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	size, subdirs, err := u.dirUsage(dir)
+	if err != nil {
+		return 0, nil, err
+	}
+	delta := size - u.usage.ownUsage(dir)
+	u.updateQuotas(dir, delta)
+	return delta, subdirs, nil
+}
+
+// dropTree forgets the usage of dir and everything beneath it, crediting
+// the quota (must be called with mu held).
+func (u *UserFS) dropTree(dir string) int64 {
+	size := u.usage.subtree(dir)
+	u.usage.removeTree(dir)
+	u.quota.AddUsage(-size)
+	if u.server != nil && u.server.commonQuota != nil {
+		u.server.commonQuota.AddUsage(-size)
+	}
+	return size
+}
+
+// recountTree recounts dir and every directory beneath it, calling fn for
+// each directory whose usage had to be corrected. The usage of a directory
+// that no longer exists is dropped.
+func (u *UserFS) recountTree(ctx context.Context, dir string, fn func(dir string, delta int64)) (map[string]bool, error) {
+	seen := make(map[string]bool)
+	queue := []string{dir}
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return seen, err
+		}
+		d := queue[0]
+		queue = queue[1:]
+		seen[d] = true
+		delta, subdirs, err := u.recountDir(d)
+		if errors.Is(err, fs.ErrNotExist) {
+			u.mu.Lock()
+			delta = -u.dropTree(d)
+			u.mu.Unlock()
+		} else if err != nil {
+			log.Printf("Usage %s/%s error: %v", u.name, d, err)
+			continue
+		}
+		if delta != 0 {
+			fn(d, delta)
+		}
+		queue = append(queue, subdirs...)
+	}
+	return seen, nil
+}
+
+// Reconcile recounts every directory of the tree and corrects the usage
+// index and quota where they drifted from the stored data, e.g. after
+// files were changed outside nssc. Each directory is locked only while it
+// is counted. It returns the total correction applied.
+func (u *UserFS) Reconcile(ctx context.Context) (int64, error) {
+	var drift int64
+	// Files changed behind our back are indexed again.
+	u.index.invalidate("")
+	seen, err := u.recountTree(ctx, "", func(dir string, delta int64) {
+		log.Printf("Usage %s/%s drift: corrected by %d bytes", u.name, dir, delta)
+		drift += delta
+	})
+	if err != nil {
+		return drift, err
+	}
+	// Directories removed behind our back.
+	for _, dir := range u.usage.dirs() {
+		if seen[dir] {
+			continue
+		}
+		u.mu.Lock()
+		if info, err := u.backend.Stat(dir); err != nil || !info.IsDir() {
+			recorded := u.usage.ownUsage(dir)
+			log.Printf("Usage %s/%s drift: recorded %d, directory gone", u.name, dir, recorded)
+			u.updateQuotas(dir, -recorded)
+			drift -= recorded
+		}
+		u.mu.Unlock()
+	}
+	return drift, nil
+}
+
+// WithReconcileInterval makes the server recount all user trees shortly
+// after startup and then every interval, correcting usage drift.
+func WithReconcileInterval(interval time.Duration) ServerOption {
+	return func(s *UserFSServer) {
+		s.reconcileInterval = interval
+	}
+}
+
+// reconcileLoop runs Reconcile for every user until ctx is cancelled.
+func (s *UserFSServer) reconcileLoop(ctx context.Context, interval time.Duration) {
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		if _, err := s.Reconcile(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Usage reconcile error: %v", err)
+		}
+		timer.Reset(interval)
+	}
+}
+
+// Reconcile recounts all user trees; see UserFS.Reconcile.
+func (s *UserFSServer) Reconcile(ctx context.Context) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var drift int64
+	for _, ufs := range s.users {
+		d, err := ufs.Reconcile(ctx)
+		drift += d
+		if err != nil {
+			return drift, err
+		}
+	}
+	return drift, nil
+}
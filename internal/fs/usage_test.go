@@ -0,0 +1,135 @@
+package fs_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+func TestUsageIndex(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, err := fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufs, _ := server.GetUserFS("user")
+	ufs.WriteFile("a/b/one.txt", strings.NewReader("12345"), 5)
+	ufs.WriteFile("a/two.txt", strings.NewReader("123"), 3)
+	ufs.WriteFile("top.txt", strings.NewReader("1"), 1)
+	ufs.WriteFile("c/old.txt", strings.NewReader("1234"), 4)
+
+	// Replacing a file by rename credits the replaced file.
+	if err := ufs.Rename(ctx, "top.txt", "c/old.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, used, _ := ufs.GetQuota(); used != 9 {
+		t.Errorf("used after rename = %d, want 9", used)
+	}
+	// Directory removal takes the size from the index.
+	if err := ufs.RemoveAll(ctx, "a/b"); err != nil {
+		t.Fatal(err)
+	}
+	if _, used, _ := ufs.GetQuota(); used != 4 {
+		t.Errorf("used after RemoveAll = %d, want 4", used)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the tree while the server is down.
+	os.Remove(filepath.Join(root, "user", "c", "old.txt"))
+	os.MkdirAll(filepath.Join(root, "user", "d"), 0755)
+	os.WriteFile(filepath.Join(root, "user", "d", "new.txt"), make([]byte, 100), 0644)
+
+	// Startup recounts the directories whose modification time changed.
+	server, err = fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufs, _ = server.GetUserFS("user")
+	if _, used, _ := ufs.GetQuota(); used != 103 {
+		t.Errorf("used after restart = %d, want 103", used)
+	}
+	if drift, _ := server.Reconcile(ctx); drift != 0 {
+		t.Errorf("reconcile after restart drift = %d, want 0", drift)
+	}
+	if err := server.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rewriting a file in place leaves its directory as it was, so only
+	// the reconciler sees it.
+	os.WriteFile(filepath.Join(root, "user", "d", "new.txt"), make([]byte, 50), 0644)
+	server, err = fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ufs, _ = server.GetUserFS("user")
+	drift, err := server.Reconcile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if drift != -50 {
+		t.Errorf("drift = %d, want -50", drift)
+	}
+	if _, used, _ := ufs.GetQuota(); used != 53 {
+		t.Errorf("used after reconcile = %d, want 53", used)
+	}
+	if drift, _ := server.Reconcile(ctx); drift != 0 {
+		t.Errorf("second reconcile drift = %d, want 0", drift)
+	}
+}
+
+func TestUsageAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, err := fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ufs, _ := server.GetUserFS("user")
+	ufs.WriteFile("a/one.txt", strings.NewReader("12345"), 5)
+	ufs.WriteFile("b/c/two.txt", strings.NewReader("123"), 3)
+	// Stamp every directory with its current modification time.
+	server.Reconcile(ctx)
+	if err := server.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes whose counters were not saved yet when the server died.
+	f, err := ufs.OpenFile(ctx, "a/one.txt", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(make([]byte, 10))
+	f.Close()
+	if err := ufs.Rename(ctx, "b/c", "c"); err != nil {
+		t.Fatal(err)
+	}
+	ufs.WriteFile("c/three.txt", strings.NewReader("1234567"), 7)
+
+	restarted, err := fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close()
+	server.Close()
+	ufs, _ = restarted.GetUserFS("user")
+	if _, used, _ := ufs.GetQuota(); used != 25 {
+		t.Errorf("used after restart = %d, want 25", used)
+	}
+	if drift, _ := restarted.Reconcile(ctx); drift != 0 {
+		t.Errorf("reconcile drift = %d, want 0", drift)
+	}
+}
@@ -2,184 +2,439 @@ package fs
 
 import (
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"log"
 	"os"
 	"path/filepath"
-	"regexp"
-	"strings"
 	"sync"
 	"time"
 
-	"github.com/dustin/go-humanize"
-
 	"golang.org/x/net/webdav"
+
+	"nssc/internal/events"
 )
 
 // UserFS
 type UserFS struct {
-	root   string
-	mu     sync.RWMutex
-	tree   fs.FS
-	quota  *Quota
-	server *UserFSServer
+	name    string
+	root    string // local directory of disk-backed trees, "" otherwise
+	mu      sync.RWMutex
+	backend Backend
+	quota   *Quota
+	server  *UserFSServer
+	meta    *metaStore
+	attrs   *attrStore
+	usage   *usageIndex
+	index   *searchIndex
+	changes *changeTracker
+	journal *journal
+	open    *openSizes
+
+	dirQuotaMu sync.RWMutex
+	dirQuotas  map[string]int64 // directory → limit in bytes
 }
 
+// NewUserFS creates a UserFS stored in the local directory root.
 func NewUserFS(root string, quota *Quota, server *UserFSServer) *UserFS {
-	return &UserFS{
-		root:   root,
-		tree:   os.DirFS(root),
-		quota:  quota,
-		server: server,
-	}
+	return newUserFS(filepath.Base(root), root, newDiskBackend(root), quota, server)
 }
 
-func (u *UserFS) Root() string { return u.root }
-
-func (u *UserFS) resolvePath(name string) (string, error) {
-	cleaned := filepath.Clean(name)
-	if cleaned == "/" || cleaned == "." || cleaned == "" {
-		return u.root, nil
+func newUserFS(name, root string, backend Backend, quota *Quota, server *UserFSServer) *UserFS {
+	metaPath, attrsPath, usagePath, indexPath, journalPath := "", "", "", "", ""
+	if server != nil {
+		metaPath = server.metaPath(name)
+		attrsPath = server.attrsPath(name)
+		usagePath = server.usagePath(name)
+		indexPath = server.indexPath(name)
+		journalPath = server.journalPath(name)
 	}
-	if strings.HasPrefix(cleaned, "/") {
-		cleaned = strings.TrimPrefix(cleaned, "/")
-	}
-	if strings.HasPrefix(cleaned, "..") {
-		return "", fs.ErrInvalid
-	}
-	fullPath := filepath.Join(u.root, cleaned)
-	// Resolve symlinks to prevent path traversal via symlinks.
-	resolved, err := filepath.EvalSymlinks(fullPath)
+	meta, err := loadMetaStore(metaPath)
 	if err != nil {
-		// File may not exist yet (e.g. WriteFile creating new file) — fall back to lexical check.
-		resolved = fullPath
+		log.Printf("Metadata load %s error: %v", metaPath, err)
+		meta, _ = loadMetaStore("")
 	}
-	rel, err := filepath.Rel(u.root, resolved)
-	if err != nil || strings.HasPrefix(rel, "..") {
-		return "", fs.ErrInvalid
-	}
-	return fullPath, nil
+	attrs, err := loadAttrStore(attrsPath)
+	if err != nil {
+		log.Printf("Attributes load %s error: %v", attrsPath, err)
+		attrs, _ = loadAttrStore("")
+	}
+	u := &UserFS{
+		name:    name,
+		root:    root,
+		backend: backend,
+		quota:   quota,
+		server:  server,
+		meta:    meta,
+		attrs:   attrs,
+		usage:   newUsageIndex(usagePath),
+		changes: newChangeTracker(),
+		journal: loadJournal(journalPath),
+		open:    newOpenSizes(),
+	}
+	u.index = loadSearchIndex(indexPath, u.updateIndex)
+	return u
 }
 
+// Root returns the local directory holding the tree, or "" if the tree is
+// kept in a non-disk backend.
+func (u *UserFS) Root() string { return u.root }
+
+// Name returns the name of the user owning the tree.
+func (u *UserFS) Name() string { return u.name }
+
 // WriteFile creates or overwrites a file, correctly accounting for quota on overwrite.
 // On io.Copy failure the partially-written file is removed and quota is not updated.
 func (u *UserFS) WriteFile(name string, file io.Reader, sz int64) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	fullPath, err := u.resolvePath(name)
+	name, err := cleanName(name)
 	if err != nil {
 		return err
 	}
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+	defer u.changing(name)()
+	return u.writeFile(name, file, sz)
+}
+
+// writeFile is WriteFile of a cleaned name (must be called with mu held).
+func (u *UserFS) writeFile(name string, file io.Reader, sz int64) error {
+	if err := u.backend.MkdirAll(parentName(name), 0755); err != nil {
 		return err
 	}
-	// Subtract existing file size from quota before overwrite.
-	var oldSize int64
-	if info, err := os.Stat(fullPath); err == nil {
-		oldSize = info.Size()
+	_, statErr := u.backend.Stat(name)
+	// Subtract existing file size from quota before overwrite. A size
+	// that is unknown (< 0) or wrong is settled with the bytes copied.
+	oldSize := u.fileSize(name)
+	if err := u.checkQuotas(name, max(sz, 0)-oldSize); err != nil {
+		return err
 	}
-	netDelta := sz - oldSize
-	if err := u.checkQuotas(netDelta); err != nil {
+	if err := u.detach(name, false); err != nil {
 		return err
 	}
-	dstFile, err := os.Create(fullPath)
+	dstFile, err := u.backend.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
 		return err
 	}
 	defer dstFile.Close()
-	if _, err := io.Copy(dstFile, file); err != nil {
+	h := sha256.New()
+	w := &quotaWriter{w: dstFile, ufs: u, name: name, oldSize: oldSize, checked: max(sz, 0)}
+	_, err = io.Copy(w, io.TeeReader(file, h))
+	if err == nil {
+		// Close explicitly: encrypted and remote files are flushed here.
+		err = dstFile.Close()
+	}
+	if err != nil {
 		// Roll back: remove the partially-written file so disk usage stays consistent.
-		_ = os.Remove(fullPath)
+		_ = u.backend.Remove(name)
+		u.meta.remove(name)
 		return err
 	}
-	u.updateQuotas(netDelta)
+	u.updateQuotas(parentName(name), w.n-oldSize)
+	u.open.set(name, w.n)
+	u.recordChecksum(name, h.Sum(nil))
+	u.record(writeEvent(name, statErr != nil, w.n))
 	return nil
 }
 
+// quotaWriter counts the bytes written to the file name, checking the
+// quotas once they go beyond the checked size, as the size declared for
+// a write may be unknown or wrong. oldSize is the size charged for the
+// file before; nothing is charged until the write ends.
+type quotaWriter struct {
+	w       io.Writer
+	ufs     *UserFS
+	name    string
+	oldSize int64
+	checked int64
+	n       int64
+}
+
+func (w *quotaWriter) Write(p []byte) (int, error) {
+	if end := w.n + int64(len(p)); end > w.checked {
+		if err := w.ufs.checkQuotas(w.name, end-w.oldSize); err != nil {
+			return 0, err
+		}
+		w.checked = end
+	}
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// writeEvent describes the creation of the file name, or a change of it.
+func writeEvent(name string, created bool, size int64) events.Event {
+	if created {
+		return events.Event{Type: events.Create, Path: name, Size: size}
+	}
+	return events.Event{Type: events.Write, Path: name, Size: size}
+}
+
 // Open opens a file for reading. Implements fs.FS.
 func (u *UserFS) Open(ctx context.Context, path string) (fs.File, error) {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		log.Printf("Path %s open error: fs.ErrInvalid", path)
 		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrInvalid}
 	}
-	return os.Open(fullPath)
+	return u.backend.OpenFile(name, os.O_RDONLY, 0)
 }
 
-// quotaWebDAVFile wraps an os.File opened for writing and enforces quota on each Write.
+// quotaWebDAVFile wraps a File opened for writing. It charges quota for the
+// growth of the file beyond the size already charged, so overwrites and
+// seeks back cost nothing, and settles the charge with the stored size on
+// Close. Sequential writes are hashed, so the checksum can be recorded on
+// Close without reading the file back. The File is deliberately not
+// embedded: promoted methods such as os.File.ReadFrom would bypass quota checks.
 type quotaWebDAVFile struct {
-	*os.File
-	ufs *UserFS
+	f       File
+	ufs     *UserFS
+	name    string
+	size    *openSize
+	append  bool
+	created bool // the file did not exist before
+	pos     int64
+	hash    hash.Hash // nil once a write lands out of order
+	hashed  int64
+	dirty   bool
+	closed  bool
+}
+
+// newQuotaWebDAVFile wraps f, opened with flag, whose stored size was
+// charged as oldSize before opening; created tells if it was created.
+func newQuotaWebDAVFile(f File, ufs *UserFS, name string, flag int, oldSize int64, created bool) *quotaWebDAVFile {
+	size := oldSize
+	if info, err := f.Stat(); err == nil {
+		size = info.Size()
+	}
+	// Opening with O_TRUNC gives the old content back.
+	if size != oldSize {
+		ufs.updateQuotas(parentName(name), size-oldSize)
+	}
+	qf := &quotaWebDAVFile{
+		f:       f,
+		ufs:     ufs,
+		name:    name,
+		size:    ufs.open.acquire(name, size),
+		append:  flag&os.O_APPEND != 0,
+		created: created,
+	}
+	ufs.changes.openWriter(name)
+	// Hashing on the fly is only possible when writes start from an empty file.
+	if size == 0 && !qf.append {
+		qf.hash = sha256.New()
+	}
+	return qf
+}
+
+func (f *quotaWebDAVFile) Read(p []byte) (int, error) {
+	n, err := f.f.Read(p)
+	f.pos += int64(n)
+	return n, err
+}
+
+func (f *quotaWebDAVFile) ReadAt(p []byte, off int64) (int, error)  { return f.f.ReadAt(p, off) }
+func (f *quotaWebDAVFile) Readdir(count int) ([]fs.FileInfo, error) { return f.f.Readdir(count) }
+func (f *quotaWebDAVFile) Stat() (fs.FileInfo, error)               { return f.f.Stat() }
+
+func (f *quotaWebDAVFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := f.f.Seek(offset, whence)
+	if err == nil {
+		f.pos = pos
+	}
+	return pos, err
 }
 
 func (f *quotaWebDAVFile) Write(p []byte) (int, error) {
-	delta := int64(len(p))
-	if err := f.ufs.CheckQuota(delta); err != nil {
+	off := f.pos
+	if f.append {
+		_, off, _ = f.ufs.open.current(f.size)
+	}
+	if err := f.reserve(off + int64(len(p))); err != nil {
+		return 0, err
+	}
+	n, err := f.f.Write(p)
+	if n > 0 {
+		f.grew(off + int64(n))
+		f.hashAt(p[:n], off)
+		f.pos = off + int64(n)
+	}
+	return n, err
+}
+
+func (f *quotaWebDAVFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.reserve(off + int64(len(p))); err != nil {
 		return 0, err
 	}
-	n, err := f.File.Write(p)
+	n, err := f.f.WriteAt(p, off)
 	if n > 0 {
-		f.ufs.AddUsage(int64(n))
+		f.grew(off + int64(n))
+		f.hashAt(p[:n], off)
 	}
 	return n, err
 }
 
+// reserve checks that growing the file to end bytes fits in quota.
+func (f *quotaWebDAVFile) reserve(end int64) error {
+	name, delta := f.ufs.open.growth(f.size, end)
+	if delta <= 0 {
+		return nil
+	}
+	return f.ufs.checkQuotas(name, delta)
+}
+
+// grew charges the growth of the file to end bytes.
+func (f *quotaWebDAVFile) grew(end int64) {
+	if name, delta := f.ufs.open.grow(f.size, end); delta > 0 {
+		f.ufs.updateQuotas(parentName(name), delta)
+	}
+}
+
+// hashAt feeds p to the running hash if it continues the hashed prefix.
+func (f *quotaWebDAVFile) hashAt(p []byte, off int64) {
+	f.dirty = true
+	if f.hash == nil {
+		return
+	}
+	if off != f.hashed {
+		f.hash = nil
+		return
+	}
+	f.hash.Write(p)
+	f.hashed += int64(len(p))
+}
+
+// Close closes the file and records its checksum if it was written to.
+// Closing the last handle of the file settles the charged size with the
+// stored one, which differs e.g. after appends or short writes.
+func (f *quotaWebDAVFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+	err := f.f.Close()
+	name, _, present := f.ufs.open.current(f.size)
+	if f.dirty && present {
+		var sum []byte
+		if f.hash != nil {
+			sum = f.hash.Sum(nil)
+		}
+		f.ufs.recordChecksumSize(name, sum, f.hashed)
+	}
+	f.ufs.mu.RLock()
+	if name, charged, last := f.ufs.open.release(f.size); last {
+		if info, err := f.ufs.backend.Stat(name); err == nil && info.Size() != charged {
+			f.ufs.updateQuotas(parentName(name), info.Size()-charged)
+		}
+	}
+	if (f.created || f.dirty) && present {
+		var size int64
+		if info, err := f.ufs.backend.Stat(name); err == nil {
+			size = info.Size()
+		}
+		f.ufs.record(writeEvent(name, f.created, size))
+	}
+	f.ufs.mu.RUnlock()
+	f.ufs.changes.closeWriter(f.name)
+	f.ufs.index.invalidate(name)
+	f.ufs.dropThumbnails(name)
+	return err
+}
+
 // OpenFile opens a file with the given flags and permissions. Used by WebDAV.
 // Write-mode opens are wrapped with quotaWebDAVFile to enforce quota.
 func (u *UserFS) OpenFile(ctx context.Context, path string, flag int, perm os.FileMode) (webdav.File, error) {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		log.Printf("Path %s open error: fs.ErrInvalid", path)
 		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrInvalid}
 	}
-	f, err := os.OpenFile(fullPath, flag, perm)
+	writable := flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND) != 0
+	var (
+		oldSize int64
+		created bool
+	)
+	if writable {
+		u.changes.mark(name)
+		_, statErr := u.backend.Stat(name)
+		created = statErr != nil && flag&os.O_CREATE != 0
+		replace := flag&os.O_TRUNC != 0 && flag&os.O_CREATE != 0
+		if err := u.detach(name, !replace); err != nil {
+			return nil, err
+		}
+		oldSize = u.fileSize(name)
+	}
+	f, err := u.backend.OpenFile(name, flag, perm)
 	if err != nil {
 		return nil, err
 	}
-	// Wrap write-mode files to enforce quota per Write call.
-	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND) != 0 {
-		return &quotaWebDAVFile{File: f, ufs: u}, nil
+	// Wrap write-mode files to charge quota for their growth.
+	if writable {
+		return newQuotaWebDAVFile(f, u, name, flag, oldSize, created), nil
 	}
 	return f, nil
 }
 
 // Create creates or truncates a file for reading and writing. Used by 9P Tcreate.
-func (u *UserFS) Create(ctx context.Context, path string, perm os.FileMode) (*os.File, error) {
+// The returned file enforces quota and records the checksum on Close.
+func (u *UserFS) Create(ctx context.Context, path string, perm os.FileMode) (webdav.File, error) {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		return nil, &fs.PathError{Op: "create", Path: path, Err: fs.ErrInvalid}
 	}
-	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
+	u.changes.mark(name)
+	if err := u.backend.MkdirAll(parentName(name), 0755); err != nil {
+		return nil, err
+	}
+	if err := u.detach(name, false); err != nil {
 		return nil, err
 	}
-	return os.OpenFile(fullPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	_, statErr := u.backend.Stat(name)
+	// Truncating credits the old content.
+	oldSize := u.fileSize(name)
+	f, err := u.backend.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return nil, err
+	}
+	return newQuotaWebDAVFile(f, u, name, os.O_TRUNC, oldSize, statErr != nil), nil
 }
 
 // Remove removes a single file or empty directory. Used by 9P Tremove.
 func (u *UserFS) Remove(ctx context.Context, path string) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		return err
 	}
-	info, err := os.Stat(fullPath)
+	defer u.changing(name)()
+	info, err := u.backend.Stat(name)
 	if err != nil {
 		return err
 	}
-	size := info.Size()
-	if err := os.Remove(fullPath); err != nil {
+	size := u.fileSize(name)
+	sums := u.meta.sums(name)
+	if err := u.backend.Remove(name); err != nil {
 		return err
 	}
-	u.updateQuotas(-size)
+	if info.IsDir() {
+		u.usage.removeTree(name)
+	} else {
+		u.updateQuotas(parentName(name), -size)
+	}
+	u.open.drop(name)
+	u.meta.remove(name)
+	u.attrs.remove(name)
+	u.releaseBlobs(sums)
+	u.record(events.Event{Type: events.Remove, Path: name, IsDir: info.IsDir()})
 	return nil
 }
 
@@ -187,24 +442,30 @@ func (u *UserFS) Remove(ctx context.Context, path string) error {
 func (u *UserFS) Truncate(ctx context.Context, path string, size int64) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		return err
 	}
-	info, err := os.Stat(fullPath)
-	if err != nil {
+	defer u.changing(name)()
+	if _, err := u.backend.Stat(name); err != nil {
 		return err
 	}
-	delta := size - info.Size()
+	delta := size - u.fileSize(name)
 	if delta > 0 {
-		if err := u.checkQuotas(delta); err != nil {
+		if err := u.checkQuotas(name, delta); err != nil {
 			return err
 		}
 	}
-	if err := os.Truncate(fullPath, size); err != nil {
+	if err := u.detach(name, true); err != nil {
+		return err
+	}
+	if err := u.backend.Truncate(name, size); err != nil {
 		return err
 	}
-	u.updateQuotas(delta)
+	u.updateQuotas(parentName(name), delta)
+	u.open.set(name, size)
+	u.meta.remove(name)
+	u.record(events.Event{Type: events.Write, Path: name, Size: size})
 	return nil
 }
 
@@ -212,37 +473,52 @@ func (u *UserFS) Truncate(ctx context.Context, path string, size int64) error {
 func (u *UserFS) Chtimes(ctx context.Context, path string, atime, mtime time.Time) error {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		return err
 	}
-	return os.Chtimes(fullPath, atime, mtime)
+	defer u.changing(name)()
+	if err := u.detach(name, true); err != nil {
+		return err
+	}
+	if err := u.backend.Chtimes(name, atime, mtime); err != nil {
+		return err
+	}
+	// Content is unchanged, so keep the recorded checksum valid.
+	if fm, ok := u.meta.get(name); ok && fm.SHA256 != "" {
+		if info, err := u.backend.Stat(name); err == nil && info.Size() == fm.Size {
+			fm.ModTime = info.ModTime()
+			u.meta.set(name, fm)
+		}
+	}
+	return nil
 }
 
-// CheckQuota returns an error if adding size bytes would exceed the user quota.
+// CheckQuota returns an error if adding size bytes would exceed the user quota
+// or a server-wide limit.
 // Used by the 9P and WebDAV quota-enforcing writers.
 func (u *UserFS) CheckQuota(size int64) error {
-	return u.checkQuotas(size)
+	return u.checkQuotas("", size)
 }
 
 // AddUsage charges delta bytes to the user (and common) quota.
 // Pass a negative delta when freeing space.
 // Used by the 9P and WebDAV quota-enforcing writers.
 func (u *UserFS) AddUsage(delta int64) {
-	u.updateQuotas(delta)
+	u.updateQuotas("", delta)
 }
 
 // Stat returns file info. Implements fs.StatFS.
-func (u *UserFS) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
+func (u *UserFS) Stat(ctx context.Context, path string) (fs.FileInfo, error) {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	fullPath, err := u.resolvePath(name)
+	name, err := cleanName(path)
 	if err != nil {
-		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: fs.ErrInvalid}
 	}
-	info, err := os.Stat(fullPath)
+	info, err := u.backend.Stat(name)
 	if err != nil {
-		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+		return nil, &fs.PathError{Op: "stat", Path: path, Err: err}
 	}
 	return info, nil
 }
@@ -251,17 +527,22 @@ func (u *UserFS) Stat(ctx context.Context, name string) (fs.FileInfo, error) {
 func (u *UserFS) MkdirAll(ctx context.Context, path string, perm os.FileMode) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		return err
 	}
-	if err := os.MkdirAll(fullPath, perm); err != nil {
+	defer u.changing(name)()
+	_, statErr := u.backend.Stat(name)
+	if err := u.backend.MkdirAll(name, perm); err != nil {
 		return &fs.PathError{
 			Op:   "mkdir",
 			Path: path,
 			Err:  err,
 		}
 	}
+	if statErr != nil {
+		u.record(events.Event{Type: events.Mkdir, Path: name, IsDir: true})
+	}
 	return nil
 }
 
@@ -269,152 +550,210 @@ func (u *UserFS) MkdirAll(ctx context.Context, path string, perm os.FileMode) er
 func (u *UserFS) Mkdir(ctx context.Context, path string, perm os.FileMode) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		return err
 	}
-	log.Printf("Full path: %s", fullPath)
-	if err := os.Mkdir(fullPath, perm); err != nil {
+	defer u.changing(name)()
+	if err := u.backend.Mkdir(name, perm); err != nil {
 		return &fs.PathError{
 			Op:   "mkdir",
 			Path: path,
 			Err:  err,
 		}
 	}
+	u.record(events.Event{Type: events.Mkdir, Path: name, IsDir: true})
 	return nil
 }
 
-func (u *UserFS) Rename(ctx context.Context, oldName, newName string) error {
+func (u *UserFS) Rename(ctx context.Context, oldPath, newPath string) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	oldPath, err := u.resolvePath(oldName)
+	oldName, err := cleanName(oldPath)
+	if err != nil {
+		return err
+	}
+	newName, err := cleanName(newPath)
 	if err != nil {
 		return err
 	}
-	newPath, err := u.resolvePath(newName)
+	defer u.changing(oldName, newName)()
+	info, err := u.rename(oldName, newName)
 	if err != nil {
 		return err
 	}
-	return os.Rename(oldPath, newPath)
+	u.record(events.Event{Type: events.Rename, Path: newName, OldPath: oldName, IsDir: info.IsDir()})
+	return nil
+}
+
+// rename moves the cleaned oldName to newName, without recording the
+// change (must be called with mu held).
+func (u *UserFS) rename(oldName, newName string) (fs.FileInfo, error) {
+	info, err := u.backend.Stat(oldName)
+	if err != nil {
+		return nil, err
+	}
+	replacedSize := u.fileSize(newName)
+	// Moving into a directory with a quota adds to its usage.
+	moved := u.fileSize(oldName)
+	if info.IsDir() {
+		moved = u.usage.subtree(oldName)
+	}
+	if err := u.checkDirQuotas(newName, moved-replacedSize, oldName); err != nil {
+		return nil, err
+	}
+	replaced := u.meta.sums(newName)
+	if err := u.backend.Rename(oldName, newName); err != nil {
+		return nil, err
+	}
+	u.updateQuotas(parentName(newName), -replacedSize)
+	if info.IsDir() {
+		u.usage.move(oldName, newName)
+	} else {
+		u.usage.add(parentName(oldName), -moved)
+		u.usage.add(parentName(newName), moved)
+	}
+	u.open.move(oldName, newName)
+	u.meta.rename(oldName, newName)
+	u.attrs.rename(oldName, newName)
+	u.index.rename(oldName, newName)
+	u.touchMoved(newName)
+	u.releaseBlobs(replaced)
+	return info, nil
+}
+
+// touchMoved re-records the modification times of files moved to name.
+// Backends that rename by copying (S3) give the copies new times, while
+// the content and so the checksum is unchanged.
+func (u *UserFS) touchMoved(name string) {
+	for key, fm := range u.meta.entries(name) {
+		info, err := u.backend.Stat(key)
+		if err != nil || info.Size() != fm.Size || info.ModTime().Equal(fm.ModTime) {
+			continue
+		}
+		fm.ModTime = info.ModTime()
+		u.meta.set(key, fm)
+	}
 }
 
 // RemoveAll removes a file or directory tree.
 func (u *UserFS) RemoveAll(ctx context.Context, path string) error {
 	u.mu.Lock()
 	defer u.mu.Unlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		return err
 	}
-	info, err := os.Stat(fullPath)
+	defer u.changing(name)()
+	info, err := u.removeAll(name)
 	if err != nil {
 		return err
 	}
-	var size int64
-	if info.IsDir() {
-		size = u.calculateDirSize(fullPath)
-	} else {
-		size = info.Size()
+	u.record(events.Event{Type: events.Remove, Path: name, IsDir: info.IsDir()})
+	return nil
+}
+
+// removeAll removes the cleaned name, without recording the change (must
+// be called with mu held).
+func (u *UserFS) removeAll(name string) (fs.FileInfo, error) {
+	info, err := u.backend.Stat(name)
+	if err != nil {
+		return nil, err
 	}
-	if err := os.RemoveAll(fullPath); err != nil {
-		return err
+	size := u.fileSize(name)
+	sums := u.meta.sums(name)
+	if err := u.backend.RemoveAll(name); err != nil {
+		return nil, err
 	}
-	u.quota.AddUsage(-size)
-	if u.server.commonQuota != nil {
-		u.server.commonQuota.AddUsage(-size)
+	if info.IsDir() {
+		// The index knows the subtree size, so no walk is needed.
+		u.dropTree(name)
+	} else {
+		u.updateQuotas(parentName(name), -size)
 	}
-	return nil
+	u.open.drop(name)
+	u.meta.remove(name)
+	u.attrs.remove(name)
+	u.releaseBlobs(sums)
+	return info, nil
 }
 
 // ReadDir lists directory contents. Protected by RLock to prevent races with RemoveAll.
 func (u *UserFS) ReadDir(path string) ([]fs.DirEntry, error) {
 	u.mu.RLock()
 	defer u.mu.RUnlock()
-	fullPath, err := u.resolvePath(path)
+	name, err := cleanName(path)
 	if err != nil {
 		return nil, err
 	}
-	return os.ReadDir(fullPath)
-}
-
-// Search walks the user root and returns entries whose names match re.
-// Uses fs.WalkDir to avoid the per-entry Lstat call of filepath.Walk.
-func (u *UserFS) Search(re *regexp.Regexp) ([]FileEntry, error) {
-	var results []FileEntry
-	fs.WalkDir(os.DirFS(u.root), ".", func(path string, d fs.DirEntry, err error) error {
-		if err != nil || d == nil {
-			return nil
-		}
-		if re.MatchString(d.Name()) {
-			info, err := d.Info()
-			if err != nil {
-				return nil
-			}
-			size := ""
-			if !d.IsDir() {
-				size = humanize.Bytes(uint64(info.Size()))
-			}
-			results = append(results, FileEntry{
-				Name:    d.Name(),
-				RelPath: path,
-				IsDir:   d.IsDir(),
-				Size:    size,
-				ModTime: info.ModTime().Format("2006-01-02 15:04:05"),
-			})
-		}
-		return nil
-	})
-	return results, nil
-}
-
-// calculateDirSize returns the total size of regular files under path.
-// Uses fs.WalkDir to avoid the per-entry Lstat call of filepath.Walk.
-func (u *UserFS) calculateDirSize(path string) int64 {
-	var size int64
-	fs.WalkDir(os.DirFS(path), ".", func(_ string, d fs.DirEntry, err error) error {
-		if err != nil || d == nil || d.IsDir() {
-			return nil
-		}
-		info, err := d.Info()
-		if err != nil {
-			return nil
-		}
-		size += info.Size()
-		return nil
-	})
-	return size
+	return u.backend.ReadDir(name)
 }
 
 func (u *UserFS) GetQuota() (int64, int64, int64) {
 	return u.quota.Values()
 }
 
-func (u *UserFS) checkQuotas(size int64) error {
+// checkQuotas returns an error if adding size bytes to the file name would
+// exceed the user quota, a server-wide limit or a directory quota above name.
+func (u *UserFS) checkQuotas(name string, size int64) error {
 	if total, _, remain := u.quota.Values(); total > 0 && remain < size {
-		return fmt.Errorf("user quota exceeded: remain %d < need %d", remain, size)
+		return fmt.Errorf("user %w: remain %d < need %d", ErrQuotaExceeded, remain, size)
 	}
 	if u.server != nil {
-		return u.server.checkCommonQuota(size)
+		if err := u.server.checkServerLimits(size); err != nil {
+			return err
+		}
 	}
-	return nil
+	return u.checkDirQuotas(name, size, "")
 }
 
-func (u *UserFS) updateQuotas(size int64) {
+// updateQuotas charges size bytes written to files directly inside dir.
+func (u *UserFS) updateQuotas(dir string, size int64) {
 	u.quota.AddUsage(size)
 	if u.server != nil && u.server.commonQuota != nil {
 		u.server.commonQuota.AddUsage(size)
 	}
+	u.usage.add(dir, size)
+	if size > 0 {
+		u.warnCrossed(dir, size)
+	}
 }
 
+// Init loads the stored usage index and recounts the directories changed
+// since it was saved, building it by walking the tree only when there is
+// none yet or the journal no longer tells what changed.
 func (u *UserFS) Init() {
-	used := u.calculateDirSize(u.root)
+	usage, ok, err := loadUsageIndex(u.usage.path)
+	if err != nil {
+		log.Printf("Usage index load %s error: %v", u.usage.path, err)
+		usage, ok = newUsageIndex(u.usage.path), false
+	}
+	usage.cursor = u.ChangeCursor
+	u.usage = usage
+	if ok && !u.checkUsage() {
+		log.Printf("Usage index %s older than the journal: counting again", u.usage.path)
+		u.usage = newUsageIndex(u.usage.path)
+		u.usage.cursor = u.ChangeCursor
+		ok = false
+	}
+	if !ok {
+		u.buildUsage()
+		if err := u.usage.save(); err != nil {
+			log.Printf("Usage index save %s error: %v", u.usage.path, err)
+		}
+	}
+	used := u.usage.subtree("")
 	u.quota.AddUsage(used)
+	if u.server != nil && u.server.commonQuota != nil {
+		u.server.commonQuota.AddUsage(used)
+	}
 }
 
+// FS returns a read-only io/fs view of the tree.
 func (u *UserFS) FS() fs.FS {
-	return u.tree
+	return backendFS{u.backend}
 }
 
 func (u *UserFS) Sub(dir string) (fs.FS, error) {
-	return fs.Sub(u.tree, dir)
+	return fs.Sub(u.FS(), dir)
 }
@@ -62,3 +62,29 @@ func TestQuotaEnforcement(t *testing.T) {
 		t.Error("Expected quota exceeding error")
 	}
 }
+
+func TestQuotaUnknownSize(t *testing.T) {
+	root := t.TempDir()
+	q := fs.NewQuota(100)
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	srv, _ := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	ufs := fs.NewUserFS(root, q, srv)
+
+	// A chunked upload does not tell its size; the bytes copied count.
+	if err := ufs.WriteFile("a", bytes.NewReader(make([]byte, 60)), -1); err != nil {
+		t.Fatal(err)
+	}
+	if _, used, _ := q.Values(); used != 60 {
+		t.Errorf("used = %d, want 60", used)
+	}
+	if err := ufs.WriteFile("b", bytes.NewReader(make([]byte, 60)), -1); err == nil {
+		t.Error("Expected quota exceeding error for an unknown size")
+	}
+	if err := ufs.WriteFile("c", bytes.NewReader(make([]byte, 60)), 10); err == nil {
+		t.Error("Expected quota exceeding error for a wrong size")
+	}
+	if _, used, _ := q.Values(); used != 60 {
+		t.Errorf("used = %d after failed writes, want 60", used)
+	}
+}
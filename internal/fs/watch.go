@@ -0,0 +1,138 @@
+package fs
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"nssc/internal/events"
+)
+
+// internalGrace is how long after a change made by nssc itself filesystem
+// notifications for the same path are attributed to nssc rather than to an
+// outside writer.
+const internalGrace = 2 * time.Second
+
+// WithWatch makes every disk-backed user tree watched for changes made
+// outside nssc. They are applied to quota and published on the event bus.
+func WithWatch() ServerOption {
+	return func(s *UserFSServer) {
+		s.watch = true
+	}
+}
+
+// Events returns the bus on which changes in user trees are published.
+func (s *UserFSServer) Events() *events.Bus {
+	return s.events
+}
+
+// changeTracker remembers which paths nssc itself is changing, so the
+// watcher can tell its own writes from outside ones.
+type changeTracker struct {
+	mu      sync.Mutex
+	recent  map[string]time.Time // path and its subtree → end of grace period
+	parents map[string]time.Time // directories that may be created on the way
+	writers map[string]int       // path → files open for writing
+}
+
+func newChangeTracker() *changeTracker {
+	return &changeTracker{
+		recent:  make(map[string]time.Time),
+		parents: make(map[string]time.Time),
+		writers: make(map[string]int),
+	}
+}
+
+// mark records that names, and everything beneath them, are being changed
+// by nssc. Their parent directories, which the change may create, are
+// covered too, but not their other entries.
+func (t *changeTracker) mark(names ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if len(t.recent)+len(t.parents) > 1024 {
+		for _, m := range []map[string]time.Time{t.recent, t.parents} {
+			for name, until := range m {
+				if now.After(until) {
+					delete(m, name)
+				}
+			}
+		}
+	}
+	until := now.Add(internalGrace)
+	for _, name := range names {
+		t.recent[name] = until
+		for dir := parentName(name); dir != ""; dir = parentName(dir) {
+			t.parents[dir] = until
+		}
+	}
+}
+
+// openWriter and closeWriter bracket the lifetime of a writable file.
+func (t *changeTracker) openWriter(name string) {
+	t.mu.Lock()
+	t.writers[name]++
+	t.mu.Unlock()
+}
+
+func (t *changeTracker) closeWriter(name string) {
+	t.mark(name)
+	t.mu.Lock()
+	if t.writers[name]--; t.writers[name] <= 0 {
+		delete(t.writers, name)
+	}
+	t.mu.Unlock()
+}
+
+// internal reports whether name, or a directory above it, is being changed
+// by nssc.
+func (t *changeTracker) internal(name string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := time.Now()
+	if until, ok := t.parents[name]; ok && now.Before(until) {
+		return true
+	}
+	for {
+		if t.writers[name] > 0 {
+			return true
+		}
+		if until, ok := t.recent[name]; ok && now.Before(until) {
+			return true
+		}
+		if name == "" {
+			return false
+		}
+		name = parentName(name)
+	}
+}
+
+// busy reports whether a file directly inside dir is open for writing.
+func (t *changeTracker) busy(dir string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for name := range t.writers {
+		if parentName(name) == dir {
+			return true
+		}
+	}
+	return false
+}
+
+// changing marks names as changed by nssc for the duration of an operation
+// and the grace period after it, and queues them for indexing and drops
+// their thumbnails once it is done. Use as defer u.changing(name)().
+func (u *UserFS) changing(names ...string) func() {
+	u.changes.mark(names...)
+	return func() {
+		u.changes.mark(names...)
+		u.index.invalidate(names...)
+		u.dropThumbnails(names...)
+	}
+}
+
+// ignoredName reports whether name is a temporary file of nssc itself.
+func ignoredName(name string) bool {
+	base := name[strings.LastIndex(name, "/")+1:]
+	return strings.HasPrefix(base, ".nssc-")
+}
@@ -0,0 +1,305 @@
+//go:build linux
+
+package fs
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"nssc/internal/events"
+)
+
+const watchMask = syscall.IN_CREATE | syscall.IN_CLOSE_WRITE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_ONLYDIR
+
+// watcher follows a disk-backed user tree with inotify, applying changes
+// made outside nssc to the usage index, the journal and the bus.
+type watcher struct {
+	u   *UserFS
+	fd  int
+	f   *os.File
+	wds map[int32]string // watch descriptor → directory name
+
+	mu      sync.Mutex
+	pending map[string]bool // directories to recount → recursively
+	retry   *time.Timer
+}
+
+// watch starts watching the tree until ctx is done.
+func (u *UserFS) watch(ctx context.Context) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	w := &watcher{
+		u:       u,
+		fd:      fd,
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		wds:     make(map[int32]string),
+		pending: make(map[string]bool),
+	}
+	w.addTree("")
+	go func() {
+		<-ctx.Done()
+		w.f.Close()
+	}()
+	go w.run()
+	return nil
+}
+
+// addTree watches dir and every directory beneath it, returning the
+// regular files found.
+func (w *watcher) addTree(dir string) []string {
+	var files []string
+	queue := []string{dir}
+	for len(queue) > 0 {
+		d := queue[0]
+		queue = queue[1:]
+		wd, err := syscall.InotifyAddWatch(w.fd, filepath.Join(w.u.root, filepath.FromSlash(d)), watchMask)
+		if err != nil {
+			log.Printf("Watch %s/%s error: %v", w.u.name, d, err)
+			continue
+		}
+		w.wds[int32(wd)] = d
+		entries, err := os.ReadDir(filepath.Join(w.u.root, filepath.FromSlash(d)))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			name := joinName(d, e.Name())
+			switch {
+			case e.IsDir():
+				queue = append(queue, name)
+			case e.Type().IsRegular() && !ignoredName(name):
+				files = append(files, name)
+			}
+		}
+	}
+	return files
+}
+
+// removeTree stops watching dir and everything beneath it.
+func (w *watcher) removeTree(dir string) {
+	for wd, d := range w.wds {
+		if under(d, dir) {
+			syscall.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.wds, wd)
+		}
+	}
+}
+
+// renameTree updates the names of watched directories moved to newDir.
+func (w *watcher) renameTree(oldDir, newDir string) {
+	for wd, d := range w.wds {
+		if under(d, oldDir) {
+			w.wds[wd] = newDir + strings.TrimPrefix(d, oldDir)
+		}
+	}
+}
+
+// rawEvent is a decoded inotify event with the name relative to the root.
+type rawEvent struct {
+	mask   uint32
+	cookie uint32
+	name   string
+}
+
+func (w *watcher) run() {
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		var batch []rawEvent
+		overflow := false
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+syscall.SizeofInotifyEvent : off+syscall.SizeofInotifyEvent+int(raw.Len)]
+			off += syscall.SizeofInotifyEvent + int(raw.Len)
+			if raw.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				overflow = true
+				continue
+			}
+			dir, ok := w.wds[raw.Wd]
+			if raw.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.wds, raw.Wd)
+				continue
+			}
+			if !ok {
+				continue
+			}
+			name := string(bytes.TrimRight(nameBytes, "\x00"))
+			batch = append(batch, rawEvent{mask: raw.Mask, cookie: raw.Cookie, name: joinName(dir, name)})
+		}
+		w.handle(batch)
+		if overflow {
+			log.Printf("Watch %s: event queue overflow, recounting", w.u.name)
+			w.addTree("")
+			w.schedule("", true)
+		}
+		w.flush()
+	}
+}
+
+// handle publishes external changes of a batch and schedules recounts.
+func (w *watcher) handle(batch []rawEvent) {
+	movedFrom := make(map[uint32]rawEvent)
+	for _, ev := range batch {
+		if ev.mask&syscall.IN_MOVED_FROM != 0 {
+			movedFrom[ev.cookie] = ev
+		}
+	}
+	for _, ev := range batch {
+		if ignoredName(ev.name) {
+			continue
+		}
+		isDir := ev.mask&syscall.IN_ISDIR != 0
+		switch {
+		case ev.mask&syscall.IN_CREATE != 0:
+			w.created(ev.name, isDir)
+		case ev.mask&syscall.IN_CLOSE_WRITE != 0:
+			if w.external(ev.name) {
+				w.publish(events.Event{Type: events.Write, Path: ev.name, Size: w.size(ev.name)})
+				w.schedule(parentName(ev.name), false)
+			}
+		case ev.mask&syscall.IN_DELETE != 0:
+			w.removed(ev.name, isDir)
+		case ev.mask&syscall.IN_MOVED_TO != 0:
+			from, ok := movedFrom[ev.cookie]
+			delete(movedFrom, ev.cookie)
+			if !ok || ignoredName(from.name) {
+				// Moved in from outside, or a temporary file of nssc
+				// put in place.
+				w.created(ev.name, isDir)
+				continue
+			}
+			if isDir {
+				w.renameTree(from.name, ev.name)
+			}
+			if w.external(from.name) && w.external(ev.name) {
+				w.publish(events.Event{Type: events.Rename, Path: ev.name, OldPath: from.name, IsDir: isDir})
+				w.schedule(from.name, isDir)
+				w.schedule(ev.name, isDir)
+				if !isDir {
+					w.schedule(parentName(from.name), false)
+					w.schedule(parentName(ev.name), false)
+				}
+			}
+		}
+	}
+	// Moved out of the tree.
+	for _, ev := range movedFrom {
+		if ignoredName(ev.name) {
+			continue
+		}
+		isDir := ev.mask&syscall.IN_ISDIR != 0
+		if isDir {
+			w.removeTree(ev.name)
+		}
+		w.removed(ev.name, isDir)
+	}
+}
+
+func (w *watcher) created(name string, isDir bool) {
+	if !isDir {
+		if w.external(name) {
+			w.publish(events.Event{Type: events.Create, Path: name, Size: w.size(name)})
+			w.schedule(parentName(name), false)
+		}
+		return
+	}
+	// Content may have landed before the watch was added.
+	files := w.addTree(name)
+	if !w.external(name) {
+		return
+	}
+	w.publish(events.Event{Type: events.Mkdir, Path: name, IsDir: true})
+	for _, f := range files {
+		w.publish(events.Event{Type: events.Create, Path: f, Size: w.size(f)})
+	}
+	w.schedule(name, true)
+}
+
+func (w *watcher) removed(name string, isDir bool) {
+	if !w.external(name) {
+		return
+	}
+	w.publish(events.Event{Type: events.Remove, Path: name, IsDir: isDir})
+	if isDir {
+		w.schedule(name, true)
+	} else {
+		w.schedule(parentName(name), false)
+	}
+}
+
+func (w *watcher) external(name string) bool {
+	return !w.u.changes.internal(name)
+}
+
+func (w *watcher) size(name string) int64 {
+	info, err := w.u.backend.Stat(name)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (w *watcher) publish(e events.Event) {
+	e.User = w.u.name
+	e.External = true
+	w.u.index.invalidate(e.Path)
+	w.u.dropThumbnails(e.Path)
+	if e.OldPath != "" {
+		w.u.index.invalidate(e.OldPath)
+		w.u.dropThumbnails(e.OldPath)
+	}
+	w.u.record(e)
+}
+
+// schedule queues dir for a recount.
+func (w *watcher) schedule(dir string, recursive bool) {
+	w.mu.Lock()
+	w.pending[dir] = w.pending[dir] || recursive
+	w.mu.Unlock()
+}
+
+// flush recounts queued directories. Directories with files open for
+// writing by nssc are retried later, as their usage is still changing.
+func (w *watcher) flush() {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = make(map[string]bool)
+	w.mu.Unlock()
+	for dir, recursive := range pending {
+		if w.u.changes.busy(dir) {
+			w.schedule(dir, recursive)
+			continue
+		}
+		if recursive {
+			w.u.recountTree(context.Background(), dir, func(string, int64) {})
+		} else {
+			// A failure means the directory is gone too; its own removal
+			// event follows.
+			w.u.recountDir(dir)
+		}
+	}
+	w.mu.Lock()
+	if len(w.pending) > 0 && w.retry == nil {
+		w.retry = time.AfterFunc(time.Second, func() {
+			w.mu.Lock()
+			w.retry = nil
+			w.mu.Unlock()
+			w.flush()
+		})
+	}
+	w.mu.Unlock()
+}
@@ -0,0 +1,102 @@
+package fs_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"nssc/internal/events"
+	"nssc/internal/fs"
+	"nssc/internal/users"
+)
+
+// nextEvent waits for the next event or fails the test.
+func nextEvent(t *testing.T, ch <-chan events.Event) events.Event {
+	t.Helper()
+	select {
+	case e := <-ch:
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+		return events.Event{}
+	}
+}
+
+// waitUsed polls until the user quota reports want bytes used.
+func waitUsed(t *testing.T, ufs *fs.UserFS, want int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		_, used, _ := ufs.GetQuota()
+		if used == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("used = %d, want %d", used, want)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchExternalChanges(t *testing.T) {
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	server, err := fs.NewUserFSServer(root, nil, db.Users, fs.WithWatch())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	ufs, _ := server.GetUserFS("user")
+	ch, cancel := server.Events().Subscribe(16)
+	defer cancel()
+
+	// Changes made through nssc are not reported as external.
+	if err := ufs.WriteFile("own/file.txt", strings.NewReader("abc"), 3); err != nil {
+		t.Fatal(err)
+	}
+	if e := nextEvent(t, ch); e.Type != events.Create || e.Path != "own/file.txt" || e.External {
+		t.Errorf("event = %+v, want own create of own/file.txt", e)
+	}
+
+	userDir := filepath.Join(root, "user")
+	os.WriteFile(filepath.Join(userDir, "dropped.bin"), make([]byte, 1000), 0644)
+	e := nextEvent(t, ch)
+	if e.Type != events.Create || e.Path != "dropped.bin" || !e.External || e.User != "user" {
+		t.Errorf("event = %+v, want external create of dropped.bin", e)
+	}
+	if e = nextEvent(t, ch); e.Type != events.Write || e.Size != 1000 {
+		t.Errorf("event = %+v, want write of 1000 bytes", e)
+	}
+	waitUsed(t, ufs, 1003)
+
+	// A directory copied in with content, as rsync or cp -r would.
+	staging := t.TempDir()
+	os.MkdirAll(filepath.Join(staging, "photos", "2024"), 0755)
+	os.WriteFile(filepath.Join(staging, "photos", "2024", "a.jpg"), make([]byte, 500), 0644)
+	if err := os.Rename(filepath.Join(staging, "photos"), filepath.Join(userDir, "photos")); err != nil {
+		t.Fatal(err)
+	}
+	if e = nextEvent(t, ch); e.Type != events.Mkdir || e.Path != "photos" {
+		t.Errorf("event = %+v, want mkdir photos", e)
+	}
+	if e = nextEvent(t, ch); e.Type != events.Create || e.Path != "photos/2024/a.jpg" {
+		t.Errorf("event = %+v, want create photos/2024/a.jpg", e)
+	}
+	waitUsed(t, ufs, 1503)
+
+	os.Rename(filepath.Join(userDir, "dropped.bin"), filepath.Join(userDir, "photos", "dropped.bin"))
+	if e = nextEvent(t, ch); e.Type != events.Rename || e.OldPath != "dropped.bin" || e.Path != "photos/dropped.bin" {
+		t.Errorf("event = %+v, want rename", e)
+	}
+	os.RemoveAll(filepath.Join(userDir, "photos"))
+	waitUsed(t, ufs, 3)
+
+	// Usage tracked by the watcher agrees with a full recount.
+	if drift, err := server.Reconcile(context.Background()); err != nil || drift != 0 {
+		t.Errorf("Reconcile drift = %d, %v; want 0", drift, err)
+	}
+}
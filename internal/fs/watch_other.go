@@ -0,0 +1,14 @@
+//go:build !linux
+
+package fs
+
+import (
+	"context"
+	"errors"
+)
+
+// watch is only implemented with Linux inotify; elsewhere changes made
+// outside nssc are picked up by the reconciler.
+func (u *UserFS) watch(ctx context.Context) error {
+	return errors.New("filesystem watching is not supported on this platform")
+}
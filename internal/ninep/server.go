@@ -88,14 +88,14 @@ func (srv *Server) Serve9P(s *styx.Session) {
 		case styx.Topen:
 			p := cleanPath(msg.Path())
 			// fs.File is read-only; writable opens need OpenFile which
-			// returns *os.File (satisfies io.ReadWriteCloser).
+			// returns a quota-enforcing webdav.File (io.ReadWriteCloser).
 			if msg.Flag&os.O_WRONLY != 0 || msg.Flag&os.O_RDWR != 0 {
 				f, err := ufs.OpenFile(ctx, p, msg.Flag, 0644)
 				if err != nil {
 					msg.Ropen(nil, err)
 					continue
 				}
-				msg.Ropen(newQuotaWriter(f, ufs), nil)
+				msg.Ropen(newQuotaWriter(f.(writableFile)), nil)
 			} else {
 				f, err := ufs.Open(ctx, p)
 				if err != nil {
@@ -112,7 +112,7 @@ func (srv *Server) Serve9P(s *styx.Session) {
 				msg.Rcreate(nil, err)
 				continue
 			}
-			msg.Rcreate(newQuotaWriter(f, ufs), nil)
+			msg.Rcreate(newQuotaWriter(f.(writableFile)), nil)
 
 		case styx.Tremove:
 			p := cleanPath(msg.Path())
@@ -139,32 +139,37 @@ func cleanPath(p string) string {
 	return path.Clean("/" + p)[1:]
 }
 
-// quotaWriter wraps an io.ReadWriteCloser and charges written bytes to the
-// user quota. If the quota is exceeded the write is rejected and the file
-// is closed.
+// quotaWriter wraps a writable file returned by UserFS, which charges the
+// growth of the file to the user quota and records the checksum on Close.
+// Reads and writes go to the offsets the client asks for, so files can be
+// changed in place. Writes that would exceed a quota are rejected with
+// EPERM; the file stays open.
 type quotaWriter struct {
-	inner io.ReadWriteCloser
-	ufs   *fsinternal.UserFS
+	inner writableFile
 }
 
-func newQuotaWriter(rwc io.ReadWriteCloser, ufs *fsinternal.UserFS) *quotaWriter {
-	return &quotaWriter{inner: rwc, ufs: ufs}
+// writableFile is the part of webdav.File opened for writing by UserFS
+// that 9P uses.
+type writableFile interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
 }
 
-func (qw *quotaWriter) Read(p []byte) (int, error) { return qw.inner.Read(p) }
-func (qw *quotaWriter) Close() error               { return qw.inner.Close() }
+func newQuotaWriter(f writableFile) *quotaWriter {
+	return &quotaWriter{inner: f}
+}
 
-func (qw *quotaWriter) Write(p []byte) (int, error) {
-	if err := qw.ufs.CheckQuota(int64(len(p))); err != nil {
-		qw.inner.Close()
-		return 0, fs.ErrPermission
-	}
-	written, err := qw.inner.Write(p)
-	if written > 0 {
-		qw.ufs.AddUsage(int64(written))
+func (qw *quotaWriter) ReadAt(p []byte, off int64) (int, error) { return qw.inner.ReadAt(p, off) }
+func (qw *quotaWriter) Close() error                            { return qw.inner.Close() }
+
+func (qw *quotaWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := qw.inner.WriteAt(p, off)
+	if fsinternal.IsInsufficientStorage(err) {
+		return n, fs.ErrPermission
 	}
-	return written, err
+	return n, err
 }
 
-// Ensure quotaWriter satisfies io.ReadWriteCloser at compile time.
-var _ io.ReadWriteCloser = (*quotaWriter)(nil)
+// Ensure quotaWriter supports positioned I/O at compile time.
+var _ writableFile = (*quotaWriter)(nil)
@@ -3,34 +3,36 @@ package share
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
 	"github.com/google/uuid"
+
+	"nssc/internal/events"
 )
 
 // ShareManager creates and removes public symlinks for shared files.
 type ShareManager struct {
 	PublicDir string
+	// Events, if set, receives a Share event for every share created.
+	Events *events.Bus
 }
 
 func NewShareManager(publicDir string) *ShareManager {
 	return &ShareManager{PublicDir: publicDir}
 }
 
-// CreateShare validates that relPath is inside userRoot, then creates a
-// symlink with a UUIDv7 name in PublicDir pointing to the resolved absolute path.
-// PublicDir is created on first use if it does not exist.
-func (sm *ShareManager) CreateShare(userRoot, relPath string) (string, error) {
-	abs := filepath.Join(userRoot, relPath)
-	resolved, err := filepath.EvalSymlinks(abs)
-	if err != nil {
-		return "", fmt.Errorf("share target not found: %w", err)
-	}
-	// Ensure the resolved path is still inside userRoot.
-	cleanRoot := filepath.Clean(userRoot)
-	if !strings.HasPrefix(resolved, cleanRoot+string(filepath.Separator)) {
-		return "", fmt.Errorf("path outside user root")
+// CreateShare creates a public link to relPath in the tree of user: a
+// symlink with a UUIDv7 name in PublicDir, which is created on first use.
+// The target names the file relative to the storage root, as
+// ../<user>/<relPath>, rather than where it is stored, so links are
+// resolved by Resolve through the storage of the user, whether it is kept
+// on disk or not. The caller checks that relPath exists.
+func (sm *ShareManager) CreateShare(user, relPath string) (string, error) {
+	name := cleanName(relPath)
+	if !validUser(user) || name == "" {
+		return "", fmt.Errorf("invalid share target %s/%s", user, relPath)
 	}
 
 	// Create PublicDir lazily so a fresh data directory works out of the box.
@@ -44,12 +46,80 @@ func (sm *ShareManager) CreateShare(userRoot, relPath string) (string, error) {
 	}
 	id := uid.String()
 	linkPath := filepath.Join(sm.PublicDir, id)
-	if err := os.Symlink(resolved, linkPath); err != nil {
+	target := filepath.Join("..", user, filepath.FromSlash(name))
+	if err := os.Symlink(target, linkPath); err != nil {
 		return "", fmt.Errorf("failed to create share symlink: %w", err)
 	}
+	sm.Events.Publish(events.Event{
+		Type:  events.Share,
+		User:  user,
+		Path:  name,
+		Share: id,
+	})
 	return id, nil
 }
 
+// Resolve returns the user and the path in its tree, slash-separated, of
+// the share id. Links to absolute paths, as made by earlier versions, are
+// taken relative to the storage root.
+func (sm *ShareManager) Resolve(id string) (user, relPath string, err error) {
+	if id == "" || id != filepath.Base(id) || id == "." || id == ".." {
+		return "", "", os.ErrNotExist
+	}
+	target, err := os.Readlink(filepath.Join(sm.PublicDir, id))
+	if err != nil {
+		return "", "", err
+	}
+	if filepath.IsAbs(target) {
+		target, err = filepath.Rel(filepath.Dir(sm.PublicDir), target)
+		if err != nil {
+			return "", "", fmt.Errorf("share %s: %w", id, err)
+		}
+	} else {
+		target = filepath.Join(filepath.Base(sm.PublicDir), target)
+	}
+	user, relPath, _ = strings.Cut(filepath.ToSlash(filepath.Clean(target)), "/")
+	if !validUser(user) || relPath == "" {
+		return "", "", fmt.Errorf("share %s: target %s outside the user trees", id, target)
+	}
+	return user, relPath, nil
+}
+
+// FindShares returns the ids of the shares of relPath in the tree of user,
+// oldest first, none if it has not been shared.
+func (sm *ShareManager) FindShares(user, relPath string) ([]string, error) {
+	name := cleanName(relPath)
+	entries, err := os.ReadDir(sm.PublicDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	// UUIDv7 names sort by creation time, as ReadDir returns them.
+	var ids []string
+	for _, e := range entries {
+		if e.Type()&os.ModeSymlink == 0 {
+			continue
+		}
+		if u, p, err := sm.Resolve(e.Name()); err == nil && u == user && p == name {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+// cleanName returns relPath slash-separated, without leading or trailing
+// slashes, "" for the root of the tree.
+func cleanName(relPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(relPath)), "/")
+}
+
+// validUser reports whether user can name a directory of the storage root.
+func validUser(user string) bool {
+	return user != "" && user != "." && user != ".." && !strings.ContainsAny(user, `/\`)
+}
+
 // RemoveShare removes the symlink identified by id.
 func (sm *ShareManager) RemoveShare(id string) error {
 	linkPath := filepath.Join(sm.PublicDir, id)
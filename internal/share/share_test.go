@@ -8,30 +8,55 @@ import (
 )
 
 func TestShareManager(t *testing.T) {
-	publicDir := filepath.Join(os.TempDir(), "public")
-	os.MkdirAll(publicDir, os.ModePerm)
-	defer os.RemoveAll(publicDir)
-
+	root := t.TempDir()
+	publicDir := filepath.Join(root, "public")
 	sm := share.NewShareManager(publicDir)
 
 	t.Run("Create and remove share", func(t *testing.T) {
-		// userRoot acts as the boundary; testFile is placed directly inside it.
-		userRoot := os.TempDir()
-		testFile := filepath.Join(userRoot, "test.txt")
-		os.WriteFile(testFile, []byte("test"), 0644)
-		defer os.Remove(testFile)
-
-		link, err := sm.CreateShare(userRoot, "test.txt")
+		link, err := sm.CreateShare("alice", "/docs/test.txt")
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		if _, err := os.Lstat(filepath.Join(publicDir, link)); err != nil {
-			t.Error("Symlink not created")
+		// The link names the file relative to the root, so it needs no
+		// local copy of the tree.
+		if target, err := os.Readlink(filepath.Join(publicDir, link)); err != nil || target != filepath.Join("..", "alice", "docs", "test.txt") {
+			t.Errorf("symlink target = %q, %v", target, err)
+		}
+		if user, name, err := sm.Resolve(link); err != nil || user != "alice" || name != "docs/test.txt" {
+			t.Errorf("Resolve = %q, %q, %v", user, name, err)
+		}
+
+		if ids, err := sm.FindShares("alice", "docs/test.txt"); err != nil || len(ids) != 1 || ids[0] != link {
+			t.Errorf("FindShares = %v, %v, want [%s]", ids, err, link)
+		}
+		if ids, _ := sm.FindShares("bob", "docs/test.txt"); len(ids) != 0 {
+			t.Errorf("FindShares of another user = %v", ids)
 		}
 
 		if err := sm.RemoveShare(link); err != nil {
 			t.Error("Failed to remove share")
 		}
+		if _, _, err := sm.Resolve(link); !os.IsNotExist(err) {
+			t.Errorf("Resolve after remove: %v", err)
+		}
+	})
+
+	t.Run("Invalid shares", func(t *testing.T) {
+		for _, target := range [][2]string{{"alice", "/"}, {"alice", "."}, {"", "a.txt"}, {"..", "a.txt"}, {"a/b", "c.txt"}} {
+			if _, err := sm.CreateShare(target[0], target[1]); err == nil {
+				t.Errorf("CreateShare(%q, %q) succeeded", target[0], target[1])
+			}
+		}
+		os.Symlink(filepath.Join(root, "alice", "old.txt"), filepath.Join(publicDir, "legacy"))
+		if user, name, err := sm.Resolve("legacy"); err != nil || user != "alice" || name != "old.txt" {
+			t.Errorf("Resolve of an absolute link = %q, %q, %v", user, name, err)
+		}
+		os.Symlink("../../etc/passwd", filepath.Join(publicDir, "escape"))
+		for _, id := range []string{"escape", "../public/legacy", "missing"} {
+			if _, _, err := sm.Resolve(id); err == nil {
+				t.Errorf("Resolve(%q) succeeded", id)
+			}
+		}
 	})
 }
@@ -20,12 +20,18 @@ type User struct {
 	Password string `json:"password"` // bcrypt hash (bcrypt stores its own salt)
 	Key      string `json:"key"`      // random key for JWT signing
 	Quota    string `json:"quota"`    // quota string like "1GiB"
+	// DirQuotas limits directories of the tree, e.g. {"camera-uploads": "20GiB"}.
+	DirQuotas map[string]string `json:"dir_quotas,omitempty"`
 }
 
 type UsersDB struct {
 	Users []User `json:"users"`
-	Root  string `json:"-"`
-	mu    sync.Mutex
+	// StorageQuota caps the bytes stored by all users together, e.g. "2TiB".
+	StorageQuota string `json:"storage_quota,omitempty"`
+	// Reserve is the free disk space writes must leave, e.g. "10GiB".
+	Reserve string `json:"reserve,omitempty"`
+	Root    string `json:"-"`
+	mu      sync.Mutex
 }
 
 func (db *UsersDB) Load(path string) error {
@@ -124,6 +130,30 @@ func (db *UsersDB) AddUser(name, password, quota string) error {
 	return nil
 }
 
+// SetDirQuota limits the directory dir of user name to quota, e.g. "20GiB".
+// An empty quota removes the limit.
+func (db *UsersDB) SetDirQuota(name, dir, quota string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	for i := range db.Users {
+		u := &db.Users[i]
+		if u.Name != name {
+			continue
+		}
+		if quota == "" {
+			delete(u.DirQuotas, dir)
+			return nil
+		}
+		if u.DirQuotas == nil {
+			u.DirQuotas = make(map[string]string)
+		}
+		u.DirQuotas[dir] = quota
+		return nil
+	}
+	return errors.New("user not found")
+}
+
 // Authenticate checks name/password without holding the mutex during bcrypt.
 func (db *UsersDB) Authenticate(name, password string) bool {
 	// Copy the hash under the lock, then compare outside to avoid holding
@@ -40,4 +40,22 @@ func TestUserManagement(t *testing.T) {
 			t.Error("DB load failed")
 		}
 	})
+
+	t.Run("Directory quota", func(t *testing.T) {
+		db := users.UsersDB{}
+		db.AddUser("user", "pass", "1GiB")
+		if err := db.SetDirQuota("user", "camera", "20GiB"); err != nil {
+			t.Fatal(err)
+		}
+		if q := db.GetUser("user").DirQuotas["camera"]; q != "20GiB" {
+			t.Errorf("quota = %q, want 20GiB", q)
+		}
+		db.SetDirQuota("user", "camera", "")
+		if _, ok := db.GetUser("user").DirQuotas["camera"]; ok {
+			t.Error("quota not removed")
+		}
+		if err := db.SetDirQuota("nobody", "camera", "1GiB"); err == nil {
+			t.Error("expected error for unknown user")
+		}
+	})
 }
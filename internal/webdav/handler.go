@@ -50,30 +50,34 @@ func (h *WebDAVHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// LockSystem is created per ServeHTTP call to prevent cross-user lock leakage.
 	handler := &webdav.Handler{
 		Prefix:     "/webdav/" + username,
-		FileSystem: ufs,
+		FileSystem: davFS{ufs},
 		LockSystem: webdav.NewMemLS(),
 	}
 
-	h.quotaMiddleware(handler, ufs).ServeHTTP(w, r)
+	h.quotaMiddleware(handler, ufs, handler.Prefix).ServeHTTP(w, r)
 }
 
-// quotaMiddleware rejects write operations that would exceed the user's quota.
-// ufs is passed directly to avoid a redundant GetUserFS lookup.
-func (h *WebDAVHandler) quotaMiddleware(next http.Handler, ufs *fs.UserFS) http.Handler {
+// quotaMiddleware rejects write operations that would exceed the user's quota
+// or a server-wide limit.
+// ufs is passed directly to avoid a redundant GetUserFS lookup; prefix is
+// the URL path of the user root.
+func (h *WebDAVHandler) quotaMiddleware(next http.Handler, ufs *fs.UserFS, prefix string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case "PUT", "MKCOL", "COPY", "MOVE":
-			total, used, _ := ufs.GetQuota()
-			if total > 0 {
-				var needed int64
-				if r.Method == "PUT" {
-					needed = r.ContentLength
-				}
-				if uint64(used+needed) > uint64(total) {
-					http.Error(w, "Quota exceeded", http.StatusInsufficientStorage)
-					return
+			var needed int64
+			if r.Method == "PUT" && r.ContentLength > 0 {
+				// Overwriting a file only needs room for its growth.
+				needed = r.ContentLength
+				name := strings.TrimPrefix(r.URL.Path, prefix)
+				if info, err := ufs.Stat(r.Context(), name); err == nil && !info.IsDir() {
+					needed -= info.Size()
 				}
 			}
+			if err := ufs.CheckQuota(needed); err != nil {
+				http.Error(w, "Insufficient storage", http.StatusInsufficientStorage)
+				return
+			}
 		}
 		next.ServeHTTP(w, r)
 	})
@@ -0,0 +1,151 @@
+package webdav_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"nssc/internal/fs"
+	"nssc/internal/users"
+	"nssc/internal/webdav"
+)
+
+func TestWebDAVQuotaAccounting(t *testing.T) {
+	root := t.TempDir()
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1000B")
+	ufss, err := fs.NewUserFSServer(root, nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ufss.Close()
+	ufs, _ := ufss.GetUserFS("user")
+	handler := webdav.NewHandler(db, root, ufss)
+
+	do := func(method, path, body string, header ...string) int {
+		req := httptest.NewRequest(method, "/webdav/user/"+path, strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Code
+	}
+	check := func(step string) {
+		t.Helper()
+		stored, err := fs.DiskUsage(filepath.Join(root, "user"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, used, _ := ufs.GetQuota(); used != stored {
+			t.Errorf("%s: used = %d, stored %d", step, used, stored)
+		}
+	}
+
+	do("MKCOL", "docs", "")
+	do("PUT", "docs/a.txt", strings.Repeat("a", 400))
+	check("PUT")
+	do("PUT", "docs/a.txt", strings.Repeat("b", 100))
+	check("overwrite with smaller")
+	do("PUT", "docs/a.txt", strings.Repeat("c", 600))
+	check("overwrite with larger")
+	do("PUT", "b.txt", strings.Repeat("d", 300))
+	check("second file")
+	// Replacing the larger file fits, as only its growth counts.
+	if code := do("PUT", "docs/a.txt", strings.Repeat("e", 650)); code >= 300 {
+		t.Errorf("overwrite near quota status %d", code)
+	}
+	check("overwrite near quota")
+	if code := do("PUT", "c.txt", strings.Repeat("f", 200)); code != http.StatusInsufficientStorage {
+		t.Errorf("PUT over quota status %d, want 507", code)
+	}
+	do("COPY", "b.txt", "", "Destination", "/webdav/user/docs/b.txt")
+	check("COPY")
+	do("MOVE", "docs/b.txt", "", "Destination", "/webdav/user/docs/a.txt", "Overwrite", "T")
+	check("MOVE over file")
+	do("DELETE", "docs", "")
+	check("DELETE")
+}
+
+func TestWebDAVTags(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, err := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ufss.Close()
+	ufs, _ := ufss.GetUserFS("user")
+	ufs.MkdirAll(context.Background(), "docs", 0755)
+	handler := webdav.NewHandler(db, "", ufss)
+
+	do := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/webdav/user/"+path, strings.NewReader(body))
+		req.SetBasicAuth("user", "pass")
+		req.Header.Set("Depth", "0")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("PROPPATCH", "docs", `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:N="urn:nssc">
+  <D:set><D:prop><N:tags>Work, urgent</N:tags></D:prop></D:set>
+</D:propertyupdate>`)
+	if w.Code != http.StatusMultiStatus || !strings.Contains(w.Body.String(), "200 OK") {
+		t.Fatalf("PROPPATCH status %d: %s", w.Code, w.Body)
+	}
+	if a, _ := ufs.Attrs(context.Background(), "docs"); strings.Join(a.Tags, ",") != "urgent,work" {
+		t.Errorf("tags = %v", a.Tags)
+	}
+	w = do("PROPFIND", "docs", `<?xml version="1.0"?>
+<D:propfind xmlns:D="DAV:" xmlns:N="urn:nssc"><D:prop><N:tags/></D:prop></D:propfind>`)
+	if !strings.Contains(w.Body.String(), "urgent,work</tags>") {
+		t.Errorf("PROPFIND = %s", w.Body)
+	}
+
+	// The checksum cannot be set, and fails the tags set with it.
+	w = do("PROPPATCH", "docs", `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:N="urn:nssc">
+  <D:set><D:prop><N:tags>other</N:tags><N:sha256>x</N:sha256></D:prop></D:set>
+</D:propertyupdate>`)
+	if !strings.Contains(w.Body.String(), "403 Forbidden") {
+		t.Errorf("PROPPATCH of checksum = %s", w.Body)
+	}
+	if a, _ := ufs.Attrs(context.Background(), "docs"); strings.Join(a.Tags, ",") != "urgent,work" {
+		t.Errorf("tags after failed PROPPATCH = %v", a.Tags)
+	}
+	do("PROPPATCH", "docs", `<?xml version="1.0"?>
+<D:propertyupdate xmlns:D="DAV:" xmlns:N="urn:nssc">
+  <D:remove><D:prop><N:tags/></D:prop></D:remove>
+</D:propertyupdate>`)
+	if a, _ := ufs.Attrs(context.Background(), "docs"); len(a.Tags) != 0 {
+		t.Errorf("tags after remove = %v", a.Tags)
+	}
+}
+
+func TestWebDAVPutETag(t *testing.T) {
+	db := &users.UsersDB{}
+	db.AddUser("user", "pass", "1GiB")
+	ufss, err := fs.NewUserFSServer(t.TempDir(), nil, db.Users)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ufss.Close()
+	ufs, _ := ufss.GetUserFS("user")
+	handler := webdav.NewHandler(db, "", ufss)
+
+	req := httptest.NewRequest("PUT", "/webdav/user/a.txt", strings.NewReader("content"))
+	req.SetBasicAuth("user", "pass")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	// The same tag the REST API reports: the quoted SHA-256 of "content".
+	want, _ := ufs.ETag(context.Background(), "a.txt")
+	if got := w.Header().Get("ETag"); got != want || !strings.HasPrefix(want, `"ed7002b4`) {
+		t.Errorf("PUT ETag %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,203 @@
+package webdav
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"os"
+	"strings"
+
+	"golang.org/x/net/webdav"
+
+	"nssc/internal/fs"
+)
+
+// checksumProp is the read-only property exposing a file's SHA-256.
+var checksumProp = xml.Name{Space: "urn:nssc", Local: "sha256"}
+
+// tagsProp holds the tags of a file or directory as a comma-separated
+// list. Unlike checksumProp it can be changed with PROPPATCH.
+var tagsProp = xml.Name{Space: "urn:nssc", Local: "tags"}
+
+// davFS adapts a UserFS to webdav.FileSystem, publishing the ETags of
+// fs.ETagOf and recorded checksums as the checksumProp property.
+type davFS struct {
+	*fs.UserFS
+}
+
+func (d davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := d.UserFS.Stat(ctx, name)
+	if err != nil || info.IsDir() {
+		return info, err
+	}
+	sum, _ := d.UserFS.Checksum(ctx, name)
+	return etagInfo{FileInfo: info, etag: fs.ETagOf(info, sum)}, nil
+}
+
+func (d davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	// PROPPATCH, and only PROPPATCH, opens with plain O_RDWR, to patch the
+	// dead properties. Those live outside the content, so a read-only
+	// handle does, and it also works for directories.
+	if flag == os.O_RDWR {
+		flag = os.O_RDONLY
+	}
+	f, err := d.UserFS.OpenFile(ctx, name, flag, perm)
+	if err != nil {
+		return f, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND) != 0 {
+		return writeFile{File: f, fs: d, name: name}, nil
+	}
+	return &davFile{File: f, ctx: ctx, ufs: d.UserFS, name: name}, nil
+}
+
+// writeFile is a file opened for writing. A PUT reports the ETag of its
+// Stat, which it asks for once the file is closed and its checksum
+// recorded, so the ETag is looked up then.
+type writeFile struct {
+	webdav.File
+	fs   davFS
+	name string
+}
+
+func (f writeFile) Stat() (os.FileInfo, error) {
+	info, err := f.File.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return lateETagInfo{FileInfo: info, fs: f.fs, name: f.name}, nil
+}
+
+// lateETagInfo looks up the entity tag of the file when asked for it.
+type lateETagInfo struct {
+	os.FileInfo
+	fs   davFS
+	name string
+}
+
+func (i lateETagInfo) ETag(ctx context.Context) (string, error) {
+	info, err := i.fs.Stat(ctx, i.name)
+	if err != nil {
+		return "", err
+	}
+	if e, ok := info.(webdav.ETager); ok {
+		return e.ETag(ctx)
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+// etagInfo reports the entity tag the REST API uses, the content
+// checksum where recorded, as the WebDAV getetag property.
+type etagInfo struct {
+	os.FileInfo
+	etag string
+}
+
+func (i etagInfo) ETag(ctx context.Context) (string, error) {
+	return i.etag, nil
+}
+
+// davFile exposes UserFS metadata as WebDAV dead properties.
+type davFile struct {
+	webdav.File
+	ctx  context.Context
+	ufs  *fs.UserFS
+	name string
+}
+
+func (f *davFile) DeadProps() (map[xml.Name]webdav.Property, error) {
+	props := make(map[xml.Name]webdav.Property)
+	sum, err := f.ufs.Checksum(f.ctx, f.name)
+	if err != nil {
+		return nil, err
+	}
+	if sum != "" {
+		props[checksumProp] = webdav.Property{
+			XMLName:  checksumProp,
+			InnerXML: []byte(sum),
+		}
+	}
+	attrs, err := f.ufs.Attrs(f.ctx, f.name)
+	if err != nil {
+		return nil, err
+	}
+	if len(attrs.Tags) > 0 {
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, []byte(strings.Join(attrs.Tags, ",")))
+		props[tagsProp] = webdav.Property{
+			XMLName:  tagsProp,
+			InnerXML: buf.Bytes(),
+		}
+	}
+	return props, nil
+}
+
+// Patch sets or removes tagsProp. Every other property is rejected:
+// checksums are maintained by the server and nothing else is stored.
+// Patching is atomic, so a rejected property fails the whole request.
+func (f *davFile) Patch(patches []webdav.Proppatch) ([]webdav.Propstat, error) {
+	forbidden := webdav.Propstat{Status: http.StatusForbidden}
+	accepted := webdav.Propstat{Status: http.StatusOK}
+	var tags []string
+	for _, patch := range patches {
+		for _, p := range patch.Props {
+			if p.XMLName != tagsProp {
+				forbidden.Props = append(forbidden.Props, webdav.Property{XMLName: p.XMLName})
+				continue
+			}
+			accepted.Props = append(accepted.Props, webdav.Property{XMLName: p.XMLName})
+			tags = nil
+			if !patch.Remove {
+				text, err := innerText(p.InnerXML)
+				if err != nil {
+					return failPatch(accepted, http.StatusBadRequest, forbidden), nil
+				}
+				tags = strings.Split(text, ",")
+			}
+		}
+	}
+	if len(forbidden.Props) > 0 {
+		return failPatch(accepted, http.StatusFailedDependency, forbidden), nil
+	}
+	if len(accepted.Props) == 0 {
+		return []webdav.Propstat{accepted}, nil
+	}
+	attrs, err := f.ufs.Attrs(f.ctx, f.name)
+	if err != nil {
+		return nil, err
+	}
+	attrs.Tags = tags
+	if err := f.ufs.SetAttrs(f.ctx, f.name, attrs); err != nil {
+		return failPatch(accepted, http.StatusConflict), nil
+	}
+	return []webdav.Propstat{accepted}, nil
+}
+
+// failPatch marks the properties of accepted with status, as they are not
+// applied, and appends the propstats that caused the failure.
+func failPatch(accepted webdav.Propstat, status int, causes ...webdav.Propstat) []webdav.Propstat {
+	accepted.Status = status
+	var res []webdav.Propstat
+	if len(accepted.Props) > 0 {
+		res = append(res, accepted)
+	}
+	for _, c := range causes {
+		if len(c.Props) > 0 {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+// innerText returns the character data of a property value.
+func innerText(innerXML []byte) (string, error) {
+	var v struct {
+		Text string `xml:",chardata"`
+	}
+	data := append(append([]byte("<v>"), innerXML...), "</v>"...)
+	if err := xml.Unmarshal(data, &v); err != nil {
+		return "", err
+	}
+	return v.Text, nil
+}
@@ -0,0 +1,727 @@
+// Package webhook delivers the events of user trees to HTTP endpoints
+// registered by users or an admin.
+//
+// Every matching event becomes a delivery, queued on disk before it is
+// attempted, so deliveries survive a restart. A failed delivery is retried
+// with exponential backoff until it succeeds or runs out of attempts. The
+// outcome of every attempt is kept in the history of the hook.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"nssc/internal/events"
+)
+
+// Upload matches the events of files created or written, in the event
+// filter of a hook.
+const Upload = "upload"
+
+const (
+	defaultBackoff     = 30 * time.Second
+	maxBackoff         = time.Hour
+	defaultMaxAttempts = 10
+	maxHistory         = 100 // attempts kept per hook
+	maxConcurrent      = 8   // deliveries attempted at once
+)
+
+var (
+	// ErrNotFound is returned for hooks that do not exist.
+	ErrNotFound = errors.New("webhook not found")
+	// ErrInvalid is returned when registering a malformed hook.
+	ErrInvalid = errors.New("invalid webhook")
+	// ErrForbiddenAddress fails the deliveries of the hooks users registered
+	// to loopback, link-local, private and other non-public addresses.
+	ErrForbiddenAddress = errors.New("address not allowed for webhooks of users")
+)
+
+// sharedAddressSpace is the range of carrier-grade NAT, private too.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// Hook is a registered endpoint and the events it receives.
+type Hook struct {
+	ID string `json:"id"`
+	// User owns the hook and only its events are delivered; "" for a hook
+	// registered by an admin, which receives the events of all users.
+	User string `json:"user,omitempty"`
+	URL  string `json:"url"`
+	// Secret is the key of the HMAC-SHA256 signature of the payloads.
+	Secret string `json:"secret,omitempty"`
+	// Events lists the event types delivered, or Upload; none for all.
+	Events []string `json:"events,omitempty"`
+	// Path limits the hook to the changes beneath it; "" for the whole tree.
+	Path string `json:"path,omitempty"`
+	// Admin is set for a hook of a user registered by an admin, which may
+	// reach any address like the hooks of all users. The hooks users
+	// register only reach public addresses.
+	Admin   bool      `json:"admin,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Matches reports whether e is to be delivered to h.
+func (h *Hook) Matches(e events.Event) bool {
+	if h.User != "" && h.User != e.User {
+		return false
+	}
+	if len(h.Events) > 0 && !slices.ContainsFunc(h.Events, func(t string) bool {
+		return t == string(e.Type) || t == Upload && (e.Type == events.Create || e.Type == events.Write)
+	}) {
+		return false
+	}
+	return e.Beneath(h.Path)
+}
+
+// Payload is the JSON body posted to a hook.
+type Payload struct {
+	Delivery string       `json:"delivery"`
+	Hook     string       `json:"hook"`
+	Event    events.Event `json:"event"`
+}
+
+// Sign returns the value of the X-Nssc-Signature header of body.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Record is the outcome of an attempt at a delivery.
+type Record struct {
+	Delivery string      `json:"delivery"`
+	Event    events.Type `json:"event"`
+	Path     string      `json:"path"`
+	Time     time.Time   `json:"time"`
+	Attempt  int         `json:"attempt"`
+	Status   int         `json:"status,omitempty"` // HTTP status of the answer, if any
+	Error    string      `json:"error,omitempty"`
+	// Outcome is "delivered", "retrying" or "failed" once no attempts are left.
+	Outcome string `json:"outcome"`
+}
+
+// delivery is a queued event for a hook.
+type delivery struct {
+	ID       string       `json:"id"`
+	Hook     string       `json:"hook"`
+	Event    events.Event `json:"event"`
+	Attempts int          `json:"attempts"`
+	Next     time.Time    `json:"next"`
+}
+
+// Option configures a Manager.
+type Option func(*Manager)
+
+// WithClient delivers with client instead of one timing out after 30s,
+// for the hooks users registered too: client must refuse the addresses
+// they may not reach, if any.
+func WithClient(client *http.Client) Option {
+	return func(m *Manager) {
+		m.client = client
+		m.userClient = client
+	}
+}
+
+// WithRetries makes up to attempts attempts at each delivery, waiting
+// backoff after the first failure and twice as long after each other.
+func WithRetries(attempts int, backoff time.Duration) Option {
+	return func(m *Manager) {
+		m.maxAttempts = attempts
+		m.backoff = backoff
+	}
+}
+
+// Manager keeps the hooks, their delivery queue and history in a
+// directory: hooks.json, queue/ with a file per pending delivery, and
+// history/ with a file per hook. Other processes, such as the command
+// line, may change hooks.json; the changes are picked up on the next
+// event.
+type Manager struct {
+	dir         string
+	client      *http.Client
+	userClient  *http.Client // for hooks users registered, which only reach public addresses
+	backoff     time.Duration
+	maxAttempts int
+
+	// inbox holds the events received from the bus until they are queued,
+	// so writing the queue never holds up the subscription.
+	inboxMu  sync.Mutex
+	inbox    []events.Event
+	received chan struct{}
+
+	mu       sync.Mutex
+	hooks    []*Hook
+	hooksMod time.Time // modification time of hooks.json when read
+	queue    map[string]*delivery
+	inflight map[string]bool
+	history  map[string][]Record
+	wake     chan struct{}
+	sem      chan struct{}
+	stop     context.CancelFunc
+	wg       sync.WaitGroup
+}
+
+// New opens the hooks kept in dir, which is created if needed. Deliveries
+// only start with Start.
+func New(dir string, opts ...Option) (*Manager, error) {
+	m := &Manager{
+		dir:         dir,
+		client:      &http.Client{Timeout: 30 * time.Second},
+		userClient:  publicClient(),
+		backoff:     defaultBackoff,
+		maxAttempts: defaultMaxAttempts,
+		queue:       make(map[string]*delivery),
+		inflight:    make(map[string]bool),
+		history:     make(map[string][]Record),
+		received:    make(chan struct{}, 1),
+		wake:        make(chan struct{}, 1),
+		sem:         make(chan struct{}, maxConcurrent),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	for _, sub := range []string{"queue", "history"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.loadHooks(); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(dir, "queue"))
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue // being written
+		}
+		var d delivery
+		if err := readJSON(filepath.Join(dir, "queue", e.Name()), &d); err != nil || d.ID+".json" != e.Name() {
+			log.Printf("Webhook queue: dropping %s: %v", e.Name(), err)
+			os.Remove(filepath.Join(dir, "queue", e.Name()))
+			continue
+		}
+		m.queue[d.ID] = &d
+	}
+	return m, nil
+}
+
+// Start delivers the events published on bus, and the deliveries queued
+// before, until Close.
+func (m *Manager) Start(bus *events.Bus) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.stop = cancel
+	ch, unsubscribe := bus.SubscribeBlocking(1024)
+	m.wg.Add(3)
+	go func() {
+		defer m.wg.Done()
+		defer unsubscribe()
+		for {
+			select {
+			case e := <-ch:
+				m.inboxMu.Lock()
+				m.inbox = append(m.inbox, e)
+				m.inboxMu.Unlock()
+				select {
+				case m.received <- struct{}{}:
+				default:
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	go func() {
+		defer m.wg.Done()
+		for {
+			select {
+			case <-m.received:
+				m.enqueueInbox()
+			case <-ctx.Done():
+				m.enqueueInbox()
+				return
+			}
+		}
+	}()
+	go func() {
+		defer m.wg.Done()
+		m.run(ctx)
+	}()
+}
+
+// Close stops delivering. Pending deliveries stay queued for the next Start.
+func (m *Manager) Close() {
+	if m.stop != nil {
+		m.stop()
+	}
+	m.wg.Wait()
+}
+
+// Add registers h, filling in its ID, creation time and, if empty, its
+// secret, and returns it.
+func (m *Manager) Add(h Hook) (Hook, error) {
+	u, err := url.Parse(h.URL)
+	if err != nil || u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return Hook{}, fmt.Errorf("%w: URL must be http or https", ErrInvalid)
+	}
+	for _, t := range h.Events {
+		switch events.Type(t) {
+		case events.Create, events.Write, events.Remove, events.Rename, events.Mkdir,
+			events.Share, events.QuotaWarning, Upload:
+		default:
+			return Hook{}, fmt.Errorf("%w: unknown event %q", ErrInvalid, t)
+		}
+	}
+	h.Path = strings.Trim(path.Clean("/"+h.Path), "/")
+	id, err := uuid.NewV7()
+	if err != nil {
+		return Hook{}, err
+	}
+	h.ID = id.String()
+	h.Created = time.Now().UTC()
+	if h.Secret == "" {
+		key := make([]byte, 32)
+		rand.Read(key)
+		h.Secret = hex.EncodeToString(key)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadHooks(); err != nil {
+		return Hook{}, err
+	}
+	m.hooks = append(m.hooks, &h)
+	if err := m.saveHooks(); err != nil {
+		m.hooks = m.hooks[:len(m.hooks)-1]
+		return Hook{}, err
+	}
+	return h, nil
+}
+
+// Remove unregisters the hook id of user, or of any user if user is "".
+// Its pending deliveries are dropped and its history removed.
+func (m *Manager) Remove(user, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadHooks(); err != nil {
+		return err
+	}
+	i := slices.IndexFunc(m.hooks, func(h *Hook) bool { return h.ID == id && (user == "" || h.User == user) })
+	if i < 0 {
+		return ErrNotFound
+	}
+	hooks := slices.Delete(slices.Clone(m.hooks), i, i+1)
+	old := m.hooks
+	m.hooks = hooks
+	if err := m.saveHooks(); err != nil {
+		m.hooks = old
+		return err
+	}
+	for did, d := range m.queue {
+		if d.Hook == id && !m.inflight[did] {
+			m.dequeue(did)
+		}
+	}
+	delete(m.history, id)
+	os.Remove(m.historyPath(id))
+	return nil
+}
+
+// Hooks returns the hooks of user, or all of them if user is "", in the
+// order they were registered.
+func (m *Manager) Hooks(user string) ([]Hook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadHooks(); err != nil {
+		return nil, err
+	}
+	hooks := []Hook{}
+	for _, h := range m.hooks {
+		if user == "" || h.User == user {
+			hooks = append(hooks, *h)
+		}
+	}
+	return hooks, nil
+}
+
+// History returns the latest attempts at deliveries to the hook id of
+// user, or of any user if user is "", oldest first.
+func (m *Manager) History(user, id string) ([]Record, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadHooks(); err != nil {
+		return nil, err
+	}
+	if !slices.ContainsFunc(m.hooks, func(h *Hook) bool { return h.ID == id && (user == "" || h.User == user) }) {
+		return nil, ErrNotFound
+	}
+	records, err := m.historyOf(id)
+	return slices.Clone(records), err
+}
+
+// loadHooks reads hooks.json if it changed since it was read (must be
+// called with mu held, or before m is shared).
+func (m *Manager) loadHooks() error {
+	p := filepath.Join(m.dir, "hooks.json")
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		m.hooks, m.hooksMod = nil, time.Time{}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(m.hooksMod) && m.hooks != nil {
+		return nil
+	}
+	var hooks []*Hook
+	if err := readJSON(p, &hooks); err != nil {
+		return fmt.Errorf("failed to load webhooks: %w", err)
+	}
+	if hooks == nil {
+		hooks = []*Hook{}
+	}
+	m.hooks, m.hooksMod = hooks, info.ModTime()
+	return nil
+}
+
+// saveHooks writes hooks.json (must be called with mu held).
+func (m *Manager) saveHooks() error {
+	p := filepath.Join(m.dir, "hooks.json")
+	hooks := m.hooks
+	if hooks == nil {
+		hooks = []*Hook{}
+	}
+	if err := writeJSON(p, hooks); err != nil {
+		return err
+	}
+	if info, err := os.Stat(p); err == nil {
+		m.hooksMod = info.ModTime()
+	}
+	return nil
+}
+
+// enqueueInbox queues the deliveries of the events received so far.
+func (m *Manager) enqueueInbox() {
+	m.inboxMu.Lock()
+	inbox := m.inbox
+	m.inbox = nil
+	m.inboxMu.Unlock()
+	for _, e := range inbox {
+		m.enqueue(e)
+	}
+}
+
+// enqueue queues a delivery of e for every hook it matches.
+func (m *Manager) enqueue(e events.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadHooks(); err != nil {
+		log.Printf("Webhook: %v", err)
+	}
+	queued := false
+	for _, h := range m.hooks {
+		if !h.Matches(e) {
+			continue
+		}
+		id, err := uuid.NewV7()
+		if err != nil {
+			log.Printf("Webhook %s: %v", h.ID, err)
+			continue
+		}
+		d := &delivery{ID: id.String(), Hook: h.ID, Event: e, Next: time.Now()}
+		if err := writeJSON(m.queuePath(d.ID), d); err != nil {
+			log.Printf("Webhook %s: failed to queue %s %s: %v", h.ID, e.Type, e.Path, err)
+			continue
+		}
+		m.queue[d.ID] = d
+		queued = true
+	}
+	if queued {
+		m.signal()
+	}
+}
+
+// signal makes run look at the queue again.
+func (m *Manager) signal() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run attempts the deliveries that are due, oldest first, until ctx is done.
+func (m *Manager) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		m.mu.Lock()
+		now := time.Now()
+		var due []*delivery
+		var next time.Time
+		for id, d := range m.queue {
+			switch {
+			case m.inflight[id]:
+			case !d.Next.After(now):
+				due = append(due, d)
+			case next.IsZero() || d.Next.Before(next):
+				next = d.Next
+			}
+		}
+		slices.SortFunc(due, func(a, b *delivery) int { return strings.Compare(a.ID, b.ID) })
+		for _, d := range due {
+			m.inflight[d.ID] = true
+			m.wg.Add(1)
+			go m.attempt(ctx, *d)
+		}
+		m.mu.Unlock()
+
+		wait := maxBackoff
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		timer.Reset(wait)
+		select {
+		case <-ctx.Done():
+			return
+		case <-m.wake:
+		case <-timer.C:
+		}
+	}
+}
+
+// attempt posts d to its hook and records the outcome.
+func (m *Manager) attempt(ctx context.Context, d delivery) {
+	defer m.wg.Done()
+	select {
+	case m.sem <- struct{}{}:
+		defer func() { <-m.sem }()
+	case <-ctx.Done():
+		m.release(d.ID)
+		return
+	}
+	m.mu.Lock()
+	var hook *Hook
+	if i := slices.IndexFunc(m.hooks, func(h *Hook) bool { return h.ID == d.Hook }); i >= 0 {
+		hook = m.hooks[i]
+	}
+	m.mu.Unlock()
+	if hook == nil {
+		m.mu.Lock()
+		m.dequeue(d.ID)
+		m.mu.Unlock()
+		return
+	}
+
+	status, err := m.post(ctx, hook, d)
+	if ctx.Err() != nil {
+		// Shutting down: the attempt does not count.
+		m.release(d.ID)
+		return
+	}
+	d.Attempts++
+	rec := Record{
+		Delivery: d.ID,
+		Event:    d.Event.Type,
+		Path:     d.Event.Path,
+		Time:     time.Now().UTC(),
+		Attempt:  d.Attempts,
+		Status:   status,
+	}
+	if err == nil && (status < 200 || status > 299) {
+		err = fmt.Errorf("status %d", status)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.inflight, d.ID)
+	if !slices.ContainsFunc(m.hooks, func(h *Hook) bool { return h.ID == hook.ID }) {
+		// Removed meanwhile, with its history.
+		m.dequeue(d.ID)
+		return
+	}
+	switch {
+	case err == nil:
+		rec.Outcome = "delivered"
+		m.dequeue(d.ID)
+	case d.Attempts >= m.maxAttempts:
+		rec.Error, rec.Outcome = err.Error(), "failed"
+		log.Printf("Webhook %s: giving up on %s %s after %d attempts: %v", hook.ID, d.Event.Type, d.Event.Path, d.Attempts, err)
+		m.dequeue(d.ID)
+	default:
+		rec.Error, rec.Outcome = err.Error(), "retrying"
+		d.Next = time.Now().Add(min(m.backoff<<(d.Attempts-1), maxBackoff))
+		if werr := writeJSON(m.queuePath(d.ID), &d); werr != nil {
+			log.Printf("Webhook %s: failed to requeue %s: %v", hook.ID, d.ID, werr)
+		}
+		m.queue[d.ID] = &d
+		m.signal()
+	}
+	m.addHistory(hook.ID, rec)
+}
+
+// publicClient returns a client that only connects to public addresses,
+// so the hooks users registered cannot reach the server itself or the
+// services of its networks. It ignores proxies, as the addresses checked must be those
+// of the hooks.
+func publicClient() *http.Client {
+	dialer := &net.Dialer{Timeout: 30 * time.Second, Control: publicOnly}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// publicOnly refuses connections to the resolved address unless it is a
+// public unicast one.
+func publicOnly(network, address string, _ syscall.RawConn) error {
+	ap, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	ip := ap.Addr().Unmap()
+	if !ip.IsGlobalUnicast() || ip.IsPrivate() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, ip)
+	}
+	return nil
+}
+
+// post sends d to hook, returning the status of the answer.
+func (m *Manager) post(ctx context.Context, hook *Hook, d delivery) (int, error) {
+	body, err := json.Marshal(Payload{Delivery: d.ID, Hook: hook.ID, Event: d.Event})
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "nssc-webhook")
+	req.Header.Set("X-Nssc-Event", string(d.Event.Type))
+	req.Header.Set("X-Nssc-Delivery", d.ID)
+	req.Header.Set("X-Nssc-Signature", Sign(hook.Secret, body))
+	client := m.client
+	if hook.User != "" && !hook.Admin {
+		client = m.userClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// release puts back a delivery that was not attempted.
+func (m *Manager) release(id string) {
+	m.mu.Lock()
+	delete(m.inflight, id)
+	m.mu.Unlock()
+}
+
+// dequeue drops a delivery (must be called with mu held).
+func (m *Manager) dequeue(id string) {
+	delete(m.queue, id)
+	delete(m.inflight, id)
+	if err := os.Remove(m.queuePath(id)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Webhook queue: %v", err)
+	}
+}
+
+// historyOf returns the history of the hook id, reading it on first use
+// (must be called with mu held).
+func (m *Manager) historyOf(id string) ([]Record, error) {
+	if records, ok := m.history[id]; ok {
+		return records, nil
+	}
+	var records []Record
+	if err := readJSON(m.historyPath(id), &records); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if records == nil {
+		records = []Record{}
+	}
+	m.history[id] = records
+	return records, nil
+}
+
+// addHistory appends rec to the history of the hook id, keeping the
+// latest maxHistory records (must be called with mu held).
+func (m *Manager) addHistory(id string, rec Record) {
+	records, err := m.historyOf(id)
+	if err != nil {
+		log.Printf("Webhook %s history: %v", id, err)
+		records = nil
+	}
+	records = append(records, rec)
+	if len(records) > maxHistory {
+		records = slices.Clone(records[len(records)-maxHistory:])
+	}
+	m.history[id] = records
+	if err := writeJSON(m.historyPath(id), records); err != nil {
+		log.Printf("Webhook %s history: %v", id, err)
+	}
+}
+
+func (m *Manager) queuePath(id string) string {
+	return filepath.Join(m.dir, "queue", id+".json")
+}
+
+func (m *Manager) historyPath(id string) string {
+	return filepath.Join(m.dir, "history", id+".json")
+}
+
+func readJSON(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeJSON replaces the file at path with v, atomically.
+func writeJSON(path string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package webhook_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nssc/internal/events"
+	"nssc/internal/webhook"
+)
+
+// receiver is a stand-in endpoint answering with status, recording the
+// payloads whose signature checks out.
+type receiver struct {
+	*httptest.Server
+	secret string
+	status atomic.Int32
+
+	mu       sync.Mutex
+	payloads []webhook.Payload
+	bad      int
+}
+
+func newReceiver(t *testing.T, secret string) *receiver {
+	r := &receiver{secret: secret}
+	r.status.Store(http.StatusOK)
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		var p webhook.Payload
+		if req.Header.Get("X-Nssc-Signature") != webhook.Sign(r.secret, body) || json.Unmarshal(body, &p) != nil ||
+			req.Header.Get("X-Nssc-Delivery") != p.Delivery {
+			r.bad++
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.payloads = append(r.payloads, p)
+		w.WriteHeader(int(r.status.Load()))
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []webhook.Payload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhook.Payload(nil), r.payloads...)
+}
+
+// waitHistory waits for the history of the hook to reach an attempt
+// with the outcome.
+func waitHistory(t *testing.T, m *webhook.Manager, id, outcome string) []webhook.Record {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		history, err := m.History("", id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(history) > 0 && history[len(history)-1].Outcome == outcome {
+			return history
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("history = %+v, want an attempt %s", history, outcome)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	recv := newReceiver(t, "s3cret")
+	recv.status.Store(http.StatusInternalServerError)
+	bus := events.NewBus()
+	// The receiver is local, which hooks of users may not reach by default.
+	m, err := webhook.New(t.TempDir(), webhook.WithRetries(3, 10*time.Millisecond), webhook.WithClient(recv.Client()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if _, err := m.Add(webhook.Hook{URL: "ftp://example.com/"}); err == nil {
+		t.Error("Add accepted an ftp URL")
+	}
+	if _, err := m.Add(webhook.Hook{URL: recv.URL, Events: []string{"upload", "nap"}}); err == nil {
+		t.Error("Add accepted an unknown event")
+	}
+	hook, err := m.Add(webhook.Hook{User: "alice", URL: recv.URL, Secret: "s3cret", Events: []string{webhook.Upload}, Path: "/inbox/"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hook.Path != "inbox" || hook.ID == "" {
+		t.Errorf("hook = %+v", hook)
+	}
+	m.Start(bus)
+
+	bus.Publish(events.Event{Type: events.Create, User: "alice", Path: "other/a.txt"})
+	bus.Publish(events.Event{Type: events.Create, User: "bob", Path: "inbox/a.txt"})
+	bus.Publish(events.Event{Type: events.Remove, User: "alice", Path: "inbox/a.txt"})
+	bus.Publish(events.Event{Type: events.Create, User: "alice", Path: "inbox/a.txt"})
+	history := waitHistory(t, m, hook.ID, "retrying")
+	recv.status.Store(http.StatusOK)
+	history = waitHistory(t, m, hook.ID, "delivered")
+
+	got := recv.received()
+	if len(got) != 2 || recv.bad != 0 {
+		t.Fatalf("received %+v, %d badly signed", got, recv.bad)
+	}
+	for _, p := range got {
+		if p.Hook != hook.ID || p.Event.Type != events.Create || p.Event.Path != "inbox/a.txt" || p.Delivery != got[0].Delivery {
+			t.Errorf("payload = %+v", p)
+		}
+	}
+	if len(history) != 2 || history[0].Status != http.StatusInternalServerError || history[0].Attempt != 1 ||
+		history[1].Status != http.StatusOK || history[1].Attempt != 2 {
+		t.Errorf("history = %+v", history)
+	}
+
+	if err := m.Remove("bob", hook.ID); err != webhook.ErrNotFound {
+		t.Errorf("Remove by another user: %v", err)
+	}
+	if err := m.Remove("alice", hook.ID); err != nil {
+		t.Fatal(err)
+	}
+	if hooks, _ := m.Hooks(""); len(hooks) != 0 {
+		t.Errorf("hooks after Remove = %+v", hooks)
+	}
+}
+
+func TestDeliveryGivesUp(t *testing.T) {
+	recv := newReceiver(t, "k")
+	recv.status.Store(http.StatusServiceUnavailable)
+	bus := events.NewBus()
+	m, _ := webhook.New(t.TempDir(), webhook.WithRetries(2, time.Millisecond))
+	defer m.Close()
+	hook, _ := m.Add(webhook.Hook{URL: recv.URL, Secret: "k"})
+	m.Start(bus)
+
+	bus.Publish(events.Event{Type: events.Share, User: "alice", Path: "a.txt", Share: "x"})
+	history := waitHistory(t, m, hook.ID, "failed")
+	if len(history) != 2 || history[0].Outcome != "retrying" || history[1].Error == "" {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestUserHooksReachOnlyPublicAddresses(t *testing.T) {
+	recv := newReceiver(t, "k")
+	bus := events.NewBus()
+	m, _ := webhook.New(t.TempDir(), webhook.WithRetries(1, time.Millisecond))
+	defer m.Close()
+	admin, _ := m.Add(webhook.Hook{URL: recv.URL, Secret: "k"})
+	user, _ := m.Add(webhook.Hook{User: "alice", URL: recv.URL, Secret: "k"})
+	forUser, _ := m.Add(webhook.Hook{User: "alice", URL: recv.URL, Secret: "k", Admin: true})
+	m.Start(bus)
+
+	bus.Publish(events.Event{Type: events.Mkdir, User: "alice", Path: "photos", IsDir: true})
+	waitHistory(t, m, admin.ID, "delivered")
+	waitHistory(t, m, forUser.ID, "delivered")
+	history := waitHistory(t, m, user.ID, "failed")
+	if !strings.Contains(history[0].Error, webhook.ErrForbiddenAddress.Error()) {
+		t.Errorf("history = %+v", history)
+	}
+	if got := recv.received(); len(got) != 2 || slices.ContainsFunc(got, func(p webhook.Payload) bool { return p.Hook == user.ID }) {
+		t.Errorf("received %+v", got)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	recv := newReceiver(t, "k")
+	recv.status.Store(http.StatusBadGateway)
+	bus := events.NewBus()
+	m, _ := webhook.New(dir, webhook.WithRetries(5, 200*time.Millisecond))
+	hook, _ := m.Add(webhook.Hook{URL: recv.URL, Secret: "k"})
+	m.Start(bus)
+	bus.Publish(events.Event{Type: events.Mkdir, User: "alice", Path: "photos", IsDir: true})
+	waitHistory(t, m, hook.ID, "retrying")
+	m.Close()
+
+	recv.status.Store(http.StatusOK)
+	m, err := webhook.New(dir, webhook.WithRetries(5, 200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	m.Start(events.NewBus())
+	history := waitHistory(t, m, hook.ID, "delivered")
+	if got := recv.received(); len(got) < 2 || got[len(got)-1].Event.Path != "photos" {
+		t.Errorf("received %+v", got)
+	}
+	if last := history[len(history)-1]; last.Attempt < 2 {
+		t.Errorf("history = %+v", history)
+	}
+}
+
+func TestBurstIsNotDropped(t *testing.T) {
+	dir := t.TempDir()
+	recv := newReceiver(t, "k")
+	recv.status.Store(http.StatusServiceUnavailable)
+	bus := events.NewBus()
+	m, _ := webhook.New(dir, webhook.WithRetries(2, time.Hour))
+	defer m.Close()
+	m.Add(webhook.Hook{URL: recv.URL, Secret: "k"})
+	m.Start(bus)
+
+	// Far more than the subscription buffers, faster than files are written.
+	const n = 5000
+	for i := range n {
+		bus.Publish(events.Event{Type: events.Create, User: "alice", Path: fmt.Sprintf("f%d", i)})
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		queued, _ := filepath.Glob(filepath.Join(dir, "queue", "*.json"))
+		if len(queued) == n {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d of %d events queued", len(queued), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}